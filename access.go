@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// When desktops can be started is set per user, role or desktop:
+//
+//	access_hours = Mon-Fri 08:00-20:00, Sat 09:00-13:00
+//	access_blocked = 2026-06-01 - 2026-06-05, 2026-07-10 08:00 - 2026-07-10 12:00
+//
+// access_hours lists the weekly windows in which a desktop may start (days
+// are a day, a range of days or "daily"; 24:00 is midnight at the end of
+// the day). access_blocked lists periods, such as exams, in which none may,
+// whole days when given without times. Both use gateway local time and are
+// checked when a desktop starts or is booked: a desktop already running is
+// left alone, and can still be reconnected to.
+
+// accessHours is a weekly window in which desktops may start.
+type accessHours struct {
+	Days       [7]bool
+	Start, End int // Minutes since midnight
+}
+
+// accessPeriod is a period in which no desktop may start.
+type accessPeriod struct {
+	From, Until time.Time
+}
+
+// parseAccessHours parses access_hours specs.
+func parseAccessHours(specs []string) ([]accessHours, error) {
+	var hours []accessHours
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("access_hours %q: want <days> HH:MM-HH:MM", spec)
+		}
+		var h accessHours
+		if strings.EqualFold(fields[0], "daily") {
+			h.Days = [7]bool{true, true, true, true, true, true, true}
+		} else {
+			first, last, _ := strings.Cut(strings.ToLower(fields[0]), "-")
+			if last == "" {
+				last = first
+			}
+			from, ok1 := maintenanceDays[first]
+			to, ok2 := maintenanceDays[last]
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("access_hours %q: invalid days", spec)
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				h.Days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+		start, end, _ := strings.Cut(fields[1], "-")
+		var err1, err2 error
+		h.Start, err1 = clockMinutes(start)
+		h.End, err2 = clockMinutes(end)
+		if err1 != nil || err2 != nil || h.End <= h.Start {
+			return nil, fmt.Errorf("access_hours %q: invalid times (use 24:00 for midnight)", spec)
+		}
+		hours = append(hours, h)
+	}
+	return hours, nil
+}
+
+// clockMinutes parses HH:MM (up to 24:00) into minutes since midnight.
+func clockMinutes(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseAccessBlocked parses access_blocked specs.
+func parseAccessBlocked(specs []string) ([]accessPeriod, error) {
+	var periods []accessPeriod
+	for _, spec := range specs {
+		from, until, ok := strings.Cut(spec, " - ")
+		if !ok {
+			return nil, fmt.Errorf("access_blocked %q: want <from> - <until>", spec)
+		}
+		var p accessPeriod
+		var err1, err2 error
+		p.From, err1 = parseAccessTime(strings.TrimSpace(from), false)
+		p.Until, err2 = parseAccessTime(strings.TrimSpace(until), true)
+		if err1 != nil || err2 != nil || !p.Until.After(p.From) {
+			return nil, fmt.Errorf("access_blocked %q: invalid period (YYYY-MM-DD [HH:MM])", spec)
+		}
+		periods = append(periods, p)
+	}
+	return periods, nil
+}
+
+// parseAccessTime parses a date with an optional time. A date alone is the
+// start of that day, or with end, the end of it.
+func parseAccessTime(s string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// userAccess returns u's access policy.
+func userAccess(u *User) ([]accessHours, []accessPeriod, error) {
+	hours, err := parseAccessHours(u.settingKey("access_hours").Strings(","))
+	if err != nil {
+		return nil, nil, err
+	}
+	blocked, err := parseAccessBlocked(u.settingKey("access_blocked").Strings(","))
+	return hours, blocked, err
+}
+
+// accessDenied checks u's access policy for a desktop starting at t,
+// returning the error message key and argument to refuse it with, or ""
+// if it may start.
+func accessDenied(u *User, t time.Time) (key, arg string, err error) {
+	hours, blocked, err := userAccess(u)
+	if err != nil {
+		return "", "", err
+	}
+	for _, p := range blocked {
+		if !t.Before(p.From) && t.Before(p.Until) {
+			return "error.access_blocked", p.Until.Format("2006-01-02 15:04"), nil
+		}
+	}
+	if len(hours) == 0 {
+		return "", "", nil
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, h := range hours {
+		if h.Days[t.Weekday()] && m >= h.Start && m < h.End {
+			return "", "", nil
+		}
+	}
+	return "error.access_hours", strings.Join(u.settingKey("access_hours").Strings(","), ", "), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var adminToken = "" // Bearer token for /admin/ endpoints ("" = admin API disabled)
+
+// adminOnly guards an admin API handler with the configured bearer tokens.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens := acceptedAdminTokens()
+		if len(tokens) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !slices.ContainsFunc(tokens, func(t string) bool {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1
+		}) {
+			if ok {
+				authFailed(r.RemoteAddr, "", "bad admin token", "admin")
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lookingglass-admin"`)
+			httpError(w, r, 401, "error.unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error as a JSON response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each desktop runs a small agent (ubuntuBase/lg-agent.sh) that talks back to
+// the gateway over HTTP under /agent/. It authenticates with a per-session
+// bearer token handed to the container in LG_AGENT_TOKEN, alongside the
+// gateway's address in LG_GATEWAY_URL.
+//
+// Besides relaying the clipboard, the agent reports how long the X session
+// has gone without keyboard or mouse input (from xprintidle), so a desktop
+// counts as active while someone is actually using it, whichever way their
+// input arrives, and as idle when nobody is, whatever its browser tab does.
+// It also fetches the session's data policy (clipboard directions, file
+// transfer, printing), so it doesn't relay what the gateway would refuse.
+
+var agentGatewayURL = "" // Gateway URL as seen from containers ("" = derived from listen)
+
+// newAgentToken returns a random token for a session's agent.
+func newAgentToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// agentEnvArgs returns the docker run arguments that let a session's agent
+// reach the gateway.
+func agentEnvArgs(token string) []string {
+	gw := agentGatewayURL
+	if gw == "" {
+		_, port, _ := net.SplitHostPort(listenAddr)
+		gw = "http://host.docker.internal:" + port
+	}
+	return []string{
+		"--add-host=host.docker.internal:host-gateway",
+		"-e", "LG_GATEWAY_URL=" + gw,
+		"-e", "LG_AGENT_TOKEN=" + token,
+	}
+}
+
+// agentSession returns the session whose agent made the request.
+func agentSession(r *http.Request) (string, Session, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", Session{}, false
+	}
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for id, s := range sessions {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AgentToken)) == 1 {
+			return id, s, true
+		}
+	}
+	return "", Session{}, false
+}
+
+// agentActivity serves POST /agent/activity for the in-container agent,
+// with idle=<ms> since the last keyboard or mouse input on the desktop.
+// Input more recent than the session's last activity counts as activity,
+// calling off any idle countdown it started after.
+func agentActivity(w http.ResponseWriter, r *http.Request) {
+	sessionID, _, ok := agentSession(r)
+	if !ok {
+		httpError(w, r, 401, "error.unauthorized")
+		return
+	}
+	idle, err := strconv.ParseInt(r.FormValue("idle"), 10, 64)
+	if err != nil || idle < 0 {
+		httpError(w, r, 400, "error.invalid_request")
+		return
+	}
+	input := time.Now().Add(-time.Duration(idle) * time.Millisecond)
+	sessionsMu.Lock()
+	if s, ok := sessions[sessionID]; ok {
+		s.LastInput = input
+		if input.After(s.LastActive) {
+			s.LastActive = input
+			if !s.ExpiresAt.IsZero() && input.After(s.ExpiresAt.Add(-idleGrace)) {
+				s.ExpiresAt = time.Time{}
+			}
+		}
+		sessions[sessionID] = s
+	}
+	sessionsMu.Unlock()
+	w.WriteHeader(204)
+}
+
+// AgentPolicy is what a session's data policy allows, for its agent.
+type AgentPolicy struct {
+	ClipboardIn  bool `json:"clipboard_in"`
+	ClipboardOut bool `json:"clipboard_out"`
+	Upload       bool `json:"upload"`
+	Download     bool `json:"download"`
+	Printing     bool `json:"printing"`
+}
+
+// agentPolicy serves GET /agent/policy for the in-container agent.
+func agentPolicy(w http.ResponseWriter, r *http.Request) {
+	_, s, ok := agentSession(r)
+	if !ok {
+		httpError(w, r, 401, "error.unauthorized")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AgentPolicy{
+		ClipboardIn:  clipboardAllows(s.ClipboardPolicy, "in"),
+		ClipboardOut: clipboardAllows(s.ClipboardPolicy, "out"),
+		Upload:       fileTransferAllows(s.FilePolicy, "upload"),
+		Download:     fileTransferAllows(s.FilePolicy, "download"),
+		Printing:     s.PrintDir != "",
+	})
+}
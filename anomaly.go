@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Sessions behaving unusually are flagged for admins: a desktop moving
+// more than anomaly_bandwidth bytes a second over the network (in and out,
+// averaged over anomaly_interval), one whose container has used at least
+// anomaly_cpu percent CPU for anomaly_cpu_for on end (a pegged crypto
+// miner, say), and a login from a country the user hasn't logged in from
+// before (with anomaly_new_country, the country coming from country_header
+// or geoip_database; a user's first login only records where they are).
+//
+// Anomalies are audited (session.anomaly), counted on /metrics, and listed
+// for admins at GET /admin/anomalies, newest first; DELETE
+// /admin/anomalies/<id> acknowledges one. Each kind is flagged once per
+// session until acknowledged. With anomaly_action = suspend a flagged
+// session's container is also suspended and the session held: it can't be
+// resumed until every anomaly holding it is acknowledged. With stop it is
+// ended. Logins from new countries are only flagged.
+
+var (
+	anomalyInterval    = time.Minute
+	anomalyBandwidth   int64           // Bytes per second (0 = not checked)
+	anomalyCPU         float64         // Percent (0 = not checked)
+	anomalyCPUFor      = 2 * time.Hour // How long CPU must stay that high
+	anomalyNewCountry  = false         // Flag logins from new countries
+	anomalyAction      = "flag"        // flag, suspend or stop
+	loginCountriesPath = "/srv/overlays/login-countries.json"
+	anomalies          []Anomaly                // Newest last, at most maxAnomalies
+	anomalyCounts      = make(map[string]int64) // Flagged, by kind, for /metrics
+	anomaliesMu        sync.Mutex
+	errHeld            = errors.New("desktop held after unusual activity; ask an administrator")
+	maxAnomalies       = 1000
+	loginCountriesMu   sync.Mutex
+)
+
+// Anomaly is a flagged session or login.
+type Anomaly struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"` // bandwidth, cpu or new_country
+	User    string    `json:"user"`
+	Session string    `json:"session,omitempty"`
+	Detail  string    `json:"detail"`
+	Action  string    `json:"action"` // What was done: flag, suspend or stop
+	At      time.Time `json:"at"`
+}
+
+// anomalySample is what the last look at a session's container found.
+type anomalySample struct {
+	net      int64     // Network bytes in and out so far
+	at       time.Time // When net was read
+	cpuSince time.Time // Since when CPU has been over anomalyCPU (zero = it isn't)
+}
+
+// loadAnomalies reads the anomaly_* settings from the [gateway] section.
+func loadAnomalies(gw *ini.Section) error {
+	anomalyInterval = gw.Key("anomaly_interval").MustDuration(anomalyInterval)
+	anomalyCPU = gw.Key("anomaly_cpu").MustFloat64(anomalyCPU)
+	anomalyCPUFor = gw.Key("anomaly_cpu_for").MustDuration(anomalyCPUFor)
+	anomalyNewCountry = gw.Key("anomaly_new_country").MustBool(anomalyNewCountry)
+	anomalyAction = gw.Key("anomaly_action").MustString(anomalyAction)
+	loginCountriesPath = gw.Key("login_countries_file").MustString(filepath.Join(overlayRoot, "login-countries.json"))
+	if v := gw.Key("anomaly_bandwidth").String(); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			return fmt.Errorf("anomaly_bandwidth: %w", err)
+		}
+		anomalyBandwidth = n
+	}
+	switch anomalyAction {
+	case "flag", "suspend", "stop":
+	default:
+		return errors.New(`anomaly_action must be "flag", "suspend" or "stop"`)
+	}
+	if anomalyNewCountry && countryHeader == "" && geoipPath == "" {
+		return errors.New("anomaly_new_country needs country_header or geoip_database")
+	}
+	return nil
+}
+
+// flagAnomaly records an anomaly and acts on it, unless the session
+// already has an unacknowledged one of the kind.
+func flagAnomaly(kind, user, sessionID, detail string) {
+	action := anomalyAction
+	if sessionID == "" {
+		action = "flag"
+	}
+	anomaliesMu.Lock()
+	for _, a := range anomalies {
+		if sessionID != "" && a.Session == sessionID && a.Kind == kind {
+			anomaliesMu.Unlock()
+			return
+		}
+	}
+	a := Anomaly{ID: newAgentToken()[:12], Kind: kind, User: user, Session: sessionID, Detail: detail, Action: action, At: time.Now()}
+	anomalies = append(anomalies, a)
+	if len(anomalies) > maxAnomalies {
+		anomalies = anomalies[len(anomalies)-maxAnomalies:]
+	}
+	anomalyCounts[kind]++
+	anomaliesMu.Unlock()
+
+	log.Printf("Anomaly (%s) for %s: %s", kind, user, detail)
+	audit("session.anomaly", user, sessionID, map[string]string{"kind": kind, "detail": detail, "action": action})
+	switch action {
+	case "suspend":
+		sessionsMu.Lock()
+		s, ok := sessions[sessionID]
+		if ok {
+			s.Held = true
+			sessions[sessionID] = s
+			saveSessions()
+		}
+		sessionsMu.Unlock()
+		if ok && !s.containerless() && !s.Suspended {
+			suspendSession(sessionID)
+		}
+	case "stop":
+		stopSession(sessionID, endAnomaly)
+	}
+}
+
+// anomalyLoop samples every container's CPU and network use.
+func anomalyLoop() {
+	if anomalyInterval <= 0 || anomalyBandwidth <= 0 && anomalyCPU <= 0 {
+		return
+	}
+	samples := make(map[string]anomalySample)
+	for {
+		time.Sleep(anomalyInterval)
+		samples = sampleAnomalies(samples)
+	}
+}
+
+// sampleAnomalies reads docker stats once, flagging sessions over the
+// limits, and returns the new samples by session.
+func sampleAnomalies(last map[string]anomalySample) map[string]anomalySample {
+	out, err := execOutput(context.Background(), "docker", "stats", "--no-stream", "--format", "{{.Name}}|{{.CPUPerc}}|{{.NetIO}}")
+	if err != nil {
+		log.Printf("Anomaly detection: %v", err)
+		return last
+	}
+	byContainer := make(map[string]Session)
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		if !s.containerless() && !s.Suspended {
+			byContainer[s.ContainerName] = s
+		}
+	}
+	sessionsMu.RUnlock()
+
+	now := time.Now()
+	next := make(map[string]anomalySample)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 3 {
+			continue
+		}
+		s, ok := byContainer[fields[0]]
+		if !ok {
+			continue
+		}
+		in, outBytes := parseIOPair(fields[2])
+		cpu, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(fields[1]), "%"), 64)
+		prev, seen := last[s.ID]
+		cur := anomalySample{net: in + outBytes, at: now}
+
+		if anomalyBandwidth > 0 && seen && cur.net >= prev.net {
+			rate := float64(cur.net-prev.net) / now.Sub(prev.at).Seconds()
+			if rate > float64(anomalyBandwidth) {
+				flagAnomaly("bandwidth", s.Username, s.ID, fmt.Sprintf("%s/s on the network", formatBytes(int64(rate))))
+			}
+		}
+		if anomalyCPU > 0 && cpu >= anomalyCPU {
+			cur.cpuSince = now
+			if seen && !prev.cpuSince.IsZero() {
+				cur.cpuSince = prev.cpuSince
+			}
+			if now.Sub(cur.cpuSince) >= anomalyCPUFor {
+				flagAnomaly("cpu", s.Username, s.ID, fmt.Sprintf("CPU at %.0f%% or more for %s", anomalyCPU, formatDuration(now.Sub(cur.cpuSince))))
+			}
+		}
+		next[s.ID] = cur
+	}
+	return next
+}
+
+// checkLoginCountry flags a login from a country the user hasn't logged
+// in from before, and remembers the country.
+func checkLoginCountry(r *http.Request, username string) {
+	country := requestCountry(r)
+	if !anomalyNewCountry || country == "" {
+		return
+	}
+	loginCountriesMu.Lock()
+	known := make(map[string][]string)
+	if data, err := os.ReadFile(loginCountriesPath); err == nil {
+		json.Unmarshal(data, &known)
+	}
+	seen := known[username]
+	if slices.Contains(seen, country) {
+		loginCountriesMu.Unlock()
+		return
+	}
+	known[username] = append(seen, country)
+	data, _ := json.Marshal(known)
+	err := os.MkdirAll(filepath.Dir(loginCountriesPath), 0700)
+	if err == nil {
+		err = os.WriteFile(loginCountriesPath, data, 0600)
+	}
+	loginCountriesMu.Unlock()
+	if err != nil {
+		log.Printf("Recording login countries: %v", err)
+	}
+	if len(seen) > 0 {
+		flagAnomaly("new_country", username, "", fmt.Sprintf("login from %s (before: %s) at %s", country, strings.Join(seen, ", "), r.RemoteAddr))
+	}
+}
+
+// writeAnomalyMetrics prints how many anomalies of each kind were flagged.
+func writeAnomalyMetrics(w io.Writer) {
+	anomaliesMu.Lock()
+	defer anomaliesMu.Unlock()
+	fmt.Fprintln(w, "# HELP lookingglass_anomalies_total Sessions and logins flagged as anomalous, by kind.")
+	fmt.Fprintln(w, "# TYPE lookingglass_anomalies_total counter")
+	for _, kind := range []string{"bandwidth", "cpu", "new_country"} {
+		fmt.Fprintf(w, "lookingglass_anomalies_total{kind=%q} %d\n", kind, anomalyCounts[kind])
+	}
+}
+
+// adminListAnomalies handles GET /admin/anomalies.
+func adminListAnomalies(w http.ResponseWriter, r *http.Request) {
+	anomaliesMu.Lock()
+	list := slices.Clone(anomalies)
+	anomaliesMu.Unlock()
+	slices.Reverse(list)
+	if list == nil {
+		list = []Anomaly{}
+	}
+	writeJSON(w, 200, list)
+}
+
+// adminAckAnomaly handles DELETE /admin/anomalies/{id}, releasing the
+// session it held once nothing else holds it.
+func adminAckAnomaly(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	anomaliesMu.Lock()
+	i := slices.IndexFunc(anomalies, func(a Anomaly) bool { return a.ID == id })
+	if i < 0 {
+		anomaliesMu.Unlock()
+		writeJSONError(w, 404, errors.New("no such anomaly"))
+		return
+	}
+	a := anomalies[i]
+	anomalies = slices.Delete(anomalies, i, i+1)
+	held := slices.ContainsFunc(anomalies, func(b Anomaly) bool { return b.Session == a.Session && b.Action == "suspend" })
+	anomaliesMu.Unlock()
+
+	if a.Session != "" && !held {
+		sessionsMu.Lock()
+		if s, ok := sessions[a.Session]; ok && s.Held {
+			s.Held = false
+			sessions[a.Session] = s
+			saveSessions()
+		}
+		sessionsMu.Unlock()
+	}
+	audit("session.anomaly_ack", a.User, a.Session, map[string]string{"actor": "admin", "kind": a.Kind})
+	w.WriteHeader(204)
+}
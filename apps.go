@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// App profiles run a single application fullscreen, kiosk-style, instead
+// of a whole desktop: a browser on an internal tool, or a particular
+// program. Each is an [app <name>] section of the gateway config:
+//
+//	[app crm]
+//	title = Customer records
+//	command = firefox --kiosk https://crm.internal.example.com
+//	image = ubuntu-apps
+//
+// command is run in place of the desktop environment under a minimal window
+// manager, and started again if closed; any other key (image, idle_timeout,
+// egress, and so on) applies to the app's sessions as a [desktop] section's
+// would. Users, groups or roles are entitled to apps with "apps = crm, wiki"
+// (or "apps = *" for all), and pick them in the desktop chooser alongside
+// their desktops. An app's session is the user's desktop named app:<name>,
+// with its own overlay under desktops/ like any named desktop's.
+
+const appPrefix = "app:"
+
+// appSection returns an app profile's section, if there is one.
+func appSection(name string) (*ini.Section, bool) {
+	if gatewayCfg == nil || !desktopNameRe.MatchString(name) {
+		return nil, false
+	}
+	sec, err := gatewayCfg.GetSection("app " + name)
+	return sec, err == nil
+}
+
+// apps returns the names of the app profiles u may use.
+func (u *User) apps() []string {
+	allowed := u.settingKey("apps").Strings(",")
+	if len(allowed) == 0 || gatewayCfg == nil {
+		return nil
+	}
+	var names []string
+	for _, sec := range gatewayCfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "app ")
+		if ok && desktopNameRe.MatchString(name) && (slices.Contains(allowed, "*") || slices.Contains(allowed, name)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// forApp returns the user as seen by one of their app profiles.
+func (u *User) forApp(name string) (*User, error) {
+	sec, ok := appSection(name)
+	if !ok || !slices.Contains(u.apps(), name) {
+		return nil, errUnknownDesktop
+	}
+	d := *u
+	d.Desktop, d.desk = appPrefix+name, sec
+	return &d, nil
+}
+
+// appTitle returns an app profile's title for the chooser.
+func appTitle(name string) string {
+	if sec, ok := appSection(name); ok && sec.Key("title").String() != "" {
+		return sec.Key("title").String()
+	}
+	return name
+}
+
+// appEnvArgs returns the docker run arguments starting u's desktop as an
+// app, if it is one.
+func appEnvArgs(u *User) []string {
+	if !strings.HasPrefix(u.Desktop, appPrefix) {
+		return nil
+	}
+	return []string{"-e", "LG_APP=" + u.setting("command")}
+}
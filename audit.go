@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a single line of the audit log. Entries are hash-chained:
+// each Hash covers the entry's content and the Hash of the entry before it,
+// so removing or editing a line breaks verification of everything after it.
+type AuditEntry struct {
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	User    string            `json:"user,omitempty"`
+	Session string            `json:"session,omitempty"`
+	Detail  map[string]string `json:"detail,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash"`
+}
+
+var (
+	auditLogPath   = ""    // Audit log file ("" = disabled)
+	complianceMode = false // Append-only history; refuse anything that rewrites it
+
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditPrev string // Hash of the last entry written
+)
+
+// errHistoryImmutable is returned for actions refused in compliance mode.
+var errHistoryImmutable = errors.New("refused: history is immutable in compliance mode")
+
+// openAuditLog opens the audit log for appending and recovers the hash of
+// its last entry. In compliance mode the whole chain is verified first, the
+// file is marked append-only at the filesystem level, and a missing audit
+// log is a fatal configuration error.
+func openAuditLog() error {
+	if auditLogPath == "" {
+		if complianceMode {
+			return errors.New("compliance_mode requires audit_log to be set")
+		}
+		return nil
+	}
+
+	last, err := verifyAuditLog(auditLogPath)
+	if err != nil && complianceMode {
+		return err
+	}
+	if err != nil {
+		log.Printf("Audit log %s failed verification: %v", auditLogPath, err)
+	}
+
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if complianceMode {
+		makeAppendOnly(auditLogPath)
+	}
+	auditFile, auditPrev = f, last
+	return nil
+}
+
+// makeAppendOnly sets the filesystem append-only attribute on path, so not
+// even root can truncate or rewrite it without first clearing the flag.
+func makeAppendOnly(path string) {
+	if err := execRun(context.Background(), "chattr", "+a", path); err != nil {
+		log.Printf("Could not mark %s append-only: %v", path, err)
+	}
+}
+
+// audit appends an event to the audit log, and failed logins to auth_log.
+func audit(event, user, sessionID string, detail map[string]string) {
+	if event == "login.failed" {
+		authFailed(detail["remote"], user, detail["reason"], detail["via"])
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+
+	e := AuditEntry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		User:    user,
+		Session: sessionID,
+		Detail:  detail,
+		Prev:    auditPrev,
+	}
+	e.Hash = auditHash(e)
+
+	line, _ := json.Marshal(e)
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Printf("Audit write failed (%s): %v", event, err)
+		return
+	}
+	auditPrev = e.Hash
+}
+
+// auditHash computes the chained hash of an entry, excluding its own Hash.
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyAuditLog walks the audit log at path, checking every entry's hash and
+// its link to the previous one. It returns the hash of the last entry.
+func verifyAuditLog(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	prev := ""
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return prev, fmt.Errorf("line %d: %v", n, err)
+		}
+		if e.Prev != prev {
+			return prev, fmt.Errorf("line %d: chain broken (entry missing or reordered)", n)
+		}
+		if auditHash(e) != e.Hash {
+			return prev, fmt.Errorf("line %d: hash mismatch (entry modified)", n)
+		}
+		prev = e.Hash
+	}
+	return prev, sc.Err()
+}
+
+// guardHistory must be called before any action that would modify or delete
+// recorded history. In compliance mode the action is refused and the attempt
+// itself is audited.
+func guardHistory(action, actor string) error {
+	if !complianceMode {
+		return nil
+	}
+	audit("history.refused", actor, "", map[string]string{"action": action})
+	log.Printf("Refused %q by %s: compliance mode", action, actor)
+	return errHistoryImmutable
+}
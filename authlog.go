@@ -0,0 +1,64 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Failed logins (from the login form, bookings, desktop passwords, WebDAV
+// and SSH) and wrong admin or metrics tokens are written to auth_log, one
+// line each, for fail2ban or CrowdSec to ban the address at the firewall on
+// top of login_rate_limit. With auth_log = - they go to standard error (and
+// so the journal under systemd). The format is stable:
+//
+//	2024-09-01T12:00:00Z lookingglass: auth failure from 203.0.113.9 via=web user="bob" reason="bad password"
+//
+// The time is UTC, via is web, ssh, webdav, admin or metrics, and user and
+// reason are quoted Go strings, so nothing a client sends can forge the
+// address. fail2ban_example_filter.conf matches it.
+
+var (
+	authLogPath = "" // Where auth failures are logged ("" = nowhere, "-" = stderr)
+	authLog     io.Writer
+	authLogMu   sync.Mutex
+)
+
+// openAuthLog opens auth_log for appending.
+func openAuthLog() error {
+	switch authLogPath {
+	case "":
+		return nil
+	case "-":
+		authLog = os.Stderr
+		return nil
+	}
+	f, err := os.OpenFile(authLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	authLog = f
+	return nil
+}
+
+// authFailed logs an authentication failure from remoteAddr.
+func authFailed(remoteAddr, user, reason, via string) {
+	authLogMu.Lock()
+	defer authLogMu.Unlock()
+	if authLog == nil {
+		return
+	}
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return
+	}
+	line := fmt.Sprintf("%s lookingglass: auth failure from %s via=%s user=%q reason=%q\n",
+		time.Now().UTC().Format(time.RFC3339), ip, cmp.Or(via, "web"), user, reason)
+	if _, err := io.WriteString(authLog, line); err != nil {
+		log.Printf("Auth log write failed: %v", err)
+	}
+}
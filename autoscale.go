@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// A cluster can grow and shrink with demand. With an [autoscale] section
+// naming a provider, one gateway at a time (whichever holds the lead in the
+// cluster store) checks the cluster every interval:
+//
+//   - when the gateways' room for new desktops falls short of the logins
+//     queued plus headroom (by default, once every gateway is full), it
+//     creates a worker VM, one at a time, up to max_nodes;
+//   - a VM that hasn't joined the cluster within boot_timeout is destroyed;
+//   - a VM whose gateway has held no sessions (suspended ones included,
+//     as their overlays stay mounted there) for idle is drained (it takes
+//     no new desktops, so logins reaching it go elsewhere) and, once still
+//     empty, destroyed, down to min_nodes; if demand returns first, a
+//     draining VM takes desktops again before any new one is created.
+//
+// Worker VMs boot with a gateway configured to join the same cluster_store,
+// with node_capacity set, and are recognised by node_name, which defaults
+// to the host name their provider gives them. The VMs created are kept in
+// the store, so a restarted or new leader carries on managing them. Only
+// those are ever drained or destroyed; gateways started by hand are left
+// alone. GET /admin/autoscale shows the gateways and managed VMs.
+//
+// Providers:
+//
+//	hetzner  Hetzner Cloud servers of server_type from image (in location),
+//	         given the cloud-init file user_data; token is an API token.
+//	proxmox  Full clones of the VM template (a VM ID) on node of the Proxmox
+//	         VE cluster at url, named for their cloud-init host name; token is
+//	         an API token, user@realm!name=secret.
+//	ec2      EC2 instances from launch_template (a name, or an lt- ID) in
+//	         region, through the aws command line tool and its credentials.
+
+var (
+	autoscaler        cloudProvider // nil = no autoscaling
+	autoscaleMin      = 0
+	autoscaleMax      = 4
+	autoscaleHeadroom = 0                // Free desktops kept across the cluster
+	autoscaleIdle     = 15 * time.Minute // Empty this long before a VM is drained
+	autoscaleBoot     = 10 * time.Minute // Longest a new VM may take to join
+	autoscaleInterval = 30 * time.Second
+	autoscalePrefix   = "lookingglass-" // Start of new VMs' names
+	cloudClient       = &http.Client{Timeout: 30 * time.Second}
+)
+
+const (
+	autoscaleVMsKey    = "lookingglass:autoscale:vms"
+	autoscaleLeaderKey = "lookingglass:autoscale:leader"
+	cloudTimeout       = 5 * time.Minute // Longest creating or destroying a VM may take
+)
+
+// cloudVM is a worker VM the autoscaler created.
+type cloudVM struct {
+	ID        string     `json:"id"`   // The provider's ID
+	Name      string     `json:"name"` // Host name, which its gateway publishes as node_name
+	Created   time.Time  `json:"created"`
+	Node      string     `json:"node,omitempty"` // Its gateway's node_url, once joined
+	LastSeen  time.Time  `json:"last_seen,omitempty"`
+	IdleSince *time.Time `json:"idle_since,omitempty"`
+	DrainedAt *time.Time `json:"drained_at,omitempty"`
+}
+
+// cloudProvider creates and destroys worker VMs.
+type cloudProvider interface {
+	create(ctx context.Context, name string) (cloudVM, error)
+	destroy(ctx context.Context, vm cloudVM) error
+}
+
+// shortHostname returns the host name up to its first dot.
+func shortHostname() string {
+	hostname, _ := os.Hostname()
+	name, _, _ := strings.Cut(hostname, ".")
+	return name
+}
+
+// loadAutoscale reads the [autoscale] section.
+func loadAutoscale(sec *ini.Section) error {
+	autoscaler = nil
+	provider := sec.Key("provider").String()
+	if provider == "" {
+		return nil
+	}
+	if clusterStore == "" {
+		return errors.New("autoscale: needs cluster_store")
+	}
+	autoscaleMin = sec.Key("min_nodes").MustInt(autoscaleMin)
+	autoscaleMax = sec.Key("max_nodes").MustInt(autoscaleMax)
+	autoscaleHeadroom = sec.Key("headroom").MustInt(autoscaleHeadroom)
+	autoscaleIdle = sec.Key("idle").MustDuration(autoscaleIdle)
+	autoscaleBoot = sec.Key("boot_timeout").MustDuration(autoscaleBoot)
+	autoscaleInterval = sec.Key("interval").MustDuration(autoscaleInterval)
+	autoscalePrefix = sec.Key("name_prefix").MustString(autoscalePrefix)
+	token, err := resolveSecret(sec.Key("token").String())
+	if err != nil {
+		return fmt.Errorf("autoscale: token: %v", err)
+	}
+	switch provider {
+	case "hetzner":
+		autoscaler = &hetznerProvider{
+			token:      token,
+			serverType: sec.Key("server_type").MustString("cx32"),
+			image:      sec.Key("image").MustString("ubuntu-24.04"),
+			location:   sec.Key("location").String(),
+			userData:   sec.Key("user_data").String(),
+		}
+	case "proxmox":
+		template, err := sec.Key("template").Int()
+		if err != nil {
+			return fmt.Errorf("autoscale: proxmox needs template, the VM ID to clone")
+		}
+		autoscaler = &proxmoxProvider{
+			url:      strings.TrimRight(sec.Key("url").String(), "/"),
+			token:    token,
+			node:     sec.Key("node").String(),
+			template: template,
+		}
+	case "ec2":
+		autoscaler = &ec2Provider{
+			launchTemplate: sec.Key("launch_template").String(),
+			region:         sec.Key("region").String(),
+		}
+	default:
+		return fmt.Errorf("autoscale: unknown provider %q", provider)
+	}
+	if autoscaleMax < autoscaleMin {
+		return errors.New("autoscale: max_nodes is below min_nodes")
+	}
+	return nil
+}
+
+// autoscaleLoop checks the cluster every interval while this gateway leads.
+func autoscaleLoop() {
+	if autoscaler == nil || cluster == nil {
+		return
+	}
+	for {
+		if leadAutoscaler() {
+			if err := autoscaleOnce(context.Background()); err != nil {
+				log.Printf("Autoscaler: %v", err)
+			}
+		}
+		time.Sleep(autoscaleInterval)
+	}
+}
+
+// leadAutoscaler takes or keeps the autoscaler's lead, reporting whether
+// this gateway holds it.
+func leadAutoscaler() bool {
+	ttl := strconv.FormatInt((3 * autoscaleInterval).Milliseconds(), 10)
+	_, err := cluster.do("SET", autoscaleLeaderKey, nodeURL, "NX", "PX", ttl)
+	if err == nil {
+		return true
+	}
+	if err != errRedisNil {
+		log.Printf("Cluster store: %v", err)
+		return false
+	}
+	if holder, _ := cluster.get(autoscaleLeaderKey); holder == nodeURL {
+		cluster.do("PEXPIRE", autoscaleLeaderKey, ttl)
+		return true
+	}
+	return false
+}
+
+// managedVMs returns the VMs the autoscaler has created.
+func managedVMs() ([]cloudVM, error) {
+	reply, err := cluster.do("HGETALL", autoscaleVMsKey)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]any)
+	var vms []cloudVM
+	for i := 1; i < len(items); i += 2 {
+		v, _ := items[i].(string)
+		var vm cloudVM
+		if json.Unmarshal([]byte(v), &vm) == nil {
+			vms = append(vms, vm)
+		}
+	}
+	return vms, nil
+}
+
+// saveVM records a managed VM.
+func saveVM(vm cloudVM) error {
+	v, _ := json.Marshal(vm)
+	_, err := cluster.do("HSET", autoscaleVMsKey, vm.ID, string(v))
+	return err
+}
+
+// destroyVM destroys a managed VM and forgets it.
+func destroyVM(ctx context.Context, vm cloudVM, why string) error {
+	ctx, cancel := context.WithTimeout(ctx, cloudTimeout)
+	defer cancel()
+	if err := autoscaler.destroy(ctx, vm); err != nil {
+		return fmt.Errorf("destroying %s (%s): %v", vm.Name, vm.ID, err)
+	}
+	if vm.Node != "" {
+		cluster.do("SREM", "lookingglass:nodes", vm.Node)
+		cluster.do("DEL", "lookingglass:drain:"+vm.Node)
+	}
+	cluster.do("HDEL", autoscaleVMsKey, vm.ID)
+	log.Printf("Autoscaler: destroyed %s (%s): %s", vm.Name, vm.ID, why)
+	audit("autoscale.destroy", "", "", map[string]string{"vm": vm.ID, "name": vm.Name, "node": vm.Node, "reason": why})
+	return nil
+}
+
+// autoscaleOnce makes one round of scaling decisions.
+func autoscaleOnce(ctx context.Context) error {
+	vms, err := managedVMs()
+	if err != nil {
+		return err
+	}
+	nodes, err := clusterNodes()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]nodeStatus)
+	room, queued := 0, 0
+	for _, st := range nodes {
+		byName[st.Name] = st
+		room = min(room+min(st.room(), math.MaxInt/4), math.MaxInt/4)
+		queued += st.Queued
+	}
+
+	now := time.Now()
+	pending, active := 0, 0
+	var idle, drained []cloudVM
+	for _, vm := range vms {
+		st, joined := byName[vm.Name]
+		switch {
+		case !joined && vm.Node == "" && now.Sub(vm.Created) > autoscaleBoot:
+			if err := destroyVM(ctx, vm, "never joined the cluster"); err != nil {
+				log.Printf("Autoscaler: %v", err)
+			}
+			continue
+		case !joined && vm.Node == "":
+			pending++
+			continue
+		case !joined && now.Sub(vm.LastSeen) > autoscaleBoot:
+			if err := destroyVM(ctx, vm, "left the cluster"); err != nil {
+				log.Printf("Autoscaler: %v", err)
+			}
+			continue
+		case !joined:
+			active++ // Missed a publish, perhaps
+			continue
+		}
+		vm.Node, vm.LastSeen = st.URL, now
+		// Suspended sessions keep their overlays mounted there, so count too
+		busy := st.Load > 0 || st.Sessions > 0
+		if busy || st.Queued > 0 {
+			vm.IdleSince = nil
+		} else if vm.IdleSince == nil {
+			vm.IdleSince = &now
+		}
+		switch {
+		case vm.DrainedAt != nil && !busy && now.Sub(*vm.DrainedAt) > 2*clusterTTL:
+			// Long enough for its gateway to have seen the drain
+			if err := destroyVM(ctx, vm, "idle"); err != nil {
+				log.Printf("Autoscaler: %v", err)
+			}
+			continue
+		case vm.DrainedAt == nil:
+			active++
+			if vm.IdleSince != nil && now.Sub(*vm.IdleSince) > autoscaleIdle {
+				idle = append(idle, vm)
+			}
+		default:
+			drained = append(drained, vm)
+		}
+		if err := saveVM(vm); err != nil {
+			return err
+		}
+	}
+
+	// Drain one idle VM at a time, if the rest leave enough room
+	if len(idle) > 0 && active > autoscaleMin && queued == 0 && room-byName[idle[0].Name].room() >= autoscaleHeadroom {
+		vm := idle[0]
+		if _, err := cluster.do("SET", "lookingglass:drain:"+vm.Node, "1"); err != nil {
+			return err
+		}
+		vm.DrainedAt = &now
+		if err := saveVM(vm); err != nil {
+			return err
+		}
+		log.Printf("Autoscaler: draining %s (%s), idle since %s", vm.Name, vm.ID, vm.IdleSince.Format(time.RFC3339))
+		return nil
+	}
+
+	wanted := active < autoscaleMin || room < max(queued+autoscaleHeadroom, 1)
+	if !wanted {
+		return nil
+	}
+	if len(drained) > 0 {
+		// Needed after all: take new desktops again rather than wait for a VM
+		vm := drained[0]
+		if _, err := cluster.do("DEL", "lookingglass:drain:"+vm.Node); err != nil {
+			return err
+		}
+		vm.DrainedAt = nil
+		log.Printf("Autoscaler: no longer draining %s (%s)", vm.Name, vm.ID)
+		return saveVM(vm)
+	}
+	if pending > 0 || active+pending >= autoscaleMax {
+		return nil
+	}
+	name := autoscalePrefix + newAgentToken()[:8]
+	cctx, cancel := context.WithTimeout(ctx, cloudTimeout)
+	vm, err := autoscaler.create(cctx, name)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", name, err)
+	}
+	vm.Created = now
+	if err := saveVM(vm); err != nil {
+		return err
+	}
+	log.Printf("Autoscaler: created %s (%s): %d queued, room for %d", vm.Name, vm.ID, queued, room)
+	audit("autoscale.create", "", "", map[string]string{"vm": vm.ID, "name": vm.Name, "queued": strconv.Itoa(queued)})
+	return nil
+}
+
+// adminAutoscale handles GET /admin/autoscale.
+func adminAutoscale(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		writeJSONError(w, 404, errors.New("not clustered"))
+		return
+	}
+	nodes, err := clusterNodes()
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	vms := []cloudVM{}
+	if autoscaler != nil {
+		list, err := managedVMs()
+		if err != nil {
+			writeJSONError(w, 500, err)
+			return
+		}
+		vms = append(vms, list...)
+	}
+	if nodes == nil {
+		nodes = []nodeStatus{}
+	}
+	leader, _ := cluster.get(autoscaleLeaderKey)
+	writeJSON(w, 200, map[string]any{"nodes": nodes, "vms": vms, "leader": leader})
+}
+
+// cloudRequest makes a JSON API call, decoding the reply into out.
+func cloudRequest(ctx context.Context, method, url, auth string, body io.Reader, contentType string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return &cloudError{resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// cloudError is an error status from a provider's API.
+type cloudError struct {
+	status int
+	body   string
+}
+
+func (e *cloudError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.body)
+}
+
+// isNotFound reports whether err is a provider saying something doesn't
+// exist (so there is nothing left to destroy).
+func isNotFound(err error) bool {
+	var ce *cloudError
+	return errors.As(err, &ce) && ce.status == 404
+}
+
+// --- Hetzner Cloud ---
+
+type hetznerProvider struct {
+	token, serverType, image, location string
+	userData                           string // Path of a cloud-init file
+}
+
+func (p *hetznerProvider) create(ctx context.Context, name string) (cloudVM, error) {
+	server := map[string]any{
+		"name":        name,
+		"server_type": p.serverType,
+		"image":       p.image,
+		"labels":      map[string]string{"lookingglass": "node"},
+	}
+	if p.location != "" {
+		server["location"] = p.location
+	}
+	if p.userData != "" {
+		data, err := os.ReadFile(p.userData)
+		if err != nil {
+			return cloudVM{}, err
+		}
+		server["user_data"] = string(data)
+	}
+	body, _ := json.Marshal(server)
+	var reply struct {
+		Server struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"server"`
+	}
+	err := cloudRequest(ctx, "POST", "https://api.hetzner.cloud/v1/servers", "Bearer "+p.token,
+		bytes.NewReader(body), "application/json", &reply)
+	if err != nil {
+		return cloudVM{}, err
+	}
+	return cloudVM{ID: strconv.FormatInt(reply.Server.ID, 10), Name: reply.Server.Name}, nil
+}
+
+func (p *hetznerProvider) destroy(ctx context.Context, vm cloudVM) error {
+	err := cloudRequest(ctx, "DELETE", "https://api.hetzner.cloud/v1/servers/"+url.PathEscape(vm.ID), "Bearer "+p.token, nil, "", nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// --- Proxmox VE ---
+
+type proxmoxProvider struct {
+	url, token, node string
+	template         int
+}
+
+// call makes a Proxmox API call, returning its data.
+func (p *proxmoxProvider) call(ctx context.Context, method, path string, form url.Values) (json.RawMessage, error) {
+	var body io.Reader
+	contentType := ""
+	if form != nil {
+		body, contentType = strings.NewReader(form.Encode()), "application/x-www-form-urlencoded"
+	}
+	var reply struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err := cloudRequest(ctx, method, p.url+"/api2/json"+path, "PVEAPIToken="+p.token, body, contentType, &reply)
+	return reply.Data, err
+}
+
+// wait waits for a task to finish, returning an error if it failed.
+func (p *proxmoxProvider) wait(ctx context.Context, upid json.RawMessage) error {
+	var task string
+	if err := json.Unmarshal(upid, &task); err != nil {
+		return err
+	}
+	for {
+		data, err := p.call(ctx, "GET", "/nodes/"+p.node+"/tasks/"+url.PathEscape(task)+"/status", nil)
+		if err != nil {
+			return err
+		}
+		var st struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		json.Unmarshal(data, &st)
+		if st.Status == "stopped" {
+			if st.ExitStatus != "OK" {
+				return fmt.Errorf("task %s: %s", task, st.ExitStatus)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// clone makes a full clone of a template VM, returning the new VM's ID.
+func (p *proxmoxProvider) clone(ctx context.Context, template int, name string) (string, error) {
+	data, err := p.call(ctx, "GET", "/cluster/nextid", nil)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	if err := json.Unmarshal(data, &id); err != nil {
+		return "", err
+	}
+	upid, err := p.call(ctx, "POST", fmt.Sprintf("/nodes/%s/qemu/%d/clone", p.node, template),
+		url.Values{"newid": {id}, "name": {name}, "full": {"1"}})
+	if err == nil {
+		err = p.wait(ctx, upid)
+	}
+	if err != nil {
+		p.destroy(context.WithoutCancel(ctx), cloudVM{ID: id, Name: name})
+		return "", err
+	}
+	return id, nil
+}
+
+func (p *proxmoxProvider) create(ctx context.Context, name string) (cloudVM, error) {
+	id, err := p.clone(ctx, p.template, name)
+	if err != nil {
+		return cloudVM{}, err
+	}
+	vm := cloudVM{ID: id, Name: name}
+	if _, err := p.call(ctx, "POST", "/nodes/"+p.node+"/qemu/"+id+"/status/start", url.Values{}); err != nil {
+		p.destroy(context.WithoutCancel(ctx), vm)
+		return cloudVM{}, err
+	}
+	return vm, nil
+}
+
+func (p *proxmoxProvider) destroy(ctx context.Context, vm cloudVM) error {
+	upid, err := p.call(ctx, "POST", "/nodes/"+p.node+"/qemu/"+vm.ID+"/status/stop", url.Values{})
+	if err == nil {
+		err = p.wait(ctx, upid)
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	upid, err = p.call(ctx, "DELETE", "/nodes/"+p.node+"/qemu/"+vm.ID+"?purge=1", nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return p.wait(ctx, upid)
+}
+
+// --- EC2, through the aws command line tool ---
+
+type ec2Provider struct {
+	launchTemplate, region string
+}
+
+// aws runs an aws ec2 command.
+func (p *ec2Provider) aws(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"ec2"}, args...)
+	if p.region != "" {
+		args = append(args, "--region", p.region)
+	}
+	out, err := execOutput(ctx, "aws", args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func (p *ec2Provider) create(ctx context.Context, name string) (cloudVM, error) {
+	template := "LaunchTemplateName=" + p.launchTemplate
+	if strings.HasPrefix(p.launchTemplate, "lt-") {
+		template = "LaunchTemplateId=" + p.launchTemplate
+	}
+	out, err := p.aws(ctx, "run-instances", "--launch-template", template, "--count", "1",
+		"--tag-specifications", "ResourceType=instance,Tags=[{Key=Name,Value="+name+"},{Key=lookingglass,Value=node}]",
+		"--query", "Instances[0].[InstanceId,PrivateDnsName]", "--output", "text")
+	if err != nil {
+		return cloudVM{}, err
+	}
+	id, dns, _ := strings.Cut(out, "\t")
+	if !strings.HasPrefix(id, "i-") {
+		return cloudVM{}, fmt.Errorf("unexpected run-instances output %q", out)
+	}
+	// Instances take their host name from their private DNS name
+	host, _, _ := strings.Cut(strings.TrimSpace(dns), ".")
+	return cloudVM{ID: id, Name: host}, nil
+}
+
+func (p *ec2Provider) destroy(ctx context.Context, vm cloudVM) error {
+	_, err := p.aws(ctx, "terminate-instances", "--instance-ids", vm.ID)
+	return err
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Base rootfs versions live side by side under basesDir, one directory per
+// version, with basesDir/CURRENT naming the one new logins use. Each overlay
+// records the base it was last mounted on in <overlay>/base, so a version
+// can only be retired once no overlay depends on it. With no versions
+// registered, the legacy single baseOverlay directory is used.
+
+var (
+	basesDir      = "/srv/overlays/bases"  // Registered base rootfs versions
+	baseImportDir = "/srv/overlays/import" // Where directories to register as bases must be
+)
+
+var baseNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errUnknownBase = errors.New("unknown base")
+
+// BaseInfo describes a registered base rootfs version.
+type BaseInfo struct {
+	Name    string   `json:"name"`
+	Current bool     `json:"current"`
+	Users   []string `json:"users"` // Overlays that still depend on it
+}
+
+// currentBase returns the name and path of the base new logins mount.
+func currentBase() (name, dir string) {
+	b, err := os.ReadFile(filepath.Join(basesDir, "CURRENT"))
+	if err != nil {
+		return "", baseOverlay
+	}
+	name = strings.TrimSpace(string(b))
+	return name, filepath.Join(basesDir, name)
+}
+
+// recordBase notes in an overlay which base it is mounted on, logging when
+// the user is migrated from an older version.
+func recordBase(overlayDir, username, name string) {
+	marker := filepath.Join(overlayDir, "base")
+	if old, err := os.ReadFile(marker); err == nil && string(old) != name {
+		log.Printf("Migrating %s from base %q to %q", username, old, name)
+	}
+	os.WriteFile(marker, []byte(name), 0644)
+}
+
+// listBases returns every registered base version and its dependants.
+func listBases() ([]BaseInfo, error) {
+	entries, err := os.ReadDir(basesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	current, _ := currentBase()
+	users := baseUsers()
+
+	var bases []BaseInfo
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		bases = append(bases, BaseInfo{
+			Name:    e.Name(),
+			Current: e.Name() == current,
+			Users:   users[e.Name()],
+		})
+	}
+	return bases, nil
+}
+
+// baseUsers maps each base version to the overlays recorded against it:
+// persistent overlays from user configs (named desktops, apps and catalog
+// images included, as user/desktop), plus any guest overlays.
+func baseUsers() map[string][]string {
+	overlays := make(map[string]string) // overlay dir -> owner
+	for _, name := range userNames() {
+		u, err := loadUser(name)
+		if err != nil {
+			continue
+		}
+		if o := u.setting("overlay"); o != "" && o != "ephemeral" {
+			overlays[o] = name
+		}
+		for _, desktop := range u.overlayDesktops() {
+			d, err := u.forDesktop(desktop)
+			if err != nil {
+				continue
+			}
+			if o := d.overlay(); o != "" && o != "ephemeral" {
+				overlays[o] = name + "/" + d.Desktop
+			}
+		}
+	}
+	guests, _ := filepath.Glob(filepath.Join(overlayRoot, "guest-*"))
+	for _, g := range guests {
+		overlays[g] = filepath.Base(g)
+	}
+
+	users := make(map[string][]string)
+	for dir, owner := range overlays {
+		if b, err := os.ReadFile(filepath.Join(dir, "base")); err == nil {
+			name := strings.TrimSpace(string(b))
+			users[name] = append(users[name], owner)
+		}
+	}
+	for _, u := range users {
+		sort.Strings(u)
+	}
+	return users
+}
+
+// registerBase installs a new base version from source, which is either a
+// directory under baseImportDir holding an extracted rootfs (moved into
+// place) or the name of a Docker image to export.
+func registerBase(ctx context.Context, name, source string) error {
+	if !baseNameRe.MatchString(name) || name == "CURRENT" {
+		return fmt.Errorf("invalid base name %q", name)
+	}
+	if source == "" || strings.HasPrefix(source, "-") {
+		return fmt.Errorf("invalid source %q", source)
+	}
+	dst := filepath.Join(basesDir, name)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("base %q already exists", name)
+	}
+	if err := os.MkdirAll(basesDir, 0755); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(source); err == nil && fi.IsDir() {
+		src, ok := importedDir(source)
+		if !ok {
+			return fmt.Errorf("directories to register must be under %s", baseImportDir)
+		}
+		return os.Rename(src, dst)
+	}
+
+	// Export the image's filesystem, as ubuntuBase/build.sh does
+	out, err := execOutput(ctx, "docker", "create", source)
+	if err != nil {
+		return fmt.Errorf("docker create %s: %v", source, err)
+	}
+	id := strings.TrimSpace(string(out))
+	defer execRun(context.Background(), "docker", "rm", id)
+
+	tmp := dst + ".partial"
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	_, err = timedCommand(ctx, exportTimeout, "sh", "-c", `docker export "$1" | tar -C "$2" -x`, "sh", id, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("exporting %s: %v", source, err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// importedDir resolves symlinks in dir, reporting whether it is inside
+// baseImportDir (and not the directory itself).
+func importedDir(dir string) (string, bool) {
+	root, err := filepath.EvalSymlinks(baseImportDir)
+	if err != nil {
+		return "", false
+	}
+	p, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, p)
+	return p, err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// activateBase makes name the base that new logins are migrated to.
+func activateBase(name string) error {
+	if fi, err := os.Stat(filepath.Join(basesDir, name)); err != nil || !fi.IsDir() || !baseNameRe.MatchString(name) {
+		return fmt.Errorf("%w %q", errUnknownBase, name)
+	}
+	tmp := filepath.Join(basesDir, ".CURRENT.tmp")
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(basesDir, "CURRENT"))
+}
+
+// retireBase deletes a base version that is neither current nor depended
+// on by any overlay.
+func retireBase(name string) error {
+	dir := filepath.Join(basesDir, name)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() || !baseNameRe.MatchString(name) {
+		return fmt.Errorf("%w %q", errUnknownBase, name)
+	}
+	if current, _ := currentBase(); current == name {
+		return fmt.Errorf("base %q is current", name)
+	}
+	if users := baseUsers()[name]; len(users) > 0 {
+		return fmt.Errorf("base %q is still used by: %s", name, strings.Join(users, ", "))
+	}
+	return os.RemoveAll(dir)
+}
+
+// --- Admin API ---
+
+// adminListBases handles GET /admin/bases.
+func adminListBases(w http.ResponseWriter, r *http.Request) {
+	bases, err := listBases()
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, bases)
+}
+
+// adminRegisterBase handles POST /admin/bases with a JSON body of
+// {"name": ..., "source": ..., "activate": bool}.
+func adminRegisterBase(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string `json:"name"`
+		Source   string `json:"source"`
+		Activate bool   `json:"activate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if err := registerBase(r.Context(), req.Name, req.Source); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	audit("base.register", "admin", "", map[string]string{"base": req.Name, "source": req.Source})
+	if req.Activate {
+		if err := activateBase(req.Name); err != nil {
+			writeJSONError(w, 500, err)
+			return
+		}
+		audit("base.activate", "admin", "", map[string]string{"base": req.Name})
+	}
+	writeJSON(w, 201, map[string]string{"name": req.Name})
+}
+
+// adminActivateBase handles POST /admin/bases/{name}/activate.
+func adminActivateBase(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := activateBase(name); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	audit("base.activate", "admin", "", map[string]string{"base": name})
+	w.WriteHeader(204)
+}
+
+// adminRetireBase handles DELETE /admin/bases/{name}.
+func adminRetireBase(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := retireBase(name); err != nil {
+		status := 409
+		if errors.Is(err, errUnknownBase) {
+			status = 404
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+	audit("base.retire", "admin", "", map[string]string{"base": name})
+	w.WriteHeader(204)
+}
+
+// --- CLI ---
+
+// baseCommand implements "lookingglass base ...".
+func baseCommand(args []string) error {
+	usage := errors.New("usage: lookingglass base list | register <name> <dir|image> [--activate] | activate <name> | retire <name>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		bases, err := listBases()
+		if err != nil {
+			return err
+		}
+		for _, b := range bases {
+			mark := " "
+			if b.Current {
+				mark = "*"
+			}
+			fmt.Printf("%s %-24s %d overlay(s) %s\n", mark, b.Name, len(b.Users), strings.Join(b.Users, ","))
+		}
+	case args[0] == "register" && (len(args) == 3 || len(args) == 4 && args[3] == "--activate"):
+		if err := registerBase(context.Background(), args[1], args[2]); err != nil {
+			return err
+		}
+		if len(args) == 4 {
+			return activateBase(args[1])
+		}
+	case args[0] == "activate" && len(args) == 2:
+		return activateBase(args[1])
+	case args[0] == "retire" && len(args) == 2:
+		return retireBase(args[1])
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bookings pre-start desktops ahead of a known login time, so a class of
+// users logging in together at 09:00 find their desktops already running
+// rather than all starting containers at once. Desktops are started one at
+// a time from bookingLead before the booked time, and held for bookingHold
+// after it; a user who logs in during that window takes over the running
+// desktop.
+
+var (
+	bookingsPath = "/srv/overlays/bookings.json" // Pending bookings
+	bookingLead  = 10 * time.Minute
+	bookingHold  = 30 * time.Minute
+	bookings     = make(map[string]*Booking)
+	bookingsMu   sync.Mutex
+)
+
+var (
+	errBookingPast      = errors.New("booking time has already passed")
+	errBookingEncrypted = errors.New("encrypted desktops need the user's password to start and cannot be pre-booked")
+	errUnknownBooking   = errors.New("no such booking")
+)
+
+// Booking is a request to have desktops running for some users at a time.
+type Booking struct {
+	ID       string    `json:"id"`
+	Users    []string  `json:"users"`
+	At       time.Time `json:"at"`
+	BookedBy string    `json:"booked_by"`
+	Started  bool      `json:"started"` // Desktops have been pre-started
+
+	Labels map[string]string `json:"labels,omitempty"` // Given to the pre-started sessions
+}
+
+// loadBookings reads pending bookings saved by a previous run.
+func loadBookings() error {
+	data, err := os.ReadFile(bookingsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Booking
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	bookingsMu.Lock()
+	defer bookingsMu.Unlock()
+	for _, b := range list {
+		// Desktops don't survive a restart, so start them again
+		b.Started = false
+		bookings[b.ID] = b
+	}
+	return nil
+}
+
+// saveBookings writes the pending bookings to disk. The caller must hold
+// bookingsMu.
+func saveBookings() {
+	list := make([]*Booking, 0, len(bookings))
+	for _, b := range bookings {
+		list = append(list, b)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := bookingsPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, bookingsPath)
+		}
+	}
+	if err != nil {
+		log.Printf("Saving bookings: %v", err)
+	}
+}
+
+// addBooking books desktops for users at the given time.
+func addBooking(users []string, at time.Time, bookedBy string, labels map[string]string) (*Booking, error) {
+	if len(users) == 0 {
+		return nil, errors.New("no users to book for")
+	}
+	if err := validateLabels(labels); err != nil {
+		return nil, err
+	}
+	if !at.After(time.Now()) {
+		return nil, errBookingPast
+	}
+	for _, name := range users {
+		u, err := loadUser(name)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", name, err)
+		}
+		if names := u.desktops(); len(names) > 0 {
+			u, _ = u.forDesktop(names[0])
+		}
+		if u.setting("overlay") != "ephemeral" && u.setting("encryption") == "fscrypt" {
+			return nil, fmt.Errorf("user %q: %w", name, errBookingEncrypted)
+		}
+	}
+	b := &Booking{ID: randSeq(8), Users: users, At: at, BookedBy: bookedBy, Labels: labels}
+	bookingsMu.Lock()
+	bookings[b.ID] = b
+	saveBookings()
+	bookingsMu.Unlock()
+	audit("booking.create", bookedBy, "", map[string]string{
+		"booking": b.ID, "users": strings.Join(users, ","), "at": at.Format(time.RFC3339),
+	})
+	return b, nil
+}
+
+// cancelBooking removes a booking. Desktops already started for it are left
+// to be claimed or to time out.
+func cancelBooking(id, actor string) error {
+	bookingsMu.Lock()
+	_, ok := bookings[id]
+	delete(bookings, id)
+	if ok {
+		saveBookings()
+	}
+	bookingsMu.Unlock()
+	if !ok {
+		return errUnknownBooking
+	}
+	audit("booking.cancel", actor, "", map[string]string{"booking": id})
+	return nil
+}
+
+// listBookings returns pending bookings, soonest first.
+func listBookings() []Booking {
+	bookingsMu.Lock()
+	defer bookingsMu.Unlock()
+	list := make([]Booking, 0, len(bookings))
+	for _, b := range bookings {
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// bookingLoop pre-starts desktops for bookings that are coming up, and
+// forgets bookings once their hold period is over.
+func bookingLoop() {
+	for {
+		time.Sleep(30 * time.Second)
+		var due []*Booking
+		bookingsMu.Lock()
+		for id, b := range bookings {
+			switch {
+			case time.Now().After(b.At.Add(bookingHold)):
+				delete(bookings, id)
+				saveBookings()
+			case !b.Started && time.Until(b.At) < bookingLead:
+				b.Started = true
+				due = append(due, b)
+			}
+		}
+		bookingsMu.Unlock()
+
+		// One at a time, so a large class doesn't start all at once
+		for _, b := range due {
+			for _, name := range b.Users {
+				prestart(b, name)
+			}
+		}
+	}
+}
+
+// prestart starts a reserved desktop for one user of a booking.
+func prestart(b *Booking, name string) {
+	if _, ok := findUserSession(name); ok {
+		return
+	}
+	u, err := loadUser(name)
+	if err != nil {
+		log.Printf("Booking %s: user %s: %v", b.ID, name, err)
+		return
+	}
+	if names := u.desktops(); len(names) > 0 {
+		// Users with several desktops get their first one ready
+		u, _ = u.forDesktop(names[0])
+	}
+	if !reserveSlot(false) {
+		log.Printf("Booking %s: no capacity to pre-start a desktop for %s", b.ID, name)
+		return
+	}
+	sessionID, started, err := startOrFind(context.Background(), u, "", "booking:"+b.ID)
+	releaseSlot()
+	if err != nil {
+		log.Printf("Booking %s: starting desktop for %s: %v", b.ID, name, err)
+		return
+	}
+	if !started {
+		return // The user logged in meanwhile
+	}
+	sessionsMu.Lock()
+	if s, ok := sessions[sessionID]; ok {
+		s.ReservedUntil = b.At.Add(bookingHold)
+		s.Labels = b.Labels
+		sessions[sessionID] = s
+		saveSessions()
+	}
+	sessionsMu.Unlock()
+	log.Printf("Booking %s: pre-started desktop %s for %s", b.ID, sessionID, name)
+}
+
+// claimReserved hands a user their pre-started desktop, if they have one.
+func claimReserved(username, desktop string) (string, bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		if s.Username == username && s.Desktop == desktop && !s.ReservedUntil.IsZero() {
+			s.ReservedUntil = time.Time{}
+			s.ClaimToken = "" // Logging in claims it as the link would
+			s.ClaimExpires = time.Time{}
+			s.StartedAt = time.Now()
+			s.LastActive = time.Now()
+			sessions[id] = s
+			saveSessions()
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// book lets a user book a desktop for themselves.
+func book(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "book.html", nil)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		httpError(w, r, 400, "error.invalid_form")
+		return
+	}
+	username := r.FormValue("username")
+	if loginBlocked(r.RemoteAddr) {
+		audit("login.failed", username, "", map[string]string{"reason": "rate limited", "remote": r.RemoteAddr})
+		httpError(w, r, 429, "error.too_many_attempts")
+		return
+	}
+	if geoBlocked(w, r, username) {
+		return
+	}
+	if err := verifyCaptcha(r); err != nil {
+		audit("login.failed", username, "", map[string]string{"reason": "captcha", "remote": r.RemoteAddr})
+		log.Printf("CAPTCHA for %s from %s: %v", username, r.RemoteAddr, err)
+		httpError(w, r, 401, "error.captcha")
+		return
+	}
+	u, err := loadUser(username)
+	if err != nil || !u.checkPassword(r.FormValue("password")) {
+		audit("login.failed", username, "", map[string]string{"reason": "booking", "remote": r.RemoteAddr})
+		loginFailed(r.RemoteAddr)
+		httpError(w, r, 401, "error.invalid_credentials")
+		return
+	}
+	at, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("at"), time.Local)
+	if err != nil {
+		httpError(w, r, 400, "error.invalid_time")
+		return
+	}
+	if key, arg, err := accessDenied(u, at); err != nil {
+		serverError(w, r, 500, err)
+		return
+	} else if key != "" {
+		httpError(w, r, 403, key, arg)
+		return
+	}
+	b, err := addBooking([]string{u.Name}, at, u.Name, nil)
+	switch {
+	case errors.Is(err, errBookingPast):
+		httpError(w, r, 400, "error.booking_past")
+		return
+	case errors.Is(err, errBookingEncrypted):
+		httpError(w, r, 400, "error.booking_encrypted")
+		return
+	case err != nil:
+		serverError(w, r, 500, err)
+		return
+	}
+	renderTemplate(w, r, "book.html", map[string]any{"Booked": b, "HoldMinutes": int(bookingHold.Minutes())})
+}
+
+// adminListBookings handles GET /admin/bookings.
+func adminListBookings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, listBookings())
+}
+
+// adminAddBooking handles POST /admin/bookings with a JSON body of
+// {"users": [...], "at": "2026-09-01T09:00:00+01:00", "labels": {...}}.
+func adminAddBooking(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Users  []string          `json:"users"`
+		At     time.Time         `json:"at"`
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	b, err := addBooking(req.Users, req.At, "admin", req.Labels)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	writeJSON(w, 201, b)
+}
+
+// adminCancelBooking handles DELETE /admin/bookings/{id}.
+func adminCancelBooking(w http.ResponseWriter, r *http.Request) {
+	if err := cancelBooking(r.PathValue("id"), "admin"); err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Requests and SSH connections from known-bad addresses are refused before
+// they reach login or a desktop, from a CrowdSec local API (crowdsec_url,
+// with a bouncer key from "cscli bouncers add", crowdsec_key) and from
+// blocklist_urls, plain-text lists of addresses and CIDR ranges, one per
+// line (# starts a comment; anything after the first field is ignored).
+// Both are polled every blocklist_refresh: CrowdSec in stream mode, so
+// only new and expired ban decisions are fetched after the first poll. A
+// failed poll keeps what was fetched last. Refused requests are counted on
+// /metrics.
+
+var (
+	crowdsecURL      = ""
+	crowdsecKey      = ""
+	blocklistURLs    []string
+	blocklistRefresh = time.Minute
+	bouncerClient    = &http.Client{Timeout: 30 * time.Second}
+
+	crowdsecBans  = make(map[string]netip.Prefix) // CrowdSec ban decisions, by value
+	blocklists    = make(map[string][]netip.Prefix)
+	blockedAddrs  map[netip.Addr]bool // Single addresses of all the above
+	blockedRanges []netip.Prefix      // And ranges
+	blockedCount  = make(map[string]int64)
+	bouncerMu     sync.RWMutex
+)
+
+// crowdsecDecision is a decision in the local API's stream.
+type crowdsecDecision struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// loadBouncer reads the blocklist settings from the [gateway] section.
+func loadBouncer(gw *ini.Section) error {
+	crowdsecURL = strings.TrimSuffix(gw.Key("crowdsec_url").MustString(crowdsecURL), "/")
+	key, err := secretKey(gw, "crowdsec_key", crowdsecKey)
+	if err != nil {
+		return err
+	}
+	crowdsecKey = key
+	blocklistURLs = gw.Key("blocklist_urls").Strings(",")
+	blocklistRefresh = gw.Key("blocklist_refresh").MustDuration(blocklistRefresh)
+	if crowdsecURL != "" && crowdsecKey == "" {
+		return errors.New("crowdsec_url needs crowdsec_key")
+	}
+	return nil
+}
+
+// parsePrefix parses an address or CIDR range.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// bouncerLoop polls CrowdSec and the blocklists.
+func bouncerLoop() {
+	if crowdsecURL == "" && len(blocklistURLs) == 0 {
+		return
+	}
+	startup := true
+	for {
+		if crowdsecURL != "" {
+			if err := pollCrowdsec(startup); err != nil {
+				log.Printf("CrowdSec: %v", err)
+			} else {
+				startup = false
+			}
+		}
+		for _, u := range blocklistURLs {
+			if err := fetchBlocklist(u); err != nil {
+				log.Printf("Blocklist %s: %v", u, err)
+			}
+		}
+		rebuildBlocked()
+		time.Sleep(blocklistRefresh)
+	}
+}
+
+// pollCrowdsec applies the ban decisions added and deleted since the last
+// poll (all current ones at startup).
+func pollCrowdsec(startup bool) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/decisions/stream?startup=%t", crowdsecURL, startup), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", crowdsecKey)
+	req.Header.Set("User-Agent", "lookingglass-bouncer")
+	res, err := bouncerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("local API answered %s", res.Status)
+	}
+	var stream struct {
+		New     []crowdsecDecision `json:"new"`
+		Deleted []crowdsecDecision `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stream); err != nil {
+		return err
+	}
+	bouncerMu.Lock()
+	defer bouncerMu.Unlock()
+	if startup {
+		crowdsecBans = make(map[string]netip.Prefix)
+	}
+	for _, d := range stream.Deleted {
+		delete(crowdsecBans, d.Value)
+	}
+	for _, d := range stream.New {
+		scope := strings.ToLower(d.Scope)
+		if d.Type != "ban" || scope != "ip" && scope != "range" {
+			continue
+		}
+		if p, err := parsePrefix(d.Value); err == nil {
+			crowdsecBans[d.Value] = p
+		}
+	}
+	return nil
+}
+
+// fetchBlocklist reads one of blocklist_urls.
+func fetchBlocklist(url string) error {
+	res, err := bouncerClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("answered %s", res.Status)
+	}
+	var list []netip.Prefix
+	sc := bufio.NewScanner(io.LimitReader(res.Body, 64<<20))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if p, err := parsePrefix(fields[0]); err == nil {
+			list = append(list, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	bouncerMu.Lock()
+	blocklists[url] = list
+	bouncerMu.Unlock()
+	return nil
+}
+
+// rebuildBlocked merges the CrowdSec decisions and blocklists for lookup.
+func rebuildBlocked() {
+	bouncerMu.Lock()
+	defer bouncerMu.Unlock()
+	addrs := make(map[netip.Addr]bool)
+	var ranges []netip.Prefix
+	add := func(p netip.Prefix) {
+		if p.IsSingleIP() {
+			addrs[p.Addr()] = true
+		} else {
+			ranges = append(ranges, p)
+		}
+	}
+	for _, p := range crowdsecBans {
+		add(p)
+	}
+	for _, list := range blocklists {
+		for _, p := range list {
+			add(p)
+		}
+	}
+	blockedAddrs, blockedRanges = addrs, ranges
+}
+
+// addrBlocked reports whether a host:port address is on a blocklist.
+func addrBlocked(remoteAddr string) bool {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	a := ap.Addr().Unmap()
+	bouncerMu.RLock()
+	defer bouncerMu.RUnlock()
+	if blockedAddrs[a] {
+		return true
+	}
+	for _, p := range blockedRanges {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteBlocked counts a refused request or connection.
+func noteBlocked(via string) {
+	bouncerMu.Lock()
+	blockedCount[via]++
+	bouncerMu.Unlock()
+}
+
+// blockBadAddrs refuses requests from blocked addresses.
+func blockBadAddrs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addrBlocked(r.RemoteAddr) {
+			noteBlocked("http")
+			httpError(w, r, 403, "error.address_blocked")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeBouncerMetrics prints the blocklists' sizes and what they refused.
+func writeBouncerMetrics(w io.Writer) {
+	bouncerMu.RLock()
+	defer bouncerMu.RUnlock()
+	fmt.Fprintln(w, "# HELP lookingglass_blocklist_entries Addresses and ranges blocked, from CrowdSec and blocklist_urls.")
+	fmt.Fprintln(w, "# TYPE lookingglass_blocklist_entries gauge")
+	fmt.Fprintf(w, "lookingglass_blocklist_entries %d\n", len(blockedAddrs)+len(blockedRanges))
+	fmt.Fprintln(w, "# HELP lookingglass_blocked_total Requests and SSH connections refused from blocked addresses.")
+	fmt.Fprintln(w, "# TYPE lookingglass_blocked_total counter")
+	for _, via := range []string{"http", "ssh"} {
+		fmt.Fprintf(w, "lookingglass_blocked_total{via=%q} %d\n", via, blockedCount[via])
+	}
+}
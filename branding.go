@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Branding white-labels the portal: the [branding] section of the gateway
+// config is made available to every template through the brand function,
+// and the partials in templates/brand.tmpl apply it.
+type Branding struct {
+	Product    string // Plain-text product name, for page titles
+	Name       string // Product name shown in page headings; the built-in logotype if empty
+	Logo       string // URL of a logo shown above the heading
+	Background string // Page background colour
+	Panel      string // Background colour of the page's main box
+	Accent     string // Button colour
+	Footer     string // Text shown at the foot of every page
+	Terms      string // Terms of use, shown on the login page
+}
+
+var branding = Branding{Product: "LookingGlassOS"}
+
+// hexColourRe matches the colours branding accepts. The "#" is optional, as
+// it starts a comment in the config file unless the value is quoted.
+var hexColourRe = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// loadBranding reads the [branding] section of the gateway config.
+func loadBranding(sec *ini.Section) error {
+	b := Branding{
+		Name:       sec.Key("product_name").String(),
+		Logo:       sec.Key("logo_url").String(),
+		Background: sec.Key("background_colour").String(),
+		Panel:      sec.Key("panel_colour").String(),
+		Accent:     sec.Key("accent_colour").String(),
+		Footer:     sec.Key("footer").String(),
+		Terms:      sec.Key("terms").String(),
+	}
+	b.Product = b.Name
+	if b.Product == "" {
+		b.Product = branding.Product
+	}
+	for key, c := range map[string]*string{
+		"background_colour": &b.Background,
+		"panel_colour":      &b.Panel,
+		"accent_colour":     &b.Accent,
+	} {
+		if *c == "" {
+			continue
+		}
+		if !hexColourRe.MatchString(*c) {
+			return fmt.Errorf("branding: invalid %s %q", key, *c)
+		}
+		*c = "#" + strings.TrimPrefix(*c, "#")
+	}
+	branding = b
+	return nil
+}
+
+// brand is the template function giving access to the branding.
+func brand() Branding {
+	return branding
+}
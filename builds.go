@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Admins build new desktop images through the gateway rather than by hand:
+// POST /admin/images/builds with a Dockerfile, or a list of packages to
+// install on top of an existing image (or catalog entry), runs docker build
+// in the background and registers the result in the image catalog. With
+// canary_groups, the new image only reaches those groups (as the entry's
+// canary) until POST /admin/images/{name}/promote releases it to everyone
+// else; DELETE /admin/images/{name}/canary withdraws it. Builds run one at
+// a time, each limited to build_timeout, and are tagged
+// <build_repository>/<name>:<timestamp>; with build_push they are pushed,
+// so other gateways and hosts can pull them.
+
+var (
+	buildRepository = "lookingglass"   // Repository built images are tagged into
+	buildPush       = false            // Push built images to their registry
+	buildTimeout    = 30 * time.Minute // Longest a build may run
+
+	buildJobs   = make(map[string]*BuildJob)
+	buildJobsMu sync.Mutex
+	buildMu     sync.Mutex // Held by the running build
+)
+
+const (
+	maxBuildJobs = 50       // Finished builds remembered
+	maxBuildLog  = 64 << 10 // Bytes of build output kept, from the end
+)
+
+var (
+	packageNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]{0,127}$`)
+	memoryRe      = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+	cpusRe        = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// BuildJob is an image build, as reported by the admin API.
+type BuildJob struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`  // Catalog entry
+	Image    string     `json:"image"` // Tag built
+	Canary   bool       `json:"canary"`
+	Status   string     `json:"status"` // queued, building, done or failed
+	Error    string     `json:"error,omitempty"`
+	Log      string     `json:"log,omitempty"` // Only for a single build
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	req buildRequest
+}
+
+// buildRequest is the body of POST /admin/images/builds.
+type buildRequest struct {
+	Name         string   `json:"name"`
+	Title        string   `json:"title"`
+	Description  string   `json:"description"`
+	Icon         string   `json:"icon"`
+	Groups       []string `json:"groups"`
+	Memory       string   `json:"memory"`
+	CPUs         string   `json:"cpus"`
+	From         string   `json:"from"`     // With packages: image or catalog entry to build on
+	Packages     []string `json:"packages"` // Installed with apt-get
+	Dockerfile   string   `json:"dockerfile"`
+	CanaryGroups []string `json:"canary_groups"`
+}
+
+// validate checks a build request.
+func (req buildRequest) validate() error {
+	if !desktopNameRe.MatchString(req.Name) {
+		return fmt.Errorf("invalid image name %q", req.Name)
+	}
+	if gatewayCfg != nil {
+		if _, err := gatewayCfg.GetSection("image " + req.Name); err == nil {
+			return fmt.Errorf("image %q is defined in the gateway config", req.Name)
+		}
+	}
+	if (req.Dockerfile == "") == (len(req.Packages) == 0) {
+		return errors.New("give either a dockerfile or packages")
+	}
+	for _, p := range req.Packages {
+		if !packageNameRe.MatchString(p) {
+			return fmt.Errorf("invalid package name %q", p)
+		}
+	}
+	if req.Memory != "" && !memoryRe.MatchString(req.Memory) {
+		return fmt.Errorf("invalid memory %q", req.Memory)
+	}
+	if req.CPUs != "" && !cpusRe.MatchString(req.CPUs) {
+		return fmt.Errorf("invalid cpus %q", req.CPUs)
+	}
+	return nil
+}
+
+// dockerfile returns the Dockerfile to build.
+func (req buildRequest) dockerfile() string {
+	if req.Dockerfile != "" {
+		return req.Dockerfile
+	}
+	from := resolveImage(req.From)
+	return "FROM " + from + "\n" +
+		"USER root\n" +
+		"RUN apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " +
+		strings.Join(req.Packages, " ") + " && rm -rf /var/lib/apt/lists/*\n"
+}
+
+// tailBuffer keeps the last maxBuildLog bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxBuildLog {
+		b.buf = b.buf[len(b.buf)-maxBuildLog:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// buildOutput holds the output of running builds, by job.
+var buildOutput = make(map[string]*tailBuffer) // Guarded by buildJobsMu
+
+// startBuild queues a build.
+func startBuild(req buildRequest) *BuildJob {
+	job := &BuildJob{
+		ID:      newAgentToken()[:16],
+		Name:    req.Name,
+		Image:   buildRepository + "/" + req.Name + ":" + time.Now().UTC().Format("20060102150405"),
+		Canary:  len(req.CanaryGroups) > 0,
+		Status:  "queued",
+		Created: time.Now(),
+		req:     req,
+	}
+	buildJobsMu.Lock()
+	buildJobs[job.ID] = job
+	buildOutput[job.ID] = &tailBuffer{}
+	pruneBuildJobs()
+	buildJobsMu.Unlock()
+	go runBuild(job)
+	return job
+}
+
+// pruneBuildJobs forgets the oldest finished builds beyond maxBuildJobs.
+// The caller must hold buildJobsMu.
+func pruneBuildJobs() {
+	var finished []*BuildJob
+	for _, j := range buildJobs {
+		if j.Finished != nil {
+			finished = append(finished, j)
+		}
+	}
+	sort.Slice(finished, func(i, k int) bool { return finished[i].Created.After(finished[k].Created) })
+	for _, j := range finished[min(len(finished), maxBuildJobs):] {
+		delete(buildJobs, j.ID)
+		delete(buildOutput, j.ID)
+	}
+}
+
+// setBuildStatus records a build's progress.
+func setBuildStatus(job *BuildJob, status string, err error) {
+	buildJobsMu.Lock()
+	defer buildJobsMu.Unlock()
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == "done" || status == "failed" {
+		now := time.Now()
+		job.Finished = &now
+	}
+}
+
+// runBuild builds, pushes and registers an image.
+func runBuild(job *BuildJob) {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	setBuildStatus(job, "building", nil)
+	buildJobsMu.Lock()
+	out := buildOutput[job.ID]
+	buildJobsMu.Unlock()
+	err := buildImage(job, out)
+	if err == nil {
+		err = registerBuild(job)
+	}
+	if err != nil {
+		log.Printf("Building image %s: %v", job.Image, err)
+		audit("image.build_failed", "admin", "", map[string]string{"image": job.Image, "error": err.Error()})
+		setBuildStatus(job, "failed", err)
+		return
+	}
+	log.Printf("Built image %s", job.Image)
+	details := map[string]string{"name": job.Name, "image": job.Image}
+	if job.Canary {
+		details["canary_groups"] = strings.Join(job.req.CanaryGroups, ",")
+	}
+	audit("image.register", "admin", "", details)
+	setBuildStatus(job, "done", nil)
+}
+
+// buildImage runs docker build (and push) for a job.
+func buildImage(job *BuildJob, out *tailBuffer) error {
+	dir, err := os.MkdirTemp("", "lookingglass-build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(job.req.dockerfile()), 0644); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), buildTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker", "build", "--progress", "plain", "-t", job.Image, dir)
+	cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.WaitDelay = 5 * time.Second
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("docker build: timed out after %v", buildTimeout)
+		}
+		return fmt.Errorf("docker build: %w", err)
+	}
+	if buildPush {
+		if _, err := timedCommand(context.Background(), pullTimeout, "docker", "push", job.Image); err != nil {
+			return fmt.Errorf("docker push: %w", err)
+		}
+	}
+	return nil
+}
+
+// registerBuild adds a built image to the catalog.
+func registerBuild(job *BuildJob) error {
+	req := job.req
+	return updateCatalog(func(f *ini.File) error {
+		sec := f.Section("image " + req.Name)
+		for k, v := range map[string]string{
+			"title":       req.Title,
+			"description": req.Description,
+			"icon":        req.Icon,
+			"memory":      req.Memory,
+			"cpus":        req.CPUs,
+			"groups":      strings.Join(req.Groups, ", "),
+		} {
+			if v != "" {
+				sec.Key(k).SetValue(v)
+			}
+		}
+		if job.Canary {
+			sec.Key("canary_image").SetValue(job.Image)
+			sec.Key("canary_groups").SetValue(strings.Join(req.CanaryGroups, ", "))
+		} else {
+			sec.Key("image").SetValue(job.Image)
+			sec.DeleteKey("canary_image")
+			sec.DeleteKey("canary_groups")
+		}
+		return nil
+	})
+}
+
+// errNoCanary is returned for a registered image without a canary.
+var errNoCanary = errors.New("no such image canary")
+
+// endCanary promotes a registered image's canary to its image, or withdraws
+// it.
+func endCanary(name string, promote bool) error {
+	return updateCatalog(func(f *ini.File) error {
+		sec, err := f.GetSection("image " + name)
+		if err != nil || sec.Key("canary_image").String() == "" {
+			return errNoCanary
+		}
+		if promote {
+			sec.Key("image").SetValue(sec.Key("canary_image").String())
+		} else if !sec.HasKey("image") {
+			f.DeleteSection(sec.Name()) // Never released
+			return nil
+		}
+		sec.DeleteKey("canary_image")
+		sec.DeleteKey("canary_groups")
+		return nil
+	})
+}
+
+// CatalogImage is a catalog entry as reported by the admin API.
+type CatalogImage struct {
+	Name         string   `json:"name"`
+	Title        string   `json:"title,omitempty"`
+	Image        string   `json:"image,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	CanaryImage  string   `json:"canary_image,omitempty"`
+	CanaryGroups []string `json:"canary_groups,omitempty"`
+	Registered   bool     `json:"registered"` // From catalog_file rather than the gateway config
+}
+
+// adminListImages handles GET /admin/images.
+func adminListImages(w http.ResponseWriter, r *http.Request) {
+	names, secs := catalogSections()
+	list := []CatalogImage{}
+	for i, name := range names {
+		sec := secs[i]
+		img := CatalogImage{
+			Name:         name,
+			Title:        sec.Key("title").String(),
+			Image:        sec.Key("image").String(),
+			Groups:       sec.Key("groups").Strings(","),
+			CanaryImage:  sec.Key("canary_image").String(),
+			CanaryGroups: sec.Key("canary_groups").Strings(","),
+		}
+		if gatewayCfg == nil || !gatewayCfg.HasSection(sec.Name()) {
+			img.Registered = true
+		} else if img.Image == "" {
+			img.Image = name
+		}
+		list = append(list, img)
+	}
+	writeJSON(w, 200, list)
+}
+
+// adminStartBuild handles POST /admin/images/builds.
+func adminStartBuild(w http.ResponseWriter, r *http.Request) {
+	var req buildRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	job := startBuild(req)
+	audit("image.build", "admin", "", map[string]string{"name": job.Name, "image": job.Image, "build": job.ID})
+	writeJSON(w, 202, job)
+}
+
+// adminListBuilds handles GET /admin/images/builds, newest first.
+func adminListBuilds(w http.ResponseWriter, r *http.Request) {
+	buildJobsMu.Lock()
+	list := []BuildJob{}
+	for _, j := range buildJobs {
+		list = append(list, *j)
+	}
+	buildJobsMu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.After(list[k].Created) })
+	writeJSON(w, 200, list)
+}
+
+// adminGetBuild handles GET /admin/images/builds/{id}, with its output.
+func adminGetBuild(w http.ResponseWriter, r *http.Request) {
+	buildJobsMu.Lock()
+	j, ok := buildJobs[r.PathValue("id")]
+	var job BuildJob
+	if ok {
+		job = *j
+		job.Log = buildOutput[j.ID].String()
+	}
+	buildJobsMu.Unlock()
+	if !ok {
+		writeJSONError(w, 404, errors.New("no such build"))
+		return
+	}
+	writeJSON(w, 200, job)
+}
+
+// adminPromoteImage handles POST /admin/images/{name}/promote.
+func adminPromoteImage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := endCanary(name, true); err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+	audit("image.promote", "admin", "", map[string]string{"name": name})
+	w.WriteHeader(204)
+}
+
+// adminWithdrawCanary handles DELETE /admin/images/{name}/canary.
+func adminWithdrawCanary(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := endCanary(name, false); err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+	audit("image.withdraw", "admin", "", map[string]string{"name": name})
+	w.WriteHeader(204)
+}
+
+// adminRemoveImage handles DELETE /admin/images/{name}, removing a
+// registered entry from the catalog, with a snapshot's files. Desktops
+// already running it carry on.
+func adminRemoveImage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := updateCatalog(func(f *ini.File) error {
+		sec, err := f.GetSection("image " + name)
+		if err != nil {
+			return errors.New("no such registered image")
+		}
+		removeSnapshotFiles(sec)
+		f.DeleteSection(sec.Name())
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+	audit("image.remove", "admin", "", map[string]string{"name": name})
+	w.WriteHeader(204)
+}
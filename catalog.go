@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/ini.v1"
+)
+
+// The image catalog describes the desktop images users may pick from, as
+// [image <name>] sections of the gateway config:
+//
+//	[image cs101]
+//	title = CS101 desktop
+//	description = Ubuntu with the course toolchain
+//	icon = https://www.example.ac.uk/icons/cs101.png
+//	image = registry.example.ac.uk/cs101-desktop:2024
+//	memory = 4g
+//	cpus = 2
+//	groups = cs101, staff
+//
+// Members of the listed groups, and anyone listed in "users" (everyone,
+// without either), see each entry they're entitled to as a tile in the desktop chooser after logging in;
+// starting one gives them a desktop named image:<name>, with its own overlay
+// under desktops/ like any named desktop's. Other keys (idle_timeout,
+// egress, and so on) apply to those sessions as a [desktop] section's
+// would.
+//
+// Anywhere an image is named (a user's, group's or role's "image",
+// invite_images), a catalog entry's name may be given instead of a Docker
+// image reference: the entry's image is run, with its memory and cpus as
+// the container's limits unless the user's settings give their own.
+//
+// Entries can also be registered at run time (by image builds, see
+// builds.go), into catalog_file, which has the same sections and is read
+// after the gateway config's. A registered entry may carry a canary: its
+// canary_image is run instead for members of its canary_groups until it is
+// promoted to the entry's image. An entry with only a canary is offered to
+// the canary groups alone.
+
+const imagePrefix = "image:"
+
+var (
+	catalogPath  = "/srv/overlays/catalog.conf" // Entries registered at run time
+	builtCatalog = ini.Empty()                  // Replaced, never modified, guarded by catalogMu
+	catalogMu    sync.RWMutex
+)
+
+// loadCatalog reads the registered catalog entries.
+func loadCatalog() error {
+	f := ini.Empty()
+	if _, err := os.Stat(catalogPath); err == nil {
+		if f, err = ini.Load(catalogPath); err != nil {
+			return err
+		}
+	}
+	catalogMu.Lock()
+	builtCatalog = f
+	catalogMu.Unlock()
+	return nil
+}
+
+// updateCatalog changes the registered entries, saving them.
+func updateCatalog(fn func(f *ini.File) error) error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	f := ini.Empty()
+	if _, err := os.Stat(catalogPath); err == nil {
+		if f, err = ini.Load(catalogPath); err != nil {
+			return err
+		}
+	}
+	if err := fn(f); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(catalogPath), 0755); err != nil {
+		return err
+	}
+	tmp := catalogPath + ".tmp"
+	if err := f.SaveTo(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, catalogPath); err != nil {
+		return err
+	}
+	builtCatalog = f
+	return nil
+}
+
+// catalogSections returns every catalog entry's section by name, registered
+// entries after (and never replacing) the gateway config's.
+func catalogSections() ([]string, []*ini.Section) {
+	var names []string
+	var secs []*ini.Section
+	catalogMu.RLock()
+	built := builtCatalog
+	catalogMu.RUnlock()
+	for _, f := range []*ini.File{gatewayCfg, built} {
+		if f == nil {
+			continue
+		}
+		for _, sec := range f.Sections() {
+			name, ok := strings.CutPrefix(sec.Name(), "image ")
+			if ok && desktopNameRe.MatchString(name) && !slices.Contains(names, name) {
+				names = append(names, name)
+				secs = append(secs, sec)
+			}
+		}
+	}
+	return names, secs
+}
+
+// catalogSection returns a catalog entry's section, if there is one.
+func catalogSection(name string) (*ini.Section, bool) {
+	if !desktopNameRe.MatchString(name) {
+		return nil, false
+	}
+	catalogMu.RLock()
+	built := builtCatalog
+	catalogMu.RUnlock()
+	for _, f := range []*ini.File{gatewayCfg, built} {
+		if f == nil {
+			continue
+		}
+		if sec, err := f.GetSection("image " + name); err == nil {
+			return sec, true
+		}
+	}
+	return nil, false
+}
+
+// inCanary reports whether a user in groups gets an entry's canary.
+func inCanary(sec *ini.Section, groups []string) bool {
+	return sec.Key("canary_image").String() != "" && sharesGroup(sec.Key("canary_groups").Strings(","), groups)
+}
+
+// sharesGroup reports whether two lists of groups overlap.
+func sharesGroup(a, b []string) bool {
+	return slices.ContainsFunc(a, func(g string) bool { return slices.Contains(b, g) })
+}
+
+// catalog returns the names of the catalog entries u may start.
+func (u *User) catalog() []string {
+	mine := u.groupNames()
+	var names []string
+	all, secs := catalogSections()
+	for i, name := range all {
+		sec := secs[i]
+		if inCanary(sec, mine) {
+			names = append(names, name)
+			continue
+		}
+		if !sec.HasKey("image") && sec.HasKey("canary_image") {
+			continue // Not yet released
+		}
+		groups, users := sec.Key("groups").Strings(","), sec.Key("users").Strings(",")
+		if len(groups) == 0 && len(users) == 0 || sharesGroup(groups, mine) || slices.Contains(users, u.Name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// forImage returns the user as seen by a catalog entry's desktop.
+func (u *User) forImage(name string) (*User, error) {
+	sec, ok := catalogSection(name)
+	if !ok || !slices.Contains(u.catalog(), name) {
+		return nil, errUnknownDesktop
+	}
+	d := *u
+	d.Desktop, d.desk = imagePrefix+name, sec
+	return &d, nil
+}
+
+// catalogTitle returns a catalog entry's title for the chooser.
+func catalogTitle(name string) string {
+	if sec, ok := catalogSection(name); ok && sec.Key("title").String() != "" {
+		return sec.Key("title").String()
+	}
+	return name
+}
+
+// resolveImage turns an image setting, which may name a catalog entry,
+// into the Docker image to run.
+func resolveImage(image string) string {
+	if image == "" {
+		return defaultImage
+	}
+	if sec, ok := catalogSection(image); ok {
+		return sec.Key("image").MustString(image)
+	}
+	return image
+}
+
+// desktopImage returns the Docker image u's desktop runs, which for a
+// catalog entry may be its canary.
+func desktopImage(u *User) string {
+	image := u.setting("image")
+	if name, ok := strings.CutPrefix(u.Desktop, imagePrefix); ok {
+		image = name
+	}
+	if sec, ok := catalogSection(image); ok && inCanary(sec, u.groupNames()) {
+		return sec.Key("canary_image").String()
+	}
+	return resolveImage(image)
+}
+
+// resourceSetting returns one of u's resource limits (memory or cpus),
+// falling back to the catalog entry their image names.
+func resourceSetting(u *User, key string) string {
+	if v := u.setting(key); v != "" {
+		return v
+	}
+	if sec, ok := catalogSection(u.setting("image")); ok {
+		return sec.Key(key).String()
+	}
+	return ""
+}
+
+// resourceArgs returns the docker run arguments limiting u's container.
+func resourceArgs(u *User) []string {
+	var args []string
+	if memory := resourceSetting(u, "memory"); memory != "" {
+		args = append(args, "--memory", memory)
+	}
+	if cpus := resourceSetting(u, "cpus"); cpus != "" {
+		args = append(args, "--cpus", cpus)
+	}
+	return args
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// "config check" (or -check) validates a deployment without starting the
+// gateway: the config, every user file, Docker and the images users need,
+// the base overlay, and the templates. Each problem is printed on its own
+// line with what to fix, and the exit status is non-zero if there were any,
+// so it can gate a deployment pipeline. Settings that are valid but have no
+// effect, such as a watermark on a VM, are printed as warnings, which don't
+// fail the check.
+
+// checkSetup runs every check on the loaded config and returns the number
+// of problems found.
+func checkSetup() int {
+	var problems, warnings []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, "warning: "+fmt.Sprintf(format, args...))
+	}
+
+	for _, g := range groupSections() {
+		if path := g.Key("passwords").String(); path != "" {
+			if _, err := os.ReadFile(path); err != nil {
+				fail("[%s] passwords: %v", g.Name(), err)
+			}
+		}
+		if role := g.Key("role").String(); role != "" {
+			if _, err := gatewayCfg.GetSection("role " + role); err != nil {
+				fail("[%s]: role %s has no [role %s] section", g.Name(), role, role)
+			}
+		}
+	}
+	for _, sec := range gatewayCfg.Sections() {
+		if name, ok := strings.CutPrefix(sec.Name(), "app "); ok {
+			if !desktopNameRe.MatchString(name) {
+				fail("[%s]: invalid app name (lowercase letters, digits, - and _)", sec.Name())
+			} else if sec.Key("command").String() == "" {
+				fail("[%s]: no command set", sec.Name())
+			}
+		}
+	}
+	users := userNames()
+	if len(users) == 0 {
+		fail("users_dir %s: no <username>.conf files found, and no group passwords files", userConfDir)
+	}
+	for _, name := range users {
+		path := filepath.Join(userConfDir, name+".conf")
+		if _, err := os.Stat(path); err != nil {
+			path = "user " + name // From a group passwords file
+		} else if _, err := ini.Load(path); err != nil {
+			fail("%s: %v", path, err)
+			continue
+		}
+		u, err := loadUser(name)
+		if err != nil {
+			fail("%s: %v", path, err)
+			continue
+		}
+		own := checkUser(u)
+		for _, p := range own {
+			fail("%s: %s", path, p)
+		}
+		for _, d := range u.desktops() {
+			du, _ := u.forDesktop(d)
+			for _, p := range checkUser(du) {
+				if !slices.Contains(own, p) { // Inherited problems are reported once
+					fail("%s [desktop %s]: %s", path, d, p)
+				}
+			}
+		}
+		ownKind := unwatermarked(u)
+		if ownKind != "" {
+			warn("%s: watermark is set, but a %s can't show it", path, ownKind)
+		}
+		desks := u.desktops()
+		for _, h := range u.hosts() {
+			desks = append(desks, hostPrefix+h)
+		}
+		for _, d := range desks {
+			du, err := u.forDesktop(d)
+			if err != nil {
+				continue
+			}
+			if kind := unwatermarked(du); kind != "" && kind != ownKind { // Inherited ones are reported once
+				warn("%s [desktop %s]: watermark is set, but a %s can't show it", path, d, kind)
+			}
+		}
+	}
+
+	if err := execRun(context.Background(), "docker", "info", "--format", "{{.ServerVersion}}"); err != nil {
+		fail("docker: not reachable: %v", err)
+	} else {
+		images := neededImages()
+		names := make([]string, 0, len(images))
+		for image := range images {
+			names = append(names, image)
+		}
+		slices.Sort(names)
+		for _, image := range names {
+			if execRun(context.Background(), "docker", "image", "inspect", image) != nil {
+				fail("docker: image %s is missing; build or pull it (needed by %s)", image, imageUsers(images[image]))
+			}
+		}
+	}
+
+	if name, dir := currentBase(); !dirHasEntries(dir) {
+		if name != "" {
+			dir += " (base " + name + ")"
+		}
+		fail("base overlay %s is missing or empty; export the desktop image into it (see README)", dir)
+	}
+	if fi, err := os.Stat(overlayRoot); err != nil || !fi.IsDir() {
+		fail("overlay_root %s does not exist", overlayRoot)
+	}
+	if tlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+			fail("tls_cert, tls_key: %v", err)
+		}
+		if _, err := tlsConfig(); err != nil {
+			fail("%v", err)
+		}
+	} else if tlsClientCA != "" {
+		fail("tls_client_ca needs tls_cert and tls_key")
+	}
+	if sentryDSN != "" {
+		if _, _, err := sentryEndpoint(sentryDSN); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	if err := loadLanguages(); err != nil {
+		fail("language packs: %v", err)
+	} else if err := loadTemplates(); err != nil {
+		fail("templates: %v", err)
+	}
+
+	for _, p := range append(warnings, problems...) {
+		fmt.Println(p)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK (%d users)\n", configPath, len(users))
+	}
+	return len(problems)
+}
+
+// checkUser returns the problems with one user's (or desktop's) settings.
+// Several of these would otherwise fall back to a default unnoticed.
+func checkUser(u *User) []string {
+	var problems []string
+	oneOf := func(key string, allowed ...string) {
+		if v := u.setting(key); v != "" && !slices.Contains(allowed, v) {
+			problems = append(problems, fmt.Sprintf("%s = %s: must be one of %s", key, v, strings.Join(allowed, ", ")))
+		}
+	}
+	if u.Desktop == "" {
+		if u.conf.Key("password").String() == "" {
+			problems = append(problems, "no password set")
+		}
+		if role := u.conf.Key("role").String(); role != "" && u.role == nil {
+			problems = append(problems, fmt.Sprintf("role %s has no [role %s] section in the gateway config", role, role))
+		}
+		for _, g := range u.conf.Key("groups").Strings(",") {
+			if !slices.ContainsFunc(u.groups, func(s *ini.Section) bool { return s.Name() == "group "+g }) {
+				problems = append(problems, fmt.Sprintf("group %s has no [group %s] section in the gateway config", g, g))
+			}
+		}
+	}
+	// A user with named desktops only needs an overlay through them
+	if u.overlay() == "" && (u.desk != nil || len(u.desktops()) == 0) {
+		problems = append(problems, "no overlay set (a directory, or ephemeral)")
+	}
+	oneOf("clipboard", "both", "in", "out", "none")
+	oneOf("file_transfer", "both", "upload", "download", "none")
+	oneOf("sharing", "control", "view", "none")
+	oneOf("encryption", "fscrypt")
+	oneOf("idle_action", "stop", "suspend")
+	oneOf("on_crash", "restart", "fail")
+	oneOf("handoff", "takeover", "mirror")
+	oneOf("scan", "uploads", "logout", "none")
+	oneOf("backend", "container", "vm", "rdp", "terminal")
+	if _, err := rdpConnection(u, ""); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, app := range u.settingKey("apps").Strings(",") {
+		if _, ok := appSection(app); !ok && app != "*" {
+			problems = append(problems, fmt.Sprintf("apps: no [app %s] section in the gateway config", app))
+		}
+	}
+	if _, err := parseVolumes(u.settingKey("volumes").Strings(",")); err != nil {
+		problems = append(problems, "volumes: "+err.Error())
+	}
+	if _, err := userQuota(u); err != nil {
+		problems = append(problems, "quota: "+err.Error())
+	}
+	if _, err := userEgress(u); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, _, err := userAccess(u); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if home := u.setting("home"); home != "" {
+		if _, _, err := homeSource(home); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := homeTarget(u); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if _, err := clientCertName(u); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if role := u.setting("invite_role"); role != "" {
+		if _, err := gatewayCfg.GetSection("role " + role); err != nil {
+			problems = append(problems, fmt.Sprintf("invite_role %s has no [role %s] section in the gateway config", role, role))
+		}
+	}
+	for _, key := range []string{"idle_timeout", "max_lifetime", "invite_max_duration", "lock_on_disconnect"} {
+		if v := u.setting(key); v != "" {
+			if _, err := u.settingKey(key).Duration(); err != nil {
+				problems = append(problems, fmt.Sprintf("%s = %s: not a duration (e.g. 30m, 8h)", key, v))
+			}
+		}
+	}
+	for _, key := range []string{"record", "printing", "client_cert", "view_only"} {
+		if v := u.setting(key); v != "" {
+			if _, err := u.settingKey(key).Bool(); err != nil {
+				problems = append(problems, fmt.Sprintf("%s = %s: must be true or false", key, v))
+			}
+		}
+	}
+	return problems
+}
+
+// neededImages returns the desktop images users need, and who needs each.
+func neededImages() map[string][]string {
+	images := make(map[string][]string)
+	for _, name := range userNames() {
+		u, err := loadUser(name)
+		if err != nil {
+			continue
+		}
+		desks := []*User{u}
+		if names := u.desktops(); len(names) > 0 {
+			desks = nil
+			for _, name := range names {
+				d, _ := u.forDesktop(name)
+				desks = append(desks, d)
+			}
+		}
+		for _, app := range u.apps() {
+			d, _ := u.forApp(app)
+			desks = append(desks, d)
+		}
+		for _, name := range u.catalog() {
+			d, _ := u.forImage(name)
+			desks = append(desks, d)
+		}
+		for _, d := range desks {
+			image := desktopImage(d)
+			images[image] = append(images[image], u.Name)
+		}
+		guestImages, _ := inviteOptions(u)
+		for _, image := range guestImages {
+			image = resolveImage(image)
+			images[image] = append(images[image], u.Name+"'s guests")
+		}
+	}
+	return images
+}
+
+// dirHasEntries reports whether dir exists and is not empty.
+func dirHasEntries(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) > 0
+}
+
+// imageUsers lists who needs an image, for check output.
+func imageUsers(users []string) string {
+	slices.Sort(users)
+	return strings.Join(slices.Compact(users), ", ")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A desktop started through POST /admin/sessions with "claim": true comes
+// with a one-time claim link, /claim/<session>/<token>, that a learning
+// platform can hand straight to the user: following it makes the browser
+// the session's owner, as logging in would, without asking for a password.
+// The link works once and expires after claim_ttl (default an hour, at most
+// a week); a desktop started for it is held until then and stopped if it is
+// never claimed. Minting a new link for a session replaces the old one.
+
+const (
+	defaultClaimTTL = time.Hour
+	maxClaimTTL     = 7 * 24 * time.Hour
+)
+
+// parseClaimTTL parses an API claim_ttl, "" meaning the default.
+func parseClaimTTL(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultClaimTTL, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 || d > maxClaimTTL {
+		return 0, fmt.Errorf("claim_ttl must be positive and at most %v", maxClaimTTL)
+	}
+	return d, nil
+}
+
+// mintClaim gives a session a new claim link, valid for ttl. A desktop
+// that was just started for it is held unclaimed until the link expires.
+func mintClaim(sessionID string, ttl time.Duration, hold bool) (string, time.Time, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[sessionID]
+	if !ok {
+		return "", time.Time{}, errUnknownSession
+	}
+	s.ClaimToken = newAgentToken()
+	s.ClaimExpires = time.Now().Add(ttl)
+	if hold {
+		s.ReservedUntil = s.ClaimExpires
+	}
+	sessions[sessionID] = s
+	saveSessions()
+	return "/claim/" + sessionID + "/" + s.ClaimToken, s.ClaimExpires, nil
+}
+
+// claimHandler serves GET /claim/{session}/{token}, handing the session to
+// the browser that follows the link.
+func claimHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, token := r.PathValue("session"), r.PathValue("token")
+	sessionsMu.Lock()
+	s, ok := sessions[sessionID]
+	if !ok || s.ClaimToken == "" || time.Now().After(s.ClaimExpires) ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.ClaimToken)) != 1 {
+		sessionsMu.Unlock()
+		httpError(w, r, 404, "error.share_expired")
+		return
+	}
+	s.ClaimToken = ""
+	s.ClaimExpires = time.Time{}
+	if !s.ReservedUntil.IsZero() {
+		s.ReservedUntil = time.Time{}
+		s.StartedAt = time.Now()
+	}
+	s.OwnerToken = newAgentToken()
+	s.LastActive = time.Now()
+	s.ExpiresAt = time.Time{}
+	sessions[sessionID] = s
+	saveSessions()
+	sessionsMu.Unlock()
+
+	closeOwnerConns(sessionID)
+	setOwnerCookie(w, r, sessionID, s.OwnerToken)
+	audit("session.claim", s.Username, sessionID, map[string]string{"remote": r.RemoteAddr})
+	http.Redirect(w, r, "/session/"+sessionID, http.StatusSeeOther)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The binary is a CLI as well as the gateway: with no command (or "serve")
+// it runs the gateway, and otherwise runs one of commands against the same
+// config. Commands that work on files (users, bases, images, the config)
+// act directly; session commands talk to the running gateway's admin API,
+// since only it knows its live sessions.
+
+// command is a CLI subcommand.
+type command struct {
+	args  string // Usage after the command's name
+	about string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// Set here rather than in the declaration, as runCommand refers to it
+	commands = map[string]command{
+		"serve":           {"", "run the gateway (the default)", serveCommand},
+		"config check":    {"", "validate the config, users, docker, base overlay and templates", configCheckCommand},
+		"user add":        {"[-role R] [-group G] [-overlay DIR | -guest] [-password P] <name>", "create a user (password read from stdin unless given)", userAddCommand},
+		"user import":     {"[-format csv|json] <file>", "create users in bulk (username,password,password_hash,group,role,quota,overlay)", userImportCommand},
+		"user hash":       {"", "hash a password read from stdin, for a user file or password_hash", userHashCommand},
+		"user del":        {"[-wipe] <name>", "delete a user, and with -wipe their overlay", userDelCommand},
+		"user list":       {"", "list users", userListCommand},
+		"session list":    {"[-gateway URL] [-user NAME]", "list live sessions (admin API)", sessionListCommand},
+		"session kill":    {"[-gateway URL] <id>...", "end sessions (admin API)", sessionKillCommand},
+		"connect":         {"[-gateway URL] [-desktop D] [-print] [-ttl D] <user>", "start or resume a user's desktop and open it in the browser (admin API)", connectCommand},
+		"image pull":      {"[image...]", "pull desktop images (default: every image a user needs)", imagePullCommand},
+		"base":            {"<list|register|activate|retire> ...", "manage base image versions", baseCommand},
+		"launch link":     {"[-ttl D] <app>", "print a signed deep link to an app profile", launchLinkCommand},
+		"audit verify":    {"", "verify the audit log hash chain", auditVerifyCommand},
+		"manifests check": {"[dir]", "validate the YAML manifests (default: manifests_dir)", manifestsCheckCommand},
+	}
+}
+
+// usernameRe restricts the names user add accepts: they end up in paths
+// and container names.
+var usernameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// usage prints every command.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: lookingglass [-config FILE] [command]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].about)
+	}
+	tw.Flush()
+	fmt.Fprintf(out, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand loads the config and runs a command.
+func runCommand(args []string) error {
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok && len(args) > 1 {
+		name = args[0] + " " + args[1]
+		cmd, ok = commands[name]
+	}
+	if !ok {
+		usage()
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	if err := loadConfig(configPath); err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+	err := cmd.run(args[len(strings.Fields(name)):])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil // The usage has been printed
+	}
+	return err
+}
+
+// commandFlags returns a flag set for a command, with its usage line.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: lookingglass %s %s\n", name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// configCheckCommand runs checkSetup.
+func configCheckCommand(args []string) error {
+	if n := checkSetup(); n > 0 {
+		return fmt.Errorf("%d problem(s) found", n)
+	}
+	return nil
+}
+
+// auditVerifyCommand checks the audit log's hash chain.
+func auditVerifyCommand(args []string) error {
+	if _, err := verifyAuditLog(auditLogPath); err != nil {
+		return fmt.Errorf("audit log %s: %v", auditLogPath, err)
+	}
+	fmt.Printf("Audit log %s: OK\n", auditLogPath)
+	return nil
+}
+
+// userAddCommand writes a new <name>.conf.
+func userAddCommand(args []string) error {
+	fs := commandFlags("user add")
+	role := fs.String("role", "", "role for the user's defaults")
+	group := fs.String("group", "", "group to add the user to")
+	overlay := fs.String("overlay", "", "overlay directory (default <overlay_root>/<name>)")
+	guest := fs.Bool("guest", false, "give the user an ephemeral overlay")
+	password := fs.String("password", "", "password (default: read a line from stdin)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("user add takes one name")
+	}
+	name := fs.Arg(0)
+	if !usernameRe.MatchString(name) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	path := filepath.Join(userConfDir, name+".conf")
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("user %s already exists", name)
+	}
+	if *password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if *password == "" {
+		return errors.New("no password given")
+	}
+	if *guest {
+		*overlay = "ephemeral"
+	}
+	spec := UserSpec{Username: name, Password: *password, Group: *group, Role: *role, Overlay: *overlay}
+	if strings.HasPrefix(*password, passwordHashPrefix) {
+		spec.Password, spec.PasswordHash = "", *password
+	}
+	if err := provisionUser(spec); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s\n", path)
+	return nil
+}
+
+// userImportCommand creates users in bulk from a CSV or JSON file.
+func userImportCommand(args []string) error {
+	fs := commandFlags("user import")
+	format := fs.String("format", "", "csv or json (default: from the file's extension, else csv)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("user import takes one file (- for stdin)")
+	}
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = "csv"
+		if strings.EqualFold(filepath.Ext(fs.Arg(0)), ".json") {
+			*format = "json"
+		}
+	}
+	specs, err := parseUserSpecs(data, *format)
+	if err != nil {
+		return err
+	}
+	res := provisionUsers(specs, "cli")
+	for _, name := range res.Created {
+		fmt.Printf("Created %s\n", name)
+	}
+	failed := make([]string, 0, len(res.Failed))
+	for name := range res.Failed {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	for _, name := range failed {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, res.Failed[name])
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d user(s) not created", len(failed), len(specs))
+	}
+	return nil
+}
+
+// userHashCommand hashes a password read from stdin, for password or
+// password_hash.
+func userHashCommand(args []string) error {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("no password given")
+	}
+	fmt.Println(hashPassword(password))
+	return nil
+}
+
+// userDelCommand removes a user's config, and optionally their overlay.
+func userDelCommand(args []string) error {
+	fs := commandFlags("user del")
+	wipe := fs.Bool("wipe", false, "also delete the user's overlay directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("user del takes one name")
+	}
+	u, err := loadUser(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	saved, err := savedSessions()
+	if err != nil {
+		return err
+	}
+	for id, s := range saved {
+		if s.Username == u.Name {
+			return fmt.Errorf("user %s has a running session (%s); end it first", u.Name, id)
+		}
+	}
+	overlay := u.setting("overlay")
+	if *wipe && overlay != "" && overlay != "ephemeral" {
+		clean := filepath.Clean(overlay)
+		if clean == "/" || clean == filepath.Clean(overlayRoot) || clean == filepath.Clean(baseOverlay) {
+			return fmt.Errorf("refusing to delete %s", clean)
+		}
+		if err := os.RemoveAll(clean); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s\n", clean)
+	}
+	path := filepath.Join(userConfDir, u.Name+".conf")
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %s\n", path)
+	return nil
+}
+
+// userListCommand lists every user, with or without a config file.
+func userListCommand(args []string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tROLE\tGROUPS\tOVERLAY\tDESKTOPS")
+	for _, name := range userNames() {
+		u, err := loadUser(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.Name, u.setting("role"), strings.Join(u.groupNames(), ","),
+			u.setting("overlay"), strings.Join(u.desktops(), ","))
+	}
+	return tw.Flush()
+}
+
+// savedSessions reads the sessions the gateway last saved.
+func savedSessions() (map[string]Session, error) {
+	data, err := os.ReadFile(sessionsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[string]Session)
+	return saved, json.Unmarshal(data, &saved)
+}
+
+// gatewayURL is the default address of the running gateway's admin API.
+func gatewayURL() string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "http://" + listenAddr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// adminCall makes an admin API request to the running gateway, sending in
+// as JSON and decoding a JSON response into out, each if it is not nil.
+func adminCall(gateway, method, path string, in, out any) error {
+	if adminToken == "" {
+		return errors.New("admin_token is not set; session commands use the gateway's admin API")
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(gateway, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	timeout := 30 * time.Second
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+		timeout += pullTimeout // Starting a desktop may mean pulling its image
+	}
+	res, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e struct{ Error string }
+		json.NewDecoder(res.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = res.Status
+		}
+		return fmt.Errorf("%s %s: %s", method, path, e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// sessionListCommand lists the gateway's live sessions.
+func sessionListCommand(args []string) error {
+	fs := commandFlags("session list")
+	gateway := fs.String("gateway", gatewayURL(), "gateway base URL")
+	user := fs.String("user", "", "only this user's sessions")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := "/admin/sessions"
+	if *user != "" {
+		path += "?user=" + url.QueryEscape(*user)
+	}
+	var list []SessionInfo
+	if err := adminCall(*gateway, "GET", path, nil, &list); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tDESKTOP\tSTARTED\tLAST ACTIVE")
+	for _, s := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Username, s.Desktop,
+			s.StartedAt.Local().Format("2006-01-02 15:04"), s.LastActive.Local().Format("15:04:05"))
+	}
+	return tw.Flush()
+}
+
+// sessionKillCommand ends sessions through the gateway.
+func sessionKillCommand(args []string) error {
+	fs := commandFlags("session kill")
+	gateway := fs.String("gateway", gatewayURL(), "gateway base URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("session kill takes at least one session ID")
+	}
+	for _, id := range fs.Args() {
+		if err := adminCall(*gateway, "DELETE", "/admin/sessions/"+url.PathEscape(id), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Ended %s\n", id)
+	}
+	return nil
+}
+
+// connectCommand starts a user's desktop, or finds it running, and opens
+// a claim link to it (see claim.go) in the browser, or prints it: a
+// scripted demo can hand over a desktop without anyone logging in.
+func connectCommand(args []string) error {
+	fs := commandFlags("connect")
+	gateway := fs.String("gateway", gatewayURL(), "gateway base URL (as the browser reaches it)")
+	desktop := fs.String("desktop", "", "named desktop, app:<name> or image:<name>")
+	printOnly := fs.Bool("print", false, "print the link instead of opening a browser")
+	ttl := fs.String("ttl", "", "how long the link stays valid (default 1h)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("connect takes one username")
+	}
+	req := map[string]any{"user": fs.Arg(0), "desktop": *desktop, "claim": true, "claim_ttl": *ttl}
+	var reply struct {
+		ID       string `json:"id"`
+		ClaimURL string `json:"claim_url"`
+	}
+	if err := adminCall(*gateway, "POST", "/admin/sessions", req, &reply); err != nil {
+		return err
+	}
+	link := strings.TrimRight(*gateway, "/") + reply.ClaimURL
+	if *printOnly {
+		fmt.Println(link)
+		return nil
+	}
+	if err := openBrowser(link); err != nil {
+		fmt.Fprintf(os.Stderr, "Opening a browser: %v\n", err)
+		fmt.Println(link)
+	}
+	return nil
+}
+
+// openBrowser opens a URL in the desktop's default browser.
+func openBrowser(link string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", link)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", link)
+	default:
+		cmd = exec.Command("xdg-open", link)
+	}
+	return cmd.Start()
+}
+
+// imagePullCommand pulls desktop images with docker.
+func imagePullCommand(args []string) error {
+	images := args
+	if len(images) == 0 {
+		for image := range neededImages() {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+	}
+	for _, image := range images {
+		cmd := exec.Command("docker", "pull", image)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("pulling %s: %v", image, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The clipboard relay keeps two buffers per session: text copied in the
+// browser waiting to be set on the desktop, and text copied on the desktop
+// waiting to be picked up by the browser. Each has a sequence number so both
+// sides can poll cheaply for changes. A per-user "clipboard" policy of
+// both, in (browser to desktop only), out (desktop to browser only) or none
+// decides which directions are allowed.
+
+const maxClipboardSize = 1 << 20
+
+// clipBuffer is one direction of a session's clipboard.
+type clipBuffer struct {
+	Seq  int
+	Text string
+}
+
+var (
+	clipMu     sync.Mutex
+	clipToDesk = make(map[string]clipBuffer) // session ID -> browser copy-in
+	clipToWeb  = make(map[string]clipBuffer) // session ID -> desktop copy-out
+)
+
+// clipboardAllows reports whether policy permits copying in the given
+// direction ("in" or "out").
+func clipboardAllows(policy, dir string) bool {
+	return policy == "" || policy == "both" || policy == dir
+}
+
+// clipboardHandler serves /clipboard/<session> for the session page: POST
+// sends text to the desktop, GET?since=N fetches the desktop's clipboard.
+func clipboardHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/clipboard/")
+	// The page polls for the desktop's clipboard, which isn't activity
+	s, ok := peekOwnerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if !clipboardAllows(s.ClipboardPolicy, "in") {
+			httpError(w, r, 403, "error.clipboard_in_disabled")
+			return
+		}
+		touchSession(sessionID)
+		putClipboard(w, r, clipToDesk, sessionID)
+	case http.MethodGet:
+		if !clipboardAllows(s.ClipboardPolicy, "out") {
+			httpError(w, r, 403, "error.clipboard_out_disabled")
+			return
+		}
+		getClipboard(w, r, clipToWeb, sessionID)
+	default:
+		httpError(w, r, 405, "error.method_not_allowed")
+	}
+}
+
+// agentClipboard serves /agent/clipboard for the in-container agent: GET
+// fetches text to set on the desktop, POST reports the desktop's clipboard.
+func agentClipboard(w http.ResponseWriter, r *http.Request) {
+	sessionID, s, ok := agentSession(r)
+	if !ok {
+		httpError(w, r, 401, "error.unauthorized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getClipboard(w, r, clipToDesk, sessionID)
+	case http.MethodPost:
+		if !clipboardAllows(s.ClipboardPolicy, "out") {
+			// Drop it silently; the agent has nothing to do differently
+			w.WriteHeader(204)
+			return
+		}
+		putClipboard(w, r, clipToWeb, sessionID)
+	default:
+		httpError(w, r, 405, "error.method_not_allowed")
+	}
+}
+
+// putClipboard stores the request body as the next clipboard value.
+func putClipboard(w http.ResponseWriter, r *http.Request, buf map[string]clipBuffer, sessionID string) {
+	text, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxClipboardSize))
+	if err != nil {
+		httpError(w, r, 413, "error.clipboard_too_large")
+		return
+	}
+	clipMu.Lock()
+	c := buf[sessionID]
+	buf[sessionID] = clipBuffer{Seq: c.Seq + 1, Text: string(text)}
+	clipMu.Unlock()
+	w.WriteHeader(204)
+}
+
+// getClipboard returns the clipboard value if it is newer than ?since=N,
+// with its sequence number in X-Clipboard-Seq, or 204 if there is nothing new.
+func getClipboard(w http.ResponseWriter, r *http.Request, buf map[string]clipBuffer, sessionID string) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	clipMu.Lock()
+	c := buf[sessionID]
+	clipMu.Unlock()
+
+	w.Header().Set("X-Clipboard-Seq", strconv.Itoa(c.Seq))
+	if c.Seq <= since {
+		w.WriteHeader(204)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, c.Text)
+}
+
+// dropClipboard forgets a session's clipboard buffers.
+func dropClipboard(sessionID string) {
+	clipMu.Lock()
+	delete(clipToDesk, sessionID)
+	delete(clipToWeb, sessionID)
+	clipMu.Unlock()
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Several gateways can run behind one load balancer, sharing a Redis store
+// (cluster_store). Each gateway keeps running the desktops it started, and
+// publishes a route for every session, share link and queue ticket it holds
+// to its own node_url. A request for one of them that reaches another
+// gateway (a session page, its websocket, a file download, a share link) is
+// forwarded to the gateway holding it, so the load balancer needs no sticky
+// sessions. So is a login by a user whose desktop runs elsewhere, so it is
+// handed off rather than started twice. Routes expire after clusterTTL, so
+// a gateway that dies takes its routes with it.
+//
+// The store also makes limits cluster-wide: desktop start locks are taken
+// in it as well as locally (so two gateways can't start the same desktop),
+// max_sessions counts the desktops of every gateway, and login rate limits
+// count attempts wherever they land. If the store can't be reached, each
+// gateway falls back to enforcing them on its own.
+//
+// A gateway with node_capacity runs at most that many desktops itself. Once
+// it is full (or being drained by the autoscaler, see autoscale.go), new
+// logins that reach it are forwarded to the gateway with the most room;
+// only when every gateway is full are they queued (and then wait for room
+// on the gateway they reached).
+
+var (
+	clusterStore   = "" // redis:// URL of the shared store ("" = a single gateway)
+	nodeURL        = "" // This gateway's URL, as the others reach it
+	nodeName       = "" // This gateway's host name (default the short hostname)
+	nodeCapacity   = 0  // Desktops this gateway runs at most (0 = no limit of its own)
+	cluster        *redisClient
+	clusterChanged = make(chan struct{}, 1)
+	draining       atomic.Bool // Set by the autoscaler before shutting this gateway down
+)
+
+const (
+	clusterTTL       = 30 * time.Second
+	clusterInterval  = 10 * time.Second
+	clusterPrefix    = "lookingglass:route:"
+	clusterLockTTL   = 5 * time.Minute            // Long enough for any desktop to start
+	clusterLockWait  = 30 * time.Second           // Longest a desktop lock is waited for
+	clusterForwarded = "X-LookingGlass-Forwarded" // Set on forwarded requests, against loops
+)
+
+// clusterPaths are the paths whose first element is a session ID, share
+// token, queue ticket or invitation.
+var clusterPaths = []string{
+	"/session/", "/logout/", "/ping/", "/status/", "/extend/", "/reset/",
+	"/proxy/", "/files/", "/print/", "/clipboard/", "/controls/", "/resize/",
+	"/share/", "/join/", "/shadow/", "/queue/", "/claim/", "/invite/",
+}
+
+// startCluster connects to the shared store and starts publishing routes.
+func startCluster() error {
+	if clusterStore == "" {
+		return nil
+	}
+	if nodeURL == "" {
+		return errors.New("cluster_store needs node_url, this gateway's address as the others reach it")
+	}
+	c, err := newRedisClient(clusterStore)
+	if err != nil {
+		return err
+	}
+	if _, err := c.do("PING"); err != nil {
+		return err
+	}
+	cluster = c
+	go clusterLoop()
+	return nil
+}
+
+// noteClusterChange publishes routes now rather than at the next interval.
+func noteClusterChange() {
+	select {
+	case clusterChanged <- struct{}{}:
+	default:
+	}
+}
+
+// localRoutes returns the keys this gateway holds: session IDs, share
+// tokens, queue tickets, invitations and user:<name>/<desktop> for running
+// desktops.
+func localRoutes() []string {
+	var keys []string
+	sessionsMu.RLock()
+	for id, s := range sessions {
+		keys = append(keys, id)
+		if !s.Ephemeral {
+			keys = append(keys, "user:"+s.Username+"/"+s.Desktop)
+		}
+	}
+	sessionsMu.RUnlock()
+	sharesMu.Lock()
+	for token := range shares {
+		keys = append(keys, token)
+	}
+	sharesMu.Unlock()
+	queueMu.Lock()
+	for id := range queueTickets {
+		keys = append(keys, id)
+	}
+	queueMu.Unlock()
+	invitesMu.Lock()
+	for token := range invites {
+		keys = append(keys, token)
+	}
+	invitesMu.Unlock()
+	return keys
+}
+
+// clusterLoop keeps this gateway's routes in the store.
+func clusterLoop() {
+	published := make(map[string]bool)
+	failing := false
+	for {
+		err := publishLoad()
+		current := make(map[string]bool)
+		for _, key := range localRoutes() {
+			current[key] = true
+			if e := publishRoute(key); e != nil {
+				err = e
+			}
+		}
+		for key := range published {
+			if !current[key] {
+				// Unless another gateway has claimed it since
+				if node, _ := cluster.get(clusterPrefix + key); node == nodeURL {
+					cluster.do("DEL", clusterPrefix+key)
+				}
+			}
+		}
+		published = current
+		if err != nil && !failing {
+			log.Printf("Cluster store: %v", err)
+		} else if err == nil && failing {
+			log.Printf("Cluster store: reachable again")
+		}
+		failing = err != nil
+
+		select {
+		case <-clusterChanged:
+		case <-time.After(clusterInterval):
+		}
+	}
+}
+
+// publishRoute claims key for this gateway in the store.
+func publishRoute(key string) error {
+	_, err := cluster.do("SET", clusterPrefix+key, nodeURL, "PX", strconv.FormatInt(clusterTTL.Milliseconds(), 10))
+	return err
+}
+
+// routeNode returns the gateway holding key, if it isn't this one.
+func routeNode(key string) string {
+	node, err := cluster.get(clusterPrefix + key)
+	if err != nil && err != errRedisNil {
+		log.Printf("Cluster store: %v", err)
+	}
+	if node == nodeURL {
+		return ""
+	}
+	return node
+}
+
+// remoteNode returns the gateway a request should be forwarded to, if any.
+func remoteNode(r *http.Request) string {
+	if r.URL.Path == "/login" && r.Method == http.MethodPost {
+		if r.ParseForm() != nil {
+			return ""
+		}
+		username := r.PostForm.Get("username")
+		if username == "" {
+			return ""
+		}
+		if _, ok := findDesktopSession(username, ""); ok {
+			return ""
+		}
+		node := routeNode("user:" + username + "/")
+		if node == "" {
+			node = placeLogin()
+		}
+		if node != "" {
+			// The form has been read; forward it re-encoded
+			body := r.PostForm.Encode()
+			r.Body = io.NopCloser(strings.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		return node
+	}
+	for _, prefix := range clusterPaths {
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			continue
+		}
+		id, _, _ := strings.Cut(rest, "/")
+		if id == "" || isLocalRoute(id) {
+			return ""
+		}
+		return routeNode(id)
+	}
+	return ""
+}
+
+// isLocalRoute reports whether this gateway holds a session, share, queue
+// ticket or invitation.
+func isLocalRoute(id string) bool {
+	sessionsMu.RLock()
+	_, ok := lookupSession(id)
+	sessionsMu.RUnlock()
+	if ok {
+		return true
+	}
+	if _, ok := lookupShare(id); ok {
+		return true
+	}
+	queueMu.Lock()
+	_, ok = queueTickets[id]
+	queueMu.Unlock()
+	if ok {
+		return true
+	}
+	_, ok = lookupInvite(id)
+	return ok
+}
+
+// clusterRoute forwards requests for sessions held by other gateways.
+func clusterRoute(h http.Handler) http.Handler {
+	if cluster == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterForwarded) == "" {
+			if node := remoteNode(r); node != "" {
+				target, err := url.Parse(node)
+				if err != nil {
+					serverError(w, r, 503, err)
+					return
+				}
+				r.Header.Set(clusterForwarded, nodeURL)
+				proxy := httputil.NewSingleHostReverseProxy(target)
+				proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+					serverError(w, r, 503, err)
+				}
+				proxy.ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// publishLoad records how many desktops this gateway runs or is starting,
+// and its status for placing logins and autoscaling. It also picks up
+// whether the autoscaler is draining this gateway.
+func publishLoad() error {
+	st := localStatus()
+	if _, err := cluster.do("SADD", "lookingglass:nodes", nodeURL); err != nil {
+		return err
+	}
+	px := strconv.FormatInt(clusterTTL.Milliseconds(), 10)
+	if _, err := cluster.do("SET", "lookingglass:load:"+nodeURL, strconv.Itoa(st.Load), "PX", px); err != nil {
+		return err
+	}
+	status, _ := json.Marshal(st)
+	if _, err := cluster.do("SET", "lookingglass:node:"+nodeURL, string(status), "PX", px); err != nil {
+		return err
+	}
+	_, err := cluster.get("lookingglass:drain:" + nodeURL)
+	if err != nil && err != errRedisNil {
+		return err
+	}
+	draining.Store(err == nil)
+	return nil
+}
+
+// nodeStatus is a gateway's status as published in the store.
+type nodeStatus struct {
+	URL         string `json:"url"`
+	Name        string `json:"name"`                   // node_name
+	Load        int    `json:"load"`                   // Desktops running or starting
+	Sessions    int    `json:"sessions"`               // Sessions held, suspended ones included
+	Capacity    int    `json:"capacity"`               // node_capacity (0 = no limit of its own)
+	Queued      int    `json:"queued"`                 // Logins waiting
+	Draining    bool   `json:"draining"`               // Taking no new desktops, to be shut down
+	MemoryTotal int64  `json:"memory_total,omitempty"` // Bytes of host memory (0 = unknown)
+	MemoryFree  int64  `json:"memory_free,omitempty"`  // Bytes available for more desktops
+}
+
+// localStatus returns this gateway's status.
+func localStatus() nodeStatus {
+	sessionsMu.RLock()
+	n := runningSessions() + startingSessions
+	held := len(sessions) + startingSessions
+	sessionsMu.RUnlock()
+	queueMu.Lock()
+	queued := len(loginQueue)
+	queueMu.Unlock()
+	st := nodeStatus{URL: nodeURL, Name: nodeName, Load: n, Sessions: held, Capacity: nodeCapacity, Queued: queued, Draining: draining.Load()}
+	st.MemoryTotal, st.MemoryFree = hostMemory()
+	return st
+}
+
+// room returns how many more desktops a gateway can start.
+func (st nodeStatus) room() int {
+	switch {
+	case st.Draining:
+		return 0
+	case st.Capacity == 0:
+		return math.MaxInt
+	}
+	return max(st.Capacity-st.Load, 0)
+}
+
+// clusterNodes returns the status of every gateway still publishing.
+func clusterNodes() ([]nodeStatus, error) {
+	reply, err := cluster.do("SMEMBERS", "lookingglass:nodes")
+	if err != nil {
+		return nil, err
+	}
+	var list []nodeStatus
+	nodes, _ := reply.([]any)
+	for _, node := range nodes {
+		node, _ := node.(string)
+		v, err := cluster.get("lookingglass:node:" + node)
+		if err == errRedisNil {
+			continue // Gone, or not yet upgraded to publish its status
+		}
+		if err != nil {
+			return nil, err
+		}
+		var st nodeStatus
+		if json.Unmarshal([]byte(v), &st) != nil {
+			continue
+		}
+		st.URL = node
+		if _, err := cluster.get("lookingglass:drain:" + node); err == nil {
+			st.Draining = true
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	return list, nil
+}
+
+// localRoom reports whether this gateway can start another desktop itself.
+func localRoom() bool {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	return !draining.Load() && (nodeCapacity == 0 || runningSessions()+startingSessions < nodeCapacity)
+}
+
+// placeLogin returns the gateway a new login's desktop should start on, if
+// not this one: while this gateway is full or draining, whichever has the
+// most room.
+func placeLogin() string {
+	if localRoom() {
+		return ""
+	}
+	nodes, err := clusterNodes()
+	if err != nil {
+		log.Printf("Cluster store: placing login: %v", err)
+		return ""
+	}
+	best, name, room := "", "", 0
+	for _, st := range nodes {
+		if st.URL != nodeURL && st.room() > room {
+			best, name, room = st.URL, st.Name, st.room()
+		}
+	}
+	reason := "full"
+	if draining.Load() {
+		reason = "draining"
+	}
+	if best == "" {
+		noteSchedule("kept", "cluster_full")
+	} else {
+		noteSchedule("forwarded", reason)
+		noteForward(cmp.Or(name, best))
+	}
+	return best
+}
+
+// clusterLoad returns how many desktops the other gateways run. Gateways
+// that have stopped publishing count as none.
+func clusterLoad() (int, error) {
+	reply, err := cluster.do("SMEMBERS", "lookingglass:nodes")
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	nodes, _ := reply.([]any)
+	for _, node := range nodes {
+		if node, _ := node.(string); node != "" && node != nodeURL {
+			v, err := cluster.get("lookingglass:load:" + node)
+			if err == errRedisNil {
+				cluster.do("SREM", "lookingglass:nodes", node)
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			n, _ := strconv.Atoi(v)
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// unlockScript deletes a lock only if it is still held by the same token.
+const unlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// clusterLock takes a lock in the shared store, waiting up to wait for it
+// if another gateway holds it (errLockBusy after that). The lock lapses
+// after ttl if never unlocked.
+func clusterLock(name string, ttl, wait time.Duration) (unlock func(), err error) {
+	key := "lookingglass:lock:" + name
+	token := newAgentToken()
+	px := strconv.FormatInt(ttl.Milliseconds(), 10)
+	deadline := time.Now().Add(wait)
+	for {
+		_, err := cluster.do("SET", key, token, "NX", "PX", px)
+		if err == nil {
+			break
+		}
+		if err != errRedisNil {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errLockBusy
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		if _, err := cluster.do("EVAL", unlockScript, "1", key, token); err != nil {
+			log.Printf("Cluster store: unlocking %s: %v", name, err)
+		}
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Every command the gateway runs (docker, mount, iptables and the rest) is
+// limited to command_timeout, and image pulls to pull_timeout, so a hung
+// Docker daemon or NFS server fails the operation instead of blocking it
+// for good. Starting a desktop also stops when whoever asked for it goes
+// away: an admin API client disconnecting, or a login's progress page
+// being abandoned. Cleaning up after a failed start, and stopping a
+// session, always run to the end (within their timeouts). The malware
+// scanner has scan_timeout, as a whole upperdir can take a while, and
+// exporting a Docker image as a base has export_timeout. Only the Docker
+// event watcher and the command line's own docker pulls can run for as
+// long as they need.
+
+var (
+	commandTimeout = time.Minute      // Longest any command may run
+	pullTimeout    = 10 * time.Minute // Longest an image pull may run
+	scanTimeout    = 10 * time.Minute // Longest a malware scan may run
+	exportTimeout  = 30 * time.Minute // Longest exporting an image as a base may run
+)
+
+// execRun runs a command within commandTimeout. Its error includes what
+// the command printed.
+func execRun(ctx context.Context, name string, args ...string) error {
+	_, err := timedCommand(ctx, commandTimeout, name, args...)
+	return err
+}
+
+// execOutput runs a command within commandTimeout and returns its
+// standard output.
+func execOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return timedCommand(ctx, commandTimeout, name, args...)
+}
+
+// timedCommand runs a command, killing it when ctx ends or timeout passes.
+func timedCommand(ctx context.Context, timeout time.Duration, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = 5 * time.Second // In case a child keeps its output open
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("%s: timed out after %v", name, timeout)
+	case ctx.Err() != nil:
+		err = fmt.Errorf("%s: %w", name, ctx.Err())
+	default:
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(string(out))
+		}
+		if msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+	}
+	return out, err
+}
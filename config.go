@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/ini.v1"
+)
+
+// gatewayCfg is the parsed gateway config, kept for its [role ...] sections.
+var gatewayCfg *ini.File
+
+// loadConfig reads gateway-wide settings from the [gateway] section of the
+// file at path and the environment, overriding the built-in defaults. A
+// missing file is not an error; the defaults are used as-is.
+func loadConfig(path string) error {
+	cfg := ini.Empty()
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		if cfg, err = ini.Load(path); err != nil {
+			return err
+		}
+	}
+	applyEnv(cfg)
+	gatewayCfg = cfg
+	gw := cfg.Section("gateway")
+
+	listenAddr = gw.Key("listen").MustString(listenAddr)
+	tlsCert = gw.Key("tls_cert").MustString(tlsCert)
+	tlsKey = gw.Key("tls_key").MustString(tlsKey)
+	tlsClientCA = gw.Key("tls_client_ca").MustString(tlsClientCA)
+	contentSecurityPolicy = gw.Key("content_security_policy").MustString(contentSecurityPolicy)
+	frameAncestors = gw.Key("frame_ancestors").MustString(frameAncestors)
+	hstsMaxAge = gw.Key("hsts_max_age").MustDuration(hstsMaxAge)
+	referrerPolicy = gw.Key("referrer_policy").MustString(referrerPolicy)
+	accessLog = gw.Key("access_log").MustBool(accessLog)
+	sentryDSN = gw.Key("sentry_dsn").MustString(sentryDSN)
+	otlpEndpoint = gw.Key("otlp_endpoint").MustString(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	traceServiceName = gw.Key("trace_service_name").MustString(traceServiceName)
+	dockerWait = gw.Key("docker_wait").MustDuration(dockerWait)
+	commandTimeout = gw.Key("command_timeout").MustDuration(commandTimeout)
+	pullTimeout = gw.Key("pull_timeout").MustDuration(pullTimeout)
+	scanTimeout = gw.Key("scan_timeout").MustDuration(scanTimeout)
+	exportTimeout = gw.Key("export_timeout").MustDuration(exportTimeout)
+	retryAttempts = gw.Key("retry_attempts").MustInt(retryAttempts)
+	retryBackoff = gw.Key("retry_backoff").MustDuration(retryBackoff)
+	hookPreStart = gw.Key("hook_pre_start").MustString(hookPreStart)
+	hookPostStart = gw.Key("hook_post_start").MustString(hookPostStart)
+	hookPreStop = gw.Key("hook_pre_stop").MustString(hookPreStop)
+	hookPostStop = gw.Key("hook_post_stop").MustString(hookPostStop)
+	hookTimeout = gw.Key("hook_timeout").MustDuration(hookTimeout)
+	userConfDir = gw.Key("users_dir").MustString(userConfDir)
+	templatesDir = gw.Key("templates_dir").MustString(templatesDir)
+	templateReload = gw.Key("template_reload").MustBool(templateReload)
+	defaultLanguage = gw.Key("default_language").MustString(defaultLanguage)
+	baseOverlay = gw.Key("base_overlay").MustString(baseOverlay)
+	overlayRoot = gw.Key("overlay_root").MustString(overlayRoot)
+	basesDir = gw.Key("bases_dir").MustString(filepath.Join(overlayRoot, "bases"))
+	baseImportDir = gw.Key("base_import_dir").MustString(filepath.Join(overlayRoot, "import"))
+	sessionsPath = gw.Key("sessions_file").MustString(filepath.Join(overlayRoot, "sessions.json"))
+	bookingsPath = gw.Key("bookings_file").MustString(filepath.Join(overlayRoot, "bookings.json"))
+	invitesPath = gw.Key("invites_file").MustString(filepath.Join(overlayRoot, "invites.json"))
+	historyDir = gw.Key("history_dir").MustString(filepath.Join(overlayRoot, "history"))
+	endedSessionsPath = gw.Key("ended_sessions_file").MustString(filepath.Join(overlayRoot, "ended-sessions.jsonl"))
+	sessionRetention = gw.Key("session_retention").MustDuration(sessionRetention)
+	catalogPath = gw.Key("catalog_file").MustString(filepath.Join(overlayRoot, "catalog.conf"))
+	buildRepository = gw.Key("build_repository").MustString(buildRepository)
+	buildPush = gw.Key("build_push").MustBool(buildPush)
+	buildTimeout = gw.Key("build_timeout").MustDuration(buildTimeout)
+	snapshotsDir = gw.Key("snapshots_dir").MustString(filepath.Join(overlayRoot, "snapshots"))
+	rdpCredentialsDir = gw.Key("rdp_credentials_dir").MustString(filepath.Join(overlayRoot, "rdp-credentials"))
+	sshListen = gw.Key("ssh_listen").MustString(sshListen)
+	sshHostKeyPath = gw.Key("ssh_host_key").MustString(filepath.Join(overlayRoot, "ssh_host_ed25519_key"))
+	homeMounts = gw.Key("home_mounts").MustString(homeMounts)
+	scanCommand = gw.Key("scan_command").MustString(scanCommand)
+	scanAlertCommand = gw.Key("scan_alert_command").MustString(scanAlertCommand)
+	quarantineDir = gw.Key("quarantine_dir").MustString(filepath.Join(overlayRoot, "quarantine"))
+	overlayArchiveDir = gw.Key("archive_dir").MustString(filepath.Join(overlayRoot, "archive"))
+	bookingLead = gw.Key("booking_lead").MustDuration(bookingLead)
+	bookingHold = gw.Key("booking_hold").MustDuration(bookingHold)
+	maxSessions = gw.Key("max_sessions").MustInt(maxSessions)
+	containerNameTemplate = gw.Key("container_name").MustString(containerNameTemplate)
+	startWorkers = gw.Key("start_workers").MustInt(startWorkers)
+	startBacklog = gw.Key("start_backlog").MustInt(startBacklog)
+	sessionExpiry = gw.Key("session_expiry").MustDuration(sessionExpiry)
+	idleGrace = gw.Key("idle_grace").MustDuration(idleGrace)
+	suspendedExpiry = gw.Key("suspended_expiry").MustDuration(suspendedExpiry)
+	maxSessionLifetime = gw.Key("max_session_lifetime").MustDuration(maxSessionLifetime)
+	guestSessionExpiry = gw.Key("guest_session_expiry").MustDuration(guestSessionExpiry)
+	guestMaxLifetime = gw.Key("guest_max_session_lifetime").MustDuration(guestMaxLifetime)
+	maintenanceWarning = gw.Key("maintenance_warning").MustDuration(maintenanceWarning)
+	maintenanceDuration = gw.Key("maintenance_duration").MustDuration(maintenanceDuration)
+	if maintenanceWindows, err = parseMaintenance(gw.Key("maintenance_windows").Strings(",")); err != nil {
+		return err
+	}
+	if gw.HasKey("guest_tmpfs_size") {
+		// An empty value is meaningful here: it disables the tmpfs
+		guestTmpfsSize = gw.Key("guest_tmpfs_size").String()
+	}
+	guestGCAge = gw.Key("guest_gc_age").MustDuration(guestGCAge)
+	recordingsDir = gw.Key("recordings_dir").MustString(recordingsDir)
+	recordingRetention = gw.Key("recording_retention").MustDuration(recordingRetention)
+	agentGatewayURL = gw.Key("agent_gateway_url").MustString(agentGatewayURL)
+	httpProxy = gw.Key("http_proxy").MustString(httpProxy)
+	httpsProxy = gw.Key("https_proxy").MustString(httpsProxy)
+	noProxy = gw.Key("no_proxy").MustString(noProxy)
+	dnsServers = gw.Key("dns").MustString(dnsServers)
+	dnsSearch = gw.Key("dns_search").MustString(dnsSearch)
+	auditLogPath = gw.Key("audit_log").MustString(auditLogPath)
+	authLogPath = gw.Key("auth_log").MustString(authLogPath)
+	complianceMode = gw.Key("compliance_mode").MustBool(complianceMode)
+	clusterStore = gw.Key("cluster_store").MustString(clusterStore)
+	nodeURL = gw.Key("node_url").MustString(nodeURL)
+	nodeName = gw.Key("node_name").MustString(shortHostname())
+	nodeCapacity = gw.Key("node_capacity").MustInt(nodeCapacity)
+	loginRateLimit = gw.Key("login_rate_limit").MustInt(loginRateLimit)
+	guestDailyPerIP = gw.Key("guest_daily_per_ip").MustInt(guestDailyPerIP)
+	guestDailyTotal = gw.Key("guest_daily_total").MustInt(guestDailyTotal)
+	quotaEnforcement = gw.Key("quota_enforcement").MustString(quotaEnforcement)
+	if err := checkQuotaConfig(); err != nil {
+		return err
+	}
+	captchaService = gw.Key("captcha").MustString(captchaService)
+	captchaSiteKey = gw.Key("captcha_site_key").MustString(captchaSiteKey)
+	opaURL = gw.Key("opa_url").MustString(opaURL)
+	opaSettings = gw.Key("opa_settings").Strings(",")
+	opaFailOpen = gw.Key("opa_fail_open").MustBool(opaFailOpen)
+	secretRefresh = gw.Key("secret_refresh").MustDuration(secretRefresh)
+	if err := loadSecrets(gw); err != nil {
+		return err
+	}
+	if err := loadBouncer(gw); err != nil {
+		return err
+	}
+	if err := loadGeoIP(gw); err != nil {
+		return err
+	}
+	if err := loadAnomalies(gw); err != nil {
+		return err
+	}
+	if err := checkCaptchaConfig(); err != nil {
+		return err
+	}
+	if err := loadDeviceProfiles(cfg); err != nil {
+		return err
+	}
+	manifestsDir = gw.Key("manifests_dir").MustString(manifestsDir)
+	if err := loadManifests(); err != nil {
+		return err
+	}
+	if err := loadCatalog(); err != nil {
+		return err
+	}
+	if err := loadAutoscale(cfg.Section("autoscale")); err != nil {
+		return err
+	}
+	if err := loadVMs(cfg.Section("vm")); err != nil {
+		return err
+	}
+	return loadBranding(cfg.Section("branding"))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Sessions with no desktop container (a VM's, or an external host's) have
+// their VNC server bridged onto the session's port by the gateway itself,
+// as a websocket like a container's websockify, so the proxy and everything
+// it does (view-only links, sharing, recording) works unchanged. A VNC
+// password is answered by the gateway, and the browser is offered no
+// authentication, as with a container.
+
+var (
+	consoleBridges   = make(map[string]*http.Server) // By session ID, guarded by consoleBridgesMu
+	consoleBridgesMu sync.Mutex
+)
+
+// consoleDialer connects to a session's VNC server, returning its password
+// ("" = none).
+type consoleDialer func(ctx context.Context) (io.ReadWriteCloser, string, error)
+
+// startConsoleBridge serves a VNC server as noVNC's websocket on a local
+// port, as a desktop container's websockify would.
+func startConsoleBridge(sessionID string, port int, dial consoleDialer) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			if len(cfg.Protocol) > 0 {
+				cfg.Protocol = cfg.Protocol[:1] // noVNC offers "binary"
+			}
+			return nil // Only the gateway's proxy reaches this port
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			if err := bridgeConsole(ws, dial); err != nil {
+				log.Printf("Session %s: console: %v", logPath(sessionID), err)
+			}
+		},
+	}}
+	consoleBridgesMu.Lock()
+	if old := consoleBridges[sessionID]; old != nil {
+		old.Close()
+	}
+	consoleBridges[sessionID] = srv
+	consoleBridgesMu.Unlock()
+	go srv.Serve(ln)
+	return nil
+}
+
+// stopConsoleBridge closes a session's console bridge and its connections.
+func stopConsoleBridge(sessionID string) {
+	consoleBridgesMu.Lock()
+	defer consoleBridgesMu.Unlock()
+	if srv := consoleBridges[sessionID]; srv != nil {
+		srv.Close()
+		delete(consoleBridges, sessionID)
+	}
+}
+
+// bridgeConsole connects a noVNC client to a VNC server until either side
+// hangs up.
+func bridgeConsole(client io.ReadWriteCloser, dial consoleDialer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	server, password, err := dial(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	if password != "" {
+		if err := rfbAuthProxy(client, server, password); err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(server, client); done <- struct{}{} }()
+	go func() { io.Copy(client, server); done <- struct{}{} }()
+	<-done
+	return nil
+}
+
+// rfbAuthProxy answers a VNC server's password challenge on the client's
+// behalf, and offers the client no security at all, which is what it gets
+// from a container. Both sides speak RFB 3.8; from then on the connection
+// is passed through.
+func rfbAuthProxy(client, server io.ReadWriter, password string) error {
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(server, version); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(version, []byte("RFB 003.")) || string(version) < "RFB 003.008\n" {
+		return fmt.Errorf("unsupported VNC server version %q", version)
+	}
+	if _, err := io.WriteString(server, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(server, n[:]); err != nil {
+		return err
+	}
+	if n[0] == 0 {
+		return errors.New("VNC server refused the connection")
+	}
+	types := make([]byte, n[0])
+	if _, err := io.ReadFull(server, types); err != nil {
+		return err
+	}
+	if !bytes.Contains(types, []byte{2}) {
+		return fmt.Errorf("VNC server offers no password authentication (%v)", types)
+	}
+	challenge := make([]byte, 16)
+	if _, err := server.Write([]byte{2}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(server, challenge); err != nil {
+		return err
+	}
+	if _, err := server.Write(vncAuthResponse(password, challenge)); err != nil {
+		return err
+	}
+	var result [4]byte
+	if _, err := io.ReadFull(server, result[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(result[:]) != 0 {
+		return errors.New("VNC server refused the console password")
+	}
+
+	if _, err := io.WriteString(client, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(client, version); err != nil {
+		return err
+	}
+	if _, err := client.Write([]byte{1, 1}); err != nil { // Just "None"
+		return err
+	}
+	if _, err := io.ReadFull(client, n[:]); err != nil {
+		return err
+	}
+	if n[0] != 1 {
+		return fmt.Errorf("client chose security type %d", n[0])
+	}
+	_, err := client.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// vncAuthResponse encrypts a VNC authentication challenge with the
+// password: DES, keyed by its first eight bytes with each byte's bits in
+// reverse order.
+func vncAuthResponse(password string, challenge []byte) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, _ := des.NewCipher(key) // Can't fail: the key is 8 bytes
+	out := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(out[i:], challenge[i:i+8])
+	}
+	return out
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Session controls the session page offers beyond display size: the
+// desktop's keyboard layout (set with setxkbmap inside the container), the
+// VNC image quality and compression (imposed on the client's encoding
+// requests by the proxy), and a view-only mode for the owner's own
+// connections. They are kept on the session, so they outlive reconnects,
+// suspends and restarts.
+//
+// Users, roles, images or app profiles with "view_only = true" (demo
+// kiosks, monitoring walls) get sessions that start view-only and stay so:
+// the owner can't turn it off, share links can only be view-only, nothing
+// is pasted into the desktop, files can only be downloaded (the WebDAV
+// share is read-only), and there is no SSH.
+
+var (
+	keyboardLayoutRe  = regexp.MustCompile(`^[a-z]{2,8}$`)
+	keyboardVariantRe = regexp.MustCompile(`^[a-z0-9_]{0,32}$`)
+)
+
+// SessionControls is the state GET /controls/<session> reports and POST
+// changes. Quality and compression are 0-9; unset leaves them to the client.
+type SessionControls struct {
+	Keyboard        string `json:"keyboard"`
+	KeyboardVariant string `json:"keyboard_variant"`
+	Quality         *int   `json:"quality"`
+	Compression     *int   `json:"compression"`
+	ViewOnly        bool   `json:"view_only"`
+}
+
+// controlsRequest is a POST /controls/<session> body. Absent fields are left
+// as they are; a quality or compression of -1 hands it back to the client.
+type controlsRequest struct {
+	Keyboard        *string `json:"keyboard"`
+	KeyboardVariant *string `json:"keyboard_variant"`
+	Quality         *int    `json:"quality"`
+	Compression     *int    `json:"compression"`
+	ViewOnly        *bool   `json:"view_only"`
+}
+
+// controlsHandler serves /controls/<session> for the session page.
+func controlsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/controls/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, s.Controls)
+		return
+	case http.MethodPost:
+	default:
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+
+	var req controlsRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		httpError(w, r, 400, "error.invalid_request")
+		return
+	}
+	c := s.Controls
+	if req.Keyboard != nil || req.KeyboardVariant != nil {
+		if req.Keyboard != nil {
+			c.Keyboard, c.KeyboardVariant = *req.Keyboard, ""
+		}
+		if req.KeyboardVariant != nil {
+			c.KeyboardVariant = *req.KeyboardVariant
+		}
+		if !keyboardLayoutRe.MatchString(c.Keyboard) || !keyboardVariantRe.MatchString(c.KeyboardVariant) {
+			httpError(w, r, 400, "error.keyboard_layout")
+			return
+		}
+		if err := setKeyboard(s.ContainerName, c); err != nil {
+			serverError(w, r, 500, err)
+			return
+		}
+	}
+	for _, lv := range []struct {
+		req *int
+		set **int
+	}{{req.Quality, &c.Quality}, {req.Compression, &c.Compression}} {
+		switch {
+		case lv.req == nil:
+		case *lv.req == -1:
+			*lv.set = nil
+		case *lv.req < 0 || *lv.req > 9:
+			httpError(w, r, 400, "error.invalid_request")
+			return
+		default:
+			*lv.set = lv.req
+		}
+	}
+	if req.ViewOnly != nil {
+		if s.ViewOnlyLocked && !*req.ViewOnly {
+			httpError(w, r, 403, "error.view_only_locked")
+			return
+		}
+		c.ViewOnly = *req.ViewOnly
+	}
+
+	sessionsMu.Lock()
+	if s, ok = sessions[sessionID]; ok {
+		s.Controls = c
+		sessions[sessionID] = s
+		saveSessions()
+	}
+	sessionsMu.Unlock()
+	applyConnControls(sessionID, c)
+	writeJSON(w, 200, c)
+}
+
+// withViewOnly locks a new session of a view_only user into view-only
+// mode.
+func withViewOnly(u *User, s Session) Session {
+	if !u.settingKey("view_only").MustBool(false) {
+		return s
+	}
+	s.Controls.ViewOnly, s.ViewOnlyLocked = true, true
+	if shareAllows(s.SharingPolicy, "control") {
+		s.SharingPolicy = "view"
+	}
+	switch s.ClipboardPolicy {
+	case "", "both":
+		s.ClipboardPolicy = "out"
+	case "in":
+		s.ClipboardPolicy = "none"
+	}
+	s.FilePolicy = viewOnlyFiles(s.FilePolicy)
+	return s
+}
+
+// viewOnlyFiles narrows a view_only file_transfer policy to downloads.
+func viewOnlyFiles(policy string) string {
+	switch policy {
+	case "", "both":
+		return "download"
+	case "upload":
+		return "none"
+	}
+	return policy
+}
+
+// setKeyboard switches the desktop's keyboard layout.
+func setKeyboard(container string, c SessionControls) error {
+	args := []string{"setxkbmap", c.Keyboard}
+	if c.KeyboardVariant != "" {
+		args = append(args, "-variant", c.KeyboardVariant)
+	}
+	return desktopExec(container, args...)
+}
+
+// applyConnControls updates the owner's open VNC connections to a session.
+func applyConnControls(sessionID string, c SessionControls) {
+	ownerConnsMu.Lock()
+	var conns []*vncStream
+	for vs := range ownerConns[sessionID] {
+		conns = append(conns, vs)
+	}
+	ownerConnsMu.Unlock()
+	for _, vs := range conns {
+		vs.setControls(c.ViewOnly, c.Quality, c.Compression)
+	}
+}
+
+// reapplyKeyboard sets a session's chosen keyboard layout again once its
+// container has been restarted, retrying while the X server comes up.
+func reapplyKeyboard(s Session) {
+	if s.Controls.Keyboard == "" {
+		return
+	}
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = setKeyboard(s.ContainerName, s.Controls); err == nil {
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+	log.Printf("Session %s: restoring keyboard layout: %v", s.ID, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// The gateway watches Docker's event stream for desktop containers dying
+// on their own (the desktop crashed, or was OOM-killed). Depending on the
+// user's on_crash setting, the container is run again on the same overlay
+// (restart, the default, up to maxCrashRestarts times within crashWindow),
+// or the session is ended and its page told why (fail).
+
+const (
+	maxCrashRestarts = 3
+	crashWindow      = 10 * time.Minute
+)
+
+// dockerEvent is the part of a `docker events` JSON line we use.
+type dockerEvent struct {
+	Action string `json:"Action"`
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// onCrash returns what a crash does to u's sessions.
+func onCrash(u *User) string {
+	return u.settingKey("on_crash").In("restart", []string{"restart", "fail"})
+}
+
+// crashWatchLoop follows Docker's container die events, restarting the
+// watcher if the stream ends (e.g. when the daemon restarts).
+func crashWatchLoop() {
+	for {
+		if err := watchContainerDeaths(); err != nil {
+			log.Printf("Watching docker events: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// watchContainerDeaths reads die events until the stream ends.
+func watchContainerDeaths() error {
+	cmd := exec.Command("docker", "events",
+		"--filter", "type=container", "--filter", "event=die",
+		"--format", "{{json .}}")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var ev dockerEvent
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			continue
+		}
+		// Whatever the naming scheme, containerDied ignores containers that
+		// aren't a session's
+		go containerDied(ev.Actor.Attributes["name"], ev.Actor.Attributes["exitCode"])
+	}
+	return cmd.Wait()
+}
+
+// containerDied handles a desktop container exiting. Sessions the gateway
+// stopped or suspended itself are already gone or marked by then.
+func containerDied(container, exitCode string) {
+	s, found := sessionByContainer(container)
+	if !found || s.Suspended {
+		return
+	}
+
+	recent := s.RecentCrashes + 1
+	if time.Since(s.LastCrash) > crashWindow {
+		recent = 1
+	}
+	audit("session.crash", s.Username, s.ID, map[string]string{"container": container, "exit_code": exitCode})
+
+	policy := "restart"
+	if u, err := loadUser(s.Username); err == nil {
+		policy = onCrash(u)
+	}
+	if policy == "restart" && recent <= maxCrashRestarts && restartContainer(s) {
+		sessionsMu.Lock()
+		if cur, ok := sessions[s.ID]; ok {
+			cur.LastCrash = time.Now()
+			cur.RecentCrashes = recent
+			cur.Restarts++
+			sessions[s.ID] = cur
+			saveSessions()
+		}
+		sessionsMu.Unlock()
+		log.Printf("Session %s: container exited (%s), restarted", s.ID, exitCode)
+		go reapplyKeyboard(s)
+		audit("session.restart", s.Username, s.ID, nil)
+		return
+	}
+
+	log.Printf("Session %s: container exited (%s), ending session", s.ID, exitCode)
+	stopSession(s.ID, endCrashed)
+}
+
+// restartContainer runs a crashed session's container again on its port.
+// The dead container may take a moment to be removed, freeing its name,
+// which counts as a passing failure (see retry.go).
+func restartContainer(s Session) bool {
+	err := retry(context.Background(), "Restarting container "+s.ContainerName, func() error {
+		return runContainer(context.Background(), s.ContainerName, s.Port, s.RunArgs, s.Egress)
+	})
+	if err != nil {
+		log.Printf("Session %s: restarting container: %v", s.ID, err)
+	}
+	return err == nil
+}
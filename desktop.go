@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// desktopExec runs a command as the desktop user inside a session's desktop.
+// The desktop runs chrooted into the overlay at /mnt/overlay (see
+// ubuntuBase/overlay-entrypoint.sh), so plain docker exec would land outside
+// it and miss the X server.
+func desktopExec(container string, args ...string) error {
+	full := append([]string{
+		"exec", container,
+		"chroot", fmt.Sprintf("--userspec=%d:%d", desktopUID, desktopUID), "/mnt/overlay",
+		"env", "DISPLAY=:1", "HOME=/home/docker", "USER=docker",
+	}, args...)
+	if err := execRun(context.Background(), "docker", full...); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+// Limits on what the session page may ask for. The maximum matches the
+// framebuffer Xvfb is started with in ubuntuBase/supervisord.conf.
+const (
+	minDesktopWidth, minDesktopHeight = 640, 480
+	maxDesktopWidth, maxDesktopHeight = 7680, 2160
+	maxMonitors                       = 4
+)
+
+// Monitor is one screen of a multi-monitor layout, in desktop pixels.
+type Monitor struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// resizeHandler serves POST /resize/<session>. The JSON body gives the new
+// desktop size and, optionally, a layout of monitors within it:
+//
+//	{"width": 3840, "height": 1080, "monitors": [
+//	    {"x": 0, "y": 0, "width": 1920, "height": 1080},
+//	    {"x": 1920, "y": 0, "width": 1920, "height": 1080}]}
+func resizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/resize/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+
+	var req struct {
+		Width    int       `json:"width"`
+		Height   int       `json:"height"`
+		Monitors []Monitor `json:"monitors"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		httpError(w, r, 400, "error.invalid_request")
+		return
+	}
+	if req.Width < minDesktopWidth || req.Width > maxDesktopWidth ||
+		req.Height < minDesktopHeight || req.Height > maxDesktopHeight {
+		httpError(w, r, 400, "error.desktop_size")
+		return
+	}
+	if len(req.Monitors) > maxMonitors {
+		httpError(w, r, 400, "error.too_many_monitors")
+		return
+	}
+
+	// lg-resize WxH [WxH+X+Y ...]
+	args := []string{"lg-resize", fmt.Sprintf("%dx%d", req.Width, req.Height)}
+	for _, m := range req.Monitors {
+		if m.X < 0 || m.Y < 0 || m.Width <= 0 || m.Height <= 0 ||
+			m.X+m.Width > req.Width || m.Y+m.Height > req.Height {
+			httpError(w, r, 400, "error.monitor_outside")
+			return
+		}
+		args = append(args, fmt.Sprintf("%dx%d+%d+%d", m.Width, m.Height, m.X, m.Y))
+	}
+	if err := desktopExec(s.ContainerName, args...); err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users with [desktop <name>] sections in their config pick a desktop from
+// /desktops after logging in, and can start, open and stop each one there.
+// So do users entitled to app profiles, catalog images or external hosts,
+// who pick between their desktop (listed as "-" when they have no named
+// ones), their apps and hosts, and the catalog's tiles. The chooser is
+// tied to the browser by a login cookie.
+
+var (
+	desktopNameRe     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	errUnknownDesktop = errors.New("no such desktop")
+
+	userLogins   = make(map[string]userLogin) // Chooser logins by cookie value
+	userLoginsMu sync.Mutex
+)
+
+// mainDesktop names the user's own desktop in the chooser, for users with
+// no named desktops.
+const mainDesktop = "-"
+
+// userLoginTTL is how long the desktop chooser stays logged in.
+const userLoginTTL = 8 * time.Hour
+
+const userLoginCookie = "lg_user"
+
+// userLogin is a browser logged in to the desktop chooser.
+type userLogin struct {
+	Username string
+	Expires  time.Time
+}
+
+// DesktopInfo is a row of the desktop chooser, or a tile for a catalog
+// image.
+type DesktopInfo struct {
+	Name        string // As in chooser URLs
+	Title       string
+	Description string // Catalog images only
+	Icon        string // Catalog images only
+	Image       string
+	Encrypted   bool
+	Running     bool
+	Locked      bool // Running, but locked since its owner disconnected
+}
+
+// startUserLogin logs the browser in to the desktop chooser.
+func startUserLogin(w http.ResponseWriter, r *http.Request, username string) {
+	token := newAgentToken()
+	userLoginsMu.Lock()
+	for t, l := range userLogins {
+		if time.Now().After(l.Expires) {
+			delete(userLogins, t)
+		}
+	}
+	userLogins[token] = userLogin{Username: username, Expires: time.Now().Add(userLoginTTL)}
+	userLoginsMu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     userLoginCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loggedInUser returns the user logged in to the chooser, if any.
+func loggedInUser(r *http.Request) (*User, bool) {
+	c, err := r.Cookie(userLoginCookie)
+	if err != nil {
+		return nil, false
+	}
+	userLoginsMu.Lock()
+	login, ok := userLogins[c.Value]
+	userLoginsMu.Unlock()
+	if !ok || time.Now().After(login.Expires) {
+		return nil, false
+	}
+	u, err := loadUser(login.Username)
+	return u, err == nil
+}
+
+// desktopsPage shows the desktop chooser.
+func desktopsPage(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	names := u.desktops()
+	if len(names) == 0 {
+		names = []string{mainDesktop}
+	}
+	for _, app := range u.apps() {
+		names = append(names, appPrefix+app)
+	}
+	for _, image := range u.catalog() {
+		names = append(names, imagePrefix+image)
+	}
+	for _, host := range u.hosts() {
+		names = append(names, hostPrefix+host)
+	}
+	var list, catalog []DesktopInfo
+	for _, name := range names {
+		d, err := chooserDesktop(u, name)
+		if err != nil {
+			continue
+		}
+		s, running := findDesktopSession(u.Name, d.Desktop)
+		info := DesktopInfo{
+			Name:      name,
+			Title:     name,
+			Image:     desktopImage(d),
+			Encrypted: d.overlay() != "ephemeral" && d.setting("encryption") == "fscrypt",
+			Running:   running,
+			Locked:    s.ScreenLocked,
+		}
+		if protocol, address, ok := d.externalHost(); ok {
+			info.Title, info.Image = hostTitle(u, strings.TrimPrefix(name, hostPrefix)), protocol+"://"+address
+		} else if app, ok := strings.CutPrefix(name, appPrefix); ok {
+			info.Title = appTitle(app)
+		} else if image, ok := strings.CutPrefix(name, imagePrefix); ok {
+			info.Title = catalogTitle(image)
+			info.Description = d.desk.Key("description").String()
+			info.Icon = d.desk.Key("icon").String()
+			catalog = append(catalog, info)
+			continue
+		} else if name == mainDesktop {
+			info.Title = "Desktop"
+		}
+		list = append(list, info)
+	}
+	renderTemplate(w, r, "desktops.html", map[string]any{
+		"Username": u.Name,
+		"Desktops": list,
+		"Catalog":  catalog,
+	})
+}
+
+// chooserDesktop returns the user as seen by a desktop named in the
+// chooser.
+func chooserDesktop(u *User, name string) (*User, error) {
+	if name == mainDesktop && len(u.desktops()) == 0 {
+		return u, nil
+	}
+	return u.forDesktop(name)
+}
+
+// desktopOpen handles POST /desktops/{name}/open from the chooser, taking
+// the user to that desktop. Encrypted desktops need the password again to
+// unlock their overlay.
+func desktopOpen(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	d, err := chooserDesktop(u, r.PathValue("name"))
+	if err != nil {
+		httpError(w, r, 404, "error.desktop_not_found")
+		return
+	}
+	password := r.FormValue("password")
+	s, running := findDesktopSession(u.Name, d.Desktop)
+	needPassword := !running && d.setting("encryption") == "fscrypt" || s.ScreenLocked
+	if needPassword && loginBlocked(r.RemoteAddr) {
+		audit("login.failed", u.Name, "", map[string]string{"reason": "rate limited", "remote": r.RemoteAddr, "desktop": d.Desktop})
+		httpError(w, r, 429, "error.too_many_attempts")
+		return
+	}
+	if needPassword && !u.checkPassword(password) {
+		audit("login.failed", u.Name, "", map[string]string{"reason": "bad password", "remote": r.RemoteAddr, "desktop": d.Desktop})
+		loginFailed(r.RemoteAddr)
+		httpError(w, r, 401, "error.invalid_credentials")
+		return
+	}
+	openDesktop(w, r, d, password)
+}
+
+// desktopStop handles POST /desktops/{name}/stop from the chooser.
+func desktopStop(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	if d, err := chooserDesktop(u, r.PathValue("name")); err == nil {
+		if s, ok := findDesktopSession(u.Name, d.Desktop); ok {
+			stopSession(s.ID, endLogout)
+		}
+	}
+	http.Redirect(w, r, "/desktops", 302)
+}
+
+// desktopsLogout logs the browser out of the chooser. Running desktops are
+// left running.
+func desktopsLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(userLoginCookie); err == nil {
+		userLoginsMu.Lock()
+		delete(userLogins, c.Value)
+		userLoginsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: userLoginCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", 302)
+}
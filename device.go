@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Phones and tablets get different display settings from desktop browsers.
+// The device class is guessed from the User-Agent, and each class has a
+// profile, overridable in a [device <class>] section of the gateway config:
+// whether the desktop follows the browser window (remote scaling) or has a
+// fixed resolution scaled to fit by noVNC (local scaling), the DPI the
+// desktop is started with, and touch aids.
+
+// DeviceProfile is how desktops are presented on one class of device.
+type DeviceProfile struct {
+	Scaling    string // remote (desktop resized to the window) or local (scaled in the browser)
+	Resolution string // Desktop size for local scaling, WIDTHxHEIGHT
+	DPI        int    // Desktop DPI at startup (0 = the image's default)
+	Touch      bool   // Show a dot cursor, as there is no pointer to see
+}
+
+var deviceProfiles = map[string]DeviceProfile{
+	"desktop": {Scaling: "remote"},
+	"tablet":  {Scaling: "remote", DPI: 120, Touch: true},
+	"phone":   {Scaling: "local", Resolution: "1280x800", Touch: true},
+}
+
+var resolutionRe = regexp.MustCompile(`^(\d{3,4})x(\d{3,4})$`)
+
+// loadDeviceProfiles applies [device <class>] sections over the built-in
+// profiles.
+func loadDeviceProfiles(cfg *ini.File) error {
+	for class, p := range deviceProfiles {
+		sec, err := cfg.GetSection("device " + class)
+		if err != nil {
+			continue
+		}
+		p.Scaling = sec.Key("scaling").In(p.Scaling, []string{"remote", "local"})
+		p.Resolution = sec.Key("resolution").MustString(p.Resolution)
+		p.DPI = sec.Key("dpi").MustInt(p.DPI)
+		p.Touch = sec.Key("touch").MustBool(p.Touch)
+		if p.Resolution != "" {
+			var w, h int
+			if m := resolutionRe.FindStringSubmatch(p.Resolution); m != nil {
+				fmt.Sscan(m[1], &w)
+				fmt.Sscan(m[2], &h)
+			}
+			if w < minDesktopWidth || w > maxDesktopWidth || h < minDesktopHeight || h > maxDesktopHeight {
+				return fmt.Errorf("device %s: unsupported resolution %q", class, p.Resolution)
+			}
+		}
+		if p.DPI < 0 || p.DPI > 480 {
+			return fmt.Errorf("device %s: unsupported dpi %d", class, p.DPI)
+		}
+		deviceProfiles[class] = p
+	}
+	return nil
+}
+
+// deviceClass guesses whether a request comes from a phone, a tablet or a
+// desktop browser.
+func deviceClass(r *http.Request) string {
+	ua := r.UserAgent()
+	switch {
+	case strings.Contains(ua, "iPhone"),
+		strings.Contains(ua, "Android") && strings.Contains(ua, "Mobile"),
+		strings.Contains(ua, "Mobi"):
+		return "phone"
+	case strings.Contains(ua, "iPad"),
+		strings.Contains(ua, "Android"),
+		strings.Contains(ua, "Tablet"):
+		return "tablet"
+	}
+	return "desktop"
+}
+
+// deviceProfile returns the profile for a request's device.
+func deviceProfile(r *http.Request) DeviceProfile {
+	return deviceProfiles[deviceClass(r)]
+}
+
+// FixedSize is the desktop size for local scaling, or "" if the desktop
+// follows the browser window.
+func (p DeviceProfile) FixedSize() string {
+	if p.Scaling != "local" {
+		return ""
+	}
+	return p.Resolution
+}
+
+// deviceEnvArgs passes a device profile to a new desktop container, whose
+// lg-display script applies it once the X server is up.
+func deviceEnvArgs(class string) []string {
+	p, ok := deviceProfiles[class]
+	if !ok {
+		return nil
+	}
+	var args []string
+	if size := p.FixedSize(); size != "" {
+		args = append(args, "-e", "LG_RESOLUTION="+size)
+	}
+	if p.DPI > 0 {
+		args = append(args, "-e", fmt.Sprintf("LG_DPI=%d", p.DPI))
+	}
+	return args
+}
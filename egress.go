@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// What a desktop can reach on the network is set per user, role or desktop
+// with egress:
+//
+//	internet   anything (the default)
+//	internal   private addresses only (10/8, 172.16/12, 192.168/16), plus egress_allow
+//	allowlist  only the hosts and networks in egress_allow
+//	none       nothing
+//
+// egress_allow lists addresses, CIDR networks and host names; names are
+// resolved when the container starts. Policies are enforced with an
+// iptables chain per container, jumped to from Docker's DOCKER-USER chain
+// for the container's address, so they hold whatever runs inside the
+// desktop. Replies to connections made to the desktop (the gateway's noVNC
+// connection) and traffic to the host itself (the agent) are unaffected.
+// A desktop whose policy can't be applied is not started.
+
+// Egress is a desktop's network policy.
+type Egress struct {
+	Mode  string   // "", "internet", "internal", "allowlist" or "none"
+	Allow []string // Extra destinations for internal, the only ones for allowlist
+}
+
+var privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// userEgress returns u's egress policy.
+func userEgress(u *User) (Egress, error) {
+	e := Egress{Mode: u.setting("egress"), Allow: u.settingKey("egress_allow").Strings(",")}
+	switch e.Mode {
+	case "", "internet", "internal", "allowlist", "none":
+	default:
+		return e, fmt.Errorf("egress must be internet, internal, allowlist or none, not %q", e.Mode)
+	}
+	return e, nil
+}
+
+// restricted reports whether the policy needs any rules.
+func (e Egress) restricted() bool {
+	return e.Mode != "" && e.Mode != "internet"
+}
+
+// egressChain is the iptables chain for a container's policy.
+func egressChain(container string) string {
+	sum := sha1.Sum([]byte(container))
+	return "LG-" + hex.EncodeToString(sum[:8])
+}
+
+// destinations returns the policy's allowed destinations as addresses and
+// networks.
+func (e Egress) destinations() ([]string, error) {
+	var dests []string
+	if e.Mode == "internal" {
+		dests = append(dests, privateNets...)
+	}
+	if e.Mode == "none" {
+		return nil, nil
+	}
+	for _, a := range e.Allow {
+		if _, _, err := net.ParseCIDR(a); err == nil || net.ParseIP(a) != nil {
+			dests = append(dests, a)
+			continue
+		}
+		ips, err := net.LookupIP(a)
+		if err != nil {
+			return nil, fmt.Errorf("egress_allow %s: %v", a, err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				dests = append(dests, ip.String())
+			}
+		}
+	}
+	return dests, nil
+}
+
+// applyEgress sets up a running container's network policy, replacing any
+// earlier rules for it (its address changes when it is run again).
+func applyEgress(ctx context.Context, container string, e Egress) error {
+	removeEgress(container)
+	if !e.restricted() {
+		return nil
+	}
+	dests, err := e.destinations()
+	if err != nil {
+		return err
+	}
+	out, err := execOutput(ctx, "docker", "inspect", "-f",
+		"{{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}", container)
+	if err != nil {
+		return fmt.Errorf("finding the container's address: %v", err)
+	}
+	addrs := strings.Fields(string(out))
+	if len(addrs) == 0 {
+		return fmt.Errorf("container %s has no address", container)
+	}
+
+	chain := egressChain(container)
+	rules := [][]string{
+		{"-N", chain},
+		{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	if len(dests) > 0 {
+		// Name lookups, wherever the host's resolver is
+		rules = append(rules,
+			[]string{"-A", chain, "-p", "udp", "--dport", "53", "-j", "RETURN"},
+			[]string{"-A", chain, "-p", "tcp", "--dport", "53", "-j", "RETURN"})
+	}
+	for _, d := range dests {
+		rules = append(rules, []string{"-A", chain, "-d", d, "-j", "RETURN"})
+	}
+	rules = append(rules, []string{"-A", chain, "-j", "DROP"})
+	for _, a := range addrs {
+		rules = append(rules, []string{"-I", "DOCKER-USER", "-s", a, "-j", chain})
+	}
+	for _, rule := range rules {
+		if err := execRun(ctx, "iptables", rule...); err != nil {
+			removeEgress(container)
+			return fmt.Errorf("iptables %s: %v", strings.Join(rule, " "), err)
+		}
+	}
+	return nil
+}
+
+// removeEgress removes a container's network policy rules, if any.
+func removeEgress(container string) {
+	ctx := context.Background()
+	chain := egressChain(container)
+	out, _ := execOutput(ctx, "iptables", "-S", "DOCKER-USER")
+	for _, line := range strings.Split(string(out), "\n") {
+		rule := strings.Fields(line)
+		if len(rule) > 2 && rule[0] == "-A" && rule[len(rule)-1] == chain {
+			rule[0] = "-D"
+			execRun(ctx, "iptables", rule...)
+		}
+	}
+	execRun(ctx, "iptables", "-F", chain)
+	execRun(ctx, "iptables", "-X", chain)
+}
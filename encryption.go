@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted overlays keep upper/ and work/ together under a single fscrypt
+// directory: overlayfs renames from work/ into upper/, which fails across
+// directories with different encryption policies.
+const encryptedSubdir = "private"
+
+// overlayPaths returns the upper and work directories for an overlay.
+func overlayPaths(overlayDir string, encrypted bool) (upper, work string) {
+	if encrypted {
+		overlayDir = filepath.Join(overlayDir, encryptedSubdir)
+	}
+	return filepath.Join(overlayDir, "upper"), filepath.Join(overlayDir, "work")
+}
+
+// unlockOverlay unlocks a user's encrypted overlay directory with their
+// login password, encrypting it first if this is the first login. The
+// directory must exist, and be empty if it is not yet encrypted.
+func unlockOverlay(ctx context.Context, username, dir, password string) error {
+	status, _ := execOutput(ctx, "fscrypt", "status", dir)
+	if !strings.Contains(string(status), "is encrypted with fscrypt") {
+		return fscrypt(ctx, password, "encrypt", dir,
+			"--source=custom_passphrase", "--name=lookingglass-"+username, "--quiet")
+	}
+	err := fscrypt(ctx, password, "unlock", dir, "--quiet")
+	if err != nil && strings.Contains(err.Error(), "already unlocked") {
+		return nil
+	}
+	return err
+}
+
+// lockOverlay removes the key for an encrypted overlay directory, making its
+// contents unreadable until the user next logs in.
+func lockOverlay(dir string) {
+	if err := fscrypt(context.Background(), "", "lock", dir, "--quiet"); err != nil {
+		log.Printf("Failed to lock %s: %v", dir, err)
+	}
+}
+
+// fscrypt runs an fscrypt subcommand, feeding passphrase on stdin.
+func fscrypt(ctx context.Context, passphrase string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "fscrypt", args...)
+	cmd.Stdin = strings.NewReader(passphrase + "\n")
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("fscrypt %s: %w", args[0], ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("fscrypt %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Every session ends for a reason, one of the end* codes below. The reason
+// is audited with session.stop and remembered for endedReasonTTL, so that
+// the session page (through /status) and anyone following an old session
+// link later are told what happened (timed out, stopped by an admin,
+// crashed...) rather than just that it's gone.
+
+const (
+	endLogout        = "logout"        // The user logged out, or stopped it from the chooser
+	endIdle          = "idle"          // Idle past its timeout (or left suspended too long)
+	endLifetime      = "lifetime"      // Reached its maximum lifetime
+	endAdmin         = "admin"         // Terminated by an admin
+	endCrashed       = "crashed"       // The container died and wasn't restarted
+	endMaintenance   = "maintenance"   // A maintenance window began
+	endDeprovisioned = "deprovisioned" // The user's account was removed
+	endReset         = "reset"         // The user reset their desktop
+	endAnomaly       = "anomaly"       // Flagged as anomalous, with anomaly_action = stop
+)
+
+// endReasons are the reasons with a message of their own, session.ended_<reason>.
+var endReasons = []string{endLogout, endIdle, endLifetime, endAdmin, endCrashed, endMaintenance, endDeprovisioned, endReset, endAnomaly}
+
+// endedReasonTTL is how long why a session ended is remembered.
+const endedReasonTTL = 24 * time.Hour
+
+var (
+	endedReasons   = make(map[string]endedReason) // Why recently ended sessions ended, for their pages
+	endedReasonsMu sync.Mutex
+)
+
+// endedReason records why a session ended, until it is no longer asked.
+type endedReason struct {
+	Reason string
+	At     time.Time
+}
+
+// noteEnded remembers why a session ended, for its page to report.
+func noteEnded(sessionID, reason string) {
+	endedReasonsMu.Lock()
+	defer endedReasonsMu.Unlock()
+	for id, e := range endedReasons {
+		if time.Since(e.At) > endedReasonTTL {
+			delete(endedReasons, id)
+		}
+	}
+	endedReasons[sessionID] = endedReason{Reason: reason, At: time.Now()}
+}
+
+// whyEnded returns why a session recently ended, if known.
+func whyEnded(sessionID string) string {
+	endedReasonsMu.Lock()
+	defer endedReasonsMu.Unlock()
+	if e, ok := endedReasons[sessionID]; ok && time.Since(e.At) <= endedReasonTTL {
+		return e.Reason
+	}
+	return ""
+}
+
+// endedKey is the message key explaining a reason to the user.
+func endedKey(reason string) string {
+	if !slices.Contains(endReasons, reason) {
+		return "session.ended"
+	}
+	return "session.ended_" + reason
+}
+
+// sessionGone responds to a request for a session that no longer exists,
+// saying why it ended if that's known.
+func sessionGone(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if reason := whyEnded(sessionID); reason != "" {
+		httpError(w, r, 410, endedKey(reason))
+		return
+	}
+	sessionsMu.RLock()
+	s, ok := lookupSession(sessionID)
+	sessionsMu.RUnlock()
+	if ok && s.ScreenLocked {
+		httpError(w, r, 401, "error.screen_locked")
+		return
+	}
+	httpError(w, r, 404, "error.session_not_found")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Any config key can also be set with a LOOKINGGLASS_* environment
+// variable, so the gateway can run as a container configured entirely
+// through its environment. LOOKINGGLASS_<KEY> sets a [gateway] key, and
+// LOOKINGGLASS_<SECTION>__<KEY> a key in another section, with the first
+// underscore of the section standing for its space:
+//
+//	LOOKINGGLASS_LISTEN=:8080                  listen in [gateway]
+//	LOOKINGGLASS_BRANDING__PRODUCT_NAME=Lab    product_name in [branding]
+//	LOOKINGGLASS_ROLE_STUDENTS__QUOTA=10G      quota in [role students]
+//
+// The environment overrides the config file, which is then optional.
+// LOOKINGGLASS_CONFIG names the file, like -config.
+
+const envPrefix = "LOOKINGGLASS_"
+
+// applyEnv sets config keys from LOOKINGGLASS_* environment variables.
+func applyEnv(cfg *ini.File) {
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		key, ok := strings.CutPrefix(name, envPrefix)
+		if !ok || key == "" || key == "CONFIG" {
+			continue
+		}
+		section := "gateway"
+		if s, k, found := strings.Cut(key, "__"); found {
+			section, key = strings.Replace(strings.ToLower(s), "_", " ", 1), k
+		}
+		cfg.Section(section).Key(strings.ToLower(key)).SetValue(value)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors reach users as branded, translated error pages, or as plain text
+// for clients that don't ask for HTML (the session page's fetch calls,
+// WebDAV clients). Either way they only carry a message from the language
+// packs: internal detail, such as why a mount failed, is logged instead.
+
+// httpError responds with status and the translated message for key.
+func httpError(w http.ResponseWriter, r *http.Request, status int, key string, args ...any) {
+	msg := tr(r, key, args...)
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, msg, status)
+		return
+	}
+	title := tr(r, "error.title_"+strconv.Itoa(status))
+	if title == "error.title_"+strconv.Itoa(status) {
+		title = http.StatusText(status)
+	}
+	renderPage(w, r, status, "error.html", map[string]any{
+		"Status":  status,
+		"Title":   title,
+		"Message": msg,
+	})
+}
+
+// serverError logs err and responds with a generic error for status: 503 if
+// the gateway is out of capacity, 423 if the desktop is held after an
+// anomaly, otherwise an internal error.
+func serverError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	switch {
+	case errors.Is(err, errNoCapacity):
+		httpError(w, r, 503, "error.capacity")
+	case errors.Is(err, errHeld):
+		httpError(w, r, 423, "error.session_held")
+	case status == 503:
+		httpError(w, r, 503, "error.unavailable")
+	default:
+		httpError(w, r, status, "error.internal")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Each session gets an exchange directory on the host, bind-mounted into the
+// desktop at exchangeTarget. The gateway serves it over HTTP so users can get
+// files in and out of their desktop from the browser. A per-user
+// "file_transfer" policy of both, upload (browser to desktop only), download
+// (desktop to browser only) or none decides which directions are allowed,
+// here, over WebDAV and (both only) over SFTP.
+
+const (
+	exchangeTarget = "/home/docker/Exchange" // Where the desktop sees the exchange dir
+	desktopUID     = 1000                    // uid/gid of the desktop user in the image
+	maxUploadSize  = 1 << 30                 // Per-request upload limit
+)
+
+// errOutsideExchange wraps os.ErrPermission so callers (notably the WebDAV
+// server's directory walks) treat escaping entries as merely inaccessible.
+var errOutsideExchange = fmt.Errorf("path escapes the exchange directory: %w", os.ErrPermission)
+
+// FileEntry is one row of a file browser listing.
+type FileEntry struct {
+	Name    string
+	Path    string // Relative to the exchange dir, slash-separated
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// exchangePath returns the exchange directory for an overlay. Encrypted
+// overlays keep it inside their encrypted directory.
+func exchangePath(overlayDir string, encrypted bool) string {
+	if encrypted {
+		overlayDir = filepath.Join(overlayDir, encryptedSubdir)
+	}
+	return filepath.Join(overlayDir, "exchange")
+}
+
+// prepareExchange creates an exchange directory owned by the desktop user.
+func prepareExchange(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Chown(dir, desktopUID, desktopUID)
+}
+
+// fileTransferAllows reports whether policy permits transfers in the given
+// direction ("upload" or "download").
+func fileTransferAllows(policy, dir string) bool {
+	return policy == "" || policy == "both" || policy == dir
+}
+
+// resolveExchange maps a slash-separated path onto the exchange directory.
+// The desktop user controls the directory's contents, so symlinks are
+// resolved and anything that ends up outside the directory is refused.
+func resolveExchange(root, rel string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(path.Clean("/"+rel))))
+	if err != nil {
+		return "", err
+	}
+	if p != realRoot && !strings.HasPrefix(p, realRoot+string(filepath.Separator)) {
+		return "", errOutsideExchange
+	}
+	return p, nil
+}
+
+// filesHandler serves /files/<session>/<path>: GET lists a directory or
+// downloads a file, POST uploads files into a directory.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, rel, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	if s.ExchangeDir == "" {
+		httpError(w, r, 404, "error.no_container")
+		return
+	}
+	if s.FilePolicy == "none" {
+		httpError(w, r, 403, "error.files_disabled")
+		return
+	}
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+
+	p, err := resolveExchange(s.ExchangeDir, rel)
+	if err != nil {
+		httpError(w, r, 404, "error.file_not_found")
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		httpError(w, r, 404, "error.file_not_found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && fi.IsDir() && !fileTransferAllows(s.FilePolicy, "upload"):
+		httpError(w, r, 403, "error.upload_disabled")
+	case r.Method == http.MethodPost && fi.IsDir() && overQuota(s):
+		httpError(w, r, 507, "error.quota_full")
+	case r.Method == http.MethodPost && fi.IsDir():
+		if err := receiveUploads(w, r, p, s); errors.Is(err, errInfected) {
+			httpError(w, r, 422, "error.upload_infected")
+			return
+		} else if errors.Is(err, errScanFailed) {
+			httpError(w, r, 503, "error.upload_unscanned")
+			return
+		} else if err != nil {
+			log.Printf("Upload to session %s: %v", sessionID, err)
+			httpError(w, r, 400, "error.upload_failed")
+			return
+		}
+		http.Redirect(w, r, "/files/"+sessionID+"/"+rel, 303)
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		httpError(w, r, 405, "error.method_not_allowed")
+	case fi.IsDir():
+		listExchange(w, r, s, rel, p)
+	case !fileTransferAllows(s.FilePolicy, "download"):
+		httpError(w, r, 403, "error.download_disabled")
+	default:
+		f, err := os.Open(p)
+		if err != nil {
+			httpError(w, r, 404, "error.file_not_found")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(fi.Name()))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	}
+}
+
+// listExchange renders the file browser for a directory.
+func listExchange(w http.ResponseWriter, r *http.Request, s Session, rel, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	var files []FileEntry
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, FileEntry{
+			Name:    e.Name(),
+			Path:    path.Join(rel, e.Name()),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
+	})
+
+	parent := ""
+	if rel != "" {
+		parent = path.Dir("/" + rel)[1:]
+	}
+	renderTemplate(w, r, "files.html", map[string]any{
+		"SessionID": s.ID,
+		"Path":      rel,
+		"HasParent": rel != "",
+		"Parent":    parent,
+		"Files":     files,
+		"Upload":    fileTransferAllows(s.FilePolicy, "upload"),
+		"Download":  fileTransferAllows(s.FilePolicy, "download"),
+	})
+}
+
+// receiveUploads streams every file in a multipart upload into dir. Each file
+// is written to a temporary name, scanned and renamed into place, so an
+// existing symlink at the destination is replaced rather than followed.
+func receiveUploads(w http.ResponseWriter, r *http.Request, dir string, s Session) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(filepath.FromSlash(part.FileName()))
+		if part.FormName() != "file" || name == "." || name == ".." || name == string(filepath.Separator) {
+			continue
+		}
+
+		tmp, err := os.CreateTemp(dir, ".upload-*")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tmp, part)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = scanUpload(r.Context(), s.Scan, s.Username, s.ID, tmp.Name(), name)
+		}
+		if err == nil {
+			os.Chown(tmp.Name(), desktopUID, desktopUID)
+			os.Chmod(tmp.Name(), 0644)
+			err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+}
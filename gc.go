@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var guestGCAge = time.Hour // Minimum age before an orphaned guest overlay is removed
+
+// guestGCLoop periodically removes orphaned guest overlays. It runs once at
+// startup, since a crash is the usual way for them to be left behind.
+func guestGCLoop() {
+	for {
+		gcGuestOverlays()
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// gcGuestOverlays removes guest-* overlay directories older than guestGCAge
+// that no live session refers to.
+func gcGuestOverlays() {
+	dirs, err := filepath.Glob(filepath.Join(overlayRoot, "guest-*"))
+	if err != nil {
+		return
+	}
+
+	live := make(map[string]bool)
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		live[filepath.Clean(s.OverlayDir)] = true
+	}
+	sessionsMu.RUnlock()
+
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() || live[filepath.Clean(dir)] {
+			continue
+		}
+		if time.Since(fi.ModTime()) < guestGCAge {
+			continue // may belong to a login still in progress
+		}
+		log.Printf("Removing orphaned guest overlay %s", dir)
+		execRun(context.Background(), "umount", "-l", filepath.Join(dir, "merged"))
+		releaseOverlay(dir, true, false)
+	}
+}
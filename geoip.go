@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// Clients can be kept out by country: countries_deny lists ISO 3166 codes
+// refused, countries_allow the only ones let in. Either applies to logins
+// (the login form, bookings, WebDAV and SSH) and to connections to desktops
+// (the session page, the proxied VNC websocket and share links), so that a
+// session opened from an allowed country can't be carried on from another.
+// Blocked attempts are audited (geo.blocked) with the address and country.
+//
+// The country comes from country_header when a CDN or proxy in front of the
+// gateway sets one (such as CF-IPCountry), otherwise from geoip_database, a
+// MaxMind-format database (GeoLite2 Country or City, say), reread when the
+// file changes. Private and loopback addresses have no country and are
+// always let in; other addresses with no known country are refused when
+// countries_allow is set.
+
+var (
+	countryHeader  = "" // Request header carrying the client's country
+	geoipPath      = "" // MaxMind database of countries by address
+	countriesAllow []string
+	countriesDeny  []string
+	geoipDB        *maxminddb.Reader
+	geoipModTime   time.Time // The database file's when it was read
+	geoipMu        sync.RWMutex
+)
+
+// geoipRecord is the part of a database record naming the country.
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// loadGeoIP reads the country settings from the [gateway] section and
+// opens geoip_database.
+func loadGeoIP(gw *ini.Section) error {
+	countryHeader = gw.Key("country_header").MustString(countryHeader)
+	geoipPath = gw.Key("geoip_database").MustString(geoipPath)
+	countriesAllow, countriesDeny = nil, nil
+	for _, c := range gw.Key("countries_allow").Strings(",") {
+		countriesAllow = append(countriesAllow, strings.ToUpper(c))
+	}
+	for _, c := range gw.Key("countries_deny").Strings(",") {
+		countriesDeny = append(countriesDeny, strings.ToUpper(c))
+	}
+	if len(countriesAllow) > 0 || len(countriesDeny) > 0 {
+		if countryHeader == "" && geoipPath == "" {
+			return errors.New("countries_allow and countries_deny need country_header or geoip_database")
+		}
+	}
+	if geoipPath == "" {
+		return nil
+	}
+	return openGeoIP()
+}
+
+// openGeoIP reads geoip_database, replacing the one in use.
+func openGeoIP() error {
+	fi, err := os.Stat(geoipPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(geoipPath)
+	if err != nil {
+		return err
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return err
+	}
+	geoipMu.Lock()
+	geoipDB, geoipModTime = db, fi.ModTime()
+	geoipMu.Unlock()
+	return nil
+}
+
+// geoipLoop rereads geoip_database when it is updated (by geoipupdate,
+// say).
+func geoipLoop() {
+	if geoipPath == "" {
+		return
+	}
+	for {
+		time.Sleep(time.Minute)
+		fi, err := os.Stat(geoipPath)
+		geoipMu.RLock()
+		changed := err == nil && !fi.ModTime().Equal(geoipModTime)
+		geoipMu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := openGeoIP(); err != nil {
+			log.Printf("Reloading %s: %v", geoipPath, err)
+			continue
+		}
+		log.Printf("Reloaded %s", geoipPath)
+	}
+}
+
+// remoteIP returns the address in a host:port address (nil if it isn't
+// one).
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// localAddr reports whether a host:port address is on the local network.
+func localAddr(remoteAddr string) bool {
+	ip := remoteIP(remoteAddr)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback())
+}
+
+// addrCountry returns the country of a host:port address from
+// geoip_database ("" if unknown).
+func addrCountry(remoteAddr string) string {
+	ip := remoteIP(remoteAddr)
+	if ip == nil || localAddr(remoteAddr) {
+		return ""
+	}
+	geoipMu.RLock()
+	db := geoipDB
+	geoipMu.RUnlock()
+	if db == nil {
+		return ""
+	}
+	var rec geoipRecord
+	if err := db.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// requestCountry returns the country a request comes from, if known.
+func requestCountry(r *http.Request) string {
+	if countryHeader != "" {
+		c := strings.ToUpper(strings.TrimSpace(r.Header.Get(countryHeader)))
+		if len(c) == 2 && c != "XX" {
+			return c
+		}
+	}
+	return addrCountry(r.RemoteAddr)
+}
+
+// countryAllowed reports whether clients from country (at remoteAddr) may
+// log in and connect.
+func countryAllowed(country, remoteAddr string) bool {
+	if len(countriesAllow) == 0 && len(countriesDeny) == 0 {
+		return true
+	}
+	if country == "" {
+		return len(countriesAllow) == 0 || localAddr(remoteAddr)
+	}
+	if slices.Contains(countriesDeny, country) {
+		return false
+	}
+	return len(countriesAllow) == 0 || slices.Contains(countriesAllow, country)
+}
+
+// geoBlocked refuses a request from a country that isn't allowed, auditing
+// it, and reports whether it did.
+func geoBlocked(w http.ResponseWriter, r *http.Request, username string) bool {
+	country := requestCountry(r)
+	if countryAllowed(country, r.RemoteAddr) {
+		return false
+	}
+	audit("geo.blocked", username, "", map[string]string{"country": country, "remote": r.RemoteAddr, "path": r.URL.Path})
+	httpError(w, r, 403, "error.country_blocked")
+	return true
+}
+
+// sshGeoBlocked reports whether an SSH client comes from a country that
+// isn't allowed, auditing it if so.
+func sshGeoBlocked(conn ssh.ConnMetadata) bool {
+	remote := conn.RemoteAddr().String()
+	country := addrCountry(remote)
+	if countryAllowed(country, remote) {
+		return false
+	}
+	audit("geo.blocked", conn.User(), "", map[string]string{"country": country, "remote": remote, "via": "ssh"})
+	return true
+}
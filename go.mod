@@ -2,6 +2,15 @@ module lookingglass
 
 go 1.22.2
 
-require gopkg.in/ini.v1 v1.67.0
+require (
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require github.com/stretchr/testify v1.11.1 // indirect
+require (
+	github.com/stretchr/testify v1.11.1 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Groups configure many users at once, in [group <name>] sections of the
+// gateway config. A group's settings (image, quota, idle_timeout, printing,
+// role, and so on) apply to its members unless their own file sets them,
+// ahead of their role's. Members are listed in the group's members key, or
+// name the group in their own groups key, or are listed in its passwords
+// file: one "name:password" line each, so that a class of 500 needs no user
+// files at all. Where a user is in several groups, the first to set a key
+// wins, groups named in the user's file first.
+
+// groupSections returns every [group <name>] section.
+func groupSections() []*ini.Section {
+	if gatewayCfg == nil {
+		return nil
+	}
+	var groups []*ini.Section
+	for _, sec := range gatewayCfg.Sections() {
+		if strings.HasPrefix(sec.Name(), "group ") {
+			groups = append(groups, sec)
+		}
+	}
+	return groups
+}
+
+// readGroupPasswords reads a group's passwords file into a map.
+func readGroupPasswords(g *ini.Section) map[string]string {
+	path := g.Key("passwords").String()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	passwords := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, password, ok := strings.Cut(line, ":"); ok {
+			passwords[name] = password
+		}
+	}
+	return passwords
+}
+
+// groupPassword returns the password for a user with no file of their own,
+// from the first group passwords file that lists them.
+func groupPassword(username string) (string, bool) {
+	for _, g := range groupSections() {
+		if password, ok := readGroupPasswords(g)[username]; ok {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+// inGroup reports whether a group lists username as a member.
+func inGroup(g *ini.Section, username string) bool {
+	if slices.Contains(g.Key("members").Strings(","), username) {
+		return true
+	}
+	_, ok := readGroupPasswords(g)[username]
+	return ok
+}
+
+// userGroups returns the groups a user is in: those named in their file,
+// then those listing them.
+func userGroups(username string, named []string) []*ini.Section {
+	var groups []*ini.Section
+	if gatewayCfg == nil {
+		return nil
+	}
+	for _, name := range named {
+		if g, err := gatewayCfg.GetSection("group " + name); err == nil {
+			groups = append(groups, g)
+		}
+	}
+	for _, g := range groupSections() {
+		if !slices.Contains(groups, g) && inGroup(g, username) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// groupNames returns the names of the groups u is in.
+func (u *User) groupNames() []string {
+	var names []string
+	for _, g := range u.groups {
+		names = append(names, strings.TrimPrefix(g.Name(), "group "))
+	}
+	return names
+}
+
+// userNames returns every user: those with a file and those only listed in
+// a group passwords file.
+func userNames() []string {
+	var names []string
+	paths, _ := filepath.Glob(filepath.Join(userConfDir, "*.conf"))
+	for _, path := range paths {
+		names = append(names, strings.TrimSuffix(filepath.Base(path), ".conf"))
+	}
+	for _, g := range groupSections() {
+		for name := range readGroupPasswords(g) {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Guest desktops (ephemeral overlays, including invited guests) can be
+// limited per day, against anonymous abuse: guest_daily_per_ip desktops
+// from any one client address (IPv6 clients counted by /64), and
+// guest_daily_total from everyone (0 = unlimited). Days run midnight to
+// midnight in gateway local time. Clients over either limit get a page
+// asking them to come back later. With a cluster store the counts are kept
+// there, so they hold across gateways.
+
+var (
+	guestDailyPerIP = 0 // Guest desktops one client address may start a day
+	guestDailyTotal = 0 // Guest desktops that may be started a day
+)
+
+var (
+	guestCounts = make(map[string]int) // Guest desktops started by key, today
+	guestDay    time.Time
+	guestMu     sync.Mutex
+)
+
+// today returns the start of the current day in local time.
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// guestCount returns the guest desktops counted against key today, first
+// counting one more if add is set.
+func guestCount(key string, add bool) int {
+	day := today()
+	if cluster != nil {
+		k := "lookingglass:guests:" + key + ":" + day.Format("20060102")
+		var n int
+		var err error
+		if add {
+			var reply any
+			if reply, err = cluster.do("INCR", k); err == nil {
+				n = int(reply.(int64))
+				if n == 1 {
+					cluster.do("PEXPIRE", k, strconv.FormatInt((48*time.Hour).Milliseconds(), 10))
+				}
+			}
+		} else {
+			var v string
+			if v, err = cluster.get(k); err == errRedisNil {
+				err = nil
+			}
+			n, _ = strconv.Atoi(v)
+		}
+		if err == nil {
+			return n
+		}
+		log.Printf("Cluster store: guest quota, counting locally: %v", err)
+	}
+	guestMu.Lock()
+	defer guestMu.Unlock()
+	if !day.Equal(guestDay) {
+		guestCounts, guestDay = make(map[string]int), day
+	}
+	if add {
+		guestCounts[key]++
+	}
+	return guestCounts[key]
+}
+
+// guestKey is the quota key for a request's client: its address, or its
+// /64 for IPv6, where clients often hold a whole prefix.
+func guestKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return "ip:" + host
+}
+
+// takeGuestQuota counts a guest desktop for a client, reporting false
+// without counting it if the client or the gateway has had its share today.
+func takeGuestQuota(remoteAddr string) bool {
+	key := guestKey(remoteAddr)
+	if guestDailyPerIP > 0 && guestCount(key, false) >= guestDailyPerIP {
+		return false
+	}
+	if guestDailyTotal > 0 && guestCount("total", false) >= guestDailyTotal {
+		return false
+	}
+	if guestDailyPerIP > 0 {
+		guestCount(key, true)
+	}
+	if guestDailyTotal > 0 {
+		guestCount("total", true)
+	}
+	return true
+}
+
+// guestQuotaPage tells a guest over quota to come back tomorrow.
+func guestQuotaPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(today().AddDate(0, 0, 1)).Seconds())+1))
+	msg := tr(r, "error.guest_quota")
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, msg, 429)
+		return
+	}
+	renderPage(w, r, 429, "error.html", map[string]any{
+		"Status":  429,
+		"Title":   tr(r, "error.title_guest_quota"),
+		"Message": msg,
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The browser that logged in holds a per-session owner cookie, and the owner
+// endpoints (/session/, /proxy/, /files/, ...) only answer to it. Logging in
+// again while a desktop is running hands it to the new browser instead of
+// starting another: with handoff = takeover (the default) the old browser's
+// cookie stops working and its VNC connection is closed; with
+// handoff = mirror both keep working side by side. A desktop locked after
+// its owner disconnected (see screenlock.go) is unlocked by logging in
+// again, and always gets a new cookie.
+
+var (
+	ownerConns   = make(map[string]map[*vncStream]bool) // Owner VNC connections by session
+	ownerConnsMu sync.Mutex
+)
+
+// ownerCookieName is per session, so one browser can own several desktops.
+func ownerCookieName(sessionID string) string {
+	return "lg_" + sessionID
+}
+
+// setOwnerCookie gives the browser ownership of a session.
+func setOwnerCookie(w http.ResponseWriter, r *http.Request, sessionID, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ownerCookieName(sessionID),
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ownerToken returns the owner cookie value for a session.
+func ownerToken(sessionID string) string {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	return sessions[sessionID].OwnerToken
+}
+
+// isOwner reports whether the request carries the session's owner cookie,
+// and the client certificate it needs if any (see mtls.go).
+func isOwner(r *http.Request, sessionID string, s Session) bool {
+	return hasOwnerCookie(r, sessionID, s) && clientCertMatches(r, s)
+}
+
+// hasOwnerCookie reports whether the request carries the session's owner
+// cookie.
+func hasOwnerCookie(r *http.Request, sessionID string, s Session) bool {
+	c, err := r.Cookie(ownerCookieName(sessionID))
+	return err == nil && s.OwnerToken != "" &&
+		subtle.ConstantTimeCompare([]byte(c.Value), []byte(s.OwnerToken)) == 1
+}
+
+// ownerSession is touchSession for the owner endpoints: requests without
+// the owner cookie are treated as if the session didn't exist.
+func ownerSession(r *http.Request, sessionID string) (Session, bool) {
+	if _, ok := peekOwnerSession(r, sessionID); !ok {
+		return Session{}, false
+	}
+	return touchSession(sessionID)
+}
+
+// peekOwnerSession is ownerSession for requests the page makes on its own,
+// such as polling, which don't count as the user being active.
+func peekOwnerSession(r *http.Request, sessionID string) (Session, bool) {
+	sessionsMu.RLock()
+	s, ok := lookupSession(sessionID)
+	sessionsMu.RUnlock()
+	if !ok || !isOwner(r, sessionID, s) {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// handOff gives a running session to the browser that just logged in.
+func handOff(w http.ResponseWriter, r *http.Request, sessionID string, u *User) {
+	mode := u.settingKey("handoff").In("takeover", []string{"takeover", "mirror"})
+	sessionsMu.Lock()
+	s := sessions[sessionID]
+	locked := s.ScreenLocked
+	if mode == "takeover" || locked {
+		s.OwnerToken = newAgentToken()
+	}
+	s.ScreenLocked = false
+	s.LastActive = time.Now()
+	s.ExpiresAt = time.Time{}
+	sessions[sessionID] = s
+	saveSessions()
+	sessionsMu.Unlock()
+	if mode == "takeover" {
+		closeOwnerConns(sessionID)
+	}
+	if locked {
+		unlockScreen(r, s)
+	}
+	setOwnerCookie(w, r, sessionID, s.OwnerToken)
+	audit("session.handoff", u.Name, sessionID, map[string]string{"mode": mode, "remote": r.RemoteAddr})
+}
+
+// trackOwnerConn registers an owner's VNC connection, so a takeover can
+// close it.
+func trackOwnerConn(sessionID string, vs *vncStream) {
+	ownerConnsMu.Lock()
+	defer ownerConnsMu.Unlock()
+	if ownerConns[sessionID] == nil {
+		ownerConns[sessionID] = make(map[*vncStream]bool)
+	}
+	ownerConns[sessionID][vs] = true
+	cancelScreenLock(sessionID)
+}
+
+// untrackOwnerConn forgets a closed connection.
+func untrackOwnerConn(sessionID string, vs *vncStream) {
+	ownerConnsMu.Lock()
+	defer ownerConnsMu.Unlock()
+	delete(ownerConns[sessionID], vs)
+	if len(ownerConns[sessionID]) == 0 {
+		delete(ownerConns, sessionID)
+		go scheduleScreenLock(sessionID)
+	}
+}
+
+// closeOwnerConns disconnects every owner VNC connection to a session.
+func closeOwnerConns(sessionID string) {
+	ownerConnsMu.Lock()
+	var conns []*vncStream
+	for vs := range ownerConns[sessionID] {
+		conns = append(conns, vs)
+	}
+	ownerConnsMu.Unlock()
+	for _, vs := range conns {
+		vs.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every response carries security headers: a Content-Security-Policy
+// allowing the gateway's own pages (Bootstrap from its CDN, the CAPTCHA
+// provider's widget, the noVNC client in a same-origin frame), frame
+// protection, Referrer-Policy and, over HTTPS, Strict-Transport-Security.
+//
+// frame_ancestors lists the origins allowed to embed the gateway in a frame,
+// such as a learning platform: 'self' (the default) also sends
+// X-Frame-Options: SAMEORIGIN, 'none' sends DENY, and anything else only
+// the CSP frame-ancestors directive, as X-Frame-Options can't name origins.
+// content_security_policy replaces the generated policy ("off" sends none).
+// hsts_max_age (0 = no HSTS) applies to requests that came in over HTTPS,
+// directly or as reported by a proxy in X-Forwarded-Proto.
+
+var (
+	contentSecurityPolicy = ""                   // Replaces the generated policy ("off" = none)
+	frameAncestors        = "'self'"             // Origins that may frame the gateway
+	hstsMaxAge            = 365 * 24 * time.Hour // Strict-Transport-Security max-age (0 = off)
+	referrerPolicy        = "no-referrer"        // Links carry tokens, so nothing is sent by default
+)
+
+// securityPolicy returns the Content-Security-Policy for responses.
+func securityPolicy() string {
+	if contentSecurityPolicy != "" {
+		return contentSecurityPolicy
+	}
+	scripts := "'self' 'unsafe-inline' https://cdn.jsdelivr.net"
+	frames := "'self'"
+	if p, ok := captchaProviders[captchaService]; ok {
+		scripts += " " + p.origins
+		frames += " " + p.origins
+	}
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src " + scripts,
+		"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net",
+		"img-src 'self' data: blob: https:", // Branding logos may be anywhere
+		"connect-src 'self'",
+		"frame-src " + frames,
+		"frame-ancestors " + frameAncestors,
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+	}, "; ")
+}
+
+// securityHeaders adds the security headers to every response.
+func securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		if csp := securityPolicy(); csp != "off" {
+			hdr.Set("Content-Security-Policy", csp)
+		}
+		switch frameAncestors {
+		case "'self'":
+			hdr.Set("X-Frame-Options", "SAMEORIGIN")
+		case "'none'":
+			hdr.Set("X-Frame-Options", "DENY")
+		}
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		if referrerPolicy != "" {
+			hdr.Set("Referrer-Policy", referrerPolicy)
+		}
+		if hstsMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			hdr.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(hstsMaxAge.Seconds())))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A user, role or group can give desktops a home directory on network
+// storage instead of keeping everything in the overlay:
+//
+//	home = nfs://filer.example.com/export/homes/{user}
+//	home = cifs://filer.example.com/homes/{user}
+//	home = /mnt/nas/homes/{user}       (already mounted on the host)
+//
+// The home is bind-mounted at home_target (default /home/docker, the
+// desktop user's home in the shipped image) and is the only thing that
+// persists: the rest of the root filesystem starts afresh from the base
+// image every time the desktop starts, as on a lab machine. NFS and CIFS
+// homes are mounted by the gateway under home_mounts while the user has a
+// desktop running, with home_options as mount options; CIFS logs in as
+// home_username with home_password (which, like other secrets, may be a
+// file:, env: or vault: reference).
+
+var homeMounts = "/run/lookingglass/homes" // Where the gateway mounts NFS and CIFS homes
+
+const defaultHomeTarget = "/home/docker"
+
+// homeSource returns the mount type and source for a home setting: "" and
+// a host path, or "nfs" or "cifs" and what mount takes.
+func homeSource(home string) (fstype, source string, err error) {
+	if filepath.IsAbs(home) {
+		return "", filepath.Clean(home), nil
+	}
+	u, err := url.Parse(home)
+	if err != nil || u.Host == "" || u.Path == "" {
+		return "", "", fmt.Errorf("home %q: want nfs://host/path, cifs://host/share/path or an absolute path", home)
+	}
+	switch u.Scheme {
+	case "nfs":
+		return "nfs", u.Host + ":" + path.Clean(u.Path), nil
+	case "cifs", "smb":
+		return "cifs", "//" + u.Host + path.Clean(u.Path), nil
+	}
+	return "", "", fmt.Errorf("home %q: unknown scheme %q (nfs or cifs)", home, u.Scheme)
+}
+
+// homeTarget returns where u's home is mounted inside the desktop.
+func homeTarget(u *User) (string, error) {
+	target := u.setting("home_target")
+	if target == "" {
+		return defaultHomeTarget, nil
+	}
+	target = path.Clean(target)
+	if !path.IsAbs(target) || target == "/" {
+		return "", fmt.Errorf("home_target %q: must be an absolute path below /", target)
+	}
+	return target, nil
+}
+
+// mountHome makes u's network home available on the host, returning the
+// volume to bind-mount it with and, for NFS and CIFS, the mount point to
+// unmount when the user's last desktop stops. Users without a home get a
+// zero volume.
+func mountHome(ctx context.Context, u *User) (Volume, string, error) {
+	home := u.setting("home")
+	if home == "" {
+		return Volume{}, "", nil
+	}
+	fstype, source, err := homeSource(home)
+	if err != nil {
+		return Volume{}, "", err
+	}
+	target, err := homeTarget(u)
+	if err != nil {
+		return Volume{}, "", err
+	}
+	if fstype == "" {
+		if _, err := os.Stat(source); err != nil {
+			return Volume{}, "", err
+		}
+		return Volume{Source: source, Target: target}, "", nil
+	}
+
+	dir := filepath.Join(homeMounts, u.Name)
+	if execRun(ctx, "mountpoint", "-q", dir) == nil {
+		// Already mounted for another of the user's desktops
+		return Volume{Source: dir, Target: target}, dir, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Volume{}, "", err
+	}
+	opts := u.setting("home_options")
+	if fstype == "cifs" {
+		creds, err := homeCredentials(u)
+		if err != nil {
+			return Volume{}, "", err
+		}
+		if creds != "" {
+			defer os.Remove(creds)
+			opts = strings.TrimPrefix(opts+",credentials="+creds, ",")
+		}
+	}
+	args := []string{"-t", fstype}
+	if opts != "" {
+		args = append(args, "-o", opts)
+	}
+	err = retry(ctx, "Mounting home "+source, func() error {
+		return execRun(ctx, "mount", append(args, source, dir)...)
+	})
+	if err != nil {
+		return Volume{}, "", fmt.Errorf("mounting %s: %v", source, err)
+	}
+	return Volume{Source: dir, Target: target}, dir, nil
+}
+
+// homeCredentials writes u's CIFS credentials to a private file for
+// mount.cifs, returning its path, or "" if none are configured.
+func homeCredentials(u *User) (string, error) {
+	username := u.setting("home_username")
+	if username == "" {
+		return "", nil
+	}
+	password, err := resolveSecret(u.setting("home_password"))
+	if err != nil {
+		return "", fmt.Errorf("home_password: %v", err)
+	}
+	f, err := os.CreateTemp(homeMounts, ".credentials-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "username=%s\npassword=%s\n", username, password); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// homeIdle reports whether a network home is mounted but no session uses
+// it any more. The caller must hold sessionsMu, with the stopping session
+// already removed.
+func homeIdle(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	for _, s := range sessions {
+		if s.HomeMount == dir {
+			return false
+		}
+	}
+	return true
+}
+
+// unmountHome unmounts a network home found idle by homeIdle. umount can
+// hang on an unreachable filer, so it runs without sessionsMu held.
+func unmountHome(dir string) {
+	execRun(context.Background(), "umount", "-l", dir)
+	os.Remove(dir)
+}
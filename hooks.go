@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sites can run their own scripts as sessions start and stop (registering
+// DNS, notifying a CMDB, mounting extra storage) without patching the
+// gateway. Each hook is a shell command from the gateway config:
+//
+//	hook_pre_start   before anything is mounted; failing stops the start
+//	hook_post_start  once the container is running
+//	hook_pre_stop    before the container is removed
+//	hook_post_stop   once everything is torn down (also after a start that
+//	                 failed past hook_pre_start, with reason start_failed)
+//
+// Hooks get the session in LG_* environment variables and as JSON on
+// standard input, and may run for hook_timeout. Only hook_pre_start can
+// change what happens; the others' failures are logged.
+
+var (
+	hookPreStart  = ""
+	hookPostStart = ""
+	hookPreStop   = ""
+	hookPostStop  = ""
+	hookTimeout   = 30 * time.Second
+)
+
+// hookEvent is what a hook is told about the session.
+type hookEvent struct {
+	Hook      string `json:"hook"`
+	Session   string `json:"session"`
+	Username  string `json:"user"`
+	Desktop   string `json:"desktop,omitempty"`
+	Container string `json:"container,omitempty"` // Not yet named before the start
+	Port      int    `json:"port,omitempty"`
+	Overlay   string `json:"overlay,omitempty"`
+	Guest     bool   `json:"guest"`
+	Image     string `json:"image,omitempty"`
+	Remote    string `json:"remote,omitempty"` // Starts only
+	Reason    string `json:"reason,omitempty"` // Stops only: one of the end* codes, or start_failed
+}
+
+// sessionHookEvent describes a running session to a hook.
+func sessionHookEvent(s Session, reason string) hookEvent {
+	return hookEvent{
+		Session:   s.ID,
+		Username:  s.Username,
+		Desktop:   s.Desktop,
+		Container: s.ContainerName,
+		Port:      s.Port,
+		Overlay:   s.OverlayDir,
+		Guest:     s.Ephemeral,
+		Reason:    reason,
+	}
+}
+
+// env returns the event as LG_* variables.
+func (ev hookEvent) env() []string {
+	return []string{
+		"LG_HOOK=" + ev.Hook,
+		"LG_SESSION=" + ev.Session,
+		"LG_USER=" + ev.Username,
+		"LG_DESKTOP=" + ev.Desktop,
+		"LG_CONTAINER=" + ev.Container,
+		"LG_PORT=" + strconv.Itoa(ev.Port),
+		"LG_OVERLAY=" + ev.Overlay,
+		"LG_GUEST=" + strconv.FormatBool(ev.Guest),
+		"LG_IMAGE=" + ev.Image,
+		"LG_REMOTE=" + ev.Remote,
+		"LG_REASON=" + ev.Reason,
+	}
+}
+
+// runHook runs a hook command, if one is set, returning an error that
+// includes what it printed if it fails.
+func runHook(ctx context.Context, name, command string, ev hookEvent) error {
+	if command == "" {
+		return nil
+	}
+	ev.Hook = name
+	input, _ := json.Marshal(ev)
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), ev.env()...)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s hook: timed out after %v", name, hookTimeout)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%s hook: %w", name, ctx.Err())
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%s hook: %w: %s", name, err, msg)
+	}
+	return fmt.Errorf("%s hook: %w", name, err)
+}
+
+// logHook runs a hook whose failure changes nothing, logging it.
+func logHook(ctx context.Context, name, command string, ev hookEvent) {
+	if err := runHook(ctx, name, command, ev); err != nil {
+		log.Printf("Session %s: %v", ev.Session, err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Existing machines (lab PCs, Windows VMs nobody wants containerised) can
+// be brokered too, as [host <name>] sections, either in the gateway config
+// for the users and groups listed (everyone, without either, as for
+// catalog images), or in a user's own config for that user alone:
+//
+//	[host lab-pc-07]
+//	title = Lab PC 7 (GPU)
+//	protocol = vnc
+//	address = lab-pc-07.example.ac.uk:5900
+//	vnc_password = file:/etc/lookingglass/lab-vnc-password
+//	groups = physics
+//
+// They are offered in the desktop chooser as host:<name>. A VNC host's
+// server is bridged straight to the session (see console.go), with no
+// container or overlay; its vnc_password, if it has one, is answered by the
+// gateway and never reaches the browser. An RDP host is reached through the
+// RDP client container (see rdp.go), with the section's rdp_username,
+// rdp_domain, rdp_password and rdp_options. A VNC host is used by one
+// session at a time unless it sets shared = true (Windows arbitrates RDP
+// logins itself). Logins, idle timeouts, sharing, recording and the audit
+// log treat these sessions as any other.
+
+const hostPrefix = "host:"
+
+// hostSection returns an external host's section: the user's own, else one
+// of the gateway config's.
+func (u *User) hostSection(name string) (*ini.Section, bool) {
+	if !desktopNameRe.MatchString(name) {
+		return nil, false
+	}
+	for _, f := range []*ini.File{u.file, gatewayCfg} {
+		if f == nil {
+			continue
+		}
+		if sec, err := f.GetSection("host " + name); err == nil {
+			return sec, true
+		}
+	}
+	return nil, false
+}
+
+// hosts returns the names of the external hosts u may connect to.
+func (u *User) hosts() []string {
+	var names []string
+	add := func(f *ini.File, entitled func(*ini.Section) bool) {
+		if f == nil {
+			return
+		}
+		for _, sec := range f.Sections() {
+			name, ok := strings.CutPrefix(sec.Name(), "host ")
+			if ok && desktopNameRe.MatchString(name) && !slices.Contains(names, name) && entitled(sec) {
+				names = append(names, name)
+			}
+		}
+	}
+	add(u.file, func(*ini.Section) bool { return true })
+	mine := u.groupNames()
+	add(gatewayCfg, func(sec *ini.Section) bool {
+		groups, users := sec.Key("groups").Strings(","), sec.Key("users").Strings(",")
+		return len(groups) == 0 && len(users) == 0 || sharesGroup(groups, mine) || slices.Contains(users, u.Name)
+	})
+	return names
+}
+
+// forHost returns the user as seen by one of their external hosts.
+func (u *User) forHost(name string) (*User, error) {
+	sec, ok := u.hostSection(name)
+	if !ok || !slices.Contains(u.hosts(), name) {
+		return nil, errUnknownDesktop
+	}
+	d := *u
+	d.Desktop, d.desk = hostPrefix+name, sec
+	return &d, nil
+}
+
+// externalHost returns the protocol and address of the external host u's
+// desktop is, if it is one. Both are read from the host's own section, not
+// inherited from the user's settings.
+func (u *User) externalHost() (protocol, address string, ok bool) {
+	if !strings.HasPrefix(u.Desktop, hostPrefix) || u.desk == nil {
+		return "", "", false
+	}
+	protocol = u.desk.Key("protocol").In("vnc", []string{"vnc", "rdp"})
+	address = u.desk.Key("address").String()
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "5900"
+		if protocol == "rdp" {
+			port = "3389"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	return protocol, address, true
+}
+
+// hostTitle returns an external host's title for the chooser.
+func hostTitle(u *User, name string) string {
+	if sec, ok := u.hostSection(name); ok && sec.Key("title").String() != "" {
+		return sec.Key("title").String()
+	}
+	return name
+}
+
+// containerless reports whether a session runs without a desktop container
+// of its own (in a VM, or on an external VNC host), and so without an
+// overlay, exchange directory or in-container agent.
+func (s Session) containerless() bool {
+	return s.VM != "" || s.Target != ""
+}
+
+// startHostSession is startSession for an external VNC host.
+func startHostSession(ctx context.Context, u *User, address, remote, sharingPolicy, clientCert, trace string) (sessionID string, err error) {
+	password, err := resolveSecret(u.desk.Key("vnc_password").String())
+	if err != nil {
+		return "", &startError{500, "Config error: vnc_password: " + err.Error()}
+	}
+	if !u.desk.Key("shared").MustBool(false) {
+		sessionsMu.RLock()
+		for _, s := range sessions {
+			if s.Target == address {
+				sessionsMu.RUnlock()
+				return "", &startError{409, "Host " + address + " is in use by " + s.Username}
+			}
+		}
+		sessionsMu.RUnlock()
+	}
+
+	id := newSessionID()
+	ev := hookEvent{Session: id, Username: u.Name, Desktop: u.Desktop, Image: "vnc://" + address, Remote: remote}
+	if err := runHook(ctx, "pre_start", hookPreStart, ev); err != nil {
+		return "", &startError{500, err.Error()}
+	}
+	defer func() {
+		if err != nil {
+			ev.Reason = "start_failed"
+			logHook(context.Background(), "post_stop", hookPostStop, ev)
+		}
+	}()
+
+	progress(ctx, "container")
+	err = timeStep(ctx, "host.connect", func(sp *span) error {
+		sp.set("host", address)
+		conn, _, err := hostConsole(address, password)(ctx)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return "", &startError{502, "Host " + address + " not reachable: " + err.Error()}
+	}
+
+	sessionID = id
+	var port int
+	err = retry(ctx, "Bridging "+address, func() error {
+		port = randomPort()
+		return startConsoleBridge(sessionID, port, hostConsole(address, password))
+	})
+	if err != nil {
+		return "", &startError{500, "Failed to bridge host: " + err.Error()}
+	}
+
+	idleTimeout, maxLifetime := sessionLimits(u, false)
+	sessionsMu.Lock()
+	sessions[sessionID] = withViewOnly(u, Session{
+		ID:              sessionID,
+		Username:        u.Name,
+		Desktop:         u.Desktop,
+		Image:           "vnc://" + address,
+		Target:          address,
+		Port:            port,
+		LastActive:      time.Now(),
+		OwnerToken:      newAgentToken(),
+		ClipboardPolicy: "none",
+		SharingPolicy:   sharingPolicy,
+		Record:          u.settingKey("record").MustBool(false),
+		StartedAt:       time.Now(),
+		IdleTimeout:     idleTimeout,
+		MaxLifetime:     maxLifetime,
+		IdleAction:      "stop",
+		Scan:            "none",
+		ClientCert:      clientCert,
+		Trace:           trace,
+		LockAfter:       u.settingKey("lock_on_disconnect").MustDuration(0),
+	})
+	saveSessions()
+	sessionsMu.Unlock()
+	audit("session.start", u.Name, sessionID, map[string]string{"host": address, "remote": remote})
+	ev.Port = port
+	logHook(ctx, "post_start", hookPostStart, ev)
+	return sessionID, nil
+}
+
+// restoredHostConsole returns a restored session's external VNC host, its
+// password read from the host's section again.
+func restoredHostConsole(s Session) (consoleDialer, error) {
+	u, err := loadUser(s.Username)
+	if err == nil {
+		u, err = u.forDesktop(s.Desktop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	password, err := resolveSecret(u.desk.Key("vnc_password").String())
+	if err != nil {
+		return nil, err
+	}
+	return hostConsole(s.Target, password), nil
+}
+
+// hostConsole returns an external VNC host's server, for
+// startConsoleBridge.
+func hostConsole(address, password string) consoleDialer {
+	return func(ctx context.Context) (io.ReadWriteCloser, string, error) {
+		d := net.Dialer{Timeout: 10 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, "", fmt.Errorf("connecting to %s: %w", address, err)
+		}
+		return conn, password, nil
+	}
+}
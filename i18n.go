@@ -0,0 +1,106 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// The web UI is translated through the language packs in lang/, one ini
+// file per language holding message keys. Pages are rendered in the best
+// match for the browser's Accept-Language, and any key missing from a pack
+// falls back to English.
+
+//go:embed lang/*.ini
+var langFiles embed.FS
+
+var (
+	defaultLanguage = "en"
+	languages       map[string]map[string]string // language -> key -> message
+)
+
+// loadLanguages reads the built-in language packs.
+func loadLanguages() error {
+	names, err := fs.Glob(langFiles, "lang/*.ini")
+	if err != nil {
+		return err
+	}
+	packs := make(map[string]map[string]string)
+	for _, n := range names {
+		data, err := langFiles.ReadFile(n)
+		if err != nil {
+			return err
+		}
+		// Messages may contain ';' and '#', which ini otherwise takes as comments
+		cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", n, err)
+		}
+		packs[strings.TrimSuffix(path.Base(n), ".ini")] = cfg.Section("").KeysHash()
+	}
+	if packs["en"] == nil {
+		return fmt.Errorf("no English language pack")
+	}
+	if packs[defaultLanguage] == nil {
+		return fmt.Errorf("unknown default_language %q", defaultLanguage)
+	}
+	languages = packs
+	return nil
+}
+
+// requestLanguage picks the language pack best matching the request's
+// Accept-Language header.
+func requestLanguage(r *http.Request) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, pref{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		// "de-AT" is served by the "de" pack
+		primary, _, _ := strings.Cut(p.tag, "-")
+		if languages[primary] != nil {
+			return primary
+		}
+	}
+	return defaultLanguage
+}
+
+// translate returns the message for key in lang, formatted with args.
+func translate(lang, key string, args ...any) string {
+	msg, ok := languages[lang][key]
+	if !ok {
+		if msg, ok = languages["en"][key]; !ok {
+			msg = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// tr translates a message for the language of request r.
+func tr(r *http.Request, key string, args ...any) string {
+	return translate(requestLanguage(r), key, args...)
+}
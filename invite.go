@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// An invitation gives someone without an account a guest desktop: a
+// one-time /invite/<token> link that starts an ephemeral desktop on a given
+// image for a fixed time. Users may invite guests from their profile page
+// onto the images listed in their invite_images setting, for up to
+// invite_max_duration (default 2h); the guest's other settings come from
+// the [role <name>] named by the inviter's invite_role. Admins mint
+// invitations for any image through POST /admin/invites. A link that is
+// not used within its validity (default a day) lapses, and every invite
+// and redemption is audited.
+
+var (
+	invitesPath = "/srv/overlays/invites.json" // Pending invitations
+	invites     = make(map[string]*Invite)     // token -> invitation
+	invitesMu   sync.Mutex
+)
+
+const (
+	defaultInviteDuration = time.Hour
+	defaultInviteValidity = 24 * time.Hour
+	maxInviteValidity     = 30 * 24 * time.Hour
+)
+
+var errUnknownInvite = errors.New("no such invitation")
+
+// Invite is an unused invitation.
+type Invite struct {
+	Token    string        `json:"token"`
+	Image    string        `json:"image"`
+	Duration time.Duration `json:"duration"`       // How long the guest's desktop runs
+	Role     string        `json:"role,omitempty"` // Role the guest's settings come from
+	By       string        `json:"by"`             // Who invited the guest
+	Created  time.Time     `json:"created"`
+	Expires  time.Time     `json:"expires"` // When the link lapses unused
+}
+
+// loadInvites reads pending invitations at startup.
+func loadInvites() error {
+	data, err := os.ReadFile(invitesPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Invite
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+	for _, inv := range list {
+		invites[inv.Token] = inv
+	}
+	return nil
+}
+
+// saveInvites writes pending invitations, dropping lapsed ones. The caller
+// must hold invitesMu.
+func saveInvites() {
+	list := make([]*Invite, 0, len(invites))
+	for token, inv := range invites {
+		if time.Now().After(inv.Expires) {
+			delete(invites, token)
+			continue
+		}
+		list = append(list, inv)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := invitesPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, invitesPath)
+		}
+	}
+	if err != nil {
+		log.Printf("Saving invitations: %v", err)
+	}
+}
+
+// createInvite mints an invitation.
+func createInvite(image string, duration, validity time.Duration, role, by string) (*Invite, error) {
+	if image == "" {
+		return nil, errors.New("no image given")
+	}
+	if duration <= 0 {
+		return nil, errors.New("duration must be positive")
+	}
+	if validity <= 0 || validity > maxInviteValidity {
+		return nil, fmt.Errorf("valid_for must be positive and at most %v", maxInviteValidity)
+	}
+	if role != "" {
+		if _, err := gatewayCfg.GetSection("role " + role); err != nil {
+			return nil, fmt.Errorf("no [role %s] section in %s", role, configPath)
+		}
+	}
+	inv := &Invite{
+		Token: newAgentToken(), Image: image, Duration: duration, Role: role,
+		By: by, Created: time.Now(), Expires: time.Now().Add(validity),
+	}
+	invitesMu.Lock()
+	invites[inv.Token] = inv
+	saveInvites()
+	invitesMu.Unlock()
+	audit("invite.create", by, "", map[string]string{
+		"image": image, "duration": duration.String(), "expires": inv.Expires.UTC().Format(time.RFC3339),
+	})
+	return inv, nil
+}
+
+// lookupInvite returns an unused, unexpired invitation.
+func lookupInvite(token string) (*Invite, bool) {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+	inv, ok := invites[token]
+	if !ok || time.Now().After(inv.Expires) {
+		return nil, false
+	}
+	return inv, true
+}
+
+// takeInvite uses up an invitation, reporting whether it was still valid.
+func takeInvite(token string) (*Invite, bool) {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+	inv, ok := invites[token]
+	if !ok || time.Now().After(inv.Expires) {
+		return nil, false
+	}
+	delete(invites, token)
+	saveInvites()
+	return inv, true
+}
+
+// guestUser returns the account-less user an invitation's guest runs as.
+func guestUser(inv *Invite) *User {
+	cfg := ini.Empty()
+	sec := cfg.Section("user")
+	sec.Key("overlay").SetValue("ephemeral")
+	sec.Key("image").SetValue(inv.Image)
+	sec.Key("max_lifetime").SetValue(inv.Duration.String())
+	u := &User{Name: "guest-" + randSeq(8), file: cfg, conf: sec}
+	if inv.Role != "" {
+		u.role, _ = gatewayCfg.GetSection("role " + inv.Role)
+	}
+	return u
+}
+
+// inviteOptions returns the images u may invite guests onto, and for how
+// long at most. Users without invite_images can't invite anyone.
+func inviteOptions(u *User) ([]string, time.Duration) {
+	return u.settingKey("invite_images").Strings(","), u.settingKey("invite_max_duration").MustDuration(2 * time.Hour)
+}
+
+// inviteHandler serves /invite/{token}: GET shows the invitation, and
+// POST starts the guest's desktop. Starting it takes a click so that link
+// previews and scanners don't use invitations up.
+func inviteHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	if r.Method != http.MethodPost {
+		inv, ok := lookupInvite(token)
+		if !ok {
+			httpError(w, r, 404, "error.share_expired")
+			return
+		}
+		renderTemplate(w, r, "invite.html", map[string]any{
+			"Token":    token,
+			"By":       inv.By,
+			"Duration": formatDuration(inv.Duration),
+		})
+		return
+	}
+	inv, ok := takeInvite(token)
+	if !ok {
+		httpError(w, r, 404, "error.share_expired")
+		return
+	}
+	g := guestUser(inv)
+	audit("invite.redeem", inv.By, "", map[string]string{"guest": g.Name, "image": inv.Image, "remote": r.RemoteAddr})
+	openDesktop(w, r, g, "")
+}
+
+// profileInvite handles POST /profile/invite, where a user invites a guest
+// onto one of their invite_images for up to invite_max_duration.
+func profileInvite(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	images, maxDuration := inviteOptions(u)
+	image := r.FormValue("image")
+	if !slices.Contains(images, image) {
+		httpError(w, r, 403, "error.invite_not_allowed")
+		return
+	}
+	minutes, err := strconv.Atoi(r.FormValue("minutes"))
+	duration := time.Duration(minutes) * time.Minute
+	if err != nil || duration <= 0 || duration > maxDuration {
+		httpError(w, r, 400, "error.invalid_duration")
+		return
+	}
+	inv, err := createInvite(image, duration, defaultInviteValidity, u.setting("invite_role"), u.Name)
+	if err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	http.Redirect(w, r, "/profile?invite="+inv.Token, 303)
+}
+
+// adminCreateInvite handles POST /admin/invites with a JSON body of
+// {"image": ..., "duration": "1h", "valid_for": "24h", "role": ..., "by": ...}.
+func adminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Image    string `json:"image"`
+		Duration string `json:"duration"`
+		ValidFor string `json:"valid_for"`
+		Role     string `json:"role"`
+		By       string `json:"by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	duration, validity := defaultInviteDuration, defaultInviteValidity
+	var err error
+	if req.Duration != "" {
+		if duration, err = time.ParseDuration(req.Duration); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+	}
+	if req.ValidFor != "" {
+		if validity, err = time.ParseDuration(req.ValidFor); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+	}
+	if req.Image == "" {
+		req.Image = defaultImage
+	}
+	if req.By == "" {
+		req.By = "admin"
+	}
+	inv, err := createInvite(req.Image, duration, validity, req.Role, req.By)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	writeJSON(w, 201, map[string]string{
+		"url":     "/invite/" + inv.Token,
+		"token":   inv.Token,
+		"expires": inv.Expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// adminListInvites handles GET /admin/invites.
+func adminListInvites(w http.ResponseWriter, r *http.Request) {
+	invitesMu.Lock()
+	list := make([]*Invite, 0, len(invites))
+	for _, inv := range invites {
+		if time.Now().Before(inv.Expires) {
+			list = append(list, inv)
+		}
+	}
+	invitesMu.Unlock()
+	slices.SortFunc(list, func(a, b *Invite) int { return a.Created.Compare(b.Created) })
+	writeJSON(w, 200, list)
+}
+
+// adminRevokeInvite handles DELETE /admin/invites/{token}.
+func adminRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	invitesMu.Lock()
+	inv, ok := invites[token]
+	if ok {
+		delete(invites, token)
+		saveInvites()
+	}
+	invitesMu.Unlock()
+	if !ok {
+		writeJSONError(w, 404, errUnknownInvite)
+		return
+	}
+	audit("invite.revoke", inv.By, "", map[string]string{"image": inv.Image, "actor": "admin"})
+	w.WriteHeader(204)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deep links start an app profile (see apps.go), or a catalog image as
+// image:<name> (see catalog.go), straight from another site, such as an
+// intranet page:
+//
+//	/launch/crm?sig=<hex>[&expires=<unix time>]
+//
+// sig is the hex HMAC-SHA256, keyed with launch_key, of the profile name,
+// or of "<profile>\n<expires>" for a link that stops working at expires.
+// "lookingglass launch link" prints one. Following a link logs the user in
+// first if need be, then opens the app's session (starting it if it isn't
+// running) as the chooser would, if they are entitled to it. Without
+// launch_key, deep links are disabled.
+
+var launchKey = "" // HMAC key for /launch/ links ("" = disabled)
+
+// launchSignature returns the signature of a link to profile.
+func launchSignature(key, profile string, expires int64) string {
+	msg := profile
+	if expires > 0 {
+		msg += "\n" + strconv.FormatInt(expires, 10)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// launchLink returns a signed link path for profile, expiring after ttl
+// unless it is 0.
+func launchLink(key, profile string, ttl time.Duration) string {
+	q := url.Values{}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+		q.Set("expires", strconv.FormatInt(expires, 10))
+	}
+	q.Set("sig", launchSignature(key, profile, expires))
+	return "/launch/" + url.PathEscape(profile) + "?" + q.Encode()
+}
+
+// verifyLaunch checks a /launch/ link, given as a request URI, returning
+// the profile it names.
+func verifyLaunch(uri string) (string, error) {
+	secretsMu.RLock()
+	key := launchKey
+	secretsMu.RUnlock()
+	if key == "" {
+		return "", errors.New("deep links are disabled")
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	profile, ok := strings.CutPrefix(u.Path, "/launch/")
+	if !ok || profile == "" {
+		return "", errors.New("not a launch link")
+	}
+	var expires int64
+	if e := u.Query().Get("expires"); e != "" {
+		if expires, err = strconv.ParseInt(e, 10, 64); err != nil {
+			return "", err
+		}
+		if time.Now().Unix() > expires {
+			return "", errors.New("link has expired")
+		}
+	}
+	want := launchSignature(key, profile, expires)
+	if !hmac.Equal([]byte(u.Query().Get("sig")), []byte(want)) {
+		return "", errors.New("bad signature")
+	}
+	return profile, nil
+}
+
+// launchHandler serves GET /launch/{profile}.
+func launchHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := verifyLaunch(r.URL.RequestURI()); err != nil {
+		httpError(w, r, 404, "error.not_found")
+		return
+	}
+	u, ok := loggedInUser(r)
+	if !ok {
+		// Back here through the login form
+		renderTemplate(w, r, "login.html", map[string]any{"Launch": r.URL.RequestURI()})
+		return
+	}
+	launchApp(w, r, u, r.PathValue("profile"), "")
+}
+
+// launchApp takes a logged-in user to an app profile's or catalog image's
+// session.
+func launchApp(w http.ResponseWriter, r *http.Request, u *User, profile, password string) {
+	var d *User
+	var err error
+	if image, ok := strings.CutPrefix(profile, imagePrefix); ok {
+		d, err = u.forImage(image)
+	} else {
+		d, err = u.forApp(profile)
+	}
+	if err != nil {
+		httpError(w, r, 403, "error.app_not_allowed")
+		return
+	}
+	if _, running := findDesktopSession(u.Name, d.Desktop); !running && password == "" && d.setting("encryption") == "fscrypt" {
+		// Its overlay needs the password; the chooser asks for it
+		http.Redirect(w, r, "/desktops", 302)
+		return
+	}
+	audit("session.launch", u.Name, "", map[string]string{"app": profile, "remote": r.RemoteAddr})
+	openDesktop(w, r, d, password)
+}
+
+// launchLinkCommand prints a signed deep link.
+func launchLinkCommand(args []string) error {
+	fs := commandFlags("launch link")
+	ttl := fs.Duration("ttl", 0, "how long the link works for (0 = no expiry)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("launch link takes one app profile")
+	}
+	if launchKey == "" {
+		return errors.New("launch_key is not set")
+	}
+	if _, ok := appSection(fs.Arg(0)); !ok {
+		return fmt.Errorf("no [app %s] section in %s", fs.Arg(0), configPath)
+	}
+	fmt.Println(launchLink(launchKey, fs.Arg(0), *ttl))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// Idle timeouts and maximum lifetimes are set gateway-wide, with separate
+// (shorter) defaults for guests, and can be overridden per role or per user
+// with idle_timeout and max_lifetime.
+
+var (
+	maxSessionLifetime = time.Duration(0) // Hard cap on session length (0 = none)
+	guestSessionExpiry = 5 * time.Minute  // Idle timeout for guest sessions
+	guestMaxLifetime   = 2 * time.Hour    // Hard cap on guest session length
+)
+
+// sessionLimits returns the idle timeout and maximum lifetime (0 = none)
+// for a new session of u.
+func sessionLimits(u *User, ephemeral bool) (idle, lifetime time.Duration) {
+	idle, lifetime = sessionExpiry, maxSessionLifetime
+	if ephemeral {
+		idle, lifetime = guestSessionExpiry, guestMaxLifetime
+	}
+	idle = u.settingKey("idle_timeout").MustDuration(idle)
+	lifetime = u.settingKey("max_lifetime").MustDuration(lifetime)
+	return idle, lifetime
+}
+
+// endsAt returns when a session reaches its maximum lifetime, or the zero
+// time if it has none.
+func (s Session) endsAt() time.Time {
+	if s.MaxLifetime <= 0 {
+		return time.Time{}
+	}
+	return s.StartedAt.Add(s.MaxLifetime)
+}
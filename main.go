@@ -1,4 +1,5 @@
 package main
+
 /**
 LookingGlass - (c) 2024-2026 Andy Dixon <lookingglass@andydixon.com>
 
@@ -21,297 +22,1268 @@ You should have received a copy of the GNU General Public License along with Loo
 // - Cleans up idle sessions automatically
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"html/template"
 	"log"
+	"math/big"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
-
-	"gopkg.in/ini.v1"
 )
 
 // Session holds information about a running user desktop.
 type Session struct {
-	Username      string    // The user this session belongs to
-	ContainerName string    // The Docker container name
-	OverlayDir    string    // Overlay base path (/srv/overlays/<user>)
-	Port          int       // Random port bound for noVNC
-	LastActive    time.Time // Timestamp for last activity
-	Ephemeral     bool      // Whether this session is guest/ephemeral
+	ID              string            // The session ID, as used in URLs
+	Username        string            // The user this session belongs to
+	Desktop         string            // The user's named desktop ("" if they have just one)
+	ContainerName   string            // The Docker container name
+	Image           string            // The image it runs (a VM's template, an external host's URL)
+	OverlayDir      string            // Overlay base path (/srv/overlays/<user>)
+	Port            int               // Random port bound for noVNC
+	LastActive      time.Time         // Timestamp for last activity
+	Ephemeral       bool              // Whether this session is guest/ephemeral
+	Encrypted       bool              // Whether the overlay is fscrypt-encrypted
+	Base            string            // Base rootfs version mounted as lowerdir
+	ExchangeDir     string            // Host dir shared with the desktop for file transfer
+	AgentToken      string            // Bearer token for the in-container agent
+	OwnerToken      string            // Owner cookie value of the browser the session belongs to
+	ClipboardPolicy string            // Clipboard directions allowed: both, in, out or none
+	FilePolicy      string            // File transfer directions allowed: both, upload, download or none
+	SharingPolicy   string            // Share links allowed: control, view or none
+	Snapshots       int               // Snapshots the owner may keep (0 = may not take any)
+	Record          bool              // Record VNC traffic for compliance
+	ExpiresAt       time.Time         // When an idle session will be killed (zero = not expiring)
+	StartedAt       time.Time         // When the session was created
+	IdleTimeout     time.Duration     // Idle time before the session starts expiring
+	MaxLifetime     time.Duration     // Hard cap on the session's length (0 = none)
+	ReservedUntil   time.Time         // Pre-started by a booking, held unclaimed until then
+	ClaimToken      string            // Token of the session's one-time claim link ("" = none)
+	ClaimExpires    time.Time         // When the claim link stops working
+	Labels          map[string]string // Free-form labels set through the admin API
+	RunArgs         []string          // docker run arguments after the port and name
+	IdleAction      string            // What idling does: "stop" or "suspend"
+	Suspended       bool              // Container stopped for idling; woken on next use
+	Held            bool              // Suspended after an anomaly; not woken until acknowledged
+	Restarts        int               // Times the container was restarted after crashing
+	RecentCrashes   int               // Crashes within crashWindow of LastCrash
+	LastCrash       time.Time         // When the container last crashed
+	PrintDir        string            // Host dir the desktop's PDF printer writes to ("" = no printing)
+	Controls        SessionControls   // Keyboard, quality and view-only settings from the session page
+	Quota           int64             // Storage quota in bytes (0 = none)
+	LastInput       time.Time         // Last keyboard or mouse input the agent saw (zero = no reports)
+	Egress          Egress            // Network destinations the desktop may reach
+	HomeMount       string            // Where the gateway mounted the user's network home ("" = none)
+	ClientCert      string            // Name the owner's TLS client certificate must carry ("" = none needed)
+	Trace           string            // W3C traceparent of the span that started the session ("" = untraced)
+	FirstByte       time.Time         // When noVNC first answered through the proxy
+	Scan            string            // What the malware scanner checks: uploads, logout or none
+	VM              string            // The virtual machine the session runs in, instead of a container ("" = none)
+	Terminal        bool              // A shell in a web terminal rather than a desktop
+	Target          string            // The external VNC host the session is bridged to ("" = none)
+	Watermark       string            // Text overlaid on the desktop, before {ip} and {time} are filled in
+	ClientAddr      string            // Address the owner last connected from, for the watermark
+	ViewOnlyLocked  bool              // Started view-only (view_only = true); the owner can't take control
+	LockAfter       time.Duration     // Lock the screen this long after the owner disconnects (0 = never)
+	ScreenLocked    bool              // Locked after the owner disconnected; the owner must log in again
 }
 
 var (
-	userConfDir   = "./users"        // Directory containing <username>.conf
-	templatesDir  = "./templates"    // Directory with HTML templates
-	baseOverlay   = "/srv/overlays/base" // Extracted base rootfs
-	sessions      = make(map[string]Session)
-	sessionsMu    sync.Mutex
-	sessionExpiry = 10 * time.Minute // Idle timeout
+	configPath     = "./lookingglass.conf" // Gateway config file
+	listenAddr     = ":8081"               // HTTP listen address
+	userConfDir    = "./users"             // Directory containing <username>.conf
+	templatesDir   = "./templates"         // Directory of HTML templates overriding the built-in ones
+	baseOverlay    = "/srv/overlays/base"  // Extracted base rootfs
+	overlayRoot    = "/srv/overlays"       // Parent directory for guest overlays
+	defaultImage   = "ubuntu-xfce-novnc"   // Desktop image unless a user or role sets one
+	guestTmpfsSize = "2g"                  // tmpfs size for guest overlays ("" = on disk)
+	sessions       = make(map[string]Session)
+	sessionsMu     sync.RWMutex
+	sessionExpiry  = 10 * time.Minute // Idle timeout
+	idleGrace      = 2 * time.Minute  // Warning period before an idle session is killed
 )
 
 func main() {
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		configPath = path
+	}
+	flag.StringVar(&configPath, "config", configPath, "path to the gateway config file")
+	verifyAudit := flag.Bool("verify-audit", false, "verify the audit log hash chain and exit (audit verify)")
+	check := flag.Bool("check", false, "validate the deployment and exit (config check)")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	switch {
+	case *check:
+		args = []string{"config", "check"}
+	case *verifyAudit:
+		args = []string{"audit", "verify"}
+	case len(args) == 0:
+		args = []string{"serve"}
+	}
+	if err := runCommand(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serveCommand runs the gateway.
+func serveCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New("serve takes no arguments")
+	}
+	if err := openAuditLog(); err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	if err := openAuthLog(); err != nil {
+		return fmt.Errorf("opening auth log: %w", err)
+	}
+	if err := loadLanguages(); err != nil {
+		return fmt.Errorf("loading language packs: %w", err)
+	}
+	if err := loadTemplates(); err != nil {
+		return fmt.Errorf("loading templates: %w", err)
+	}
+	if err := waitForDocker(); err != nil {
+		return fmt.Errorf("reaching Docker: %w", err)
+	}
+	if err := restoreSessions(); err != nil {
+		return fmt.Errorf("restoring sessions: %w", err)
+	}
+	if err := loadBookings(); err != nil {
+		return fmt.Errorf("loading bookings: %w", err)
+	}
+	if err := loadInvites(); err != nil {
+		return fmt.Errorf("loading invitations: %w", err)
+	}
+	if err := startCluster(); err != nil {
+		return fmt.Errorf("joining the cluster: %w", err)
+	}
+	if manifestsDir != "" {
+		if _, err := reloadManifests(); err != nil {
+			return fmt.Errorf("applying manifests: %w", err)
+		}
+	}
+
 	// HTTP routes
 	http.HandleFunc("/", loginForm)
 	http.HandleFunc("/login", login)
 	http.HandleFunc("/session/", session)
 	http.HandleFunc("/logout/", logout)
 	http.HandleFunc("/ping/", ping)
+	http.HandleFunc("/status/", status)
+	http.HandleFunc("/extend/", extend)
+	http.HandleFunc("/reset/", resetHandler)
 	http.HandleFunc("/proxy/", proxyHandler)
+	http.Handle("/novnc/", novncHandler())
+	http.HandleFunc("/files/", filesHandler)
+	http.HandleFunc("/print/", printHandler)
+	http.HandleFunc("/dav/", davHandler)
+	http.HandleFunc("/clipboard/", clipboardHandler)
+	http.HandleFunc("/controls/", controlsHandler)
+	http.HandleFunc("/resize/", resizeHandler)
+	http.HandleFunc("/share/", shareHandler)
+	http.HandleFunc("/snapshot/", snapshotHandler)
+	http.HandleFunc("/join/", join)
+	http.HandleFunc("GET /claim/{session}/{token}", claimHandler)
+	http.HandleFunc("/invite/{token}", inviteHandler)
+	http.HandleFunc("/shadow/", shadowHandler)
+	http.HandleFunc("/book", book)
+	http.HandleFunc("GET /launch/{profile}", launchHandler)
+	http.HandleFunc("/desktops", desktopsPage)
+	http.HandleFunc("POST /desktops/{name}/open", desktopOpen)
+	http.HandleFunc("POST /desktops/{name}/stop", desktopStop)
+	http.HandleFunc("POST /desktops/logout", desktopsLogout)
+	http.HandleFunc("/profile", profilePage)
+	http.HandleFunc("POST /profile/wipe", profileWipe)
+	http.HandleFunc("GET /profile/archive", profileArchive)
+	http.HandleFunc("POST /profile/invite", profileInvite)
+	http.HandleFunc("/queue/", queueStatus)
 
-	// Background cleanup goroutine
-	go cleanupLoop()
+	// In-container agent API
+	http.HandleFunc("/agent/clipboard", agentClipboard)
+	http.HandleFunc("POST /agent/activity", agentActivity)
+	http.HandleFunc("GET /agent/policy", agentPolicy)
+	http.HandleFunc("GET /agent/watermark", agentWatermark)
 
-	log.Println("Gateway running on :8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
-}
+	// Admin API
+	http.HandleFunc("POST /admin/users", adminOnly(adminImportUsers))
+	http.HandleFunc("GET /scim/v2/Users", scimOnly(scimListUsers))
+	http.HandleFunc("POST /scim/v2/Users", scimOnly(scimCreateUser))
+	http.HandleFunc("GET /scim/v2/Users/{id}", scimOnly(scimGetUser))
+	http.HandleFunc("PUT /scim/v2/Users/{id}", scimOnly(scimReplaceUser))
+	http.HandleFunc("PATCH /scim/v2/Users/{id}", scimOnly(scimPatchUser))
+	http.HandleFunc("DELETE /scim/v2/Users/{id}", scimOnly(scimDeleteUser))
+	http.HandleFunc("GET /scim/v2/ServiceProviderConfig", scimOnly(scimServiceProviderConfig))
+	http.HandleFunc("GET /admin/bases", adminOnly(adminListBases))
+	http.HandleFunc("POST /admin/bases", adminOnly(adminRegisterBase))
+	http.HandleFunc("POST /admin/bases/{name}/activate", adminOnly(adminActivateBase))
+	http.HandleFunc("DELETE /admin/bases/{name}", adminOnly(adminRetireBase))
+	http.HandleFunc("GET /admin/autoscale", adminOnly(adminAutoscale))
+	http.HandleFunc("GET /admin/images", adminOnly(adminListImages))
+	http.HandleFunc("GET /admin/images/builds", adminOnly(adminListBuilds))
+	http.HandleFunc("POST /admin/images/builds", adminOnly(adminStartBuild))
+	http.HandleFunc("GET /admin/images/builds/{id}", adminOnly(adminGetBuild))
+	http.HandleFunc("POST /admin/images/{name}/promote", adminOnly(adminPromoteImage))
+	http.HandleFunc("DELETE /admin/images/{name}/canary", adminOnly(adminWithdrawCanary))
+	http.HandleFunc("DELETE /admin/images/{name}", adminOnly(adminRemoveImage))
+	http.HandleFunc("GET /admin/recordings", adminOnly(adminListRecordings))
+	http.HandleFunc("GET /admin/recordings/{session}/{file}", adminOnly(adminGetRecording))
+	http.HandleFunc("DELETE /admin/recordings/{session}", adminOnly(adminDeleteRecording))
+	http.HandleFunc("GET /admin/sessions", adminOnly(adminListSessions))
+	http.HandleFunc("POST /admin/sessions", adminOnly(adminCreateSession))
+	http.HandleFunc("DELETE /admin/sessions", adminOnly(adminTerminateSessions))
+	http.HandleFunc("GET /admin/sessions/ended", adminOnly(adminListEndedSessions))
+	http.HandleFunc("GET /admin/sessions/ended/{id}", adminOnly(adminGetEndedSession))
+	http.HandleFunc("GET /admin/stats", adminOnly(adminStats))
+	http.HandleFunc("GET /admin/anomalies", adminOnly(adminListAnomalies))
+	http.HandleFunc("DELETE /admin/anomalies/{id}", adminOnly(adminAckAnomaly))
+	http.HandleFunc("DELETE /admin/sessions/{id}", adminOnly(adminTerminateSession))
+	http.HandleFunc("POST /admin/sessions/{id}/shadow", adminOnly(adminShadowSession))
+	http.HandleFunc("POST /admin/sessions/{id}/snapshot", adminOnly(adminSnapshotSession))
+	http.HandleFunc("DELETE /admin/sessions/{id}/shadow", adminOnly(adminEndShadow))
+	http.HandleFunc("GET /admin/bookings", adminOnly(adminListBookings))
+	http.HandleFunc("POST /admin/bookings", adminOnly(adminAddBooking))
+	http.HandleFunc("DELETE /admin/bookings/{id}", adminOnly(adminCancelBooking))
+	http.HandleFunc("GET /metrics", metricsOnly(metricsHandler))
+	http.HandleFunc("GET /admin/invites", adminOnly(adminListInvites))
+	http.HandleFunc("POST /admin/invites", adminOnly(adminCreateInvite))
+	http.HandleFunc("DELETE /admin/invites/{token}", adminOnly(adminRevokeInvite))
+	http.HandleFunc("POST /admin/manifests/reload", adminOnly(adminReloadManifests))
+
+	// Background cleanup goroutines
+	go cleanupLoop()
+	go guestGCLoop()
+	go recordingRetentionLoop()
+	go sessionRetentionLoop()
+	go autoscaleLoop()
+	go vmWatchLoop()
+	go bookingLoop()
+	startWorkerPool()
+	go queueLoop()
+	go secretRefreshLoop()
+	go crashWatchLoop()
+	go quotaLoop()
+	go traceExportLoop()
+	go manifestReloadLoop()
+	go anomalyLoop()
+	go geoipLoop()
+	go bouncerLoop()
 
-// renderTemplate loads an HTML template and renders it.
-func renderTemplate(w http.ResponseWriter, name string, data any) {
-	tmplPath := filepath.Join(templatesDir, name)
-	tmpl, err := template.ParseFiles(tmplPath)
+	ln, err := listen()
 	if err != nil {
-		http.Error(w, "Template error: "+err.Error(), 500)
-		return
+		return fmt.Errorf("listening: %w", err)
 	}
-	tmpl.Execute(w, data)
+	if err := startSSH(); err != nil {
+		return fmt.Errorf("SSH server: %w", err)
+	}
+	log.Printf("Gateway running on %s", ln.Addr())
+	sdNotify("READY=1\nSTATUS=Serving on " + ln.Addr().String())
+	go watchdogLoop()
+	return serveHTTP(ln, logRequests(recoverPanics(blockBadAddrs(clusterRoute(securityHeaders(http.DefaultServeMux))))))
 }
 
-// loginForm shows the login page.
+// loginForm shows the login page, and is the catch-all for unknown paths.
 func loginForm(w http.ResponseWriter, r *http.Request) {
-	renderTemplate(w, "login.html", nil)
+	if r.URL.Path != "/" {
+		httpError(w, r, 404, "error.not_found")
+		return
+	}
+	renderTemplate(w, r, "login.html", nil)
 }
 
 // login authenticates a user, mounts overlayfs, and starts a desktop container.
 func login(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form", 400)
+		httpError(w, r, 400, "error.invalid_form")
 		return
 	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-
-	confPath := filepath.Join(userConfDir, username+".conf")
-	if _, err := os.Stat(confPath); os.IsNotExist(err) {
-		http.Error(w, "Invalid user", 401)
+	if loginBlocked(r.RemoteAddr) {
+		audit("login.failed", username, "", map[string]string{"reason": "rate limited", "remote": r.RemoteAddr})
+		httpError(w, r, 429, "error.too_many_attempts")
+		return
+	}
+	if geoBlocked(w, r, username) {
+		return
+	}
+	if !validUsername(username) {
+		// Never logged or looked up as given: it could be a path or a forged log line
+		audit("login.failed", "", "", map[string]string{"reason": "invalid username", "remote": r.RemoteAddr})
+		loginFailed(r.RemoteAddr)
+		httpError(w, r, 401, "error.invalid_user")
+		return
+	}
+	if err := verifyCaptcha(r); err != nil {
+		audit("login.failed", username, "", map[string]string{"reason": "captcha", "remote": r.RemoteAddr})
+		log.Printf("CAPTCHA for %s from %s: %v", username, r.RemoteAddr, err)
+		httpError(w, r, 401, "error.captcha")
 		return
 	}
 
-	cfg, err := ini.Load(confPath)
+	u, err := loadUser(username)
+	if os.IsNotExist(err) {
+		audit("login.failed", username, "", map[string]string{"reason": "unknown user", "remote": r.RemoteAddr})
+		loginFailed(r.RemoteAddr)
+		httpError(w, r, 401, "error.invalid_user")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Config error", 500)
+		serverError(w, r, 500, err)
+		return
+	}
+	if !u.checkPassword(password) {
+		audit("login.failed", username, "", map[string]string{"reason": "bad password", "remote": r.RemoteAddr})
+		loginFailed(r.RemoteAddr)
+		httpError(w, r, 401, "error.invalid_credentials")
+		return
+	}
+	checkLoginCountry(r, u.Name)
+	if launch := r.FormValue("launch"); launch != "" {
+		// Logging in to follow a deep link
+		if profile, err := verifyLaunch(launch); err == nil {
+			startUserLogin(w, r, u.Name)
+			launchApp(w, r, u, profile, password)
+			return
+		}
+	}
+	if len(u.desktops()) > 0 || len(u.apps()) > 0 || len(u.catalog()) > 0 || len(u.hosts()) > 0 {
+		// Users with named desktops, apps, catalog images or hosts choose one next
+		startUserLogin(w, r, u.Name)
+		http.Redirect(w, r, "/desktops", 302)
+		return
+	}
+	if u.overlay() != "ephemeral" {
+		// Keeps the browser logged in to the profile page
+		startUserLogin(w, r, u.Name)
+	}
+	openDesktop(w, r, u, password)
+}
+
+// openDesktop takes an authenticated user to their desktop: one pre-started
+// by a booking, one already running elsewhere, or a new one, started in the
+// background behind a progress page (queueing if the gateway is full).
+func openDesktop(w http.ResponseWriter, r *http.Request, u *User, password string) {
+	ctx, sp := traceRequest(r, "login")
+	sp.set("user", u.Name)
+	sp.set("desktop", u.Desktop)
+	defer sp.finish()
+	u.Device = deviceClass(r)
+	if sessionID, ok := claimReserved(u.Name, u.Desktop); ok {
+		audit("session.claim", u.Name, sessionID, map[string]string{"remote": r.RemoteAddr})
+		handOff(w, r, sessionID, u)
+		http.Redirect(w, r, "/session/"+sessionID, 302)
+		return
+	}
+	if s, ok := findDesktopSession(u.Name, u.Desktop); ok && u.overlay() != "ephemeral" {
+		// Already running, perhaps in another browser or on another device
+		if s.ScreenLocked && loginBlocked(r.RemoteAddr) {
+			audit("login.failed", u.Name, s.ID, map[string]string{"reason": "rate limited", "remote": r.RemoteAddr})
+			httpError(w, r, 429, "error.too_many_attempts")
+			return
+		}
+		if s.ScreenLocked && !u.checkPassword(password) {
+			if password != "" {
+				audit("login.failed", u.Name, s.ID, map[string]string{"reason": "bad password", "remote": r.RemoteAddr})
+				loginFailed(r.RemoteAddr)
+			}
+			httpError(w, r, 401, "error.screen_locked")
+			return
+		}
+		handOff(w, r, s.ID, u)
+		http.Redirect(w, r, "/session/"+s.ID, 302)
+		return
+	}
+	if key, arg, err := accessDenied(u, time.Now()); err != nil {
+		serverError(w, r, 500, err)
+		return
+	} else if key != "" {
+		audit("login.denied", u.Name, "", map[string]string{"reason": "access policy", "remote": r.RemoteAddr, "desktop": u.Desktop})
+		httpError(w, r, 403, key, arg)
+		return
+	}
+	if end, closed := maintenanceClosed(time.Now()); closed {
+		httpError(w, r, 503, "error.maintenance", end.Format("15:04"))
+		return
+	}
+	if key, args, err := policyDenied(ctx, u, r); err != nil {
+		serverError(w, r, 503, err)
+		return
+	} else if key != "" {
+		audit("login.denied", u.Name, "", map[string]string{"reason": "policy", "remote": r.RemoteAddr, "desktop": u.Desktop})
+		httpError(w, r, 403, key, args...)
+		return
+	}
+	if u.overlay() == "ephemeral" && !takeGuestQuota(r.RemoteAddr) {
+		audit("login.denied", u.Name, "", map[string]string{"reason": "guest quota", "remote": r.RemoteAddr})
+		guestQuotaPage(w, r)
 		return
 	}
-	if cfg.Section("user").Key("password").String() != password {
-		http.Error(w, "Invalid credentials", 401)
+	if !reserveSlot(false) {
+		sp.set("queued", "true")
+		t := enqueue(u, password, r.RemoteAddr, sp.traceparent())
+		renderTemplate(w, r, "queue.html", map[string]any{"Ticket": t.ID})
 		return
 	}
-	overlaySetting := cfg.Section("user").Key("overlay").String()
+
+	// The desktop starts in the background, while the browser shows its
+	// progress and moves on to the session page once it's up
+	t := startInBackground(u, password, r.RemoteAddr, sp.traceparent())
+	renderTemplate(w, r, "starting.html", map[string]any{"Ticket": t.ID, "Stage": "mounting"})
+}
+
+// runContainer starts a desktop container publishing noVNC on port, under
+// its network egress policy.
+func runContainer(ctx context.Context, name string, port int, runArgs []string, egress Egress) error {
+	args := []string{
+		"run", "-d", "--rm", "--privileged",
+		"-p", fmt.Sprintf("%d:8080", port),
+		"--name", name,
+	}
+	if err := execRun(ctx, "docker", append(args, runArgs...)...); err != nil {
+		// Also run if the command was killed, as the container may have started
+		execRun(context.Background(), "docker", "rm", "-f", name)
+		return err
+	}
+	if err := applyEgress(ctx, name, egress); err != nil {
+		execRun(context.Background(), "docker", "rm", "-f", name)
+		return fmt.Errorf("egress policy: %w", err)
+	}
+	return nil
+}
+
+// startError is a failure to start a session, with the HTTP status to
+// report it as. Msg is for the log; users only see a generic error.
+type startError struct {
+	Status int
+	Msg    string
+}
+
+func (e *startError) Error() string { return e.Msg }
+
+// startSession mounts the user's overlay and starts their desktop container,
+// returning the new session ID. The password is only needed to unlock an
+// encrypted overlay; remote is recorded in the audit log.
+func startSession(ctx context.Context, u *User, password, remote string) (sessionID string, err error) {
+	ctx, sp := startSpan(ctx, "session.start")
+	sp.set("user", u.Name)
+	defer func() {
+		sp.set("session", sessionID)
+		sp.fail(err)
+		sp.finish()
+	}()
+
+	overlaySetting := u.overlay()
+	volumes, err := parseVolumes(u.settingKey("volumes").Strings(","))
+	if err != nil {
+		return "", &startError{500, "Config error: " + err.Error()}
+	}
+
+	clipboardPolicy := u.setting("clipboard")
+	switch clipboardPolicy {
+	case "", "both", "in", "out", "none":
+	default:
+		return "", &startError{500, "Config error: invalid clipboard policy"}
+	}
+	filePolicy := u.setting("file_transfer")
+	switch filePolicy {
+	case "", "both", "upload", "download", "none":
+	default:
+		return "", &startError{500, "Config error: invalid file_transfer policy"}
+	}
+
+	quota, err := userQuota(u)
+	if err != nil {
+		return "", &startError{500, "Config error: quota: " + err.Error()}
+	}
+
+	egress, err := userEgress(u)
+	if err != nil {
+		return "", &startError{500, "Config error: " + err.Error()}
+	}
+
+	snapshots := u.settingKey("snapshots").MustInt(0)
+	sharingPolicy := u.setting("sharing")
+	switch sharingPolicy {
+	case "", "control", "view", "none":
+	default:
+		return "", &startError{500, "Config error: invalid sharing policy"}
+	}
+
+	clientCert, err := clientCertName(u)
+	if err != nil {
+		return "", &startError{500, "Config error: " + err.Error()}
+	}
+
+	if protocol, address, ok := u.externalHost(); ok && protocol == "vnc" {
+		return startHostSession(ctx, u, address, remote, sharingPolicy, clientCert, sp.traceparent())
+	}
+	if u.setting("backend") == "vm" {
+		return startVMSession(ctx, u, remote, sharingPolicy, clientCert, sp.traceparent())
+	}
+	rdp, err := rdpConnection(u, password)
+	if err != nil {
+		return "", &startError{500, "Config error: " + err.Error()}
+	}
+	terminal := u.setting("backend") == "terminal"
+	if terminal {
+		clipboardPolicy = "none" // The browser's own clipboard works in a terminal
+	}
 
 	// Choose overlay directory
 	overlayDir := ""
 	ephemeral := false
 	if overlaySetting == "ephemeral" {
 		// Temporary overlay for guest mode
-		overlayDir = filepath.Join("/srv/overlays", "guest-"+randSeq(6))
+		overlayDir = filepath.Join(overlayRoot, "guest-"+randSeq(6))
 		ephemeral = true
 	} else {
 		overlayDir = overlaySetting
 	}
 
-	upper := filepath.Join(overlayDir, "upper")
-	work := filepath.Join(overlayDir, "work")
-	merged := filepath.Join(overlayDir, "merged")
+	// Persistent overlays can be encrypted at rest, keyed by the user's password
+	encrypted := !ephemeral && u.setting("encryption") == "fscrypt"
+	if ephemeral {
+		quota = 0 // Guests are limited by their tmpfs instead
+	}
+	l := &overlayLayout{dir: overlayDir, ephemeral: ephemeral, encrypted: encrypted}
 
-	// Ensure overlay dirs exist
-	for _, d := range []string{upper, work, merged} {
-		if err := os.MkdirAll(d, 0755); err != nil {
-			http.Error(w, "Failed to create overlay dirs", 500)
-			return
+	image := desktopImage(u)
+
+	// The site's own wiring, before anything is set up; if it ran, the
+	// post_stop hook is told about a start that then fails
+	id := newSessionID()
+	ev := hookEvent{Session: id, Username: u.Name, Desktop: u.Desktop, Overlay: overlayDir, Guest: ephemeral, Image: image, Remote: remote}
+	if err := runHook(ctx, "pre_start", hookPreStart, ev); err != nil {
+		return "", &startError{500, err.Error()}
+	}
+	defer func() {
+		if err != nil {
+			ev.Reason = "start_failed"
+			logHook(context.Background(), "post_stop", hookPostStop, ev)
 		}
+	}()
+
+	// The overlay, the network home and the image don't depend on each
+	// other, so they're readied at once
+	progress(ctx, "mounting")
+	var homeVolume Volume
+	var homeMount string
+	var wg sync.WaitGroup
+	var prepErr, homeErr, imageErr error
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		prepErr = timeStep(ctx, "overlay.prepare", func(sp *span) error {
+			sp.set("overlay", overlayDir)
+			return prepareOverlay(ctx, u, l, password, quota)
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		homeErr = timeStep(ctx, "home.mount", func(sp *span) error {
+			var err error
+			homeVolume, homeMount, err = mountHome(ctx, u)
+			return err
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		imageErr = timeStep(ctx, "image.ready", func(sp *span) error {
+			sp.set("image", image)
+			return imageReady(ctx, image)
+		})
+	}()
+	wg.Wait()
+
+	releaseHome := func() {
+		sessionsMu.Lock()
+		idle := homeIdle(homeMount)
+		sessionsMu.Unlock()
+		if idle {
+			unmountHome(homeMount)
+		}
+	}
+	if prepErr != nil || homeErr != nil || imageErr != nil {
+		if homeErr == nil {
+			releaseHome()
+		}
+		if prepErr == nil {
+			releaseOverlay(overlayDir, ephemeral, encrypted)
+		}
+		switch {
+		case prepErr != nil:
+			return "", prepErr
+		case homeErr != nil:
+			return "", &startError{500, "Failed to mount home: " + homeErr.Error()}
+		default:
+			return "", &startError{500, "Image " + image + " not available: " + imageErr.Error()}
+		}
+	}
+	volumes = append(volumes, Volume{Source: l.exchange, Target: exchangeTarget})
+	if l.printDir != "" {
+		volumes = append(volumes, Volume{Source: l.printDir, Target: printTarget})
 	}
+	if homeVolume.Source != "" {
+		volumes = append(volumes, homeVolume)
+	}
+	merged := l.merged
 
 	// Mount OverlayFS: lowerdir=base, upperdir=user, workdir=user, merged=mountpoint
-	cmd := exec.Command("mount", "-t", "overlay", "overlay",
-		"-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", baseOverlay, upper, work),
-		merged)
-	if err := cmd.Run(); err != nil {
-		http.Error(w, "Failed to mount overlay: "+err.Error(), 500)
-		return
+	err = timeStep(ctx, "overlay.mount", func(sp *span) error {
+		sp.set("base", l.baseName)
+		return retry(ctx, "Mounting overlay "+merged, func() error {
+			return execRun(ctx, "mount", "-t", "overlay", "overlay",
+				"-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", l.baseDir, l.upper, l.work),
+				merged)
+		})
+	})
+	if err != nil {
+		releaseHome()
+		releaseOverlay(overlayDir, ephemeral, encrypted)
+		return "", &startError{500, "Failed to mount overlay: " + err.Error()}
 	}
 
 	// Build docker run command
-	sessionID := randSeq(8)
+	sessionID = id
 	port := randomPort()
-	containerName := "desktop-" + username + "-" + sessionID
-
-	args := []string{
-	    "run", "-d", "--rm", "--privileged",
- 	   "-p", fmt.Sprintf("%d:8080", port),
- 	   "--name", containerName,
-	    "-v", merged + ":/mnt/overlay:rshared",
-	    "ubuntu-xfce-novnc",
-	}
+	containerName := containerNameFor(ctx, u, sessionID)
 
+	// Everything but the port and name, so a suspended session's container
+	// can be run again the same way
+	args := containerLabelArgs(u, sessionID)
+	args = append(args, "-v", merged+":/mnt/overlay:rshared")
 
 	// for video
 	args = append(args,
- 	   "-v", "/dev/urandom:/dev/urandom",
-	    "-v", "/dev/null:/dev/null",
-	    "-v", "/tmp/.X11-unix:/tmp/.X11-unix",
+		"-v", "/dev/urandom:/dev/urandom",
+		"-v", "/dev/null:/dev/null",
+		"-v", "/tmp/.X11-unix:/tmp/.X11-unix",
 	)
 
+	// Extra volumes (shared data, NAS homes) declared in the user config
+	for _, v := range volumes {
+		args = append(args, v.dockerArgs()...)
+	}
+
+	// Let the in-container agent reach back to the gateway
+	agentToken := newAgentToken()
+	args = append(args, agentEnvArgs(agentToken)...)
+
+	// Start the display to suit the device logging in
+	args = append(args, deviceEnvArgs(u.Device)...)
+
+	// Proxy and DNS settings
+	args = append(args, networkEnvArgs(u)...)
+
+	// A single fullscreen app instead of the desktop environment
+	args = append(args, appEnvArgs(u)...)
+
+	// Text drawn over the desktop, against leaks
+	args = append(args, watermarkArgs(u)...)
+
+	// Or just a shell, served as a web terminal
+	if terminal {
+		args = append(args, "-e", "LG_TERMINAL=1")
+	}
+
+	// Or an RDP client connected to the user's Windows desktop
+	if rdp != nil {
+		rdpArgs, err := rdp.dockerArgs(sessionID)
+		if err != nil {
+			execRun(context.Background(), "umount", "-l", merged)
+			releaseHome()
+			releaseOverlay(overlayDir, ephemeral, encrypted)
+			return "", &startError{500, "Failed to pass on RDP credentials: " + err.Error()}
+		}
+		args = append(args, rdpArgs...)
+	}
+
+	// Memory and CPU limits, from the user's settings or catalog entry
+	args = append(args, resourceArgs(u)...)
+
+	// Image must come last; anything after it is passed to the container
+	args = append(args, image)
 
-	cmd = exec.Command("docker", args...)
-	if err := cmd.Run(); err != nil {
+	progress(ctx, "container")
+	err = timeStep(ctx, "container.run", func(sp *span) error {
+		sp.set("container", containerName)
+		sp.set("image", image)
+		return retry(ctx, "Starting container "+containerName, func() error {
+			port = randomPort() // In case the last one was taken meanwhile
+			return runContainer(ctx, containerName, port, args, egress)
+		})
+	})
+	if err != nil {
 		// Unmount overlay if docker run fails
-		exec.Command("umount", "-l", merged).Run()
-		http.Error(w, "Failed to start container: "+err.Error(), 500)
-		return
+		execRun(context.Background(), "umount", "-l", merged)
+		dropRDPCredentials(sessionID)
+		releaseHome()
+		releaseOverlay(overlayDir, ephemeral, encrypted)
+		return "", &startError{500, "Failed to start container: " + err.Error()}
 	}
 
 	// Save session
-	sessionsMu.Lock()
-	sessions[sessionID] = Session{
-		Username:      username,
-		ContainerName: containerName,
-		OverlayDir:    overlayDir,
-		Port:          port,
-		LastActive:    time.Now(),
-		Ephemeral:     ephemeral,
+	idleTimeout, maxLifetime := sessionLimits(u, ephemeral)
+	clientAddr := ""
+	if ip := remoteIP(remote); ip != nil {
+		clientAddr = ip.String()
 	}
+	sessionsMu.Lock()
+	sessions[sessionID] = withViewOnly(u, Session{
+		ID:              sessionID,
+		Username:        u.Name,
+		Desktop:         u.Desktop,
+		ContainerName:   containerName,
+		Image:           image,
+		OverlayDir:      overlayDir,
+		Port:            port,
+		LastActive:      time.Now(),
+		Ephemeral:       ephemeral,
+		Encrypted:       encrypted,
+		Base:            l.baseName,
+		ExchangeDir:     l.exchange,
+		PrintDir:        l.printDir,
+		AgentToken:      agentToken,
+		OwnerToken:      newAgentToken(),
+		ClipboardPolicy: clipboardPolicy,
+		FilePolicy:      filePolicy,
+		SharingPolicy:   sharingPolicy,
+		Snapshots:       snapshots,
+		Record:          u.settingKey("record").MustBool(false),
+		StartedAt:       time.Now(),
+		IdleTimeout:     idleTimeout,
+		MaxLifetime:     maxLifetime,
+		RunArgs:         args,
+		IdleAction:      idleAction(u),
+		Quota:           quota,
+		Egress:          egress,
+		HomeMount:       homeMount,
+		Scan:            scanPolicy(u),
+		ClientCert:      clientCert,
+		Trace:           sp.traceparent(),
+		Terminal:        terminal,
+		Watermark:       u.setting("watermark"),
+		ClientAddr:      clientAddr,
+		LockAfter:       u.settingKey("lock_on_disconnect").MustDuration(0),
+	})
+	saveSessions()
 	sessionsMu.Unlock()
+	audit("session.start", u.Name, sessionID, map[string]string{
+		"container": containerName, "overlay": overlayDir, "remote": remote,
+	})
+	ev.Container, ev.Port = containerName, port
+	logHook(ctx, "post_start", hookPostStart, ev)
 
-	// Redirect user to session page
-	http.Redirect(w, r, "/session/"+sessionID, 302)
+	return sessionID, nil
 }
 
-// session serves the HTML wrapper page for the VNC session.
-func session(w http.ResponseWriter, r *http.Request) {
-	sessionID := strings.TrimPrefix(r.URL.Path, "/session/")
-
+// touchSession looks up a session and marks it active, calling off any
+// pending idle expiry. A session touched within the last second is left as
+// it is, so a burst of requests takes the write lock once.
+func touchSession(sessionID string) (Session, bool) {
+	sessionsMu.RLock()
+	s, ok := lookupSession(sessionID)
+	sessionsMu.RUnlock()
+	if !ok || (s.ExpiresAt.IsZero() && time.Since(s.LastActive) < time.Second) {
+		return s, ok
+	}
 	sessionsMu.Lock()
-	s, ok := sessions[sessionID]
+	defer sessionsMu.Unlock()
+	s, ok = lookupSession(sessionID)
 	if ok {
 		s.LastActive = time.Now()
-		sessions[sessionID] = s
+		s.ExpiresAt = time.Time{}
+		sessions[s.ID] = s
 	}
-	sessionsMu.Unlock()
+	return s, ok
+}
 
+// lookupSession finds a session by an ID taken from a request. Every
+// session ID is compared in constant time, so response timing gives away
+// nothing about which IDs exist. The caller must hold sessionsMu.
+func lookupSession(sessionID string) (Session, bool) {
+	var found Session
+	ok := 0
+	for id, s := range sessions {
+		if subtle.ConstantTimeCompare([]byte(id), []byte(sessionID)) == 1 {
+			found, ok = s, 1
+		}
+	}
+	return found, ok == 1
+}
+
+// status reports a session's idle state to the session page, without
+// counting as activity itself:
+//
+//	{"state": "active", "restarts": 0}      (restarts counts crash recoveries)
+//	    also "printouts", "shadows" (admins watching), "shadow_request"
+//	    and "quota": {"used": bytes, "limit": bytes, "percent": 83}
+//	{"state": "moved"}                       (opened in another browser)
+//	{"state": "suspended"}                   (idle; resumes on reload)
+//	{"state": "expiring", "expires_in": 87}  (idle; can be extended)
+//	{"state": "ending", "expires_in": 87, "reason": "lifetime"}  (cannot)
+//	{"state": "ended", "reason": "crashed", "message": "..."}  (reason only if known)
+//
+// The reason for "ending" is "lifetime" or "maintenance".
+func status(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/status/")
+	sessionsMu.RLock()
+	s, ok := lookupSession(sessionID)
+	sessionsMu.RUnlock()
 	if !ok {
-		http.Error(w, "Session not found", 404)
+		ended := map[string]any{"state": "ended"}
+		if reason := whyEnded(sessionID); reason != "" {
+			ended["reason"] = reason
+			ended["message"] = tr(r, endedKey(reason))
+		}
+		writeJSON(w, 404, ended)
+		return
+	}
+	if !isOwner(r, sessionID, s) {
+		writeJSON(w, 403, map[string]any{"state": "moved"})
+		return
+	}
+	if s.Suspended {
+		writeJSON(w, 200, map[string]any{"state": "suspended"})
+		return
+	}
+	end, reason := s.endsAt(), "lifetime"
+	if end.IsZero() || time.Until(end) >= idleGrace {
+		end = time.Time{}
+	}
+	if m, soon := maintenanceImminent(); soon && (end.IsZero() || m.Before(end)) {
+		end, reason = m, "maintenance"
+	}
+	if !end.IsZero() {
+		writeJSON(w, 200, map[string]any{
+			"state":      "ending",
+			"expires_in": int(time.Until(end).Seconds()),
+			"reason":     reason,
+		})
+		return
+	}
+	if s.ExpiresAt.IsZero() {
+		shadows, request := sessionShadows(s.ID)
+		active := map[string]any{
+			"state":          "active",
+			"restarts":       s.Restarts,
+			"printouts":      len(listPrintouts(s.PrintDir)),
+			"shadows":        shadows,
+			"shadow_request": request,
+		}
+		if used, percent, ok := sessionQuota(s); ok {
+			active["quota"] = map[string]any{"used": used, "limit": s.Quota, "percent": percent}
+		}
+		writeJSON(w, 200, active)
 		return
 	}
+	writeJSON(w, 200, map[string]any{
+		"state":      "expiring",
+		"expires_in": int(time.Until(s.ExpiresAt).Seconds()),
+	})
+}
 
-	renderTemplate(w, "session.html", map[string]any{
-		"SessionID": sessionID,
+// extend is the session page's "I'm still here": it marks the session
+// active, cancelling an idle expiry.
+func extend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/extend/")
+	if _, ok := ownerSession(r, sessionID); !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// findUserSession returns a live session belonging to username, if any.
+func findUserSession(username string) (Session, bool) {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for _, s := range sessions {
+		if s.Username == username {
+			return s, true
+		}
+	}
+	return Session{}, false
+}
+
+// findDesktopSession returns the live session of one of a user's desktops.
+func findDesktopSession(username, desktop string) (Session, bool) {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for _, s := range sessions {
+		if s.Username == username && s.Desktop == desktop {
+			return s, true
+		}
+	}
+	return Session{}, false
+}
+
+// session serves the HTML wrapper page for the VNC session.
+func session(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/session/")
+	if geoBlocked(w, r, "") {
+		return
+	}
+
+	s, ok := ownerSession(r, sessionID)
+
+	if !ok {
+		if clientCertRefused(r, sessionID) {
+			httpError(w, r, 403, "error.client_cert")
+			return
+		}
+		sessionGone(w, r, sessionID)
+		return
+	}
+	if _, err := wakeSession(sessionID); err != nil {
+		serverError(w, r, 503, err)
+		return
+	}
+
+	device := deviceProfile(r)
+	renderTemplate(w, r, "session.html", map[string]any{
+		"SessionID":     sessionID,
+		"ClientURL":     clientURL(s, sessionID, false, device),
+		"Device":        device,
+		"Desktop":       s.Desktop,
+		"Printing":      s.PrintDir != "" && !s.Terminal,
+		"Display":       !s.Terminal,
+		"Files":         s.ExchangeDir != "" && s.FilePolicy != "none",
+		"Profile":       !s.Ephemeral,
+		"Reset":         !s.Ephemeral && !s.containerless(),
+		"QuotaWarn":     quotaWarn,
+		"QuotaCritical": quotaCritical,
+		"ClipboardIn":   clipboardAllows(s.ClipboardPolicy, "in"),
+		"ClipboardOut":  clipboardAllows(s.ClipboardPolicy, "out"),
+		"ViewLocked":    s.ViewOnlyLocked,
+		"ShareView":     shareAllows(s.SharingPolicy, "view"),
+		"ShareControl":  shareAllows(s.SharingPolicy, "control"),
+		"Snapshots":     s.Snapshots > 0 && !s.Ephemeral && !s.Encrypted && !s.containerless(),
 	})
 }
 
-// proxyHandler forwards requests into the noVNC server inside the container.
+// proxyHandler forwards requests into the noVNC server inside the container:
+// just the websocket when the gateway bundles the web client itself. A
+// terminal session's web terminal is proxied whole.
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/proxy/"), "/", 2)
 	if len(parts) < 2 {
-		http.Error(w, "Bad proxy path", 400)
+		httpError(w, r, 400, "error.invalid_request")
 		return
 	}
 	sessionID, rest := parts[0], parts[1]
+	if geoBlocked(w, r, "") {
+		return
+	}
 
-	sessionsMu.Lock()
-	s, ok := sessions[sessionID]
-	if ok {
-		s.LastActive = time.Now()
-		sessions[sessionID] = s
+	// Shared viewers reach the session through their share token instead
+	viewOnly, shadow := false, ""
+	var expires time.Time
+	sh, shared := lookupShare(sessionID)
+	if shared {
+		sessionID, viewOnly, expires = sh.SessionID, sh.Mode == "view" || sh.Pending, sh.Expires
+		if sh.Shadow != "" {
+			shadow = parts[0]
+		}
+	}
+
+	var s Session
+	var ok bool
+	if shared {
+		s, ok = touchSession(sessionID)
+		ok = ok && clientCertVerified(r, s)
+	} else {
+		s, ok = ownerSession(r, sessionID)
 	}
-	sessionsMu.Unlock()
 	if !ok {
-		http.Error(w, "Session not found", 404)
+		httpError(w, r, 404, "error.session_not_found")
 		return
 	}
+	if novncVersion != "" && rest != "websockify" && !s.Terminal {
+		// The web client is served by the gateway; only the websocket is proxied
+		httpError(w, r, 404, "error.not_found")
+		return
+	}
+	s, err := wakeSession(sessionID)
+	if err != nil {
+		serverError(w, r, 503, err)
+		return
+	}
+	if !shared && rest == "websockify" {
+		noteClientAddr(sessionID, r.RemoteAddr)
+	}
+
+	_, sp := startSpan(withTraceparent(r.Context(), s.Trace), "proxy")
+	sp.set("session", s.ID)
+	sp.set("path", "/"+rest)
+	defer sp.finish()
 
 	target, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", s.Port))
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	upgrade := vncUpgradeHook(vncOptions{
+		SessionID:   sessionID,
+		Username:    s.Username,
+		ViewOnly:    viewOnly || (!shared && s.Controls.ViewOnly),
+		Quality:     s.Controls.Quality,
+		Compression: s.Controls.Compression,
+		Expires:     expires,
+		Record:      s.Record,
+		Owner:       !shared,
+		Shadow:      shadow,
+		Terminal:    s.Terminal,
+	})
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The span covers the wait for noVNC's response headers
+		sp.set("status", fmt.Sprint(resp.StatusCode))
+		sp.finish()
+		traceFirstByte(s.ID)
+		return upgrade(resp)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		sp.fail(err)
+		log.Printf("Proxying to session %s: %v", logPath(s.ID), err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 	r.URL.Path = "/" + rest
 	r.Host = target.Host
 	proxy.ServeHTTP(w, r)
 }
 
-// ping updates session activity timestamp (called by JS heartbeat).
+// ping reports whether a session is still running. It doesn't count as
+// activity: an open but unused tab should still go idle. Activity comes
+// from input on the VNC connection and from using the session page.
 func ping(w http.ResponseWriter, r *http.Request) {
 	sessionID := strings.TrimPrefix(r.URL.Path, "/ping/")
-	sessionsMu.Lock()
-	if s, ok := sessions[sessionID]; ok {
-		s.LastActive = time.Now()
-		sessions[sessionID] = s
+	if _, ok := peekOwnerSession(r, sessionID); !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
 	}
-	sessionsMu.Unlock()
 	w.WriteHeader(200)
 }
 
 // logout stops a session explicitly.
 func logout(w http.ResponseWriter, r *http.Request) {
 	sessionID := strings.TrimPrefix(r.URL.Path, "/logout/")
-	stopSession(sessionID)
+	if _, ok := ownerSession(r, sessionID); ok {
+		stopSession(sessionID, endLogout)
+	}
 	http.Redirect(w, r, "/", 302)
 }
 
-// cleanupLoop checks sessions every minute and kills idle ones.
+// cleanupLoop checks sessions periodically. Sessions idle for longer than
+// their idle timeout are first marked expiring, which the session page shows
+// as a countdown; they are killed only if still idle after idleGrace.
+// Sessions past their maximum lifetime are killed regardless, as are all
+// sessions when a maintenance window starts.
 func cleanupLoop() {
 	for {
-		time.Sleep(1 * time.Minute)
+		time.Sleep(15 * time.Second)
+		var idle, expired, suspend []string
 		sessionsMu.Lock()
 		for id, s := range sessions {
-			if time.Since(s.LastActive) > sessionExpiry {
-				log.Printf("Session %s idle > %v, killing...", id, sessionExpiry)
-				stopSession(id)
+			switch {
+			case s.Suspended:
+				// Resumable until suspendedExpiry, then gone for good
+				if time.Since(s.LastActive) > suspendedExpiry {
+					idle = append(idle, id)
+				}
+			case !s.ReservedUntil.IsZero():
+				// Pre-started for a booking and not yet claimed
+				if time.Now().After(s.ReservedUntil) {
+					idle = append(idle, id)
+				}
+			case !s.endsAt().IsZero() && time.Now().After(s.endsAt()):
+				expired = append(expired, id)
+			case s.ExpiresAt.IsZero() && time.Since(s.LastActive) > s.IdleTimeout:
+				log.Printf("Session %s idle > %v, expiring in %v", id, s.IdleTimeout, idleGrace)
+				s.ExpiresAt = time.Now().Add(idleGrace)
+				sessions[id] = s
+			case !s.ExpiresAt.IsZero() && time.Now().After(s.ExpiresAt) && s.IdleAction == "suspend":
+				suspend = append(suspend, id)
+			case !s.ExpiresAt.IsZero() && time.Now().After(s.ExpiresAt):
+				idle = append(idle, id)
+			}
+		}
+		var maintenance []string
+		if maintenanceDue() {
+			for id := range sessions {
+				maintenance = append(maintenance, id)
 			}
+			expired, idle, suspend = nil, nil, nil
 		}
 		sessionsMu.Unlock()
+
+		if len(maintenance) > 0 {
+			log.Printf("Maintenance window reached, killing %d sessions...", len(maintenance))
+		}
+		for _, id := range maintenance {
+			stopSession(id, endMaintenance)
+		}
+
+		// stopSession takes the lock itself and runs docker/umount
+		for _, id := range expired {
+			log.Printf("Session %s reached its maximum lifetime, killing...", id)
+			stopSession(id, endLifetime)
+		}
+		for _, id := range idle {
+			log.Printf("Session %s still idle after grace period, killing...", id)
+			stopSession(id, endIdle)
+		}
+		for _, id := range suspend {
+			log.Printf("Session %s still idle after grace period, suspending...", id)
+			suspendSession(id)
+		}
 	}
 }
 
-// stopSession kills the container, unmounts overlay, and cleans up.
-func stopSession(sessionID string) {
+// stopSession kills the container, unmounts overlay, and cleans up. reason
+// is one of the end* codes (see ended.go).
+func stopSession(sessionID, reason string) {
+	sessionsMu.RLock()
+	s, ok := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !ok {
+		return
+	}
+	if !s.Ephemeral {
+		// The desktop stays locked until torn down, so logging in again
+		// can't mount its overlay while the old mount is still going away
+		unlock, _ := lockDesktop(s.Username, s.Desktop) // Stopped regardless
+		defer unlock()
+	}
+	stopSessionLocked(sessionID, reason)
+}
+
+// stopSessionLocked is stopSession for a caller holding the desktop's lock.
+// The slow part, removing the container and unmounting, is done without
+// holding sessionsMu.
+func stopSessionLocked(sessionID, reason string) {
 	sessionsMu.Lock()
-	if s, ok := sessions[sessionID]; ok {
-		// Kill container
-		exec.Command("docker", "rm", "-f", s.ContainerName).Run()
+	s, ok := sessions[sessionID]
+	if !ok {
+		sessionsMu.Unlock()
+		return // Stopped meanwhile
+	}
+	delete(sessions, sessionID)
+	saveSessions()
+	noteSessionEnd()
+	sessionsMu.Unlock()
+	noteEnded(sessionID, reason)
+
+	// Kill container, once what it used is known
+	ctx := context.Background() // Teardown runs to the end
+	var totals *SessionTotals
+	if sessionRetention > 0 {
+		totals = sessionTotals(ctx, s)
+	}
+	logHook(ctx, "pre_stop", hookPreStop, sessionHookEvent(s, reason))
+	if s.VM != "" {
+		stopVMSession(ctx, s)
+	} else if s.Target != "" {
+		stopConsoleBridge(sessionID)
+	} else {
+		if err := execRun(ctx, "docker", "rm", "-f", s.ContainerName); err != nil {
+			log.Printf("Session %s: removing container: %v", sessionID, err)
+		}
+		removeEgress(s.ContainerName)
 
 		// Unmount overlay
 		merged := filepath.Join(s.OverlayDir, "merged")
-		exec.Command("umount", "-l", merged).Run()
-
-		// If guest mode, remove dirs
-		if s.Ephemeral {
-			os.RemoveAll(s.OverlayDir)
+		if err := execRun(ctx, "umount", "-l", merged); err != nil {
+			log.Printf("Session %s: unmounting overlay: %v", sessionID, err)
 		}
 
-		delete(sessions, sessionID)
+		// If guest mode, drop the tmpfs and remove dirs; if encrypted, lock
+		releaseOverlay(s.OverlayDir, s.Ephemeral, s.Encrypted)
 	}
+
+	sessionsMu.Lock()
+	idleHome := homeIdle(s.HomeMount)
+	recordHistory(s)
 	sessionsMu.Unlock()
+	if idleHome {
+		unmountHome(s.HomeMount)
+	}
+
+	retainSession(s, reason, totals)
+	logHook(ctx, "post_stop", hookPostStop, sessionHookEvent(s, reason))
+	dropClipboard(sessionID)
+	dropShares(sessionID)
+	dropRDPCredentials(sessionID)
+	audit("session.stop", s.Username, sessionID, map[string]string{"reason": reason})
+	go scanUpperdir(s)
+}
+
+// mountGuestTmpfs mounts a size-limited tmpfs at dir to back a guest overlay.
+func mountGuestTmpfs(ctx context.Context, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	err := execRun(ctx, "mount", "-t", "tmpfs", "-o",
+		"size="+guestTmpfsSize+",mode=0755", "tmpfs", dir)
+	if err != nil {
+		execRun(context.Background(), "umount", dir) // In case it was killed after mounting
+		os.Remove(dir)
+	}
+	return err
+}
+
+// releaseOverlay is called once the merged overlay is unmounted. Guest
+// overlays are removed, unmounting their tmpfs first if one is mounted;
+// encrypted overlays are locked; other persistent overlays are left untouched.
+func releaseOverlay(dir string, ephemeral, encrypted bool) {
+	if encrypted {
+		lockOverlay(filepath.Join(dir, encryptedSubdir))
+	}
+	if !ephemeral {
+		return
+	}
+	// Fails harmlessly when the overlay is on disk
+	execRun(context.Background(), "umount", "-l", dir)
+	os.RemoveAll(dir)
 }
 
 // --- Utility functions ---
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+var letters = "abcdefghijklmnopqrstuvwxyz0123456789"
 
 // randSeq returns a random alphanumeric string.
 func randSeq(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]rune, n)
+	b := make([]byte, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		c, _ := crand.Int(crand.Reader, big.NewInt(int64(len(letters))))
+		b[i] = letters[c.Int64()]
 	}
 	return string(b)
 }
 
+// newSessionID returns a random 128-bit session ID, hex encoded. Session
+// IDs appear in URLs, so they must be unguessable.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
 // randomPort returns a random TCP port in range 10000–15000.
 func randomPort() int {
 	return 10000 + rand.Intn(5000)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A maintenance window is a weekly (or daily) time at which every session is
+// shut down, e.g. for host patching, lasting maintenanceDuration. Users are
+// warned maintenanceWarning ahead, and no desktop is started from then
+// until the window ends, whether for a login, a booking, a queued user or
+// the admin API.
+
+var (
+	maintenanceWindows  []maintWindow               // From maintenance_windows
+	maintenanceWarning  = 15 * time.Minute          // How far ahead users are warned
+	maintenanceDuration = 30 * time.Minute          // How long each window lasts
+	maintenanceDays     = map[string]time.Weekday{} // Day names accepted in window specs
+	maintenanceEvery    = time.Weekday(-1)          // Day value meaning "every day"
+	lastMaintenance     = time.Now()                // When cleanupLoop last checked for windows
+)
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		maintenanceDays[strings.ToLower(d.String()[:3])] = d
+	}
+}
+
+// maintWindow is one scheduled shutdown in gateway local time.
+type maintWindow struct {
+	Day          time.Weekday // maintenanceEvery for a daily window
+	Hour, Minute int
+}
+
+// parseMaintenance parses window specs of the form "Sun 02:00" or
+// "daily 02:00".
+func parseMaintenance(specs []string) ([]maintWindow, error) {
+	var windows []maintWindow
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid maintenance window %q", spec)
+		}
+		day, ok := maintenanceDays[strings.ToLower(fields[0])]
+		if strings.EqualFold(fields[0], "daily") {
+			day, ok = maintenanceEvery, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid day in maintenance window %q", spec)
+		}
+		t, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in maintenance window %q", spec)
+		}
+		windows = append(windows, maintWindow{Day: day, Hour: t.Hour(), Minute: t.Minute()})
+	}
+	return windows, nil
+}
+
+// next returns the first time after t at which the window starts.
+func (mw maintWindow) next(t time.Time) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), mw.Hour, mw.Minute, 0, 0, t.Location())
+	for !start.After(t) || (mw.Day != maintenanceEvery && start.Weekday() != mw.Day) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// nextMaintenance returns the first maintenance window after t, or the zero
+// time if none are configured.
+func nextMaintenance(t time.Time) time.Time {
+	var next time.Time
+	for _, mw := range maintenanceWindows {
+		if n := mw.next(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// maintenanceDue reports whether a window has started since the last call.
+// It is only called from cleanupLoop.
+func maintenanceDue() bool {
+	now := time.Now()
+	next := nextMaintenance(lastMaintenance)
+	lastMaintenance = now
+	return !next.IsZero() && !now.Before(next)
+}
+
+// maintenanceClosed reports whether logins are refused for maintenance,
+// because a window is under way or about to start, and when it ends.
+func maintenanceClosed(now time.Time) (time.Time, bool) {
+	// The first window starting after this is under way if it has started
+	start := nextMaintenance(now.Add(-maintenanceDuration))
+	if start.IsZero() {
+		return start, false
+	}
+	return start.Add(maintenanceDuration), !start.After(now) || start.Sub(now) < maintenanceWarning
+}
+
+// maintenanceImminent reports whether the next window is close enough that
+// users are being warned about it, and when it starts.
+func maintenanceImminent() (time.Time, bool) {
+	next := nextMaintenance(time.Now())
+	return next, !next.IsZero() && time.Until(next) < maintenanceWarning
+}
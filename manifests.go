@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Users, groups, roles, catalog images and external hosts can also be
+// declared in YAML manifests, for a GitOps pipeline to manage: every
+// *.yaml and *.yml file under manifests_dir, each holding any number of
+// documents like
+//
+//	kind: Group
+//	name: cs101
+//	settings:
+//	  image: registry.example.ac.uk/cs101-desktop:2024
+//	  quota: 10G
+//	  access_hours: [Mon-Fri 08:00-18:00]
+//	---
+//	kind: User
+//	name: alice
+//	settings:
+//	  password: pbkdf2-sha256$...
+//	  groups: [cs101]
+//	desktops:
+//	  thesis:
+//	    image: ubuntu-desktop-latex
+//
+// A manifest's settings are the keys its section would have in the gateway
+// config ([group cs101] here; Role, Image and Host manifests likewise),
+// lists becoming comma-separated values; policies (access hours, egress,
+// clipboard, sharing and the rest) are settings like any other. Sections
+// from manifests are the manifests' alone: naming one the config file also
+// has is an error.
+//
+// Users are reconciled into users_dir when the gateway starts and on every
+// reload: a user file is written for each User manifest (a new user gets
+// an overlay as "lookingglass user import" would give them), rewritten
+// when its manifest changes, and disabled, ending its sessions and
+// archiving its overlays, when its manifest goes. Files the manifests
+// manage are marked "managed = manifests"; a user file without the mark is
+// left alone, and a manifest for the same user is reported instead.
+//
+// The gateway reloads its manifests on SIGHUP and on POST
+// /admin/manifests/reload, which answers with what changed; a manifest
+// that fails to parse leaves everything as it was. "lookingglass manifests
+// check" validates them, for a pipeline to run before deploying.
+
+var manifestsDir = "" // "" = no manifests
+
+const manifestMark = "manifests" // The managed key of the user files they own
+
+// manifestSectionPrefixes are the config sections each kind of manifest
+// becomes.
+var manifestSectionPrefixes = map[string]string{
+	"Group": "group ",
+	"Role":  "role ",
+	"Image": "image ",
+	"Host":  "host ",
+}
+
+// manifest is one YAML document.
+type manifest struct {
+	Kind     string                    `yaml:"kind"`
+	Name     string                    `yaml:"name"`
+	Settings map[string]any            `yaml:"settings"`
+	Desktops map[string]map[string]any `yaml:"desktops"` // Users' named desktops
+	file     string
+}
+
+// ManifestResult reports a reload.
+type ManifestResult struct {
+	Sections int               `json:"sections"`
+	Created  []string          `json:"created"`
+	Updated  []string          `json:"updated"`
+	Disabled []string          `json:"disabled"`
+	Failed   map[string]string `json:"failed,omitempty"` // Username -> error
+}
+
+var (
+	manifestSections []string   // Config sections that came from manifests
+	manifestUsers    []manifest // User manifests, as last loaded
+	manifestsMu      sync.Mutex // Serialises reloads
+)
+
+// readManifests parses every manifest under dir.
+func readManifests(dir string) ([]manifest, error) {
+	var ms []manifest
+	seen := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ext := filepath.Ext(path); d.IsDir() || ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			var m manifest
+			err := dec.Decode(&m)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if m.Kind == "" && m.Name == "" && m.Settings == nil {
+				continue // An empty document
+			}
+			m.file = path
+			if err := m.validate(); err != nil {
+				return fmt.Errorf("%s: %s %q: %v", path, m.Kind, m.Name, err)
+			}
+			key := m.Kind + "/" + m.Name
+			if other, dup := seen[key]; dup {
+				return fmt.Errorf("%s: %s %q is also in %s", path, m.Kind, m.Name, other)
+			}
+			seen[key] = path
+			ms = append(ms, m)
+		}
+	})
+	return ms, err
+}
+
+// validate checks a manifest's kind, name and values.
+func (m manifest) validate() error {
+	switch _, ok := manifestSectionPrefixes[m.Kind]; {
+	case m.Kind == "User":
+		if !usernameRe.MatchString(m.Name) {
+			return errors.New("invalid user name")
+		}
+	case ok:
+		if !desktopNameRe.MatchString(m.Name) {
+			return errors.New("invalid name")
+		}
+		if len(m.Desktops) > 0 {
+			return errors.New("only users have desktops")
+		}
+	default:
+		return errors.New("kind must be User, Group, Role, Image or Host")
+	}
+	if _, err := manifestSection(ini.Empty(), "manifest", m.Settings); err != nil {
+		return err
+	}
+	for name, settings := range m.Desktops {
+		if !desktopNameRe.MatchString(name) {
+			return fmt.Errorf("invalid desktop name %q", name)
+		}
+		if _, err := manifestSection(ini.Empty(), "desktop "+name, settings); err != nil {
+			return fmt.Errorf("desktop %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// manifestValue renders a setting as a config value.
+func manifestValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, err := manifestValue(item)
+			if _, nested := item.([]any); err != nil || nested {
+				return "", errors.New("lists must hold plain values")
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ", "), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// manifestSection adds a section holding settings to f, keys sorted so
+// that rewriting an unchanged manifest changes nothing.
+func manifestSection(f *ini.File, name string, settings map[string]any) (*ini.Section, error) {
+	sec, err := f.NewSection(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := manifestValue(settings[k])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if _, err := sec.NewKey(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return sec, nil
+}
+
+// loadManifests reads the manifests into the gateway config, replacing the
+// sections they gave it last time. The users are left for
+// applyManifestUsers.
+func loadManifests() error {
+	if manifestsDir == "" {
+		return nil
+	}
+	ms, err := readManifests(manifestsDir)
+	if err != nil {
+		return err
+	}
+	var users []manifest
+	var names []string
+	for _, m := range ms {
+		prefix, ok := manifestSectionPrefixes[m.Kind]
+		if !ok {
+			users = append(users, m)
+			continue
+		}
+		name := prefix + m.Name
+		if _, err := gatewayCfg.GetSection(name); err == nil && !slices.Contains(manifestSections, name) {
+			return fmt.Errorf("%s: [%s] is also in %s", m.file, name, configPath)
+		}
+		names = append(names, name)
+	}
+	for _, name := range manifestSections {
+		gatewayCfg.DeleteSection(name)
+	}
+	for _, m := range ms {
+		if prefix, ok := manifestSectionPrefixes[m.Kind]; ok {
+			if _, err := manifestSection(gatewayCfg, prefix+m.Name, m.Settings); err != nil {
+				return err // Validated already
+			}
+		}
+	}
+	manifestSections, manifestUsers = names, users
+	return nil
+}
+
+// applyManifestUsers reconciles users_dir with the User manifests.
+func applyManifestUsers() ManifestResult {
+	res := ManifestResult{
+		Sections: len(manifestSections),
+		Created:  []string{},
+		Updated:  []string{},
+		Disabled: []string{},
+		Failed:   make(map[string]string),
+	}
+	if manifestsDir == "" {
+		return res
+	}
+	want := make(map[string]bool)
+	for _, m := range manifestUsers {
+		want[m.Name] = true
+		created, changed, err := applyManifestUser(m)
+		switch {
+		case err != nil:
+			res.Failed[m.Name] = err.Error()
+			log.Printf("Manifest for user %s (%s): %v", m.Name, m.file, err)
+		case created:
+			res.Created = append(res.Created, m.Name)
+			audit("user.create", "manifests", "", map[string]string{"user": m.Name})
+		case changed:
+			res.Updated = append(res.Updated, m.Name)
+			audit("user.update", "manifests", "", map[string]string{"user": m.Name})
+		}
+	}
+
+	// Managed users whose manifests have gone
+	files, _ := filepath.Glob(filepath.Join(userConfDir, "*.conf"))
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.Base(path), ".conf")
+		if want[name] {
+			continue
+		}
+		u, err := loadUser(name)
+		if err != nil || u.conf.Key("managed").String() != manifestMark || u.conf.Key("disabled").MustBool(false) {
+			continue
+		}
+		err = updateUserFile(name, func(sec *ini.Section) { sec.Key("disabled").SetValue("true") })
+		if err == nil {
+			_, err = deprovisionUser(u)
+		}
+		if err != nil {
+			res.Failed[name] = err.Error()
+			log.Printf("Disabling user %s (manifest removed): %v", name, err)
+			continue
+		}
+		res.Disabled = append(res.Disabled, name)
+		audit("user.disable", "manifests", "", map[string]string{"user": name})
+	}
+	return res
+}
+
+// applyManifestUser writes a user's file from their manifest, creating
+// the user first if they are new.
+func applyManifestUser(m manifest) (created, changed bool, err error) {
+	path := filepath.Join(userConfDir, m.Name+".conf")
+	old, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		password, _ := manifestValue(m.Settings["password"])
+		groups, _ := manifestValue(m.Settings["groups"])
+		role, _ := manifestValue(m.Settings["role"])
+		overlay, _ := manifestValue(m.Settings["overlay"])
+		group, _, _ := strings.Cut(groups, ",")
+		spec := UserSpec{Username: m.Name, Password: password, Group: strings.TrimSpace(group), Role: role, Overlay: overlay}
+		if err := provisionUser(spec); err != nil {
+			return false, false, err
+		}
+		if old, err = os.ReadFile(path); err != nil {
+			return false, false, err
+		}
+		created = true
+	case err != nil:
+		return false, false, err
+	}
+	cur, err := ini.Load(old)
+	if err != nil {
+		return false, false, err
+	}
+	if !created && cur.Section("user").Key("managed").String() != manifestMark {
+		return false, false, fmt.Errorf("%s exists and is not managed by manifests", path)
+	}
+
+	f := ini.Empty()
+	sec, err := manifestSection(f, "user", m.Settings)
+	if err != nil {
+		return false, false, err
+	}
+	if !sec.HasKey("overlay") && cur.Section("user").HasKey("overlay") {
+		// The default picked when the user was created
+		sec.Key("overlay").SetValue(cur.Section("user").Key("overlay").String())
+	}
+	sec.Key("managed").SetValue(manifestMark)
+	names := make([]string, 0, len(m.Desktops))
+	for name := range m.Desktops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := manifestSection(f, "desktop "+name, m.Desktops[name]); err != nil {
+			return false, false, err
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		return false, false, err
+	}
+	if bytes.Equal(buf.Bytes(), old) {
+		return created, false, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return false, false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, false, err
+	}
+	return created, true, nil
+}
+
+// reloadManifests reads the manifests again and reconciles the users.
+func reloadManifests() (ManifestResult, error) {
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	if err := loadManifests(); err != nil {
+		return ManifestResult{}, err
+	}
+	res := applyManifestUsers()
+	log.Printf("Manifests: %d sections, users %d created, %d updated, %d disabled, %d failed",
+		res.Sections, len(res.Created), len(res.Updated), len(res.Disabled), len(res.Failed))
+	return res, nil
+}
+
+// manifestReloadLoop reloads the manifests on SIGHUP.
+func manifestReloadLoop() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if _, err := reloadManifests(); err != nil {
+			log.Printf("Reloading manifests: %v (keeping the previous ones)", err)
+		}
+	}
+}
+
+// adminReloadManifests handles POST /admin/manifests/reload.
+func adminReloadManifests(w http.ResponseWriter, r *http.Request) {
+	if manifestsDir == "" {
+		writeJSONError(w, 404, errors.New("manifests_dir is not set"))
+		return
+	}
+	res, err := reloadManifests()
+	if err != nil {
+		writeJSONError(w, 422, err)
+		return
+	}
+	writeJSON(w, 200, res)
+}
+
+// manifestsCheckCommand validates the manifests without applying them.
+func manifestsCheckCommand(args []string) error {
+	dir := manifestsDir
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if dir == "" {
+		return errors.New("no manifests_dir set or given")
+	}
+	ms, err := readManifests(dir)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, m := range ms {
+		counts[m.Kind]++
+	}
+	fmt.Printf("%s: %d users, %d groups, %d roles, %d images, %d hosts\n", dir,
+		counts["User"], counts["Group"], counts["Role"], counts["Image"], counts["Host"])
+	return nil
+}
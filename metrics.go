@@ -0,0 +1,318 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /metrics reports the gateway's metrics in the Prometheus text format,
+// for a scraper presenting metrics_token (or an admin token) as a bearer
+// token. Without either configured the endpoint doesn't exist.
+//
+// Capacity is reported per gateway (every gateway in the cluster, as each
+// publishes it, so scraping any one is enough), for alerting before a lab
+// fills up: desktops running or starting, node_capacity and the room left
+// under it, host memory and how much is available, queued logins and
+// whether the gateway is draining. With max_sessions, the room left
+// cluster-wide too. Scheduler decisions are counted as they are made:
+// logins admitted (straight away, or from the queue), refused (and why:
+// queue, node_capacity, max_sessions, draining), and forwarded to another
+// gateway because this one is full or draining (or kept, when none has
+// room), with forwards counted by the gateway they went to.
+
+var metricsToken = "" // Bearer token for /metrics, so scrapers needn't hold an admin token
+
+// latencyBuckets are the histogram bucket bounds, in seconds. Starting a
+// desktop can take tens of seconds, hence the long tail.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations into latencyBuckets.
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// observe records one value.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	if i := sort.SearchFloat64s(latencyBuckets, v); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the histogram's series with the given labels.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cum uint64
+	for i, le := range latencyBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// routeKey identifies a route's series.
+type routeKey struct {
+	Route  string
+	Method string
+	Code   int
+}
+
+// scheduleKey identifies a scheduler decision's series.
+type scheduleKey struct {
+	Decision string
+	Reason   string
+}
+
+var (
+	httpLatency = make(map[routeKey]*histogram)
+	httpBytes   = make(map[routeKey]int64)
+	startSteps  = make(map[string]*histogram) // By step of starting a session
+	schedules   = make(map[scheduleKey]int64)
+	forwards    = make(map[string]int64) // Logins forwarded, by gateway
+	metricsMu   sync.Mutex
+)
+
+// observeRequest records a finished request.
+func observeRequest(route, method string, code int, bytes int64, d time.Duration) {
+	key := routeKey{route, method, code}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	h := httpLatency[key]
+	if h == nil {
+		h = &histogram{}
+		httpLatency[key] = h
+	}
+	h.observe(d.Seconds())
+	httpBytes[key] += bytes
+}
+
+// observeStartStep records how long a step of starting a session took.
+func observeStartStep(step string, d time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	h := startSteps[step]
+	if h == nil {
+		h = &histogram{}
+		startSteps[step] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// noteSchedule counts a scheduler decision.
+func noteSchedule(decision, reason string) {
+	metricsMu.Lock()
+	schedules[scheduleKey{decision, reason}]++
+	metricsMu.Unlock()
+}
+
+// noteForward counts a login forwarded to another gateway.
+func noteForward(node string) {
+	metricsMu.Lock()
+	forwards[node]++
+	metricsMu.Unlock()
+}
+
+// hostMemory returns the host's total and available memory in bytes, from
+// /proc/meminfo (zeroes where it can't be read).
+func hostMemory() (total, available int64) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb << 10
+		case "MemAvailable:":
+			available = kb << 10
+		}
+	}
+	return total, available
+}
+
+// metricsOnly guards the metrics endpoint.
+func metricsOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secretsMu.RLock()
+		tokens := slices.Clone(adminTokens)
+		if metricsToken != "" {
+			tokens = append(tokens, metricsToken)
+		}
+		secretsMu.RUnlock()
+		if len(tokens) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !slices.ContainsFunc(tokens, func(t string) bool {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1
+		}) {
+			if ok {
+				authFailed(r.RemoteAddr, "", "bad metrics token", "metrics")
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lookingglass-metrics"`)
+			httpError(w, r, 401, "error.unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeHTTPMetrics(w)
+	writeStartMetrics(w)
+	writeCapacityMetrics(w)
+	writeScheduleMetrics(w)
+	writeAnomalyMetrics(w)
+	writeBouncerMetrics(w)
+}
+
+// writeHTTPMetrics prints the request metrics.
+func writeHTTPMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	keys := make([]routeKey, 0, len(httpLatency))
+	for k := range httpLatency {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b routeKey) int {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+	labels := func(k routeKey) string {
+		return fmt.Sprintf("route=%q,method=%q,code=\"%d\"", k.Route, k.Method, k.Code)
+	}
+
+	fmt.Fprintln(w, "# HELP lookingglass_http_request_duration_seconds Time to serve HTTP requests, by route.")
+	fmt.Fprintln(w, "# TYPE lookingglass_http_request_duration_seconds histogram")
+	for _, k := range keys {
+		httpLatency[k].write(w, "lookingglass_http_request_duration_seconds", labels(k))
+	}
+	fmt.Fprintln(w, "# HELP lookingglass_http_response_bytes_total Response body bytes sent, by route.")
+	fmt.Fprintln(w, "# TYPE lookingglass_http_response_bytes_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "lookingglass_http_response_bytes_total{%s} %d\n", labels(k), httpBytes[k])
+	}
+}
+
+// writeStartMetrics prints the timings of starting sessions.
+func writeStartMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	steps := make([]string, 0, len(startSteps))
+	for step := range startSteps {
+		steps = append(steps, step)
+	}
+	slices.Sort(steps)
+	fmt.Fprintln(w, "# HELP lookingglass_session_start_step_seconds Time taken by each step of starting a desktop.")
+	fmt.Fprintln(w, "# TYPE lookingglass_session_start_step_seconds histogram")
+	for _, step := range steps {
+		startSteps[step].write(w, "lookingglass_session_start_step_seconds", fmt.Sprintf("step=%q", step))
+	}
+}
+
+// writeCapacityMetrics prints every gateway's capacity.
+func writeCapacityMetrics(w io.Writer) {
+	nodes := []nodeStatus{localStatus()}
+	if cluster != nil {
+		if list, err := clusterNodes(); err != nil {
+			log.Printf("Cluster store: capacity metrics, reporting this gateway's only: %v", err)
+		} else if len(list) > 0 {
+			nodes = list
+		}
+	}
+	gauge := func(name, help string, value func(st nodeStatus) (float64, bool)) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, st := range nodes {
+			if v, ok := value(st); ok {
+				fmt.Fprintf(w, "%s{node=%q} %g\n", name, cmp.Or(st.Name, st.URL), v)
+			}
+		}
+	}
+	gauge("lookingglass_node_desktops", "Desktops running or starting on each gateway.", func(st nodeStatus) (float64, bool) {
+		return float64(st.Load), true
+	})
+	gauge("lookingglass_node_capacity_desktops", "Each gateway's node_capacity, where it has one.", func(st nodeStatus) (float64, bool) {
+		return float64(st.Capacity), st.Capacity > 0
+	})
+	gauge("lookingglass_node_allocatable_desktops", "Desktops each gateway with a node_capacity can still start (0 while draining).", func(st nodeStatus) (float64, bool) {
+		return float64(st.room()), st.Capacity > 0 || st.Draining
+	})
+	gauge("lookingglass_node_memory_bytes", "Each gateway host's memory.", func(st nodeStatus) (float64, bool) {
+		return float64(st.MemoryTotal), st.MemoryTotal > 0
+	})
+	gauge("lookingglass_node_memory_available_bytes", "Memory available for more desktops on each gateway host.", func(st nodeStatus) (float64, bool) {
+		return float64(st.MemoryFree), st.MemoryTotal > 0
+	})
+	gauge("lookingglass_node_queued_logins", "Logins waiting for a desktop on each gateway.", func(st nodeStatus) (float64, bool) {
+		return float64(st.Queued), true
+	})
+	gauge("lookingglass_node_draining", "1 while a gateway is being drained for shutdown.", func(st nodeStatus) (float64, bool) {
+		if st.Draining {
+			return 1, true
+		}
+		return 0, true
+	})
+	if maxSessions > 0 {
+		load := 0
+		for _, st := range nodes {
+			load += st.Load
+		}
+		fmt.Fprintln(w, "# HELP lookingglass_cluster_allocatable_desktops Desktops that can still start under max_sessions.")
+		fmt.Fprintln(w, "# TYPE lookingglass_cluster_allocatable_desktops gauge")
+		fmt.Fprintf(w, "lookingglass_cluster_allocatable_desktops %d\n", max(maxSessions-load, 0))
+	}
+}
+
+// writeScheduleMetrics prints the scheduler's decisions.
+func writeScheduleMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	keys := make([]scheduleKey, 0, len(schedules))
+	for k := range schedules {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b scheduleKey) int {
+		return cmp.Or(strings.Compare(a.Decision, b.Decision), strings.Compare(a.Reason, b.Reason))
+	})
+	fmt.Fprintln(w, "# HELP lookingglass_scheduler_decisions_total Desktop starts admitted, refused, forwarded or kept, and why.")
+	fmt.Fprintln(w, "# TYPE lookingglass_scheduler_decisions_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "lookingglass_scheduler_decisions_total{decision=%q,reason=%q} %d\n", k.Decision, k.Reason, schedules[k])
+	}
+	nodes := make([]string, 0, len(forwards))
+	for node := range forwards {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	fmt.Fprintln(w, "# HELP lookingglass_scheduler_forwards_total Logins forwarded to another gateway, by gateway.")
+	fmt.Fprintln(w, "# TYPE lookingglass_scheduler_forwards_total counter")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "lookingglass_scheduler_forwards_total{node=%q} %d\n", node, forwards[node])
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The gateway serves HTTPS itself when tls_cert and tls_key are set. With
+// tls_client_ca as well, browsers are asked for a client certificate signed
+// by that CA, and users, groups or roles with client_cert = true can only
+// use their desktops from a browser presenting one that names them: the
+// session page, the VNC proxy and the other owner endpoints then need the
+// certificate on top of the owner cookie. A certificate names a user by its
+// subject CN or an email address in its SANs, matched against
+// client_cert_name (default the username). Shares and shadows of such a
+// desktop need a certificate from the CA too, though not the user's. The
+// certificate is checked by the gateway the browser connects to, so in a
+// cluster it must be the gateway running the desktop.
+
+var (
+	tlsCert     = "" // Server certificate (PEM) for serving HTTPS ("" = plain HTTP)
+	tlsKey      = "" // Its private key
+	tlsClientCA = "" // CA bundle (PEM) client certificates are verified against
+)
+
+// serveHTTP serves h on ln, over TLS if it is configured.
+func serveHTTP(ln net.Listener, h http.Handler) error {
+	if tlsCert == "" {
+		return http.Serve(ln, h)
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h, TLSConfig: cfg}
+	return srv.ServeTLS(ln, tlsCert, tlsKey)
+}
+
+// tlsConfig returns the server's TLS settings, asking for client
+// certificates if there is a CA to verify them with.
+func tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsClientCA == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(tlsClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("tls_client_ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls_client_ca: no certificates in %s", tlsClientCA)
+	}
+	// Only desktops that need one are refused without it
+	cfg.ClientCAs, cfg.ClientAuth = pool, tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// clientCertName returns the name u's client certificate must carry, or ""
+// if their desktops don't need one.
+func clientCertName(u *User) (string, error) {
+	if !u.settingKey("client_cert").MustBool(false) {
+		return "", nil
+	}
+	if tlsCert == "" || tlsClientCA == "" {
+		return "", errors.New("client_cert needs tls_cert, tls_key and tls_client_ca")
+	}
+	if name := u.setting("client_cert_name"); name != "" {
+		return name, nil
+	}
+	return u.Name, nil
+}
+
+// clientCertNames returns the names in the request's verified client
+// certificate: its subject CN and email addresses.
+func clientCertNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := slices.Clone(leaf.EmailAddresses)
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	return names
+}
+
+// clientCertMatches reports whether the request may reach a session as its
+// owner: it carries a verified certificate naming the session's user, or
+// the session needs none.
+func clientCertMatches(r *http.Request, s Session) bool {
+	if s.ClientCert == "" {
+		return true
+	}
+	return slices.ContainsFunc(clientCertNames(r), func(n string) bool {
+		return strings.EqualFold(n, s.ClientCert)
+	})
+}
+
+// clientCertVerified reports whether a share or shadow may reach a session:
+// any verified certificate will do, if the session needs one.
+func clientCertVerified(r *http.Request, s Session) bool {
+	return s.ClientCert == "" || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0)
+}
+
+// clientCertRefused reports whether the request holds a session's owner
+// cookie but not the client certificate it needs, to tell the user why
+// rather than report the session missing.
+func clientCertRefused(r *http.Request, sessionID string) bool {
+	sessionsMu.RLock()
+	s, ok := lookupSession(sessionID)
+	sessionsMu.RUnlock()
+	return ok && hasOwnerCookie(r, sessionID, s) && !clientCertMatches(r, s)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Desktop containers are named from the container_name template, in which
+// {user}, {desktop} ("main" for a user's only desktop), {session} and
+// {short} (the session ID's first 8 characters) are replaced. Anything
+// Docker wouldn't accept in a name becomes a dash, and a name already taken
+// (by another session or any container on the host) gets -2, -3... added.
+// The name chosen is kept with the session in the sessions file, and the
+// container is labelled lookingglass.session and lookingglass.user, so the
+// gateway finds it again after a restart whatever the template is then.
+
+var containerNameTemplate = "desktop-{user}-{session}"
+
+// maxContainerName keeps names readable in docker ps.
+const maxContainerName = 128
+
+// containerNameFor picks a free container name for a new session.
+func containerNameFor(ctx context.Context, u *User, sessionID string) string {
+	desktop := u.Desktop
+	if desktop == "" || desktop == mainDesktop {
+		desktop = "main"
+	}
+	short := sessionID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	name := sanitizeContainerName(strings.NewReplacer(
+		"{user}", u.Name,
+		"{desktop}", desktop,
+		"{session}", sessionID,
+		"{short}", short,
+	).Replace(containerNameTemplate))
+	if name == "" {
+		name = "desktop-" + sessionID
+	}
+	candidate := name
+	for i := 2; containerNameTaken(ctx, candidate); i++ {
+		candidate = name + "-" + strconv.Itoa(i)
+	}
+	return candidate
+}
+
+// sanitizeContainerName makes a name Docker accepts: [a-zA-Z0-9][a-zA-Z0-9_.-]*.
+func sanitizeContainerName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			b[i] = '-'
+		}
+	}
+	name = strings.TrimLeft(string(b), "_.-")
+	if len(name) > maxContainerName {
+		name = name[:maxContainerName]
+	}
+	return strings.TrimRight(name, "_.-")
+}
+
+// containerNameTaken reports whether a session or a container already has
+// a name.
+func containerNameTaken(ctx context.Context, name string) bool {
+	if _, ok := sessionByContainer(name); ok {
+		return true
+	}
+	return execRun(ctx, "docker", "container", "inspect", "--format", "{{.Id}}", name) == nil
+}
+
+// sessionByContainer finds the session running in a container.
+func sessionByContainer(name string) (Session, bool) {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for _, s := range sessions {
+		if s.ContainerName == name {
+			return s, true
+		}
+	}
+	return Session{}, false
+}
+
+// containerLabelArgs label a session's container with whose it is.
+func containerLabelArgs(u *User, sessionID string) []string {
+	return []string{
+		"--label", "lookingglass.session=" + sessionID,
+		"--label", "lookingglass.user=" + u.Name,
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Desktops can be given a corporate HTTP proxy and their own DNS servers,
+// for the whole deployment (in [gateway]) or per role, user or desktop:
+// http_proxy, https_proxy (default http_proxy), no_proxy, dns and
+// dns_search. The proxy is passed in the usual environment variables (lower
+// and upper case), which desktop applications and command-line tools follow;
+// DNS goes into the container's resolv.conf through docker run. The
+// gateway's own address is always added to no_proxy, so the agent reaches
+// it directly.
+
+var (
+	httpProxy  = "" // Deployment-wide defaults for the desktop settings of the same name
+	httpsProxy = ""
+	noProxy    = ""
+	dnsServers = ""
+	dnsSearch  = ""
+)
+
+// networkSetting returns a network setting for u, falling back to the
+// deployment-wide default.
+func networkSetting(u *User, key, def string) string {
+	if v := u.setting(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// networkEnvArgs returns the docker run arguments giving a desktop its
+// proxy and DNS settings.
+func networkEnvArgs(u *User) []string {
+	var args []string
+	for _, s := range strings.Split(networkSetting(u, "dns", dnsServers), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			args = append(args, "--dns", s)
+		}
+	}
+	for _, s := range strings.Split(networkSetting(u, "dns_search", dnsSearch), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			args = append(args, "--dns-search", s)
+		}
+	}
+
+	plain := networkSetting(u, "http_proxy", httpProxy)
+	secure := networkSetting(u, "https_proxy", httpsProxy)
+	if secure == "" {
+		secure = plain
+	}
+	if plain == "" && secure == "" {
+		return args
+	}
+	bypass := []string{"localhost", "127.0.0.1", "host.docker.internal"}
+	if gw, err := url.Parse(agentGatewayURL); err == nil && gw.Hostname() != "" {
+		bypass = append(bypass, gw.Hostname())
+	}
+	if v := networkSetting(u, "no_proxy", noProxy); v != "" {
+		bypass = append(bypass, v)
+	}
+	env := map[string]string{
+		"http_proxy":  plain,
+		"https_proxy": secure,
+		"no_proxy":    strings.Join(bypass, ","),
+	}
+	for _, name := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		if env[name] != "" {
+			args = append(args, "-e", name+"="+env[name], "-e", strings.ToUpper(name)+"="+env[name])
+		}
+	}
+	return args
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//go:generate sh novnc/fetch.sh
+
+// The noVNC web client can be built into the gateway (see novnc/README.md)
+// and served from /novnc/<version>/, where <version> is a hash of the
+// bundled files so it can be cached forever. The desktop's proxy then only
+// carries the websocket. Without a bundled client, the session page loads
+// the one in the desktop image through /proxy/ as before.
+
+//go:embed all:novnc
+var novncFiles embed.FS
+
+var novncVersion = bundledNoVNCVersion() // "" if no client is bundled
+
+// bundledNoVNCVersion hashes the bundled client, if there is one.
+func bundledNoVNCVersion() string {
+	if _, err := fs.Stat(novncFiles, "novnc/vnc.html"); err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fs.WalkDir(novncFiles, "novnc", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := novncFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		h.Write([]byte(p))
+		h.Write(data)
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// novncHandler serves /novnc/<version>/... from the bundled client.
+func novncHandler() http.Handler {
+	sub, _ := fs.Sub(novncFiles, "novnc")
+	files := http.FileServer(http.FS(sub))
+	prefix := "/novnc/" + novncVersion + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if novncVersion == "" || !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		// Versioned paths never change, so browsers may keep them for good
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.StripPrefix(prefix, files).ServeHTTP(w, r)
+	})
+}
+
+// vncClientURL returns the noVNC page for connecting to a session (or share
+// token) through the gateway's proxy, set up for the viewer's device.
+func vncClientURL(sessionID string, viewOnly bool, device DeviceProfile) string {
+	q := url.Values{}
+	q.Set("autoconnect", "true")
+	q.Set("path", "proxy/"+sessionID+"/websockify")
+	if viewOnly {
+		q.Set("view_only", "true")
+	}
+	if device.Scaling == "local" {
+		q.Set("resize", "scale")
+	}
+	if device.Touch {
+		q.Set("show_dot", "true")
+	}
+	if novncVersion != "" {
+		return "/novnc/" + novncVersion + "/vnc.html?" + q.Encode()
+	}
+	return "/proxy/" + sessionID + "/vnc.html?" + q.Encode()
+}
@@ -0,0 +1,18 @@
+#!/bin/sh
+# Fetches the noVNC web client into this directory, for the gateway to embed
+# and serve itself (see novnc.go). Run from the repository root with
+# "go generate" or "sh novnc/fetch.sh", then rebuild the gateway.
+set -eu
+
+VERSION=${NOVNC_VERSION:-1.4.0}
+DIR=$(dirname "$0")
+TMP=$(mktemp -d)
+trap 'rm -rf "$TMP"' EXIT
+
+curl -fsSL "https://github.com/novnc/noVNC/archive/refs/tags/v$VERSION.tar.gz" |
+    tar -xz -C "$TMP"
+SRC="$TMP/noVNC-$VERSION"
+
+rm -rf "$DIR/app" "$DIR/core" "$DIR/vendor" "$DIR/vnc.html" "$DIR/LICENSE.txt"
+cp -R "$SRC/app" "$SRC/core" "$SRC/vendor" "$SRC/vnc.html" "$SRC/LICENSE.txt" "$DIR/"
+echo "noVNC $VERSION fetched into $DIR"
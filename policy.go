@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Sites can hand authorisation decisions to Open Policy Agent, writing
+// them as Rego policies rather than waiting for the gateway to grow a
+// setting for each. With opa_url set (the URL of a decision document, such
+// as http://localhost:8181/v1/data/lookingglass/allow), the gateway asks
+// it before starting anyone's desktop, after its own checks (access hours,
+// maintenance) have passed. The input describes what is asked for:
+//
+//	{"action": "session.start",
+//	 "user": {"name": "alice", "role": "student", "groups": ["cs101"], "guest": false},
+//	 "desktop": "", "device": "desktop", "remote": "192.0.2.7",
+//	 "time": "2026-01-05T09:30:00Z",
+//	 "settings": {"image": "cs101-desktop", "quota": "10G", ...},
+//	 "sessions": {"user": 0, "total": 12}}
+//
+// settings holds the user's effective image (as run, catalog entries
+// resolved), quota, clipboard, sharing, record, encryption and overlay
+// settings, their memory and cpus limits where set, plus any named in
+// opa_settings (for a policy keyed on a site's own settings). The result
+// is either a boolean or {"allow": bool, "reason": "..."}; a reason is
+// shown to the user. An undefined result denies. If OPA can't be reached
+// the start is refused, unless opa_fail_open is set.
+
+var (
+	opaURL      = ""
+	opaSettings []string // Further user settings passed to the policy
+	opaFailOpen = false
+	opaClient   = &http.Client{Timeout: 5 * time.Second}
+)
+
+// policySettings are the settings every policy input carries.
+var policySettings = []string{"image", "quota", "clipboard", "file_transfer", "printing", "sharing", "record", "encryption", "overlay"}
+
+// policyDecision is OPA's answer.
+type policyDecision struct {
+	Allow  bool
+	Reason string
+}
+
+// UnmarshalJSON accepts a bare boolean or {"allow": ..., "reason": ...}.
+func (d *policyDecision) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Allow); err == nil {
+		return nil
+	}
+	var obj struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("policy result is neither a boolean nor {allow, reason}")
+	}
+	d.Allow, d.Reason = obj.Allow, obj.Reason
+	return nil
+}
+
+// queryPolicy asks OPA about input.
+func queryPolicy(ctx context.Context, input map[string]any) (policyDecision, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return policyDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", opaURL, bytes.NewReader(body))
+	if err != nil {
+		return policyDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := opaClient.Do(req)
+	if err != nil {
+		return policyDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return policyDecision{}, fmt.Errorf("OPA: %s", resp.Status)
+	}
+	var result struct {
+		Result *policyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return policyDecision{}, fmt.Errorf("OPA: %v", err)
+	}
+	if result.Result == nil {
+		return policyDecision{}, nil // Undefined: nothing allows it
+	}
+	return *result.Result, nil
+}
+
+// startPolicyInput describes a desktop about to start, for the policy.
+func startPolicyInput(u *User, r *http.Request) map[string]any {
+	groups := u.groupNames()
+	if groups == nil {
+		groups = []string{} // An empty list for the policy, not null
+	}
+	settings := make(map[string]string)
+	for _, k := range append(policySettings, opaSettings...) {
+		settings[k] = u.setting(k)
+	}
+	settings["image"] = desktopImage(u)
+	for _, k := range []string{"memory", "cpus"} {
+		if settings[k] = resourceSetting(u, k); settings[k] == "" {
+			delete(settings, k)
+		}
+	}
+	own, total := 0, 0
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		if s.Username == u.Name {
+			own++
+		}
+		total++
+	}
+	sessionsMu.RUnlock()
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	return map[string]any{
+		"action": "session.start",
+		"user": map[string]any{
+			"name":   u.Name,
+			"role":   u.setting("role"),
+			"groups": groups,
+			"guest":  u.overlay() == "ephemeral",
+		},
+		"desktop":  u.Desktop,
+		"device":   u.Device,
+		"remote":   remote,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"settings": settings,
+		"sessions": map[string]int{"user": own, "total": total},
+	}
+}
+
+// policyDenied asks the policy whether u may start a desktop now. It
+// returns the message key and arguments to refuse it with, or "" if it may
+// start; err is set only if OPA couldn't decide and opa_fail_open is off.
+func policyDenied(ctx context.Context, u *User, r *http.Request) (key string, args []any, err error) {
+	if opaURL == "" {
+		return "", nil, nil
+	}
+	ctx, sp := startSpan(ctx, "policy")
+	defer sp.finish()
+	d, err := queryPolicy(ctx, startPolicyInput(u, r))
+	if err != nil {
+		sp.fail(err)
+		if opaFailOpen {
+			log.Printf("Policy check for %s failed, allowing: %v", u.Name, err)
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	sp.set("allow", fmt.Sprint(d.Allow))
+	switch {
+	case d.Allow:
+		return "", nil, nil
+	case d.Reason != "":
+		return "error.policy_reason", []any{d.Reason}, nil
+	default:
+		return "error.policy", nil, nil
+	}
+}
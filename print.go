@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Printing: the desktop image has a CUPS-PDF printer, set as the default,
+// that writes each print job as a PDF into a spool directory. The gateway
+// bind-mounts that directory from the host, next to the exchange dir, and
+// offers the PDFs for download at /print/<session>/. The session page
+// polls the count through /status to show when something was printed.
+
+const printTarget = "/var/spool/lg-print" // Where CUPS-PDF writes in the desktop (see ubuntuBase)
+
+// printPath returns the print spool directory for an overlay.
+func printPath(overlayDir string, encrypted bool) string {
+	if encrypted {
+		overlayDir = filepath.Join(overlayDir, encryptedSubdir)
+	}
+	return filepath.Join(overlayDir, "print")
+}
+
+// Printout is one PDF in a session's print spool.
+type Printout struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// listPrintouts returns the PDFs in a spool directory, newest first.
+func listPrintouts(dir string) []Printout {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var list []Printout
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !strings.HasSuffix(strings.ToLower(e.Name()), ".pdf") {
+			continue
+		}
+		list = append(list, Printout{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ModTime.After(list[j].ModTime) })
+	return list
+}
+
+// printHandler serves /print/<session>/[<name>]: GET lists the printouts or
+// downloads one, POST deletes one.
+func printHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/print/"), "/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	if s.PrintDir == "" {
+		httpError(w, r, 404, "error.not_found")
+		return
+	}
+	if name == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			httpError(w, r, 405, "error.method_not_allowed")
+			return
+		}
+		renderTemplate(w, r, "print.html", map[string]any{
+			"SessionID": sessionID,
+			"Printouts": listPrintouts(s.PrintDir),
+		})
+		return
+	}
+
+	// The desktop user owns the spool, so guard against symlinks out of it
+	p, err := resolveExchange(s.PrintDir, name)
+	if err != nil || !strings.HasSuffix(strings.ToLower(p), ".pdf") {
+		httpError(w, r, 404, "error.file_not_found")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			serverError(w, r, 500, err)
+			return
+		}
+		http.Redirect(w, r, "/print/"+sessionID+"/", 303)
+	case http.MethodGet, http.MethodHead:
+		f, err := os.Open(p)
+		if err != nil {
+			httpError(w, r, 404, "error.file_not_found")
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			httpError(w, r, 404, "error.file_not_found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(fi.Name()))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	default:
+		httpError(w, r, 405, "error.method_not_allowed")
+	}
+}
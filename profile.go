@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The profile page shows a logged-in user their recent sessions, how long
+// they have used their desktops, and how much storage each desktop's
+// overlay takes. From there they can download an archive of an overlay or
+// wipe it back to the base image. Session history is kept per user in
+// historyDir as JSON lines, written as each session ends.
+
+var historyDir = "/srv/overlays/history"
+
+// profileHistory is how many past sessions the profile page lists.
+const profileHistory = 20
+
+// HistoryEntry is one finished session in a user's history.
+type HistoryEntry struct {
+	Session string    `json:"session"`
+	Desktop string    `json:"desktop,omitempty"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+}
+
+// Duration returns how long the session ran.
+func (e HistoryEntry) Duration() string {
+	return formatDuration(e.Ended.Sub(e.Started))
+}
+
+// StorageInfo is one of a user's overlays on the profile page.
+type StorageInfo struct {
+	Desktop   string // "" for the user's only desktop
+	Size      string
+	Encrypted bool
+	Running   bool
+	Download  bool // Its file_transfer policy allows downloading an archive
+}
+
+// recordHistory appends a finished session to its user's history. Guests
+// and booked desktops nobody claimed have no history. The caller must hold
+// sessionsMu.
+func recordHistory(s Session) {
+	if s.Ephemeral || !s.ReservedUntil.IsZero() || historyDir == "" {
+		return
+	}
+	line, _ := json.Marshal(HistoryEntry{Session: s.ID, Desktop: s.Desktop, Started: s.StartedAt, Ended: time.Now()})
+	err := os.MkdirAll(historyDir, 0700)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(filepath.Join(historyDir, s.Username+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+			_, err = f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Recording history for %s: %v", s.Username, err)
+	}
+}
+
+// loadHistory returns a user's finished sessions, newest first.
+func loadHistory(username string) ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(historyDir, username+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []HistoryEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e HistoryEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err == nil {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Ended.After(list[j].Ended) })
+	return list, sc.Err()
+}
+
+// profileDesktop returns the user as seen by one of their desktops: the
+// named one, or their only desktop for "".
+func profileDesktop(u *User, name string) (*User, error) {
+	if name == "" && len(u.desktops()) == 0 {
+		return u, nil
+	}
+	return u.forDesktop(name)
+}
+
+// storageDirs lists the directories holding a desktop's own data.
+func storageDirs(dir string, encrypted bool) []string {
+	upper, work := overlayPaths(dir, encrypted)
+	dirs := []string{upper, work, exchangePath(dir, encrypted), printPath(dir, encrypted)}
+	return append(dirs, keptResets(dir, encrypted)...)
+}
+
+// dirSize adds up the size of the files under dirs.
+func dirSize(dirs ...string) int64 {
+	var total int64
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+// formatBytes renders a size for people.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration renders a length of time in hours and minutes.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// profilePage shows the logged-in user's profile.
+func profilePage(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	history, err := loadHistory(u.Name)
+	if err != nil {
+		log.Printf("History of %s: %v", u.Name, err)
+	}
+	var usage time.Duration
+	for _, e := range history {
+		usage += e.Ended.Sub(e.Started)
+	}
+
+	var running []HistoryEntry
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		if s.Username == u.Name && s.ReservedUntil.IsZero() {
+			running = append(running, HistoryEntry{Session: s.ID, Desktop: s.Desktop, Started: s.StartedAt})
+			usage += time.Since(s.StartedAt)
+		}
+	}
+	sessionsMu.RUnlock()
+
+	names := u.desktops()
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	var storage []StorageInfo
+	for _, name := range names {
+		d, err := profileDesktop(u, name)
+		if err != nil || d.overlay() == "ephemeral" || d.overlay() == "" {
+			continue
+		}
+		_, active := findDesktopSession(u.Name, d.Desktop)
+		storage = append(storage, StorageInfo{
+			Desktop:   name,
+			Size:      formatBytes(dirSize(storageDirs(d.overlay(), d.setting("encryption") == "fscrypt")...)),
+			Encrypted: d.setting("encryption") == "fscrypt",
+			Running:   active,
+			Download:  fileTransferAllows(d.setting("file_transfer"), "download"),
+		})
+	}
+
+	if len(history) > profileHistory {
+		history = history[:profileHistory]
+	}
+	inviteImages, inviteMax := inviteOptions(u)
+	renderTemplate(w, r, "profile.html", map[string]any{
+		"Username":         u.Name,
+		"Running":          running,
+		"History":          history,
+		"Usage":            formatDuration(usage),
+		"Storage":          storage,
+		"Wiped":            r.URL.Query().Get("wiped") != "",
+		"InviteImages":     inviteImages,
+		"InviteMax":        formatDuration(inviteMax),
+		"InviteMaxMinutes": int(inviteMax.Minutes()),
+		"Invite":           r.URL.Query().Get("invite"),
+	})
+}
+
+// profileWipe handles POST /profile/wipe: with the user's password again,
+// it deletes everything a stopped desktop has stored, so it next starts as
+// the base image.
+func profileWipe(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	d, err := profileDesktop(u, r.FormValue("desktop"))
+	if err != nil {
+		httpError(w, r, 404, "error.desktop_not_found")
+		return
+	}
+	if d.overlay() == "ephemeral" || d.overlay() == "" {
+		httpError(w, r, 404, "error.no_storage")
+		return
+	}
+	if !u.checkPassword(r.FormValue("password")) {
+		audit("login.failed", u.Name, "", map[string]string{"reason": "bad password", "remote": r.RemoteAddr, "desktop": d.Desktop})
+		httpError(w, r, 401, "error.invalid_credentials")
+		return
+	}
+
+	// Held so the desktop can't be started while it is being wiped
+	unlock, err := lockDesktop(u.Name, d.Desktop)
+	defer unlock()
+	if _, running := findDesktopSession(u.Name, d.Desktop); running || err != nil {
+		httpError(w, r, 409, "error.desktop_running")
+		return
+	}
+	for _, dir := range storageDirs(d.overlay(), d.setting("encryption") == "fscrypt") {
+		if err := os.RemoveAll(dir); err != nil {
+			serverError(w, r, 500, err)
+			return
+		}
+	}
+	audit("overlay.wipe", u.Name, "", map[string]string{"desktop": d.Desktop, "remote": r.RemoteAddr})
+	http.Redirect(w, r, "/profile?wiped=1", 303)
+}
+
+// profileArchive handles GET /profile/archive?desktop=<name>, streaming a
+// tar.gz of a desktop's overlay (its changes to the base image) and its
+// exchange directory. Encrypted overlays can only be archived while their
+// desktop is running, as they are locked otherwise. Like the file browser,
+// it follows the desktop's file_transfer policy.
+func profileArchive(w http.ResponseWriter, r *http.Request) {
+	u, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	d, err := profileDesktop(u, r.URL.Query().Get("desktop"))
+	if err != nil {
+		httpError(w, r, 404, "error.desktop_not_found")
+		return
+	}
+	if d.overlay() == "ephemeral" || d.overlay() == "" {
+		httpError(w, r, 404, "error.no_storage")
+		return
+	}
+	if !fileTransferAllows(d.setting("file_transfer"), "download") {
+		httpError(w, r, 403, "error.download_disabled")
+		return
+	}
+	encrypted := d.setting("encryption") == "fscrypt"
+	if _, running := findDesktopSession(u.Name, d.Desktop); encrypted && !running {
+		httpError(w, r, 423, "error.storage_locked")
+		return
+	}
+
+	name := u.Name
+	if d.Desktop != "" {
+		name += "-" + d.Desktop
+	}
+	name += "-" + time.Now().Format("20060102") + ".tar.gz"
+	upper, _ := overlayPaths(d.overlay(), encrypted)
+	audit("overlay.archive", u.Name, "", map[string]string{"desktop": d.Desktop, "remote": r.RemoteAddr})
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(name))
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, dir := range []struct{ src, prefix string }{
+		{upper, "overlay"},
+		{exchangePath(d.overlay(), encrypted), "exchange"},
+	} {
+		if err := archiveDir(tw, dir.src, dir.prefix); err != nil {
+			// Too late for an error page; the truncated archive won't unpack
+			log.Printf("Archiving %s for %s: %v", dir.src, u.Name, err)
+			return
+		}
+	}
+	tw.Close()
+	gz.Close()
+}
+
+// archiveDir writes the tree under dir to tw, named under prefix. Symlinks
+// are stored as links, never followed.
+func archiveDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return nil // Sockets and the like can't be archived
+		}
+		rel, _ := filepath.Rel(dir, p)
+		hdr.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+}
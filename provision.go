@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/ini.v1"
+)
+
+// Users can be created in bulk, for a classroom rollout, from CSV (with a
+// header row naming the columns) or a JSON array of the same fields:
+//
+//	username,password,password_hash,group,role,quota,overlay
+//
+// either with "lookingglass user import" or POST /admin/users. Each user
+// gets a config file and, unless their overlay is ephemeral or encrypted,
+// an overlay directory seeded from their skeleton, so the first login is no
+// different from any other. password_hash takes a hash from "lookingglass
+// user hash" instead of a password, so no password need be stored in the
+// clear. Users that already exist, or whose row is invalid, are reported
+// and skipped; the rest are still created.
+
+// UserSpec is a user to create.
+type UserSpec struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Group        string `json:"group,omitempty"`
+	Role         string `json:"role,omitempty"`
+	Quota        string `json:"quota,omitempty"`
+	Overlay      string `json:"overlay,omitempty"` // Default <overlay_root>/<username>, unless the group or role sets one
+}
+
+// ProvisionResult reports a bulk import.
+type ProvisionResult struct {
+	Created []string          `json:"created"`
+	Failed  map[string]string `json:"failed,omitempty"` // Username (or row) -> error
+}
+
+const (
+	passwordHashPrefix = "pbkdf2-sha256$"
+	passwordHashIter   = 100000
+)
+
+// hashPassword returns a salted PBKDF2-SHA256 hash of a password, as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>.
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	sum := pbkdf2.Key([]byte(password), salt, passwordHashIter, sha256.Size, sha256.New)
+	return fmt.Sprintf("%s%d$%s$%s", passwordHashPrefix, passwordHashIter,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum))
+}
+
+// checkPasswordHash reports whether password matches a hash from
+// hashPassword.
+func checkPasswordHash(password, hash string) bool {
+	parts := strings.Split(strings.TrimPrefix(hash, passwordHashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iter, err1 := strconv.Atoi(parts[0])
+	salt, err2 := base64.RawStdEncoding.DecodeString(parts[1])
+	want, err3 := base64.RawStdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || iter < 1 || len(want) != sha256.Size {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New), want) == 1
+}
+
+// parseUserSpecs reads users to create from CSV or JSON.
+func parseUserSpecs(data []byte, format string) ([]UserSpec, error) {
+	if format == "json" {
+		var specs []UserSpec
+		if err := json.Unmarshal(data, &specs); err != nil {
+			return nil, err
+		}
+		return specs, nil
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no header row")
+	}
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errors.New("no username column")
+	}
+	var specs []UserSpec
+	for _, row := range rows[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		specs = append(specs, UserSpec{
+			Username:     field("username"),
+			Password:     field("password"),
+			PasswordHash: field("password_hash"),
+			Group:        field("group"),
+			Role:         field("role"),
+			Quota:        field("quota"),
+			Overlay:      field("overlay"),
+		})
+	}
+	return specs, nil
+}
+
+// provisionUser creates a user's config file and overlay.
+func provisionUser(spec UserSpec) error {
+	if !usernameRe.MatchString(spec.Username) {
+		return fmt.Errorf("invalid user name %q", spec.Username)
+	}
+	path := filepath.Join(userConfDir, spec.Username+".conf")
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("user %s already exists", spec.Username)
+	}
+	password := spec.Password
+	if spec.PasswordHash != "" {
+		if !strings.HasPrefix(spec.PasswordHash, passwordHashPrefix) {
+			return errors.New("password_hash must come from lookingglass user hash")
+		}
+		password = spec.PasswordHash
+	}
+	if password == "" {
+		return errors.New("no password given")
+	}
+	if spec.Group != "" {
+		if _, err := gatewayCfg.GetSection("group " + spec.Group); err != nil {
+			return fmt.Errorf("no [group %s] section in %s", spec.Group, configPath)
+		}
+	}
+	if spec.Role != "" {
+		if _, err := gatewayCfg.GetSection("role " + spec.Role); err != nil {
+			return fmt.Errorf("no [role %s] section in %s", spec.Role, configPath)
+		}
+	}
+	if spec.Quota != "" {
+		if _, err := parseSize(spec.Quota); err != nil {
+			return fmt.Errorf("quota %s: %v", spec.Quota, err)
+		}
+	}
+
+	cfg := ini.Empty()
+	sec := cfg.Section("user")
+	sec.Key("password").SetValue(password)
+	for _, kv := range [][2]string{{"groups", spec.Group}, {"role", spec.Role}, {"quota", spec.Quota}, {"overlay", spec.Overlay}} {
+		if kv[1] != "" {
+			sec.Key(kv[0]).SetValue(kv[1])
+		}
+	}
+	u := &User{Name: spec.Username, file: cfg, conf: sec}
+	u.groups = userGroups(u.Name, []string{spec.Group})
+	if role := u.setting("role"); role != "" {
+		u.role, _ = gatewayCfg.GetSection("role " + role)
+	}
+	if u.setting("overlay") == "" {
+		sec.Key("overlay").SetValue(filepath.Join(overlayRoot, u.Name))
+	}
+	if err := cfg.SaveTo(path); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+
+	// An encrypted overlay's private directory must be new at first login
+	if overlay := u.setting("overlay"); overlay != "ephemeral" && u.setting("encryption") != "fscrypt" {
+		upper, work := overlayPaths(overlay, false)
+		for _, d := range []string{upper, work, filepath.Join(overlay, "merged")} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		if skel := u.setting("skeleton"); skel != "" {
+			if err := applySkeleton(context.Background(), skel, upper); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// provisionUsers creates users, carrying on past any that fail.
+func provisionUsers(specs []UserSpec, actor string) ProvisionResult {
+	res := ProvisionResult{Created: []string{}, Failed: make(map[string]string)}
+	for i, spec := range specs {
+		if err := provisionUser(spec); err != nil {
+			key := spec.Username
+			if _, dup := res.Failed[key]; key == "" || dup {
+				key = fmt.Sprintf("row %d", i+1)
+			}
+			res.Failed[key] = err.Error()
+			continue
+		}
+		res.Created = append(res.Created, spec.Username)
+		audit("user.create", actor, "", map[string]string{"user": spec.Username, "group": spec.Group, "role": spec.Role})
+	}
+	return res
+}
+
+// adminImportUsers handles POST /admin/users: a JSON array of users, or CSV
+// with Content-Type text/csv.
+func adminImportUsers(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	format := "json"
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		format = "csv"
+	}
+	specs, err := parseUserSpecs(data, format)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	res := provisionUsers(specs, "admin")
+	status := 200
+	if len(res.Failed) > 0 && len(res.Created) == 0 {
+		status = 400
+	}
+	writeJSON(w, status, res)
+}
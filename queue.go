@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capacity: at most maxSessions desktops run at once. When they're all in
+// use, logins wait in a first-come-first-served queue and are started as
+// sessions end, rather than docker run failing or the host running out of
+// memory. Once anyone is queued, new logins queue behind them. With several
+// gateways sharing a cluster store, maxSessions covers them all, and each
+// may also be limited to nodeCapacity of its own.
+
+var (
+	maxSessions      = 0 // Concurrent desktops allowed (0 = unlimited)
+	startingSessions = 0 // Slots held by sessions still starting, guarded by sessionsMu
+	sessionGap       time.Duration
+	lastSessionEnd   time.Time // With sessionGap, guarded by sessionsMu
+
+	loginQueue   []*queueTicket
+	queueTickets = make(map[string]*queueTicket)
+	queueMu      sync.Mutex
+)
+
+// queueAbandon is how long a ticket survives without its page polling it.
+const queueAbandon = 2 * time.Minute
+
+// queueTicket is a login waiting for a free slot, or for its desktop to
+// start. The password is kept until the session starts, for unlocking an
+// encrypted overlay.
+type queueTicket struct {
+	ID        string
+	user      *User
+	password  string
+	remote    string
+	ctx       context.Context // Carries the login's trace; cancelled if the ticket is abandoned
+	cancel    context.CancelFunc
+	lastPoll  time.Time
+	Stage     string // queued, mounting, container or waiting
+	started   bool   // Whether this login started the session, rather than finding it
+	SessionID string // Set once the desktop has started
+	Err       string // Set if it failed to start
+}
+
+type progressKey struct{}
+
+// withProgress returns ctx with a function told each stage of starting a
+// session.
+func withProgress(ctx context.Context, fn func(stage string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progress reports a stage of starting a session to whoever is waiting.
+func progress(ctx context.Context, stage string) {
+	if fn, ok := ctx.Value(progressKey{}).(func(string)); ok {
+		fn(stage)
+	}
+}
+
+// reserveSlot claims capacity for a session about to start, unless the
+// gateway is full. Logins that aren't fromQueue also give way to anyone
+// already queued. The slot is handed back with releaseSlot once the
+// session is in the sessions map (or has failed).
+func reserveSlot(fromQueue bool) bool {
+	if !fromQueue {
+		queueMu.Lock()
+		waiting := len(loginQueue) > 0
+		queueMu.Unlock()
+		if waiting {
+			noteSchedule("refused", "queue")
+			return false
+		}
+	}
+	others := 0
+	if cluster != nil && maxSessions > 0 {
+		// Held until this gateway's new load is published
+		unlock, err := clusterLock("capacity", 10*time.Second, 10*time.Second)
+		if err == nil {
+			defer unlock()
+			others, err = clusterLoad()
+		}
+		if err != nil {
+			log.Printf("Cluster store: counting sessions, counting this gateway's only: %v", err)
+			others = 0
+		}
+	}
+	sessionsMu.Lock()
+	local := runningSessions() + startingSessions
+	reason := ""
+	switch {
+	case draining.Load():
+		reason = "draining"
+	case nodeCapacity > 0 && local >= nodeCapacity:
+		reason = "node_capacity"
+	case maxSessions > 0 && others+local >= maxSessions:
+		reason = "max_sessions"
+	}
+	if reason != "" {
+		sessionsMu.Unlock()
+		noteSchedule("refused", reason)
+		return false
+	}
+	startingSessions++
+	sessionsMu.Unlock()
+	if fromQueue {
+		noteSchedule("admitted", "queue")
+	} else {
+		noteSchedule("admitted", "room")
+	}
+	if cluster != nil && (maxSessions > 0 || nodeCapacity > 0) {
+		publishLoad()
+	}
+	return true
+}
+
+// releaseSlot returns a slot taken by reserveSlot.
+func releaseSlot() {
+	sessionsMu.Lock()
+	startingSessions--
+	sessionsMu.Unlock()
+}
+
+// noteSessionEnd keeps a moving average of the time between sessions
+// ending, from which queue waits are estimated. The caller must hold
+// sessionsMu.
+func noteSessionEnd() {
+	now := time.Now()
+	if !lastSessionEnd.IsZero() {
+		gap := now.Sub(lastSessionEnd)
+		if sessionGap == 0 {
+			sessionGap = gap
+		} else {
+			sessionGap = (4*sessionGap + gap) / 5
+		}
+	}
+	lastSessionEnd = now
+}
+
+// newTicket returns a ticket for a login, continuing its trace.
+func newTicket(u *User, password, remote, trace, stage string) *queueTicket {
+	t := &queueTicket{ID: newAgentToken(), user: u, password: password, remote: remote, lastPoll: time.Now(), Stage: stage}
+	t.ctx, t.cancel = context.WithCancel(withTraceparent(context.Background(), trace))
+	return t
+}
+
+// enqueue adds a login to the back of the queue.
+func enqueue(u *User, password, remote, trace string) *queueTicket {
+	t := newTicket(u, password, remote, trace, "queued")
+	queueMu.Lock()
+	loginQueue = append(loginQueue, t)
+	queueTickets[t.ID] = t
+	queueMu.Unlock()
+	noteClusterChange()
+	return t
+}
+
+// startInBackground starts a login's desktop, for which a slot is already
+// reserved, without holding up the request: the browser follows its
+// progress through the ticket returned, like a queued login's.
+func startInBackground(u *User, password, remote, trace string) *queueTicket {
+	t := newTicket(u, password, remote, trace, "mounting")
+	queueMu.Lock()
+	queueTickets[t.ID] = t
+	queueMu.Unlock()
+	noteClusterChange()
+	go admit(t)
+	return t
+}
+
+// queueLoop starts queued logins as slots free up, in order, and drops
+// tickets whose page has gone away.
+func queueLoop() {
+	for {
+		time.Sleep(2 * time.Second)
+		queueMu.Lock()
+		waiting := loginQueue[:0]
+		for _, t := range loginQueue {
+			if time.Since(t.lastPoll) < queueAbandon {
+				waiting = append(waiting, t)
+			}
+		}
+		loginQueue = waiting
+		for id, t := range queueTickets {
+			if time.Since(t.lastPoll) >= queueAbandon {
+				t.cancel() // Nobody is waiting for the desktop any more
+				delete(queueTickets, id)
+			}
+		}
+		for len(loginQueue) > 0 && reserveSlot(true) {
+			t := loginQueue[0]
+			loginQueue = loginQueue[1:]
+			go admit(t)
+		}
+		queueMu.Unlock()
+	}
+}
+
+// admit starts the desktop for a ticket that has reached the front, and
+// waits for it to come up.
+func admit(t *queueTicket) {
+	defer t.cancel()
+	ctx := withProgress(t.ctx, func(stage string) {
+		queueMu.Lock()
+		t.Stage = stage
+		queueMu.Unlock()
+	})
+	sessionID, started, err := startOrFind(ctx, t.user, t.password, t.remote)
+	releaseSlot()
+	if err == nil && started {
+		progress(ctx, "waiting")
+		sessionsMu.RLock()
+		port := sessions[sessionID].Port
+		sessionsMu.RUnlock()
+		if err := waitForPort(port, wakeTimeout); err != nil {
+			log.Printf("Session %s: %v", sessionID, err)
+		}
+	}
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	t.password = ""
+	if err != nil {
+		log.Printf("Starting desktop for %s: %v", t.user.Name, err)
+		t.Err = err.Error()
+		return
+	}
+	t.SessionID, t.started = sessionID, started
+}
+
+// queueStatus is polled by the queue page:
+//
+//	{"position": 3, "wait": 240}   (wait in seconds, null if unknown)
+//	{"session": "<sessionid>"}     (ready)
+//	{"error": "..."}               (failed to start)
+func queueStatus(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/queue/")
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	t, ok := queueTickets[id]
+	if !ok {
+		writeJSON(w, 404, map[string]string{"error": tr(r, "error.queue_expired")})
+		return
+	}
+	t.lastPoll = time.Now()
+	switch {
+	case t.SessionID != "":
+		delete(queueTickets, id)
+		if t.started {
+			setOwnerCookie(w, r, t.SessionID, ownerToken(t.SessionID))
+		} else {
+			// A concurrent login got there first
+			handOff(w, r, t.SessionID, t.user)
+		}
+		writeJSON(w, 200, map[string]string{"session": t.SessionID})
+		return
+	case t.Err != "":
+		delete(queueTickets, id)
+		writeJSON(w, 200, map[string]string{"error": tr(r, "error.internal")})
+		return
+	}
+	position := 0
+	for i, q := range loginQueue {
+		if q == t {
+			position = i + 1
+		}
+	}
+	sessionsMu.RLock()
+	gap := sessionGap
+	sessionsMu.RUnlock()
+	var wait any
+	if gap > 0 {
+		wait = int((time.Duration(position) * gap).Seconds())
+	}
+	writeJSON(w, 200, map[string]any{"position": position, "wait": wait, "stage": t.Stage, "status": tr(r, "starting."+t.Stage)})
+}
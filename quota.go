@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users can be given a storage quota (quota = 10G, per user, role or
+// desktop) covering everything their desktop keeps: the overlay's upperdir,
+// exchange directory, printouts and kept resets. The gateway measures usage
+// every quotaInterval and the session page warns at quotaWarn and
+// quotaCritical percent. With quota_enforcement = xfs the limit is also set
+// as an XFS project quota on the overlay directory, so writes inside the
+// desktop fail with "Disk quota exceeded" like on any full disk, rather than
+// the overlay filling the host. Uploads through the gateway are refused once
+// a desktop is over its quota either way.
+
+var quotaEnforcement = "none" // "none" or "xfs"
+
+const (
+	quotaInterval = time.Minute
+	quotaWarn     = 80
+	quotaCritical = 95
+)
+
+var (
+	quotaUsage   = make(map[string]int64) // Measured usage by session ID
+	quotaUsageMu sync.Mutex
+)
+
+// parseSize parses a size such as 512M or 10G (binary units).
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
+}
+
+// userQuota returns a user's storage quota in bytes (0 = none).
+func userQuota(u *User) (int64, error) {
+	v := u.setting("quota")
+	if v == "" {
+		return 0, nil
+	}
+	return parseSize(v)
+}
+
+// checkQuotaConfig validates quota_enforcement.
+func checkQuotaConfig() error {
+	switch quotaEnforcement {
+	case "none", "xfs":
+		return nil
+	}
+	return errors.New(`quota_enforcement must be "none" or "xfs"`)
+}
+
+// projectID derives a stable XFS project ID for an overlay directory.
+func projectID(dir string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(dir))
+	return h.Sum32() | 1 // Project 0 is the default for everything else
+}
+
+// enforceQuota sets an overlay directory's XFS project quota. Failures are
+// logged, not fatal: the desktop still starts, with the quota only measured.
+func enforceQuota(ctx context.Context, dir string, limit int64) {
+	if quotaEnforcement != "xfs" || limit <= 0 {
+		return
+	}
+	out, err := execOutput(ctx, "stat", "-c", "%m", dir)
+	if err != nil {
+		log.Printf("Quota for %s: finding its filesystem: %v", dir, err)
+		return
+	}
+	id := projectID(dir)
+	err = execRun(ctx, "xfs_quota", "-x",
+		"-c", fmt.Sprintf("project -s -p %s %d", dir, id),
+		"-c", fmt.Sprintf("limit -p bhard=%d %d", limit, id),
+		strings.TrimSpace(string(out)))
+	if err != nil {
+		log.Printf("Quota for %s: %v", dir, err)
+	}
+}
+
+// sessionQuota reports a session's measured usage against its quota. ok is
+// false for sessions without a quota or not measured yet.
+func sessionQuota(s Session) (used int64, percent int, ok bool) {
+	if s.Quota <= 0 {
+		return 0, 0, false
+	}
+	quotaUsageMu.Lock()
+	used, ok = quotaUsage[s.ID]
+	quotaUsageMu.Unlock()
+	return used, int(used * 100 / s.Quota), ok
+}
+
+// overQuota reports whether a session has used up its quota.
+func overQuota(s Session) bool {
+	_, percent, ok := sessionQuota(s)
+	return ok && percent >= 100
+}
+
+// quotaLoop measures the storage used by sessions with a quota.
+func quotaLoop() {
+	for {
+		sessionsMu.RLock()
+		var measure []Session
+		for _, s := range sessions {
+			if s.Quota > 0 {
+				measure = append(measure, s)
+			}
+		}
+		sessionsMu.RUnlock()
+
+		usage := make(map[string]int64, len(measure))
+		for _, s := range measure {
+			usage[s.ID] = dirSize(storageDirs(s.OverlayDir, s.Encrypted)...)
+		}
+		quotaUsageMu.Lock()
+		quotaUsage = usage
+		quotaUsageMu.Unlock()
+		time.Sleep(quotaInterval)
+	}
+}
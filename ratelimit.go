@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failed password checks are rate limited per client address, against
+// password guessing: once a client has failed loginRateLimit times in a
+// minute (0 = unlimited), its logins and WebDAV requests are refused until
+// the next. With a cluster store the failures are counted there, so
+// spreading guesses over several gateways doesn't multiply the allowance.
+
+var loginRateLimit = 0
+
+const rateWindow = time.Minute
+
+var (
+	rateCounts   = make(map[string]int) // Failures by key, in the current window
+	rateWindowAt time.Time
+	rateMu       sync.Mutex
+)
+
+// rateCount returns the failures counted against key in the current
+// window, first counting one more if add is set.
+func rateCount(key string, add bool) int {
+	window := time.Now().Truncate(rateWindow)
+	if cluster != nil {
+		k := "lookingglass:rate:" + key + ":" + strconv.FormatInt(window.Unix(), 10)
+		var n int
+		var err error
+		if add {
+			var reply any
+			if reply, err = cluster.do("INCR", k); err == nil {
+				n = int(reply.(int64))
+				if n == 1 {
+					cluster.do("PEXPIRE", k, strconv.FormatInt(2*rateWindow.Milliseconds(), 10))
+				}
+			}
+		} else {
+			var v string
+			if v, err = cluster.get(k); err == errRedisNil {
+				err = nil
+			}
+			n, _ = strconv.Atoi(v)
+		}
+		if err == nil {
+			return n
+		}
+		log.Printf("Cluster store: rate limiting, counting locally: %v", err)
+	}
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	if !window.Equal(rateWindowAt) {
+		rateCounts, rateWindowAt = make(map[string]int), window
+	}
+	if add {
+		rateCounts[key]++
+	}
+	return rateCounts[key]
+}
+
+// loginKey is the rate limiting key for a request's client.
+func loginKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "login:" + host
+}
+
+// loginBlocked reports whether a client has used up its failed logins.
+func loginBlocked(remoteAddr string) bool {
+	return loginRateLimit > 0 && rateCount(loginKey(remoteAddr), false) >= loginRateLimit
+}
+
+// loginFailed counts a failed password check.
+func loginFailed(remoteAddr string) {
+	if loginRateLimit > 0 {
+		rateCount(loginKey(remoteAddr), true)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Windows desktops are brokered over RDP. A user, group, role or desktop
+// with "backend = rdp" gets a desktop container as usual, but running just
+// an RDP client (FreeRDP, fullscreen, as an app profile would) connected to
+// rdp_host, instead of a desktop environment. The container translates RDP
+// to VNC as guacd would to Guacamole's protocol, so logins, the queue, the
+// proxy, idle timeouts, sharing and recording all work unchanged, and the
+// clipboard relay reaches the Windows clipboard through the client.
+//
+//	backend = rdp
+//	rdp_host = win-ts01.example.ac.uk
+//	rdp_username = {user}
+//	rdp_domain = EXAMPLE
+//	rdp_password = login
+//	rdp_options = /cert-ignore /printer
+//
+// rdp_password is the password to log in with: "login" (the default) passes
+// on the one the user logged in to the gateway with, when there is one;
+// anything else is a secret (a file:, env: or vault: reference, say, for a
+// shared kiosk account). Without a password the Windows logon screen asks
+// for one. The password reaches the container as a file readable only by
+// the desktop user, removed when the session ends. rdp_options are extra
+// xfreerdp arguments.
+
+var rdpCredentialsDir = "/srv/overlays/rdp-credentials"
+
+const rdpPasswordTarget = "/run/lg-rdp/password" // Where the desktop sees it
+
+var rdpOptionRe = regexp.MustCompile(`^[/+-][A-Za-z0-9:,._=-]+$`)
+
+// rdpConn is the Windows desktop an RDP session connects to.
+type rdpConn struct {
+	Host     string // host or host:port
+	Username string
+	Domain   string
+	Password string // "" = asked by the logon screen
+	Options  []string
+}
+
+// rdpConnection returns the Windows desktop u's session connects to, or nil
+// unless u's backend is rdp (or u's desktop is an RDP host). password is the
+// one u logged in with, if any.
+func rdpConnection(u *User, password string) (*rdpConn, error) {
+	host := u.setting("rdp_host")
+	if protocol, address, ok := u.externalHost(); ok {
+		if protocol != "rdp" {
+			return nil, nil
+		}
+		host = address
+	} else if u.setting("backend") != "rdp" {
+		return nil, nil
+	}
+	c := &rdpConn{
+		Host:     host,
+		Username: strings.ReplaceAll(u.settingKey("rdp_username").MustString("{user}"), "{user}", u.Name),
+		Domain:   u.setting("rdp_domain"),
+		Options:  strings.Fields(u.setting("rdp_options")),
+	}
+	host, port := c.Host, ""
+	if h, p, err := net.SplitHostPort(c.Host); err == nil {
+		host, port = h, p
+	}
+	if host == "" || strings.ContainsAny(host, " /\\\"'") || strings.ContainsAny(port, " /") {
+		return nil, fmt.Errorf("rdp_host %q is not a host or host:port", c.Host)
+	}
+	for _, opt := range c.Options {
+		if !rdpOptionRe.MatchString(opt) {
+			return nil, fmt.Errorf("rdp_options: invalid xfreerdp argument %q", opt)
+		}
+	}
+	switch secret := u.settingKey("rdp_password").MustString("login"); secret {
+	case "login":
+		c.Password = password
+	default:
+		var err error
+		if c.Password, err = resolveSecret(secret); err != nil {
+			return nil, fmt.Errorf("rdp_password: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// dockerArgs returns the docker run arguments running the RDP client in a
+// session's container, writing its password file.
+func (c *rdpConn) dockerArgs(sessionID string) ([]string, error) {
+	args := []string{
+		"-e", "LG_APP=/usr/local/bin/lg-rdp.sh",
+		"-e", "LG_RDP_HOST=" + c.Host,
+		"-e", "LG_RDP_USER=" + c.Username,
+		"-e", "LG_RDP_DOMAIN=" + c.Domain,
+		"-e", "LG_RDP_OPTIONS=" + strings.Join(c.Options, " "),
+	}
+	if c.Password == "" {
+		return args, nil
+	}
+	if err := os.MkdirAll(rdpCredentialsDir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(rdpCredentialsDir, sessionID)
+	if err := os.WriteFile(path, []byte(c.Password), 0400); err != nil {
+		return nil, err
+	}
+	if err := os.Chown(path, desktopUID, desktopUID); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return append(args, "-v", path+":"+rdpPasswordTarget+":ro"), nil
+}
+
+// dropRDPCredentials removes an ended session's RDP password file.
+func dropRDPCredentials(sessionID string) {
+	os.Remove(filepath.Join(rdpCredentialsDir, sessionID))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions of users with record = true have their VNC traffic captured at
+// the proxy. Each websocket connection becomes one file under
+// recordingsDir/<session>/, in the VNC_frame_data format written by
+// websockify --record, which noVNC's tests/vnc_playback.html replays.
+
+var (
+	recordingsDir      = "/var/lib/lookingglass/recordings" // Session recordings
+	recordingRetention = 30 * 24 * time.Hour                // Age at which recordings are deleted (0 = keep)
+)
+
+var recordingNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.js)?$`)
+
+// RecordingInfo describes a recorded session.
+type RecordingInfo struct {
+	Session string    `json:"session"`
+	User    string    `json:"user"`
+	Started time.Time `json:"started"`
+	Files   []string  `json:"files,omitempty"`
+}
+
+// recorder writes one websocket connection's traffic to a recording file.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+// startRecording opens a new recording file for a connection to a session.
+func startRecording(sessionID, username string) (*recorder, error) {
+	dir := filepath.Join(recordingsDir, sessionID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	meta := filepath.Join(dir, "session.json")
+	if _, err := os.Stat(meta); os.IsNotExist(err) {
+		b, _ := json.Marshal(RecordingInfo{Session: sessionID, User: username, Started: time.Now().UTC()})
+		os.WriteFile(meta, b, 0600)
+	}
+
+	now := time.Now()
+	name := filepath.Join(dir, fmt.Sprintf("%d.js", now.UnixMilli()))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if complianceMode {
+		makeAppendOnly(name)
+	}
+	rec := &recorder{f: f, w: bufio.NewWriter(f), start: now}
+	rec.w.WriteString("var VNC_frame_encoding = 'base64';\nvar VNC_frame_data = [\n")
+	return rec, nil
+}
+
+// frame records data sent by the server ('{') or the client ('}').
+func (rec *recorder) frame(marker byte, data []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.w == nil {
+		return
+	}
+	ms := time.Since(rec.start).Milliseconds()
+	fmt.Fprintf(rec.w, "'%c%d%c%s',\n", marker, ms, marker, base64.StdEncoding.EncodeToString(data))
+}
+
+func (rec *recorder) fromServer(data []byte) { rec.frame('{', data) }
+func (rec *recorder) fromClient(data []byte) { rec.frame('}', data) }
+
+// close terminates the recording. In compliance mode the finished file is
+// made immutable.
+func (rec *recorder) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.w == nil {
+		return
+	}
+	rec.w.WriteString("'EOF'];\n")
+	rec.w.Flush()
+	rec.f.Close()
+	rec.w = nil
+	if complianceMode {
+		execRun(context.Background(), "chattr", "+i", rec.f.Name())
+	}
+}
+
+// recordingRetentionLoop deletes recordings older than recordingRetention.
+// In compliance mode nothing is deleted: retention of recorded history is
+// left to the WORM storage itself.
+func recordingRetentionLoop() {
+	if recordingRetention <= 0 {
+		return
+	}
+	if complianceMode {
+		log.Printf("Compliance mode: recording retention is not enforced by the gateway")
+		return
+	}
+	for {
+		dirs, _ := os.ReadDir(recordingsDir)
+		for _, d := range dirs {
+			info, err := d.Info()
+			if err != nil || !d.IsDir() || time.Since(info.ModTime()) < recordingRetention {
+				continue
+			}
+			log.Printf("Recording %s is past retention, deleting", d.Name())
+			os.RemoveAll(filepath.Join(recordingsDir, d.Name()))
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// listRecordings returns every recorded session, newest first.
+func listRecordings() ([]RecordingInfo, error) {
+	dirs, err := os.ReadDir(recordingsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var recs []RecordingInfo
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		var ri RecordingInfo
+		if b, err := os.ReadFile(filepath.Join(recordingsDir, d.Name(), "session.json")); err == nil {
+			json.Unmarshal(b, &ri)
+		}
+		ri.Session = d.Name()
+		files, _ := filepath.Glob(filepath.Join(recordingsDir, d.Name(), "*.js"))
+		for _, f := range files {
+			ri.Files = append(ri.Files, filepath.Base(f))
+		}
+		recs = append(recs, ri)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Started.After(recs[j].Started) })
+	return recs, nil
+}
+
+// --- Admin API ---
+
+// adminListRecordings handles GET /admin/recordings.
+func adminListRecordings(w http.ResponseWriter, r *http.Request) {
+	recs, err := listRecordings()
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, recs)
+}
+
+// adminGetRecording handles GET /admin/recordings/{session}/{file}, serving
+// a recording for playback in noVNC's vnc_playback.html.
+func adminGetRecording(w http.ResponseWriter, r *http.Request) {
+	session, file := r.PathValue("session"), r.PathValue("file")
+	if !recordingNameRe.MatchString(session) || !recordingNameRe.MatchString(file) || !strings.HasSuffix(file, ".js") {
+		http.NotFound(w, r)
+		return
+	}
+	audit("recording.view", "admin", session, map[string]string{"file": file})
+	w.Header().Set("Content-Type", "text/javascript")
+	http.ServeFile(w, r, filepath.Join(recordingsDir, session, file))
+}
+
+// adminDeleteRecording handles DELETE /admin/recordings/{session}.
+func adminDeleteRecording(w http.ResponseWriter, r *http.Request) {
+	session := r.PathValue("session")
+	if !recordingNameRe.MatchString(session) || strings.HasSuffix(session, ".js") {
+		http.NotFound(w, r)
+		return
+	}
+	if err := guardHistory("recording.delete "+session, "admin"); err != nil {
+		writeJSONError(w, 403, err)
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(recordingsDir, session)); err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	audit("recording.delete", "admin", session, nil)
+	w.WriteHeader(204)
+}
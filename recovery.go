@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// A handler that panics gets a logged stack trace, with the request it was
+// serving, and the client the usual 500 error page (if nothing had been
+// sent yet) instead of a dropped connection. With sentry_dsn set, panics
+// are also reported to Sentry (or anything speaking its envelope protocol,
+// such as GlitchTip).
+
+var (
+	sentryDSN    = "" // Where panics are reported ("" = nowhere)
+	sentryClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// recoverPanics turns handler panics into 500 responses.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v) // Deliberately aborting the response
+			}
+			stack := debug.Stack()
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			log.Printf("Panic serving %s %s for %s: %v\n%s", r.Method, logPath(r.URL.Path), host, v, stack)
+			go reportPanic(r, v, stack)
+			if sw.status == 0 {
+				httpError(sw, r, 500, "error.internal")
+			}
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// sentryEndpoint returns the envelope URL and public key in a Sentry DSN,
+// https://<key>@<host>[/<path>]/<project>.
+func sentryEndpoint(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return "", "", fmt.Errorf("sentry_dsn: want https://<key>@<host>/<project>")
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 || p[i+1:] == "" {
+		return "", "", fmt.Errorf("sentry_dsn: no project ID")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, p[:i], p[i+1:]), u.User.Username(), nil
+}
+
+// reportPanic sends a panic to Sentry, if configured.
+func reportPanic(r *http.Request, v any, stack []byte) {
+	if sentryDSN == "" {
+		return
+	}
+	endpoint, key, err := sentryEndpoint(sentryDSN)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	hostname, _ := os.Hostname()
+	id := newAgentToken()
+	event := map[string]any{
+		"event_id":    id,
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"platform":    "go",
+		"level":       "fatal",
+		"logger":      "lookingglass",
+		"server_name": hostname,
+		"exception": map[string]any{"values": []map[string]any{{
+			"type":  fmt.Sprintf("%T", v),
+			"value": fmt.Sprint(v),
+		}}},
+		"request": map[string]any{"method": r.Method, "url": logPath(r.URL.Path)},
+		"extra":   map[string]any{"stack": string(stack)},
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.Encode(map[string]string{"event_id": id, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	enc.Encode(map[string]string{"type": "event"})
+	enc.Encode(event)
+
+	req, err := http.NewRequest("POST", endpoint, &body)
+	if err != nil {
+		log.Printf("Reporting panic to Sentry: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=lookingglass/1.0, sentry_key="+key)
+	resp, err := sentryClient.Do(req)
+	if err != nil {
+		log.Printf("Reporting panic to Sentry: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Reporting panic to Sentry: %s", resp.Status)
+	}
+}
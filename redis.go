@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Redis client, enough for the cluster store: one connection,
+// re-dialled after any error, speaking RESP with string arguments.
+
+const redisTimeout = 5 * time.Second
+
+// redisClient is a connection to a Redis server.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	tls      bool
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// errRedisNil is the reply to reading a key that doesn't exist.
+var errRedisNil = errors.New("redis: nil")
+
+// newRedisClient parses a redis://[:password@]host[:port][/db] URL (or
+// rediss:// for TLS).
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("%s: not a redis:// URL", rawURL)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("%s: invalid database %q", rawURL, db)
+		}
+	}
+	return c, nil
+}
+
+// dial connects, authenticates and selects the database. The caller must
+// hold c.mu.
+func (c *redisClient) dial() error {
+	var conn net.Conn
+	var err error
+	d := &net.Dialer{Timeout: redisTimeout}
+	if c.tls {
+		conn, err = tls.DialWithDialer(d, "tcp", c.addr, nil)
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTrip("AUTH", c.password); err != nil {
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip("SELECT", strconv.Itoa(c.db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do runs a command, returning its reply: a string, an int64, a []any,
+// or errRedisNil.
+func (c *redisClient) do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args...)
+	var redisErr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &redisErr) {
+		c.close() // The connection may be out of step; start afresh
+	}
+	return reply, err
+}
+
+// close drops the connection. The caller must hold c.mu.
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn, c.rd = nil, nil
+}
+
+// roundTrip sends one command and reads its reply. The caller must hold
+// c.mu.
+func (c *redisClient) roundTrip(args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readReply reads one RESP reply.
+func (c *redisClient) readReply() (any, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// get returns a key's value.
+func (c *redisClient) get(key string) (string, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	s, _ := reply.(string)
+	return s, nil
+}
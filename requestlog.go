@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Every request is logged with its method, path, status, response size and
+// duration (unless access_log = false), and its duration is counted by
+// route for /metrics. Routes are the handler patterns they matched, so the
+// metrics don't grow a series per session. Session IDs and tokens are cut
+// short in logged paths, as the paths are all it takes to use them, and
+// query strings are left out for the same reason.
+
+var accessLog = true // Log every request
+
+// knownMethods are the methods counted by name in the metrics: HTTP's own,
+// and WebDAV's.
+var knownMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// secretSegmentRe matches the session IDs and tokens in paths.
+var secretSegmentRe = regexp.MustCompile(`[0-9a-f]{32}`)
+
+// statusWriter records what a handler sends.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = 200
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Hijack hands over the connection for a websocket, which counts as
+// switching protocols.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err == nil && sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// logPath returns a request's path fit for the log: tokens shortened, and
+// control characters, which could forge log lines, replaced.
+func logPath(path string) string {
+	path = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, path)
+	return secretSegmentRe.ReplaceAllStringFunc(path, func(s string) string { return s[:8] + "…" })
+}
+
+// routeOf returns the handler pattern a request matches, without its
+// method.
+func routeOf(r *http.Request) string {
+	_, pattern := http.DefaultServeMux.Handler(r)
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	if pattern == "" {
+		return "other"
+	}
+	return pattern
+}
+
+// logRequests logs and times every request.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeOf(r)
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		d := time.Since(start)
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		method := r.Method
+		if !slices.Contains(knownMethods, method) {
+			method = "other" // Clients choose methods, so they can't all get a series
+		}
+		observeRequest(route, method, sw.status, sw.bytes, d)
+		if accessLog {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			log.Printf("%s %s %s %d %dB %.1fms", host, r.Method, logPath(r.URL.Path), sw.status, sw.bytes, float64(d.Microseconds())/1000)
+		}
+	})
+}
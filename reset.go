@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users can reset a broken desktop themselves from its session page: the
+// session is stopped, the overlay's upperdir is cleared (or set aside as
+// upper.reset-<time> next to it, when asked to keep it), and a fresh desktop
+// is started from the base image. The exchange directory and printouts are
+// left alone. Kept upperdirs count towards the desktop's storage on the
+// profile page and towards any quota, and are removed when it is wiped.
+
+const resetPrefix = "upper.reset-"
+
+// keptResets returns the upperdirs set aside by earlier resets.
+func keptResets(overlayDir string, encrypted bool) []string {
+	upper, _ := overlayPaths(overlayDir, encrypted)
+	kept, _ := filepath.Glob(filepath.Join(filepath.Dir(upper), resetPrefix+"*"))
+	return kept
+}
+
+// resetOverlay clears a stopped desktop's upperdir and workdir. With keep,
+// the upperdir is renamed aside instead of deleted; renaming within the
+// directory works even while an encrypted overlay is locked.
+func resetOverlay(d *User, keep bool) error {
+	dir := d.overlay()
+	encrypted := d.setting("encryption") == "fscrypt"
+	upper, work := overlayPaths(dir, encrypted)
+	if keep {
+		kept := filepath.Join(filepath.Dir(upper), resetPrefix+time.Now().Format("20060102-150405"))
+		if err := os.Rename(upper, kept); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.RemoveAll(upper); err != nil {
+		return err
+	}
+	return os.RemoveAll(work)
+}
+
+// resetHandler serves POST /reset/<session> for the session owner, with
+// the user's password (which also unlocks an encrypted overlay again) and
+// keep=1 to set the old upperdir aside. The browser ends up on the fresh
+// desktop's session page.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/reset/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	if s.Ephemeral {
+		httpError(w, r, 400, "error.no_storage")
+		return
+	}
+	if s.containerless() {
+		httpError(w, r, 400, "error.no_container")
+		return
+	}
+	u, err := loadUser(s.Username)
+	if err == nil && s.Desktop != "" {
+		u, err = u.forDesktop(s.Desktop)
+	}
+	if err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	password := r.FormValue("password")
+	if !u.checkPassword(password) {
+		audit("login.failed", u.Name, sessionID, map[string]string{"reason": "bad password", "remote": r.RemoteAddr, "desktop": u.Desktop})
+		httpError(w, r, 401, "error.invalid_credentials")
+		return
+	}
+	keep := r.FormValue("keep") != ""
+
+	// Held so nothing starts the desktop between stopping and clearing it
+	unlock, err := lockDesktop(u.Name, u.Desktop)
+	if err != nil {
+		unlock()
+		httpError(w, r, 409, "error.desktop_running")
+		return
+	}
+	stopSessionLocked(sessionID, endReset)
+	err = resetOverlay(u, keep)
+	unlock()
+	if err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	audit("overlay.reset", u.Name, sessionID, map[string]string{
+		"desktop": u.Desktop, "kept": strconv.FormatBool(keep), "remote": r.RemoteAddr,
+	})
+	openDesktop(w, r, u, password)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Starting a desktop retries the steps that fail for passing reasons: a
+// port taken between choosing it and docker run, the Docker daemon
+// restarting, a mount point still busy from the last session, a registry
+// or file server not answering. Each step is tried up to retry_attempts
+// times, waiting retry_backoff before the second try and twice as long
+// before each one after (with some jitter, so a burst of logins doesn't
+// retry in step). Anything else fails at once, and the error reported is
+// the last attempt's.
+
+var (
+	retryAttempts = 3           // Tries of each retried step
+	retryBackoff  = time.Second // Wait before the first retry
+)
+
+// maxRetryWait caps the wait between tries.
+const maxRetryWait = 30 * time.Second
+
+// transientErrors are the failures worth trying again, as the commands
+// report them.
+var transientErrors = []string{
+	"port is already allocated",
+	"address already in use",
+	"is already in use by container", // The previous container is still being removed
+	"Cannot connect to the Docker daemon",
+	"device or resource busy",
+	"target is busy",
+	"connection refused",
+	"connection reset",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"timed out after", // See timedCommand
+}
+
+// transient reports whether an error is worth trying again.
+func transient(err error) bool {
+	msg := err.Error()
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs fn until it succeeds, fails for good, ctx ends or the
+// attempts run out.
+func retry(ctx context.Context, what string, fn func() error) error {
+	wait := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= retryAttempts {
+			return fmt.Errorf("%v (gave up after %d attempts)", err, attempt)
+		}
+		d := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		log.Printf("%s failed (attempt %d of %d), retrying in %v: %v", what, attempt, retryAttempts, d.Round(time.Millisecond), err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+		wait = min(2*wait, maxRetryWait)
+	}
+}
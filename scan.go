@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files coming into desktops can be checked by a malware scanner, set
+// gateway-wide with scan_command (for example "clamdscan --fdpass
+// --no-summary --infected"). The command is run with a file or directory
+// appended, and is expected to exit 0 when it is clean and 1 when something
+// was found, printing "<path>: <signature> FOUND" for each hit, as ClamAV's
+// scanners do. What is scanned is set per user, role or group with scan:
+//
+//	uploads  files uploaded through the file browser or WebDAV (the default)
+//	logout   also the desktop's upperdir when its session ends
+//	none     nothing
+//
+// Hits are moved to quarantine_dir/<user>-<time>/, audited as
+// scan.infected and, with scan_alert_command, passed to a command (run by
+// the shell with LG_USER, LG_SESSION, LG_FILE, LG_SIGNATURE and
+// LG_QUARANTINE set) to alert admins. An upload that is found infected, or
+// that the scanner fails on or times out over, is refused; uploads are
+// scanned before they are put in place. Encrypted overlays are only scanned
+// on upload: their upperdirs are locked once the session ends.
+
+var (
+	scanCommand      = ""                         // Malware scanner, run with a path appended ("" = no scanning)
+	scanAlertCommand = ""                         // Shell command run for each hit
+	quarantineDir    = "/srv/overlays/quarantine" // Where infected files are moved
+)
+
+// errInfected is returned for an upload the scanner found infected.
+var errInfected = errors.New("the scanner found malware")
+
+// errScanFailed is returned for an upload the scanner couldn't check.
+var errScanFailed = errors.New("the scanner failed")
+
+// scanHit is a file the scanner flagged.
+type scanHit struct {
+	Path      string
+	Signature string
+}
+
+// scanPolicy returns what u's files are scanned at: uploads, logout or none.
+func scanPolicy(u *User) string {
+	if scanCommand == "" {
+		return "none"
+	}
+	if p := u.setting("scan"); p != "" {
+		return p
+	}
+	return "uploads"
+}
+
+// scanPath runs the scanner over a file or directory, within scanTimeout.
+func scanPath(ctx context.Context, target string) ([]scanHit, error) {
+	fields := strings.Fields(scanCommand)
+	out, err := timedCommand(ctx, scanTimeout, fields[0], append(fields[1:], target)...)
+	var exitErr *exec.ExitError
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return nil, fmt.Errorf("scan_command: %v", err)
+	}
+	var hits []scanHit
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		line, ok := strings.CutSuffix(strings.TrimSpace(sc.Text()), " FOUND")
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(line, ": "); i > 0 {
+			hits = append(hits, scanHit{Path: line[:i], Signature: line[i+2:]})
+		}
+	}
+	if len(hits) == 0 {
+		hits = []scanHit{{Path: target, Signature: "unknown"}}
+	}
+	return hits, nil
+}
+
+// quarantine moves hits under root into a new quarantine directory, then
+// audits and alerts on each. name gives the name a hit is reported and
+// quarantined under, from its path relative to root.
+func quarantine(user, sessionID, root string, hits []scanHit, name func(string) string) {
+	dir := filepath.Join(quarantineDir, user+"-"+time.Now().Format("20060102-150405"))
+	for _, hit := range hits {
+		rel, err := filepath.Rel(root, hit.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			log.Printf("Scanner reported %s outside %s; not quarantined", hit.Path, root)
+			continue
+		}
+		file := name(rel)
+		dest := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(file, "/")))
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err == nil {
+			err = os.Rename(hit.Path, dest)
+		}
+		if err != nil {
+			log.Printf("Quarantining %s: %v; removing it", hit.Path, err)
+			os.Remove(hit.Path)
+			dest = ""
+		} else {
+			os.Chmod(dest, 0600)
+		}
+		log.Printf("Scanner found %s in %s (user %s); quarantined to %s", hit.Signature, file, user, dest)
+		audit("scan.infected", user, sessionID, map[string]string{"file": file, "signature": hit.Signature, "quarantine": dest})
+		scanAlert(user, sessionID, file, hit.Signature, dest)
+	}
+}
+
+// scanAlert runs scan_alert_command for a hit.
+func scanAlert(user, sessionID, file, signature, dest string) {
+	if scanAlertCommand == "" {
+		return
+	}
+	_, err := timedCommand(context.Background(), commandTimeout, "env",
+		"LG_USER="+user, "LG_SESSION="+sessionID, "LG_FILE="+file,
+		"LG_SIGNATURE="+signature, "LG_QUARANTINE="+dest,
+		"sh", "-c", scanAlertCommand)
+	if err != nil {
+		log.Printf("scan_alert_command: %v", err)
+	}
+}
+
+// scanUpload scans an uploaded file before it is put in place as name,
+// quarantining it and returning errInfected if anything is found. Files
+// the scanner fails on or times out over aren't let through either
+// (errScanFailed), nor are those whose uploader goes away meanwhile.
+func scanUpload(ctx context.Context, policy, user, sessionID, tmp, name string) error {
+	if policy == "none" || policy == "" {
+		return nil
+	}
+	hits, err := scanPath(ctx, tmp)
+	if ctx.Err() != nil {
+		return ctx.Err() // The uploader left; it isn't let through unscanned
+	}
+	if err != nil {
+		log.Printf("Scanning upload %s for %s: %v", name, user, err)
+		return errScanFailed
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	quarantine(user, sessionID, filepath.Dir(tmp), hits, func(string) string { return name })
+	return errInfected
+}
+
+// scanUpperdir scans a finished session's upperdir, quarantining hits. The
+// desktop is locked meanwhile, so it can't start again on an upperdir whose
+// files are being moved out; if it already has, the scan is left for its
+// next logout.
+func scanUpperdir(s Session) {
+	if s.Scan != "logout" || s.Ephemeral || s.Encrypted {
+		return
+	}
+	unlock, err := lockDesktop(s.Username, s.Desktop)
+	defer unlock()
+	if err != nil {
+		log.Printf("Scanning %s's desktop after logout: %v; skipped", s.Username, err)
+		return
+	}
+	if _, live := findDesktopSession(s.Username, s.Desktop); live {
+		return
+	}
+	upper, _ := overlayPaths(s.OverlayDir, false)
+	hits, err := scanPath(context.Background(), upper)
+	if err != nil {
+		log.Printf("Scanning %s for %s: %v", upper, s.Username, err)
+		return
+	}
+	quarantine(s.Username, s.ID, upper, hits, func(rel string) string { return "/" + filepath.ToSlash(rel) })
+}
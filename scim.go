@@ -0,0 +1,533 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// An identity platform can manage users through a SCIM 2.0 (RFC 7644)
+// server at /scim/v2/, authenticated with scim_token as a bearer token.
+// A SCIM user is a LookingGlass user, with the user name as its id:
+//
+//	POST   /scim/v2/Users        create (userName, password, active)
+//	GET    /scim/v2/Users        list, with filter=userName eq "alice"
+//	GET    /scim/v2/Users/<id>
+//	PUT    /scim/v2/Users/<id>   replace password and active
+//	PATCH  /scim/v2/Users/<id>   change them
+//	DELETE /scim/v2/Users/<id>
+//
+// Deactivating a user (active = false) sets disabled = true in their file,
+// which refuses their logins, ends their sessions and archives their
+// overlays to archive_dir as <user>-<time>.tar.gz; reactivating them lets
+// them back in to the same overlays. Deleting a user archives their
+// overlays too, then removes them and the user's file (a user still in a
+// group passwords file is left disabled instead). Users created
+// without a password get a random one, for the identity platform to set.
+
+var (
+	scimToken         = ""                      // Bearer token for /scim/v2/ ("" = SCIM disabled)
+	overlayArchiveDir = "/srv/overlays/archive" // Where deprovisioned users' overlays are archived
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimUser is a user as a SCIM resource.
+type scimUser struct {
+	Schemas  []string `json:"schemas"`
+	ID       string   `json:"id"`
+	UserName string   `json:"userName"`
+	Active   bool     `json:"active"`
+	Groups   []struct {
+		Value string `json:"value"`
+	} `json:"groups,omitempty"`
+	Meta struct {
+		ResourceType string `json:"resourceType"`
+		Location     string `json:"location"`
+	} `json:"meta"`
+}
+
+// scimUserRequest is the body of a create or replace.
+type scimUserRequest struct {
+	UserName string `json:"userName"`
+	Password string `json:"password"`
+	Active   *bool  `json:"active"`
+}
+
+// scimPatch is the body of a PATCH.
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+var scimFilterRe = regexp.MustCompile(`^userName eq "([^"]*)"$`)
+
+// writeSCIM writes a SCIM response.
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeSCIMError writes a SCIM error response.
+func writeSCIMError(w http.ResponseWriter, status int, scimType string, err error) {
+	writeSCIM(w, status, map[string]any{
+		"schemas":  []string{scimErrorSchema},
+		"status":   strconv.Itoa(status),
+		"scimType": scimType,
+		"detail":   err.Error(),
+	})
+}
+
+// scimOnly guards a SCIM handler with scim_token.
+func scimOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secretsMu.RLock()
+		want := scimToken
+		secretsMu.RUnlock()
+		if want == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lookingglass-scim"`)
+			writeSCIMError(w, 401, "", errors.New("invalid token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// scimResource returns u as a SCIM resource.
+func scimResource(u *User) scimUser {
+	res := scimUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       u.Name,
+		UserName: u.Name,
+		Active:   !u.conf.Key("disabled").MustBool(false),
+	}
+	for _, g := range u.groupNames() {
+		res.Groups = append(res.Groups, struct {
+			Value string `json:"value"`
+		}{g})
+	}
+	res.Meta.ResourceType = "User"
+	res.Meta.Location = "/scim/v2/Users/" + u.Name
+	return res
+}
+
+// scimLoadUser loads the user a request names, answering 404 if there is
+// none.
+func scimLoadUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	id := r.PathValue("id")
+	if !usernameRe.MatchString(id) {
+		writeSCIMError(w, 404, "", fmt.Errorf("no user %s", id))
+		return nil, false
+	}
+	u, err := loadUser(id)
+	if os.IsNotExist(err) {
+		writeSCIMError(w, 404, "", fmt.Errorf("no user %s", id))
+		return nil, false
+	}
+	if err != nil {
+		writeSCIMError(w, 500, "", err)
+		return nil, false
+	}
+	return u, true
+}
+
+// scimListUsers handles GET /scim/v2/Users.
+func scimListUsers(w http.ResponseWriter, r *http.Request) {
+	names := userNames()
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		m := scimFilterRe.FindStringSubmatch(filter)
+		if m == nil {
+			writeSCIMError(w, 400, "invalidFilter", errors.New(`only userName eq "<name>" is supported`))
+			return
+		}
+		names = slices.DeleteFunc(names, func(n string) bool { return n != m[1] })
+	}
+	total := len(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	start = max(start, 1)
+	names = names[min(start-1, len(names)):]
+	if count, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && count >= 0 && count < len(names) {
+		names = names[:count]
+	}
+	resources := []scimUser{}
+	for _, name := range names {
+		if u, err := loadUser(name); err == nil {
+			resources = append(resources, scimResource(u))
+		}
+	}
+	writeSCIM(w, 200, map[string]any{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// scimGetUser handles GET /scim/v2/Users/{id}.
+func scimGetUser(w http.ResponseWriter, r *http.Request) {
+	if u, ok := scimLoadUser(w, r); ok {
+		writeSCIM(w, 200, scimResource(u))
+	}
+}
+
+// scimCreateUser handles POST /scim/v2/Users.
+func scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req scimUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", err)
+		return
+	}
+	if !usernameRe.MatchString(req.UserName) {
+		writeSCIMError(w, 400, "invalidValue", fmt.Errorf("invalid user name %q", req.UserName))
+		return
+	}
+	if _, err := loadUser(req.UserName); err == nil {
+		writeSCIMError(w, 409, "uniqueness", fmt.Errorf("user %s already exists", req.UserName))
+		return
+	}
+	password := req.Password
+	if password == "" {
+		// Nobody knows it, so nobody can log in until one is set
+		password = newAgentToken()
+	}
+	spec := UserSpec{Username: req.UserName, PasswordHash: hashPassword(password)}
+	if err := provisionUser(spec); err != nil {
+		writeSCIMError(w, 400, "invalidValue", err)
+		return
+	}
+	audit("user.create", "scim", "", map[string]string{"user": req.UserName})
+	if req.Active != nil && !*req.Active {
+		if err := setUserActive(req.UserName, false); err != nil {
+			writeSCIMError(w, 500, "", err)
+			return
+		}
+	}
+	u, err := loadUser(req.UserName)
+	if err != nil {
+		writeSCIMError(w, 500, "", err)
+		return
+	}
+	writeSCIM(w, 201, scimResource(u))
+}
+
+// scimReplaceUser handles PUT /scim/v2/Users/{id}.
+func scimReplaceUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := scimLoadUser(w, r)
+	if !ok {
+		return
+	}
+	var req scimUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", err)
+		return
+	}
+	if req.UserName != "" && req.UserName != u.Name {
+		writeSCIMError(w, 400, "mutability", errors.New("userName cannot be changed"))
+		return
+	}
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+	scimUpdate(w, u, req.Password, &active)
+}
+
+// scimPatchUser handles PATCH /scim/v2/Users/{id}: replace (or add) of
+// active and password, by path or as a value object.
+func scimPatchUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := scimLoadUser(w, r)
+	if !ok {
+		return
+	}
+	var patch scimPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", err)
+		return
+	}
+	var password string
+	var active *bool
+	for _, op := range patch.Operations {
+		if o := strings.ToLower(op.Op); o != "replace" && o != "add" {
+			writeSCIMError(w, 400, "invalidValue", fmt.Errorf("unsupported op %q", op.Op))
+			return
+		}
+		var req scimUserRequest
+		var err error
+		switch strings.ToLower(op.Path) {
+		case "":
+			err = json.Unmarshal(op.Value, &req)
+		case "active":
+			req.Active = new(bool)
+			err = json.Unmarshal(op.Value, req.Active)
+			if err != nil {
+				// Some platforms send "False"
+				var s string
+				if json.Unmarshal(op.Value, &s) == nil {
+					*req.Active, err = strconv.ParseBool(strings.ToLower(s))
+				}
+			}
+		case "password":
+			err = json.Unmarshal(op.Value, &req.Password)
+		default:
+			err = fmt.Errorf("unsupported path %q", op.Path)
+		}
+		if err != nil {
+			writeSCIMError(w, 400, "invalidValue", err)
+			return
+		}
+		if req.Password != "" {
+			password = req.Password
+		}
+		if req.Active != nil {
+			active = req.Active
+		}
+	}
+	scimUpdate(w, u, password, active)
+}
+
+// scimUpdate sets a user's password and active state, if given, and
+// answers with the user. The password of a user with an encrypted overlay
+// can't be changed: the overlay's key is protected by the old one, and
+// only the user's own login can unlock it.
+func scimUpdate(w http.ResponseWriter, u *User, password string, active *bool) {
+	if password != "" && u.encrypted() && !u.checkPassword(password) {
+		writeSCIMError(w, 400, "mutability", errors.New("the user's overlay is encrypted with their current password"))
+		return
+	}
+	if password != "" {
+		err := updateUserFile(u.Name, func(sec *ini.Section) {
+			sec.Key("password").SetValue(hashPassword(password))
+		})
+		if err != nil {
+			writeSCIMError(w, 500, "", err)
+			return
+		}
+		audit("user.password", "scim", "", map[string]string{"user": u.Name})
+	}
+	if active != nil {
+		if err := setUserActive(u.Name, *active); err != nil {
+			writeSCIMError(w, 500, "", err)
+			return
+		}
+	}
+	u, err := loadUser(u.Name)
+	if err != nil {
+		writeSCIMError(w, 500, "", err)
+		return
+	}
+	writeSCIM(w, 200, scimResource(u))
+}
+
+// scimDeleteUser handles DELETE /scim/v2/Users/{id}.
+func scimDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := scimLoadUser(w, r)
+	if !ok {
+		return
+	}
+	overlays, err := deprovisionUser(u)
+	if err != nil {
+		writeSCIMError(w, 500, "", err)
+		return
+	}
+	for _, o := range overlays {
+		clean := filepath.Clean(o)
+		if clean == "/" || clean == filepath.Clean(overlayRoot) || clean == filepath.Clean(baseOverlay) {
+			continue
+		}
+		if err := os.RemoveAll(clean); err != nil {
+			log.Printf("Deleting overlay %s of %s: %v", clean, u.Name, err)
+		}
+	}
+	if _, listed := groupPassword(u.Name); listed {
+		// Still in a group passwords file, so only disabled
+		err = updateUserFile(u.Name, func(sec *ini.Section) { sec.Key("disabled").SetValue("true") })
+	} else {
+		err = os.Remove(filepath.Join(userConfDir, u.Name+".conf"))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		writeSCIMError(w, 500, "", err)
+		return
+	}
+	audit("user.delete", "scim", "", map[string]string{"user": u.Name})
+	w.WriteHeader(204)
+}
+
+// scimServiceProviderConfig handles GET /scim/v2/ServiceProviderConfig.
+func scimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, 200, map[string]any{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": 1000},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]string{{
+			"type": "oauthbearertoken", "name": "Bearer token", "description": "scim_token from the gateway config",
+		}},
+	})
+}
+
+// updateUserFile changes a user's file, creating it for a user who only
+// has a group passwords entry.
+func updateUserFile(username string, change func(sec *ini.Section)) error {
+	path := filepath.Join(userConfDir, username+".conf")
+	cfg, err := ini.Load(path)
+	if os.IsNotExist(err) {
+		password, ok := groupPassword(username)
+		if !ok {
+			return err
+		}
+		cfg = ini.Empty()
+		cfg.Section("user").Key("password").SetValue(password)
+	} else if err != nil {
+		return err
+	}
+	change(cfg.Section("user"))
+	if err := cfg.SaveTo(path); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// setUserActive enables or disables a user. Disabling one ends their
+// sessions and archives their overlays.
+func setUserActive(username string, active bool) error {
+	u, err := loadUser(username)
+	if err != nil {
+		return err
+	}
+	if active == !u.conf.Key("disabled").MustBool(false) {
+		return nil
+	}
+	err = updateUserFile(username, func(sec *ini.Section) {
+		if active {
+			sec.DeleteKey("disabled")
+		} else {
+			sec.Key("disabled").SetValue("true")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if active {
+		audit("user.enable", "scim", "", map[string]string{"user": username})
+		return nil
+	}
+	audit("user.disable", "scim", "", map[string]string{"user": username})
+	_, err = deprovisionUser(u)
+	return err
+}
+
+// deprovisionUser ends a user's sessions and archives their overlays,
+// returning the overlay directories archived.
+func deprovisionUser(u *User) ([]string, error) {
+	var ids []string
+	sessionsMu.RLock()
+	for id, s := range sessions {
+		if s.Username == u.Name {
+			ids = append(ids, id)
+		}
+	}
+	sessionsMu.RUnlock()
+	terminateSessions(ids, endDeprovisioned)
+
+	// Named desktops' overlays usually live inside the user's own
+	var overlays []string
+	for _, d := range append([]string{""}, u.desktops()...) {
+		du := u
+		if d != "" {
+			du, _ = u.forDesktop(d)
+		}
+		o := du.overlay()
+		if o == "" || o == "ephemeral" || slices.ContainsFunc(overlays, func(p string) bool {
+			return o == p || strings.HasPrefix(o, p+"/")
+		}) {
+			continue
+		}
+		if _, err := os.Stat(o); err == nil {
+			overlays = append(overlays, o)
+		}
+	}
+	if len(overlays) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(overlayArchiveDir, 0700); err != nil {
+		return nil, err
+	}
+	path, err := archiveOverlays(u.Name, overlays)
+	if err != nil {
+		return nil, fmt.Errorf("archiving overlays: %v", err)
+	}
+	audit("overlay.archive", "scim", "", map[string]string{"user": u.Name, "archive": path})
+	return overlays, nil
+}
+
+// archiveOverlays writes a user's overlay directories to a new tar.gz file
+// in archive_dir, each under its base name, returning its path. Encrypted
+// overlays are archived as they are stored.
+func archiveOverlays(username string, overlays []string) (string, error) {
+	name := username + "-" + time.Now().Format("20060102-150405")
+	path := filepath.Join(overlayArchiveDir, name+".tar.gz")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	for i := 2; os.IsExist(err); i++ {
+		path = filepath.Join(overlayArchiveDir, fmt.Sprintf("%s-%d.tar.gz", name, i))
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := writeOverlayArchive(f, overlays); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// writeOverlayArchive writes overlay directories to f as a tar.gz.
+func writeOverlayArchive(f *os.File, overlays []string) error {
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for i, o := range overlays {
+		prefix := filepath.Base(o)
+		if i > 0 {
+			prefix = fmt.Sprintf("%s-%d", prefix, i)
+		}
+		if err := archiveDir(tw, o, prefix); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
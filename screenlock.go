@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// With lock_on_disconnect (a per-user, group, role or image grace period,
+// such as 30s) a session locks itself once its owner's last connection (a
+// VNC or web terminal websocket) has been closed that long, so walking away
+// from a shared machine (or just closing the tab) doesn't leave it open to
+// the next person at the keyboard. Sessions reattached after a gateway
+// restart lock unless their owner reconnects in time. The owner cookie is
+// replaced, so the browser that left can't simply reconnect, and desktops
+// are also locked inside the container with i3lock, which the image only
+// lets the gateway undo (the shared docker password won't, so share
+// viewers can't). Terminals, VMs and external hosts have no screen lock of
+// their own; the new cookie alone keeps them closed. The session is
+// unlocked by logging in again with the user's password (from the login
+// form, the desktop chooser or a launch link), rate limited like the login
+// form. Reconnecting within the grace period, reloading the page say,
+// doesn't lock it. Locks and unlocks are audited (session.lock,
+// session.unlock).
+
+var (
+	lockTimers   = make(map[string]*time.Timer) // Pending locks by session
+	lockTimersMu sync.Mutex
+)
+
+// scheduleScreenLock locks a session after its grace period, unless its
+// owner reconnects first.
+func scheduleScreenLock(sessionID string) {
+	sessionsMu.RLock()
+	s, ok := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !ok || s.LockAfter <= 0 || s.ScreenLocked {
+		return
+	}
+	lockTimersMu.Lock()
+	defer lockTimersMu.Unlock()
+	if t := lockTimers[sessionID]; t != nil {
+		t.Stop()
+	}
+	lockTimers[sessionID] = time.AfterFunc(s.LockAfter, func() { lockScreen(sessionID) })
+}
+
+// cancelScreenLock forgets a pending lock.
+func cancelScreenLock(sessionID string) {
+	lockTimersMu.Lock()
+	defer lockTimersMu.Unlock()
+	if t := lockTimers[sessionID]; t != nil {
+		t.Stop()
+		delete(lockTimers, sessionID)
+	}
+}
+
+// lockScreen locks a session whose owner is still gone.
+func lockScreen(sessionID string) {
+	lockTimersMu.Lock()
+	delete(lockTimers, sessionID)
+	lockTimersMu.Unlock()
+	ownerConnsMu.Lock()
+	connected := len(ownerConns[sessionID]) > 0
+	ownerConnsMu.Unlock()
+	if connected {
+		return
+	}
+
+	sessionsMu.Lock()
+	s, ok := sessions[sessionID]
+	if !ok || s.ScreenLocked {
+		sessionsMu.Unlock()
+		return
+	}
+	s.ScreenLocked = true
+	s.OwnerToken = newAgentToken()
+	sessions[sessionID] = s
+	saveSessions()
+	sessionsMu.Unlock()
+
+	if !s.containerless() && !s.Terminal && !s.Suspended {
+		if err := desktopExec(s.ContainerName, "i3lock", "--color=1e1e1e"); err != nil {
+			log.Printf("Locking the screen of %s: %v", sessionID, err)
+		}
+	}
+	audit("session.lock", s.Username, sessionID, map[string]string{"after": s.LockAfter.String()})
+}
+
+// unlockScreen unlocks a locked session for its owner, who has just logged
+// in again.
+func unlockScreen(r *http.Request, s Session) {
+	if !s.containerless() && !s.Terminal {
+		if err := desktopExec(s.ContainerName, "pkill", "-x", "i3lock"); err != nil {
+			log.Printf("Unlocking the screen of %s: %v", s.ID, err)
+		}
+	}
+	audit("session.unlock", s.Username, s.ID, map[string]string{"remote": r.RemoteAddr})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Secret config values (admin_token, scim_token, launch_key,
+// captcha_secret, vault_token) need not be written into the config file. Each can instead
+// be a reference that is resolved when the config is loaded:
+//
+//	file:/run/secrets/admin-token     the file's contents
+//	env:ADMIN_TOKEN                   an environment variable
+//	vault:secret/data/lookingglass:admin_token
+//	                                  a field of a HashiCorp Vault KV secret
+//
+// With secret_refresh set they are resolved again at that interval, so a
+// secret rotated in its file or in Vault is picked up without a restart.
+// The admin token may hold several tokens, one per line, all of which are
+// accepted: during a rotation the new token goes first (the CLI uses it) and
+// the old one stays valid until every client has moved over.
+
+var (
+	vaultAddr     = ""          // Vault server URL (default $VAULT_ADDR)
+	vaultToken    = ""          // Vault token (default $VAULT_TOKEN)
+	secretRefresh time.Duration // How often secrets are resolved again (0 = only at startup)
+	adminTokens   []string      // Every accepted admin token; adminToken is the first
+	secretsMu     sync.RWMutex  // Guards adminToken, adminTokens, scimToken, launchKey, metricsToken and captchaSecret
+	vaultClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+// resolveSecret returns the value a secret reference stands for, or the
+// value itself if it is not a reference.
+func resolveSecret(value string) (string, error) {
+	kind, ref, _ := strings.Cut(value, ":")
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "env":
+		v, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return v, nil
+	case "vault":
+		return vaultSecret(ref)
+	}
+	return value, nil
+}
+
+// vaultSecret reads a field of a Vault secret, given as <path>:<field>
+// (not #, which would start a comment in the config file).
+// Both KV version 1 and version 2 (whose paths include data/) are read.
+func vaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("vault:%s: no :field given", ref)
+	}
+	if vaultAddr == "" || vaultToken == "" {
+		return "", errors.New("vault_addr and vault_token (or $VAULT_ADDR and $VAULT_TOKEN) must be set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(vaultAddr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vaultToken)
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		data = inner // KV version 2
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s: no field %s", path, field)
+	}
+	return v, nil
+}
+
+// secretKey resolves a secret config key, returning def if it is unset.
+func secretKey(sec *ini.Section, key, def string) (string, error) {
+	if !sec.HasKey(key) {
+		return def, nil
+	}
+	v, err := resolveSecret(sec.Key(key).String())
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", key, err)
+	}
+	return v, nil
+}
+
+// loadSecrets resolves the secret keys of the [gateway] section.
+func loadSecrets(gw *ini.Section) error {
+	vaultAddr = gw.Key("vault_addr").MustString(os.Getenv("VAULT_ADDR"))
+	if strings.HasPrefix(gw.Key("vault_token").String(), "vault:") {
+		return errors.New("vault_token cannot itself come from vault")
+	}
+	token, err := secretKey(gw, "vault_token", os.Getenv("VAULT_TOKEN"))
+	if err != nil {
+		return err
+	}
+	vaultToken = token
+	admin, err := secretKey(gw, "admin_token", "")
+	if err != nil {
+		return err
+	}
+	captcha, err := secretKey(gw, "captcha_secret", "")
+	if err != nil {
+		return err
+	}
+	scim, err := secretKey(gw, "scim_token", "")
+	if err != nil {
+		return err
+	}
+	launch, err := secretKey(gw, "launch_key", "")
+	if err != nil {
+		return err
+	}
+	metrics, err := secretKey(gw, "metrics_token", "")
+	if err != nil {
+		return err
+	}
+
+	var tokens []string
+	for _, t := range strings.Split(admin, "\n") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	adminTokens, adminToken = tokens, ""
+	if len(tokens) > 0 {
+		adminToken = tokens[0]
+	}
+	captchaSecret, scimToken, launchKey, metricsToken = captcha, scim, launch, metrics
+	return nil
+}
+
+// acceptedAdminTokens returns the admin tokens currently accepted.
+func acceptedAdminTokens() []string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return adminTokens
+}
+
+// secretRefreshLoop resolves the secrets again every secretRefresh. If
+// one can't be resolved, the previous values are kept.
+func secretRefreshLoop() {
+	if secretRefresh <= 0 {
+		return
+	}
+	for range time.Tick(secretRefresh) {
+		before := acceptedAdminTokens()
+		if err := loadSecrets(gatewayCfg.Section("gateway")); err != nil {
+			log.Printf("Refreshing secrets: %v", err)
+			continue
+		}
+		if after := acceptedAdminTokens(); strings.Join(before, "\n") != strings.Join(after, "\n") {
+			log.Printf("Admin tokens rotated (%d accepted)", len(after))
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions can carry free-form labels (course ID, ticket number, project),
+// set when a session is created through the admin API or by a booking, and
+// used to find sessions in the admin session list.
+
+var labelKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+var errUnknownSession = errors.New("no such session")
+
+const (
+	maxLabels        = 32
+	maxLabelValueLen = 256
+)
+
+// SessionInfo is a session as reported by the admin API.
+type SessionInfo struct {
+	ID         string            `json:"id"`
+	Username   string            `json:"user"`
+	Desktop    string            `json:"desktop,omitempty"`
+	Container  string            `json:"container"`
+	Image      string            `json:"image,omitempty"`
+	Base       string            `json:"base"`
+	Guest      bool              `json:"guest"`
+	Reserved   bool              `json:"reserved"`
+	StartedAt  time.Time         `json:"started_at"`
+	LastActive time.Time         `json:"last_active"`
+	LastInput  *time.Time        `json:"last_input,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// info returns the admin API's view of a session.
+func (s Session) info() SessionInfo {
+	var input *time.Time
+	if !s.LastInput.IsZero() {
+		input = &s.LastInput
+	}
+	return SessionInfo{
+		ID:         s.ID,
+		Username:   s.Username,
+		Desktop:    s.Desktop,
+		Container:  s.ContainerName,
+		Image:      s.Image,
+		Base:       s.Base,
+		Guest:      s.Ephemeral,
+		Reserved:   !s.ReservedUntil.IsZero(),
+		StartedAt:  s.StartedAt,
+		LastActive: s.LastActive,
+		LastInput:  input,
+		Labels:     s.Labels,
+	}
+}
+
+// validateLabels checks labels supplied through the API.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+		if len(v) > maxLabelValueLen {
+			return fmt.Errorf("label %q is longer than %d characters", k, maxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// setLabels adds labels to a session, replacing any of the same name.
+func setLabels(sessionID string, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[sessionID]
+	if !ok {
+		return
+	}
+	merged := make(map[string]string, len(s.Labels)+len(labels))
+	for k, v := range s.Labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	s.Labels = merged
+	sessions[sessionID] = s
+	saveSessions()
+}
+
+// sessionFilter selects sessions for the admin list.
+type sessionFilter struct {
+	User    string
+	Desktop string
+	Labels  map[string]string // Each must match exactly
+	Query   string            // Case-insensitive substring of the user or any label value
+	Guests  bool              // Only guest sessions
+}
+
+// parseSessionFilter reads ?user=, ?desktop=, ?label=key=value (repeatable),
+// ?q= and ?guest=true from a query string.
+func parseSessionFilter(r *http.Request) (sessionFilter, error) {
+	q := r.URL.Query()
+	f := sessionFilter{
+		User:    q.Get("user"),
+		Desktop: q.Get("desktop"),
+		Query:   strings.ToLower(q.Get("q")),
+		Guests:  q.Get("guest") == "true",
+	}
+	for _, l := range q["label"] {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return f, fmt.Errorf("label filter %q is not key=value", l)
+		}
+		if f.Labels == nil {
+			f.Labels = make(map[string]string)
+		}
+		f.Labels[k] = v
+	}
+	return f, nil
+}
+
+// matches reports whether a session passes the filter.
+func (f sessionFilter) matches(s Session) bool {
+	if f.User != "" && s.Username != f.User {
+		return false
+	}
+	if f.Desktop != "" && s.Desktop != f.Desktop {
+		return false
+	}
+	if f.Guests && !s.Ephemeral {
+		return false
+	}
+	for k, v := range f.Labels {
+		if got, ok := s.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	if f.Query != "" {
+		if strings.Contains(strings.ToLower(s.Username), f.Query) {
+			return true
+		}
+		for _, v := range s.Labels {
+			if strings.Contains(strings.ToLower(v), f.Query) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// listSessions returns the sessions passing a filter, oldest first.
+func listSessions(f sessionFilter) []SessionInfo {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	list := []SessionInfo{}
+	for _, s := range sessions {
+		if !f.matches(s) {
+			continue
+		}
+		list = append(list, s.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// adminListSessions handles GET /admin/sessions, filtered by ?user=,
+// ?desktop=, ?label=key=value, ?q= and ?guest=true.
+func adminListSessions(w http.ResponseWriter, r *http.Request) {
+	f, err := parseSessionFilter(r)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	writeJSON(w, 200, listSessions(f))
+}
+
+// adminCreateSession handles POST /admin/sessions with a JSON body of
+// {"user": ..., "desktop": ..., "labels": {...}}, starting the user's
+// desktop ahead of their login. If it is already running, the labels are
+// added to it. With "claim": true the reply carries a one-time claim link
+// for the user (see claim.go), valid for "claim_ttl".
+func adminCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User     string            `json:"user"`
+		Desktop  string            `json:"desktop"`
+		Labels   map[string]string `json:"labels"`
+		Claim    bool              `json:"claim"`
+		ClaimTTL string            `json:"claim_ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	claimTTL, err := parseClaimTTL(req.ClaimTTL)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	u, err := loadUser(req.User)
+	if err != nil {
+		writeJSONError(w, 404, fmt.Errorf("user %q: %w", req.User, err))
+		return
+	}
+	if req.Desktop != "" {
+		if u, err = u.forDesktop(req.Desktop); err != nil {
+			writeJSONError(w, 404, err)
+			return
+		}
+	}
+	if u.overlay() != "ephemeral" && u.setting("encryption") == "fscrypt" {
+		writeJSONError(w, 409, errors.New("encrypted desktops need the user's password to start"))
+		return
+	}
+	if !reserveSlot(false) {
+		writeJSONError(w, 503, errors.New("no capacity for another desktop"))
+		return
+	}
+	sessionID, started, err := startOrFind(r.Context(), u, "", "admin")
+	releaseSlot()
+	if err != nil {
+		status := 500
+		if se, ok := err.(*startError); ok {
+			status = se.Status
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+	setLabels(sessionID, req.Labels)
+	status := 200
+	if started {
+		status = 201
+	}
+	var reply struct {
+		SessionInfo
+		ClaimURL     string     `json:"claim_url,omitempty"`
+		ClaimExpires *time.Time `json:"claim_expires,omitempty"`
+	}
+	if req.Claim {
+		link, expires, err := mintClaim(sessionID, claimTTL, started)
+		if err != nil {
+			writeJSONError(w, 500, errors.New("session ended while starting"))
+			return
+		}
+		reply.ClaimURL, reply.ClaimExpires = link, &expires
+	}
+	sessionsMu.RLock()
+	s, ok := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !ok {
+		writeJSONError(w, 500, errors.New("session ended while starting"))
+		return
+	}
+	details := map[string]string{"actor": "admin"}
+	if req.Claim {
+		details["claim_expires"] = reply.ClaimExpires.UTC().Format(time.RFC3339)
+	}
+	audit("session.create", s.Username, sessionID, details)
+	reply.SessionInfo = s.info()
+	writeJSON(w, status, reply)
+}
+
+// --- Termination ---
+
+// Bulk termination takes two calls: the first lists what would be killed
+// and returns a confirmation token for exactly those sessions, which the
+// second call must present within terminateConfirmTTL.
+
+const terminateConfirmTTL = time.Minute
+
+var (
+	terminateConfirms   = make(map[string]terminateConfirm)
+	terminateConfirmsMu sync.Mutex
+)
+
+// terminateConfirm is a pending bulk termination.
+type terminateConfirm struct {
+	IDs     []string
+	Filter  string // The preview's query string, for the audit log
+	Expires time.Time
+}
+
+// terminateSessions stops sessions on an admin's behalf, auditing each.
+func terminateSessions(ids []string, reason string) int {
+	n := 0
+	for _, id := range ids {
+		sessionsMu.RLock()
+		s, ok := sessions[id]
+		sessionsMu.RUnlock()
+		if !ok {
+			continue
+		}
+		audit("session.terminate", s.Username, id, map[string]string{"actor": "admin", "reason": reason})
+		if reason == endDeprovisioned {
+			stopSession(id, endDeprovisioned)
+		} else {
+			stopSession(id, endAdmin)
+		}
+		n++
+	}
+	return n
+}
+
+// adminTerminateSessions handles DELETE /admin/sessions, with the same
+// filters as the list (none at all means every session). Without
+// ?confirm= it only previews:
+//
+//	{"sessions": [...], "confirm": "<token>", "expires_in": 60}
+//
+// and repeating the call with ?confirm=<token> terminates those sessions.
+func adminTerminateSessions(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("confirm"); token != "" {
+		terminateConfirmsMu.Lock()
+		c, ok := terminateConfirms[token]
+		delete(terminateConfirms, token)
+		terminateConfirmsMu.Unlock()
+		if !ok || time.Now().After(c.Expires) {
+			writeJSONError(w, 409, errors.New("confirmation token is invalid or has expired"))
+			return
+		}
+		n := terminateSessions(c.IDs, "bulk")
+		audit("admin.terminate", "admin", "", map[string]string{"filter": c.Filter, "count": strconv.Itoa(n)})
+		writeJSON(w, 200, map[string]int{"terminated": n})
+		return
+	}
+
+	f, err := parseSessionFilter(r)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	list := listSessions(f)
+	ids := make([]string, len(list))
+	for i, s := range list {
+		ids[i] = s.ID
+	}
+	token := newAgentToken()
+	terminateConfirmsMu.Lock()
+	for t, c := range terminateConfirms {
+		if time.Now().After(c.Expires) {
+			delete(terminateConfirms, t)
+		}
+	}
+	terminateConfirms[token] = terminateConfirm{IDs: ids, Filter: r.URL.RawQuery, Expires: time.Now().Add(terminateConfirmTTL)}
+	terminateConfirmsMu.Unlock()
+	writeJSON(w, 200, map[string]any{
+		"sessions":   list,
+		"confirm":    token,
+		"expires_in": int(terminateConfirmTTL.Seconds()),
+	})
+}
+
+// adminTerminateSession handles DELETE /admin/sessions/{id}.
+func adminTerminateSession(w http.ResponseWriter, r *http.Request) {
+	if terminateSessions([]string{r.PathValue("id")}, "admin") == 0 {
+		writeJSONError(w, 404, errUnknownSession)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ended sessions aren't forgotten the moment they stop: a record of each
+// (who, which desktop, when, why it ended, and what it used) is appended to
+// ended_sessions_file and kept for session_retention, for admins to look
+// up through GET /admin/sessions/ended. Unlike a user's history on their
+// profile page, it covers guests and every gateway-wide detail. What a
+// session used is read from Docker just before its container is removed:
+// network and disk traffic, as totals over the container's life, and the
+// storage it last measured against its quota.
+
+var (
+	endedSessionsPath = "/srv/overlays/ended-sessions.jsonl"
+	sessionRetention  = 30 * 24 * time.Hour // How long ended sessions are kept (0 = not recorded)
+	endedSessionsMu   sync.Mutex
+)
+
+// maxEndedList caps an ended session listing.
+const maxEndedList = 1000
+
+// EndedSession is a finished session as kept for the admin API.
+type EndedSession struct {
+	ID        string            `json:"id"`
+	Username  string            `json:"user"`
+	Desktop   string            `json:"desktop,omitempty"`
+	Container string            `json:"container"`
+	Image     string            `json:"image,omitempty"`
+	Base      string            `json:"base"`
+	Guest     bool              `json:"guest"`
+	StartedAt time.Time         `json:"started_at"`
+	EndedAt   time.Time         `json:"ended_at"`
+	Duration  int64             `json:"duration"` // Seconds
+	Reason    string            `json:"reason"`
+	Restarts  int               `json:"restarts"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Totals    *SessionTotals    `json:"totals,omitempty"`
+}
+
+// SessionTotals is what a session used over its life, in bytes. Storage is
+// omitted for sessions without a quota, which aren't measured.
+type SessionTotals struct {
+	NetIn      int64  `json:"net_in"`
+	NetOut     int64  `json:"net_out"`
+	BlockRead  int64  `json:"block_read"`
+	BlockWrite int64  `json:"block_write"`
+	Storage    *int64 `json:"storage,omitempty"`
+}
+
+// sessionTotals reads what a session's container has used. It returns nil
+// if Docker can't say (the container has already gone, say).
+func sessionTotals(ctx context.Context, s Session) *SessionTotals {
+	out, err := execOutput(ctx, "docker", "stats", "--no-stream", "--format", "{{.NetIO}}|{{.BlockIO}}", s.ContainerName)
+	if err != nil {
+		return nil
+	}
+	net, block, _ := strings.Cut(strings.TrimSpace(string(out)), "|")
+	var t SessionTotals
+	t.NetIn, t.NetOut = parseIOPair(net)
+	t.BlockRead, t.BlockWrite = parseIOPair(block)
+	if used, _, ok := sessionQuota(s); ok {
+		t.Storage = &used
+	}
+	return &t
+}
+
+// parseIOPair parses docker stats' "1.2kB / 3.4MB".
+func parseIOPair(s string) (in, out int64) {
+	a, b, _ := strings.Cut(s, "/")
+	return parseDockerSize(a), parseDockerSize(b)
+}
+
+// parseDockerSize parses a size as docker stats prints it ("12.3MB",
+// "648B", "1.5GiB"), returning 0 for anything it doesn't recognise.
+func parseDockerSize(s string) int64 {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0
+	}
+	units := map[string]float64{
+		"B":  1,
+		"kB": 1e3, "KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+		"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+	}
+	mult, ok := units[strings.TrimSpace(s[i:])]
+	if !ok {
+		return 0
+	}
+	return int64(n * mult)
+}
+
+// retainSession records a session that has just ended.
+func retainSession(s Session, reason string, totals *SessionTotals) {
+	if sessionRetention <= 0 || endedSessionsPath == "" {
+		return
+	}
+	now := time.Now()
+	line, _ := json.Marshal(EndedSession{
+		ID:        s.ID,
+		Username:  s.Username,
+		Desktop:   s.Desktop,
+		Container: s.ContainerName,
+		Image:     s.Image,
+		Base:      s.Base,
+		Guest:     s.Ephemeral,
+		StartedAt: s.StartedAt,
+		EndedAt:   now,
+		Duration:  int64(now.Sub(s.StartedAt).Seconds()),
+		Reason:    reason,
+		Restarts:  s.Restarts,
+		Labels:    s.Labels,
+		Totals:    totals,
+	})
+	endedSessionsMu.Lock()
+	defer endedSessionsMu.Unlock()
+	err := os.MkdirAll(filepath.Dir(endedSessionsPath), 0700)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(endedSessionsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+			_, err = f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Recording ended session %s: %v", s.ID, err)
+	}
+}
+
+// readEndedSessions returns every ended session on record, oldest first.
+// The caller must hold endedSessionsMu.
+func readEndedSessions() ([]EndedSession, error) {
+	f, err := os.Open(endedSessionsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []EndedSession
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20) // Labels can make long lines
+	for sc.Scan() {
+		var e EndedSession
+		if err := json.Unmarshal(sc.Bytes(), &e); err == nil {
+			list = append(list, e)
+		}
+	}
+	return list, sc.Err()
+}
+
+// pruneEndedSessions drops records older than sessionRetention.
+func pruneEndedSessions() error {
+	endedSessionsMu.Lock()
+	defer endedSessionsMu.Unlock()
+	list, err := readEndedSessions()
+	if err != nil {
+		return err
+	}
+	keep := list[:0]
+	for _, e := range list {
+		if time.Since(e.EndedAt) < sessionRetention {
+			keep = append(keep, e)
+		}
+	}
+	if len(keep) == len(list) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(endedSessionsPath), ".ended-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range keep {
+		line, _ := json.Marshal(e)
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), endedSessionsPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.Printf("Dropped %d ended sessions past retention", len(list)-len(keep))
+	return nil
+}
+
+// sessionRetentionLoop prunes the ended sessions hourly. In compliance
+// mode, as with recordings, nothing is pruned.
+func sessionRetentionLoop() {
+	if sessionRetention <= 0 {
+		return
+	}
+	if complianceMode {
+		log.Printf("Compliance mode: session_retention is not enforced by the gateway")
+		return
+	}
+	for {
+		if err := pruneEndedSessions(); err != nil {
+			log.Printf("Pruning ended sessions: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// endedFilter selects ended sessions for the admin API.
+type endedFilter struct {
+	sessionFilter
+	Reason       string
+	Since, Until time.Time
+	Limit        int
+}
+
+// parseEndedFilter reads the session filter's parameters plus ?reason=,
+// ?since= and ?until= (RFC 3339) and ?limit=.
+func parseEndedFilter(r *http.Request) (endedFilter, error) {
+	var f endedFilter
+	var err error
+	if f.sessionFilter, err = parseSessionFilter(r); err != nil {
+		return f, err
+	}
+	q := r.URL.Query()
+	f.Reason = q.Get("reason")
+	for _, t := range []struct {
+		name string
+		to   *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(t.name); v != "" {
+			if *t.to, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("%s: %w", t.name, err)
+			}
+		}
+	}
+	f.Limit = maxEndedList
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > maxEndedList {
+			return f, fmt.Errorf("limit must be 1 to %d", maxEndedList)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether an ended session passes the filter.
+func (f endedFilter) matches(e EndedSession) bool {
+	if f.Reason != "" && e.Reason != f.Reason {
+		return false
+	}
+	if !f.Since.IsZero() && e.EndedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.EndedAt.After(f.Until) {
+		return false
+	}
+	return f.sessionFilter.matches(Session{Username: e.Username, Desktop: e.Desktop, Ephemeral: e.Guest, Labels: e.Labels})
+}
+
+// adminListEndedSessions handles GET /admin/sessions/ended, newest first,
+// filtered as GET /admin/sessions is and by ?reason=, ?since=, ?until=
+// and ?limit=.
+func adminListEndedSessions(w http.ResponseWriter, r *http.Request) {
+	f, err := parseEndedFilter(r)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	endedSessionsMu.Lock()
+	all, err := readEndedSessions()
+	endedSessionsMu.Unlock()
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	list := []EndedSession{}
+	for _, e := range all {
+		if f.matches(e) && time.Since(e.EndedAt) < sessionRetention {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].EndedAt.After(list[j].EndedAt) })
+	if len(list) > f.Limit {
+		list = list[:f.Limit]
+	}
+	writeJSON(w, 200, list)
+}
+
+// adminGetEndedSession handles GET /admin/sessions/ended/{id}.
+func adminGetEndedSession(w http.ResponseWriter, r *http.Request) {
+	endedSessionsMu.Lock()
+	all, err := readEndedSessions()
+	endedSessionsMu.Unlock()
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	for _, e := range all {
+		if e.ID == r.PathValue("id") && time.Since(e.EndedAt) < sessionRetention {
+			writeJSON(w, 200, e)
+			return
+		}
+	}
+	writeJSONError(w, 404, errUnknownSession)
+}
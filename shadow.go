@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admins can shadow a user's session for support. A shadow is a share link
+// minted by the admin API rather than by the owner, and named after the admin
+// who asked for it. "view" shadows join straight away; "control" shadows join
+// view-only and wait for the user to allow control from their session page,
+// and a user who refuses disconnects them. The user's page shows who is
+// watching for as long as a shadow is live. Every step is audited.
+
+const (
+	defaultShadowDuration = time.Hour
+	maxShadowReason       = 256
+)
+
+var errShadowMode = errors.New(`mode must be "view" or "control"`)
+
+var (
+	shadowConns   = make(map[string]map[*vncStream]bool) // Shadow VNC connections by token
+	shadowConnsMu sync.Mutex
+)
+
+// ShadowInfo describes a live shadow to the session's owner.
+type ShadowInfo struct {
+	Admin  string `json:"admin"`
+	Mode   string `json:"mode"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// sessionShadows returns a session's live shadows, and the one waiting for
+// the user's consent, if any.
+func sessionShadows(sessionID string) (live []ShadowInfo, pending *ShadowInfo) {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	for token, sh := range shares {
+		if sh.SessionID != sessionID || sh.Shadow == "" {
+			continue
+		}
+		if time.Now().After(sh.Expires) {
+			delete(shares, token)
+			continue
+		}
+		info := ShadowInfo{Admin: sh.Shadow, Mode: sh.Mode, Reason: sh.Reason}
+		if sh.Pending {
+			pending = &info
+		}
+		live = append(live, info)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Admin < live[j].Admin })
+	return live, pending
+}
+
+// trackShadowConn registers a shadow's VNC connection, so consent can hand
+// it control and refusal can close it.
+func trackShadowConn(token string, vs *vncStream) {
+	shadowConnsMu.Lock()
+	defer shadowConnsMu.Unlock()
+	if shadowConns[token] == nil {
+		shadowConns[token] = make(map[*vncStream]bool)
+	}
+	shadowConns[token][vs] = true
+}
+
+// untrackShadowConn forgets a closed connection.
+func untrackShadowConn(token string, vs *vncStream) {
+	shadowConnsMu.Lock()
+	defer shadowConnsMu.Unlock()
+	delete(shadowConns[token], vs)
+	if len(shadowConns[token]) == 0 {
+		delete(shadowConns, token)
+	}
+}
+
+// shadowConnsOf returns the open connections of a shadow.
+func shadowConnsOf(token string) []*vncStream {
+	shadowConnsMu.Lock()
+	defer shadowConnsMu.Unlock()
+	var conns []*vncStream
+	for vs := range shadowConns[token] {
+		conns = append(conns, vs)
+	}
+	return conns
+}
+
+// endShadows revokes a session's shadows (only the pending one if
+// pendingOnly) and disconnects them, returning the admins they belonged to.
+func endShadows(sessionID string, pendingOnly bool) []string {
+	var tokens, admins []string
+	sharesMu.Lock()
+	for token, sh := range shares {
+		if sh.SessionID == sessionID && sh.Shadow != "" && (sh.Pending || !pendingOnly) {
+			delete(shares, token)
+			tokens = append(tokens, token)
+			admins = append(admins, sh.Shadow)
+		}
+	}
+	sharesMu.Unlock()
+	for _, token := range tokens {
+		for _, vs := range shadowConnsOf(token) {
+			vs.Close()
+		}
+	}
+	sort.Strings(admins)
+	return admins
+}
+
+// shadowHandler serves /shadow/<session> for the session owner: POST with
+// decision=allow|deny answers a shadow's request for control.
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/shadow/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+
+	switch r.FormValue("decision") {
+	case "allow":
+		var token, admin string
+		sharesMu.Lock()
+		for t, sh := range shares {
+			if sh.SessionID == sessionID && sh.Pending {
+				sh.Pending = false
+				shares[t] = sh
+				token, admin = t, sh.Shadow
+			}
+		}
+		sharesMu.Unlock()
+		if token == "" {
+			httpError(w, r, 404, "error.shadow_not_found")
+			return
+		}
+		for _, vs := range shadowConnsOf(token) {
+			vs.setControls(false, s.Controls.Quality, s.Controls.Compression)
+		}
+		audit("shadow.consent", s.Username, sessionID, map[string]string{"admin": admin})
+	case "deny":
+		admins := endShadows(sessionID, true)
+		if len(admins) == 0 {
+			httpError(w, r, 404, "error.shadow_not_found")
+			return
+		}
+		audit("shadow.deny", s.Username, sessionID, map[string]string{"admin": strings.Join(admins, ",")})
+	default:
+		httpError(w, r, 400, "error.invalid_request")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// adminShadowSession handles POST /admin/sessions/{id}/shadow with a JSON
+// body of {"admin": "bob", "mode": "view"|"control", "reason": "...",
+// "minutes": 60}, returning a join URL for the admin.
+func adminShadowSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Admin   string `json:"admin"`
+		Mode    string `json:"mode"`
+		Reason  string `json:"reason"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	switch {
+	case strings.TrimSpace(req.Admin) == "":
+		writeJSONError(w, 400, errors.New("admin must name who is shadowing"))
+		return
+	case req.Mode != "view" && req.Mode != "control":
+		writeJSONError(w, 400, errShadowMode)
+		return
+	case len(req.Reason) > maxShadowReason:
+		writeJSONError(w, 400, errors.New("reason is too long"))
+		return
+	}
+	duration := defaultShadowDuration
+	if req.Minutes != 0 {
+		duration = time.Duration(req.Minutes) * time.Minute
+	}
+	if duration <= 0 || duration > maxShareDuration {
+		writeJSONError(w, 400, errors.New("minutes is out of range"))
+		return
+	}
+
+	sessionsMu.RLock()
+	s, ok := sessions[r.PathValue("id")]
+	sessionsMu.RUnlock()
+	if !ok {
+		writeJSONError(w, 404, errUnknownSession)
+		return
+	}
+
+	token := newAgentToken()
+	sh := Share{
+		SessionID: s.ID,
+		Mode:      req.Mode,
+		Expires:   time.Now().Add(duration),
+		Shadow:    req.Admin,
+		Reason:    req.Reason,
+		Pending:   req.Mode == "control",
+	}
+	sharesMu.Lock()
+	if sh.Pending {
+		// One request for control at a time; a newer one replaces the old
+		for t, old := range shares {
+			if old.SessionID == s.ID && old.Pending {
+				delete(shares, t)
+			}
+		}
+	}
+	shares[token] = sh
+	sharesMu.Unlock()
+	noteClusterChange()
+	audit("shadow.start", s.Username, s.ID, map[string]string{
+		"actor": "admin", "admin": req.Admin, "mode": req.Mode, "reason": req.Reason,
+		"expires": sh.Expires.UTC().Format(time.RFC3339),
+	})
+
+	writeJSON(w, 201, map[string]any{
+		"url":     "/join/" + token,
+		"mode":    req.Mode,
+		"expires": sh.Expires.UTC().Format(time.RFC3339),
+		"consent": sh.Pending,
+	})
+}
+
+// adminEndShadow handles DELETE /admin/sessions/{id}/shadow, ending every
+// shadow of the session.
+func adminEndShadow(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	sessionsMu.RLock()
+	s, ok := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !ok {
+		writeJSONError(w, 404, errUnknownSession)
+		return
+	}
+	admins := endShadows(sessionID, false)
+	if len(admins) > 0 {
+		audit("shadow.end", s.Username, sessionID, map[string]string{
+			"actor": "admin", "admin": strings.Join(admins, ","),
+		})
+	}
+	w.WriteHeader(204)
+}
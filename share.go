@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A share lets someone else join a running session through /join/<token>:
+// "view" shares see the desktop but every input they send is dropped by the
+// proxy (see vncStream); "control" shares get full keyboard and mouse. Shares
+// expire on their own, are revoked with the session, and can be revoked early
+// by the owner. Users may be limited with sharing = none | view | control.
+
+const maxShareDuration = 24 * time.Hour
+
+// Share is a time-limited invitation to join a session.
+type Share struct {
+	SessionID string
+	Mode      string // "view" or "control"
+	Expires   time.Time
+	Shadow    string // The admin shadowing the session, for admin shares
+	Reason    string // Why the admin is shadowing
+	Pending   bool   // A control shadow still waiting for the user's consent
+}
+
+var (
+	sharesMu sync.Mutex
+	shares   = make(map[string]Share) // token -> share
+)
+
+// lookupShare returns the live share for token.
+func lookupShare(token string) (Share, bool) {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	sh, ok := shares[token]
+	if ok && time.Now().After(sh.Expires) {
+		delete(shares, token)
+		return Share{}, false
+	}
+	return sh, ok
+}
+
+// dropShares revokes every share of a session.
+func dropShares(sessionID string) {
+	sharesMu.Lock()
+	for token, sh := range shares {
+		if sh.SessionID == sessionID {
+			delete(shares, token)
+		}
+	}
+	sharesMu.Unlock()
+}
+
+// shareAllows reports whether a user's sharing policy permits mode.
+func shareAllows(policy, mode string) bool {
+	switch policy {
+	case "", "control":
+		return mode == "view" || mode == "control"
+	case "view":
+		return mode == "view"
+	}
+	return false
+}
+
+// shareHandler serves /share/<session> for the session owner: POST with
+// mode=view|control and minutes=N mints a share link, DELETE revokes all.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/share/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		dropShares(sessionID)
+		audit("share.revoke", s.Username, sessionID, nil)
+		w.WriteHeader(204)
+		return
+	case http.MethodPost:
+	default:
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if !shareAllows(s.SharingPolicy, mode) {
+		httpError(w, r, 403, "error.share_mode")
+		return
+	}
+	minutes, err := strconv.Atoi(r.FormValue("minutes"))
+	duration := time.Duration(minutes) * time.Minute
+	if err != nil || duration <= 0 || duration > maxShareDuration {
+		httpError(w, r, 400, "error.invalid_duration")
+		return
+	}
+
+	token := newAgentToken()
+	sh := Share{SessionID: sessionID, Mode: mode, Expires: time.Now().Add(duration)}
+	sharesMu.Lock()
+	shares[token] = sh
+	sharesMu.Unlock()
+	noteClusterChange()
+	audit("share.create", s.Username, sessionID, map[string]string{
+		"mode": mode, "expires": sh.Expires.UTC().Format(time.RFC3339),
+	})
+
+	writeJSON(w, 201, map[string]string{
+		"url":     "/join/" + token,
+		"mode":    mode,
+		"expires": sh.Expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// join serves /join/<token>: the session page for someone a session has
+// been shared with.
+func join(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/join/")
+	if geoBlocked(w, r, "") {
+		return
+	}
+	sh, ok := lookupShare(token)
+	if !ok {
+		httpError(w, r, 404, "error.share_expired")
+		return
+	}
+	s, ok := touchSession(sh.SessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	if !clientCertVerified(r, s) {
+		httpError(w, r, 403, "error.client_cert")
+		return
+	}
+	if sh.Shadow != "" {
+		audit("shadow.join", s.Username, sh.SessionID, map[string]string{
+			"admin": sh.Shadow, "mode": sh.Mode, "remote": r.RemoteAddr,
+		})
+	} else {
+		audit("share.join", s.Username, sh.SessionID, map[string]string{"mode": sh.Mode, "remote": r.RemoteAddr})
+	}
+
+	renderTemplate(w, r, "session.html", map[string]any{
+		"SessionID": token, // The proxy accepts share tokens in place of session IDs
+		"ClientURL": clientURL(s, token, sh.Mode == "view", deviceProfile(r)),
+		"Shared":    true,
+		"ViewOnly":  sh.Mode == "view",
+		"Awaiting":  sh.Pending, // Input is dropped by the proxy until the user consents
+		"Owner":     s.Username,
+	})
+}
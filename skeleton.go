@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// applySkeleton copies a skeleton tree (laid out like the root filesystem,
+// e.g. home/docker/.config/...) into a fresh overlay upperdir, much like
+// /etc/skel for new accounts. Upperdirs that already hold anything are left
+// alone, so the skeleton only lands on a user's first login.
+func applySkeleton(ctx context.Context, skeleton, upper string) error {
+	entries, err := os.ReadDir(upper)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+	if err := execRun(ctx, "cp", "-a", strings.TrimRight(skeleton, "/")+"/.", upper); err != nil {
+		return fmt.Errorf("copying skeleton %s: %v", skeleton, err)
+	}
+	return nil
+}
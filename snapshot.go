@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// A desktop someone has carefully set up can be snapshotted into a new
+// catalog entry, for them and their teammates to start copies of. The
+// running container is committed to an image (tagged
+// <build_repository>/<name>:<timestamp>, and pushed with build_push), and
+// the overlay's upperdir, everything installed or changed on top of the
+// base, is copied under snapshots_dir as the entry's skeleton, seeding each
+// new copy's own overlay. The entry is offered to its owner and the users
+// they name (and, when an admin takes the snapshot, any groups given).
+//
+// Users may take snapshots from their session page when their "snapshots"
+// setting allows: it is how many they may keep (0, the default, for none).
+// Admins use POST /admin/sessions/{id}/snapshot, and remove snapshots as
+// any registered image, with DELETE /admin/images/{name}. Guest desktops
+// have nothing to keep, and encrypted ones would be copied out in the
+// clear, so neither can be snapshotted.
+
+var snapshotsDir = "/srv/overlays/snapshots"
+
+var (
+	errSnapshotExists    = errors.New("a desktop of that name already exists")
+	errSnapshotGuest     = errors.New("guest desktops can't be snapshotted")
+	errSnapshotEncrypted = errors.New("encrypted desktops can't be snapshotted")
+	errSnapshotVM        = errors.New("only desktop containers can be snapshotted")
+)
+
+// snapshotRequest describes a snapshot to take.
+type snapshotRequest struct {
+	Name        string   `json:"name"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Users       []string `json:"users"`  // Besides the owner
+	Groups      []string `json:"groups"` // Admins only
+}
+
+// validate checks a snapshot request.
+func (req snapshotRequest) validate() error {
+	if !desktopNameRe.MatchString(req.Name) {
+		return fmt.Errorf("invalid image name %q", req.Name)
+	}
+	if _, ok := catalogSection(req.Name); ok {
+		return errSnapshotExists
+	}
+	for _, name := range req.Users {
+		if !validUsername(name) {
+			return fmt.Errorf("invalid username %q", name)
+		}
+	}
+	return nil
+}
+
+// ownedSnapshots counts the catalog entries snapshotted by username.
+func ownedSnapshots(username string) int {
+	n := 0
+	_, secs := catalogSections()
+	for _, sec := range secs {
+		if sec.Key("owner").String() == username {
+			n++
+		}
+	}
+	return n
+}
+
+// snapshotSession commits a running session's container and copies its
+// upperdir, registering both as a catalog entry. It returns the image.
+func snapshotSession(ctx context.Context, s Session, req snapshotRequest) (string, error) {
+	if s.Ephemeral {
+		return "", errSnapshotGuest
+	}
+	if s.Encrypted {
+		return "", errSnapshotEncrypted
+	}
+	if s.containerless() {
+		return "", errSnapshotVM
+	}
+	image := buildRepository + "/" + req.Name + ":" + time.Now().UTC().Format("20060102150405")
+	if _, err := timedCommand(ctx, buildTimeout, "docker", "commit",
+		"-m", "Snapshot of session "+s.ID, s.ContainerName, image); err != nil {
+		return "", fmt.Errorf("docker commit: %w", err)
+	}
+	if buildPush {
+		if _, err := timedCommand(ctx, pullTimeout, "docker", "push", image); err != nil {
+			return "", fmt.Errorf("docker push: %w", err)
+		}
+	}
+
+	upper, _ := overlayPaths(s.OverlayDir, false)
+	skeleton := filepath.Join(snapshotsDir, req.Name)
+	tmp := skeleton + ".partial"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+	if _, err := timedCommand(ctx, buildTimeout, "cp", "-a", upper+"/.", tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("copying %s: %w", upper, err)
+	}
+
+	err := updateCatalog(func(f *ini.File) error {
+		if f.HasSection("image " + req.Name) {
+			return errSnapshotExists // Taken while this one was copying
+		}
+		if err := os.Rename(tmp, skeleton); err != nil {
+			return err
+		}
+		sec := f.Section("image " + req.Name)
+		sec.Key("title").SetValue(cmp.Or(req.Title, req.Name))
+		if req.Description != "" {
+			sec.Key("description").SetValue(req.Description)
+		}
+		sec.Key("image").SetValue(image)
+		sec.Key("skeleton").SetValue(skeleton)
+		sec.Key("owner").SetValue(s.Username)
+		sec.Key("users").SetValue(strings.Join(append([]string{s.Username}, req.Users...), ", "))
+		if len(req.Groups) > 0 {
+			sec.Key("groups").SetValue(strings.Join(req.Groups, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return image, nil
+}
+
+// removeSnapshotFiles deletes a removed catalog entry's skeleton, if it was
+// a snapshot's.
+func removeSnapshotFiles(sec *ini.Section) {
+	skeleton := sec.Key("skeleton").String()
+	if sec.Key("owner").String() != "" && filepath.Dir(skeleton) == filepath.Clean(snapshotsDir) {
+		os.RemoveAll(skeleton)
+	}
+}
+
+// snapshotHandler serves POST /snapshot/<session> for the session owner,
+// with the new desktop's name, title and share (usernames to offer it to,
+// separated by commas or spaces).
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, 405, "error.method_not_allowed")
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+	s, ok := ownerSession(r, sessionID)
+	if !ok {
+		httpError(w, r, 404, "error.session_not_found")
+		return
+	}
+	if s.Ephemeral {
+		httpError(w, r, 400, "error.no_storage")
+		return
+	}
+	if s.containerless() {
+		httpError(w, r, 400, "error.no_container")
+		return
+	}
+	if s.Snapshots <= 0 {
+		httpError(w, r, 403, "error.snapshots_off")
+		return
+	}
+	if s.Encrypted {
+		httpError(w, r, 400, "error.snapshot_encrypted")
+		return
+	}
+	req := snapshotRequest{
+		Name:  r.FormValue("name"),
+		Title: strings.TrimSpace(r.FormValue("title")),
+		Users: strings.FieldsFunc(r.FormValue("share"), func(c rune) bool { return c == ',' || c == ' ' }),
+	}
+	req.Users = slices.DeleteFunc(req.Users, func(name string) bool { return name == s.Username })
+	if !desktopNameRe.MatchString(req.Name) {
+		httpError(w, r, 400, "error.snapshot_name")
+		return
+	}
+	if err := req.validate(); errors.Is(err, errSnapshotExists) {
+		httpError(w, r, 409, "error.snapshot_exists", req.Name)
+		return
+	} else if err != nil {
+		httpError(w, r, 400, "error.invalid_user")
+		return
+	}
+	if ownedSnapshots(s.Username) >= s.Snapshots {
+		httpError(w, r, 403, "error.snapshot_limit", s.Snapshots)
+		return
+	}
+	image, err := snapshotSession(context.Background(), s, req)
+	if errors.Is(err, errSnapshotExists) {
+		httpError(w, r, 409, "error.snapshot_exists", req.Name)
+		return
+	}
+	if err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+	audit("session.snapshot", s.Username, sessionID, map[string]string{
+		"name": req.Name, "image": image, "users": strings.Join(req.Users, ","), "remote": r.RemoteAddr,
+	})
+	writeJSON(w, 201, map[string]string{
+		"name":    req.Name,
+		"image":   image,
+		"message": tr(r, "session.snapshot_done", cmp.Or(req.Title, req.Name)),
+	})
+}
+
+// adminSnapshotSession handles POST /admin/sessions/{id}/snapshot with a
+// JSON body of {"name", "title", "description", "users", "groups"}.
+func adminSnapshotSession(w http.ResponseWriter, r *http.Request) {
+	sessionsMu.RLock()
+	s, ok := lookupSession(r.PathValue("id"))
+	sessionsMu.RUnlock()
+	if !ok {
+		writeJSONError(w, 404, errUnknownSession)
+		return
+	}
+	var req snapshotRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if err := req.validate(); errors.Is(err, errSnapshotExists) {
+		writeJSONError(w, 409, err)
+		return
+	} else if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	image, err := snapshotSession(r.Context(), s, req)
+	switch {
+	case errors.Is(err, errSnapshotExists):
+		writeJSONError(w, 409, err)
+		return
+	case errors.Is(err, errSnapshotGuest), errors.Is(err, errSnapshotEncrypted), errors.Is(err, errSnapshotVM):
+		writeJSONError(w, 400, err)
+		return
+	case err != nil:
+		writeJSONError(w, 500, err)
+		return
+	}
+	audit("session.snapshot", s.Username, s.ID, map[string]string{
+		"name": req.Name, "image": image, "by": "admin",
+	})
+	writeJSON(w, 201, map[string]string{"name": req.Name, "image": image})
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Developers can reach their running desktop over SSH and SFTP, to use
+// their own editors and tools against it. With ssh_listen set, the gateway
+// runs an SSH server of its own, which lands users in their desktop
+// container (chrooted into the overlay as the desktop user, as
+// desktopExec does) rather than on the gateway:
+//
+//	ssh -p 2222 alice@gateway.example.ac.uk
+//	sftp -P 2222 alice+work@gateway.example.ac.uk
+//
+// alice+work picks the named desktop work (or app:<name>, image:<name>);
+// plain alice is the user's one running desktop. Only users, groups, roles
+// or desktops with "ssh = true" may connect. They log in with their gateway
+// password, or with a key from their ssh_authorized_keys file (in
+// authorized_keys format), and only while the desktop is running: SSH
+// doesn't start one, though it wakes a suspended one. Desktops without a
+// container of their own (VMs and external hosts) can't be reached, nor
+// can those needing a client certificate (see mtls.go) or whose clipboard
+// or file_transfer policy restricts either direction, which a shell could
+// get around. Shells, commands and the sftp subsystem run through docker
+// exec; a PTY is made inside the container by script(1), and resized there
+// on window changes. Traffic counts as activity for idle timeouts, failed
+// passwords count towards loginRateLimit, and logins and commands are
+// audited.
+
+var (
+	sshListen      = "" // e.g. ":2222" ("" = no SSH server)
+	sshHostKeyPath = "/srv/overlays/ssh_host_ed25519_key"
+)
+
+// sshEnvRe is the client environment passed on to the desktop (as OpenSSH
+// does with AcceptEnv LANG LC_*).
+var sshEnvRe = regexp.MustCompile(`^(LANG|LC_[A-Z]+)$`)
+
+const sftpServer = "/usr/lib/openssh/sftp-server"
+
+// sshPty is a client's pty-req.
+type sshPty struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// startSSH starts the SSH server, if one is configured.
+func startSSH() error {
+	if sshListen == "" {
+		return nil
+	}
+	key, err := sshHostKey()
+	if err != nil {
+		return fmt.Errorf("SSH host key: %w", err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback:  sshPassword,
+		PublicKeyCallback: sshPublicKey,
+		MaxAuthTries:      6,
+		ServerVersion:     "SSH-2.0-LookingGlass",
+	}
+	cfg.AddHostKey(key)
+	ln, err := net.Listen("tcp", sshListen)
+	if err != nil {
+		return err
+	}
+	log.Printf("SSH server on %s (%s)", ln.Addr(), ssh.FingerprintSHA256(key.PublicKey()))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("SSH: %v", err)
+				return
+			}
+			if addrBlocked(conn.RemoteAddr().String()) {
+				noteBlocked("ssh")
+				conn.Close()
+				continue
+			}
+			go serveSSH(conn, cfg)
+		}
+	}()
+	return nil
+}
+
+// sshHostKey loads the gateway's SSH host key, generating one the first
+// time.
+func sshHostKey() (ssh.Signer, error) {
+	data, err := os.ReadFile(sshHostKeyPath)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "LookingGlass gateway")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sshHostKeyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated SSH host key %s", sshHostKeyPath)
+	return ssh.NewSignerFromKey(priv)
+}
+
+// sshUser returns the user (as seen by their desktop, if the SSH user name
+// names one) an SSH client logs in as, if they may use SSH.
+func sshUser(conn ssh.ConnMetadata) (*User, error) {
+	name, desktop, named := strings.Cut(conn.User(), "+")
+	u, err := loadUser(name)
+	if err == nil && named {
+		u, err = u.forDesktop(desktop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !u.settingKey("ssh").MustBool(false) {
+		return nil, errors.New("SSH not enabled")
+	}
+	return u, nil
+}
+
+// sshPermissions are an authenticated connection's, carrying the user and
+// desktop on to serveSSH.
+func sshPermissions(u *User, method string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{
+		"user":    u.Name,
+		"desktop": u.Desktop,
+		"method":  method,
+	}}
+}
+
+// sshPassword checks a client's gateway password.
+func sshPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	remote := conn.RemoteAddr().String()
+	if loginBlocked(remote) {
+		audit("login.failed", conn.User(), "", map[string]string{"reason": "rate limited", "remote": remote, "via": "ssh"})
+		return nil, errors.New("too many attempts")
+	}
+	if sshGeoBlocked(conn) {
+		return nil, errors.New("not allowed from your country")
+	}
+	u, err := sshUser(conn)
+	if err != nil || !u.checkPassword(string(password)) {
+		audit("login.failed", conn.User(), "", map[string]string{"reason": "bad password", "remote": remote, "via": "ssh"})
+		loginFailed(remote)
+		return nil, errors.New("invalid credentials")
+	}
+	return sshPermissions(u, "password"), nil
+}
+
+// sshPublicKey checks a client's key against the user's
+// ssh_authorized_keys. Clients offer every key they have, so a key that
+// isn't there doesn't count as a failed login.
+func sshPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if loginBlocked(conn.RemoteAddr().String()) {
+		return nil, errors.New("too many attempts")
+	}
+	if sshGeoBlocked(conn) {
+		return nil, errors.New("not allowed from your country")
+	}
+	u, err := sshUser(conn)
+	if err != nil || u.conf.Key("disabled").MustBool(false) || u.setting("ssh_authorized_keys") == "" {
+		return nil, errors.New("invalid credentials")
+	}
+	rest, err := os.ReadFile(u.setting("ssh_authorized_keys"))
+	if err != nil {
+		log.Printf("SSH keys for %s: %v", u.Name, err)
+		return nil, errors.New("invalid credentials")
+	}
+	want := key.Marshal()
+	for len(rest) > 0 {
+		var k ssh.PublicKey
+		k, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(k.Marshal(), want) {
+			return sshPermissions(u, "publickey"), nil
+		}
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+// sshSession returns the running desktop an SSH connection lands in,
+// waking it if it is suspended.
+func sshSession(username, desktop string, named bool) (Session, error) {
+	var found []Session
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		if s.Username == username && (!named || s.Desktop == desktop) && !s.containerless() {
+			found = append(found, s)
+		}
+	}
+	sessionsMu.RUnlock()
+	switch {
+	case len(found) == 0:
+		return Session{}, errors.New("no desktop running: log in to the gateway to start one")
+	case len(found) > 1:
+		return Session{}, fmt.Errorf("%d desktops running: connect as %s+<desktop>", len(found), username)
+	case found[0].ViewOnlyLocked:
+		return Session{}, errors.New("the desktop is view-only")
+	case found[0].ClientCert != "":
+		return Session{}, errors.New("the desktop needs a client certificate, which SSH can't present")
+	case !sshPolicyAllows(found[0]):
+		return Session{}, errors.New("the desktop's clipboard or file transfer policy rules out SSH")
+	}
+	return wakeSession(found[0].ID)
+}
+
+// sshPolicyAllows reports whether a session's data policy leaves SSH
+// nothing to get around. A shell or command can copy files (scp, cat) and
+// reach the desktop's clipboard (xclip) however it likes, so SSH needs
+// file_transfer and clipboard to allow both directions. Terminals have no
+// display, so only file_transfer counts for them.
+func sshPolicyAllows(s Session) bool {
+	files := fileTransferAllows(s.FilePolicy, "upload") && fileTransferAllows(s.FilePolicy, "download")
+	clipboard := clipboardAllows(s.ClipboardPolicy, "in") && clipboardAllows(s.ClipboardPolicy, "out")
+	return files && (clipboard || s.Terminal)
+}
+
+// serveSSH serves one SSH connection.
+func serveSSH(nConn net.Conn, cfg *ssh.ServerConfig) {
+	defer nConn.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, cfg)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	username, desktop := conn.Permissions.Extensions["user"], conn.Permissions.Extensions["desktop"]
+	remote := conn.RemoteAddr().String()
+	_, _, named := strings.Cut(conn.User(), "+")
+	s, err := sshSession(username, desktop, named)
+	audit("ssh.login", username, s.ID, map[string]string{"remote": remote, "desktop": desktop, "method": conn.Permissions.Extensions["method"]})
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		if err != nil {
+			nc.Reject(ssh.Prohibited, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHChannel(s, remote, ch, chReqs)
+	}
+}
+
+// serveSSHChannel runs a session channel's shell, command or subsystem in
+// the desktop.
+func serveSSHChannel(s Session, remote string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	var (
+		env  []string
+		pty  *sshPty
+		cmd  *exec.Cmd
+		done = make(chan struct{})
+		tty  = "/tmp/lg-ssh-" + newAgentToken()[:16]
+	)
+	for {
+		var req *ssh.Request
+		select {
+		case req = <-reqs:
+		case <-done:
+			return
+		}
+		if req == nil {
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			return
+		}
+		ok := false
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if ssh.Unmarshal(req.Payload, &kv) == nil && sshEnvRe.MatchString(kv.Name) {
+				env, ok = append(env, kv.Name+"="+kv.Value), true
+			}
+		case "pty-req":
+			var p sshPty
+			if cmd == nil && ssh.Unmarshal(req.Payload, &p) == nil {
+				pty, ok = &p, true
+			}
+		case "window-change":
+			var p sshPty
+			if pty != nil && ssh.Unmarshal(req.Payload, &p) == nil {
+				pty.Columns, pty.Rows = p.Columns, p.Rows
+				if cmd != nil {
+					go resizeSSHPty(s.ContainerName, tty, pty.Rows, pty.Columns)
+				}
+			}
+		case "shell", "exec", "subsystem":
+			if cmd != nil {
+				break
+			}
+			var arg struct{ Value string }
+			if req.Type != "shell" && ssh.Unmarshal(req.Payload, &arg) != nil {
+				break
+			}
+			if req.Type == "subsystem" && arg.Value != "sftp" {
+				break
+			}
+			cmd = sshCommand(s.ContainerName, req.Type, arg.Value, pty, tty, env)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			// Not cmd.Stdin = ch, which would hold up Wait until the client closes
+			stdin, err := cmd.StdinPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				log.Printf("Session %s: SSH %s: %v", s.ID, req.Type, err)
+				break
+			}
+			go func() {
+				io.Copy(stdin, sshActivity{ch, s.ID})
+				stdin.Close()
+			}()
+			ok = true
+			audit("ssh.session", s.Username, s.ID, map[string]string{"remote": remote, "kind": req.Type, "command": arg.Value})
+			go func() {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() >= 0 {
+						status = ee.ExitCode()
+					}
+				}
+				ch.CloseWrite()
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				close(done)
+			}()
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// sshCommand returns the docker exec running a session channel's shell
+// (kind "shell"), command ("exec") or sftp server ("subsystem") in a
+// desktop. The command reaches the desktop's shell in an environment
+// variable, never quoted into a script; under a PTY the shell records its
+// terminal in tty, for resizeSSHPty.
+func sshCommand(container, kind, command string, pty *sshPty, tty string, env []string) *exec.Cmd {
+	shell := `exec /bin/bash -l`
+	switch {
+	case kind == "subsystem":
+		shell = `exec ` + sftpServer
+	case kind == "exec":
+		shell = `exec /bin/bash -lc "$LG_SSH_COMMAND"`
+	}
+	if pty != nil && kind != "subsystem" {
+		inner := strings.TrimPrefix(shell, "exec ")
+		shell = fmt.Sprintf(`exec script -qfec 'tty > "$LG_SSH_TTY"; stty rows %d cols %d; %s; s=$?; rm -f "$LG_SSH_TTY"; exit $s' /dev/null`,
+			pty.Rows, pty.Columns, inner)
+		env = append(env, "TERM="+pty.Term)
+	}
+	args := []string{
+		"exec", "-i", container,
+		"chroot", fmt.Sprintf("--userspec=%d:%d", desktopUID, desktopUID), "/mnt/overlay",
+		"env", "DISPLAY=:1", "HOME=/home/docker", "USER=docker", "LOGNAME=docker", "SHELL=/bin/bash",
+		"LG_SSH_COMMAND=" + command, "LG_SSH_TTY=" + tty,
+	}
+	args = append(args, env...)
+	args = append(args, "/bin/sh", "-c", `cd "$HOME" && `+shell)
+	return exec.Command("docker", args...)
+}
+
+// resizeSSHPty sets the size of an SSH shell's terminal, which signals
+// SIGWINCH to what runs in it.
+func resizeSSHPty(container, tty string, rows, cols uint32) {
+	err := desktopExec(container, "/bin/sh", "-c",
+		fmt.Sprintf(`stty -F "$(cat "$1")" rows %d cols %d`, rows, cols), "sh", tty)
+	if err != nil {
+		log.Printf("Resizing SSH terminal in %s: %v", container, err)
+	}
+}
+
+// sshActivity is an SSH channel's input, which counts as activity in its
+// session.
+type sshActivity struct {
+	r         io.Reader
+	sessionID string
+}
+
+func (a sshActivity) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		touchSession(a.sessionID)
+	}
+	return n, err
+}
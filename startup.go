@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Starting a desktop is a handful of slow steps. Preparing the overlay
+// (guest tmpfs, unlocking, directories, quota, skeleton), mounting the
+// network home and making sure the image is present (pulling it if not)
+// don't depend on each other, so they run at once; mounting the overlay and
+// running the container follow. Every step is timed, as a trace span and in
+// lookingglass_session_start_step_seconds on /metrics.
+
+// overlayLayout is where a session's overlay lives, filled in by
+// prepareOverlay.
+type overlayLayout struct {
+	dir                  string
+	ephemeral, encrypted bool
+	upper, work, merged  string
+	exchange, printDir   string // printDir is "" without printing
+	baseName, baseDir    string // The base mounted as lowerdir
+}
+
+// timeStep runs one step of starting a session, timing it.
+func timeStep(ctx context.Context, name string, fn func(sp *span) error) error {
+	_, sp := startSpan(ctx, name)
+	start := time.Now()
+	err := fn(sp)
+	observeStartStep(name, time.Since(start))
+	sp.fail(err)
+	sp.finish()
+	return err
+}
+
+// prepareOverlay readies the directories of u's overlay for mounting. If it
+// fails, it has already released whatever it had set up.
+func prepareOverlay(ctx context.Context, u *User, l *overlayLayout, password string, quota int64) error {
+	// Guest upper/work dirs live on a size-limited tmpfs so guest churn
+	// never touches the disk and teardown is a single unmount
+	if l.ephemeral && guestTmpfsSize != "" {
+		if err := mountGuestTmpfs(ctx, l.dir); err != nil {
+			return &startError{500, "Failed to mount guest tmpfs: " + err.Error()}
+		}
+	}
+
+	// With a network home, only the home persists; the root starts afresh
+	if !l.ephemeral && u.setting("home") != "" {
+		if err := resetOverlay(u, false); err != nil {
+			return &startError{500, "Failed to clear overlay: " + err.Error()}
+		}
+	}
+
+	l.upper, l.work = overlayPaths(l.dir, l.encrypted)
+	l.merged = filepath.Join(l.dir, "merged")
+
+	if l.encrypted {
+		private := filepath.Join(l.dir, encryptedSubdir)
+		if err := os.MkdirAll(private, 0700); err != nil {
+			return &startError{500, "Failed to create overlay dirs"}
+		}
+		if err := unlockOverlay(ctx, u.Name, private, password); err != nil {
+			log.Printf("Unlocking overlay for %s: %v", u.Name, err)
+			return &startError{500, "Failed to unlock encrypted overlay"}
+		}
+	}
+
+	// Ensure overlay dirs exist
+	for _, d := range []string{l.upper, l.work, l.merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			releaseOverlay(l.dir, l.ephemeral, l.encrypted)
+			return &startError{500, "Failed to create overlay dirs"}
+		}
+	}
+
+	// Limit the whole overlay dir, not just the upperdir
+	enforceQuota(ctx, l.dir, quota)
+
+	// Exchange dir for browser file transfer, bind-mounted into the desktop
+	l.exchange = exchangePath(l.dir, l.encrypted)
+	if err := prepareExchange(l.exchange); err != nil {
+		releaseOverlay(l.dir, l.ephemeral, l.encrypted)
+		return &startError{500, "Failed to create exchange dir"}
+	}
+
+	// Spool for the desktop's PDF printer, offered for download
+	if u.settingKey("printing").MustBool(true) {
+		l.printDir = printPath(l.dir, l.encrypted)
+		if err := prepareExchange(l.printDir); err != nil {
+			releaseOverlay(l.dir, l.ephemeral, l.encrypted)
+			return &startError{500, "Failed to create print dir"}
+		}
+	}
+
+	// Seed a brand new upperdir from the user's (or role's) skeleton
+	if skel := u.setting("skeleton"); skel != "" {
+		if err := applySkeleton(ctx, skel, l.upper); err != nil {
+			log.Printf("Skeleton for %s: %v", u.Name, err)
+		}
+	}
+
+	// Users are migrated lazily: whatever base is current at login is mounted
+	l.baseName, l.baseDir = currentBase()
+	recordBase(l.dir, u.Name, l.baseName)
+	return nil
+}
+
+// imageReady makes sure a desktop image is present, pulling it if not, so
+// a pull overlaps the mounts instead of holding up docker run.
+func imageReady(ctx context.Context, image string) error {
+	if execRun(ctx, "docker", "image", "inspect", "--format", "{{.Id}}", image) == nil {
+		return nil
+	}
+	log.Printf("Image %s missing; pulling it", image)
+	err := retry(ctx, "Pulling "+image, func() error {
+		_, err := timedCommand(ctx, pullTimeout, "docker", "pull", "--quiet", image)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("docker pull: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sessions are saved to sessionsPath as they start, change hands and stop,
+// so that a gateway restart (or crash) doesn't strand running desktops:
+// at startup, every saved session whose container is still running is
+// picked up again, and users reloading their session page carry on as if
+// nothing happened (as is every suspended session whose overlay is still
+// mounted). Sessions whose container has gone are cleaned up.
+
+var sessionsPath = "/srv/overlays/sessions.json" // Live sessions, for reattaching after a restart
+
+// saveSessions writes the live sessions to disk. The caller must hold
+// sessionsMu.
+func saveSessions() {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err == nil {
+		tmp := sessionsPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, sessionsPath)
+		}
+	}
+	if err != nil {
+		log.Printf("Saving sessions: %v", err)
+	}
+	noteClusterChange()
+}
+
+// restoreSessions reattaches sessions saved by a previous run whose
+// containers are still running, and cleans up after the rest.
+func restoreSessions() error {
+	data, err := os.ReadFile(sessionsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]Session)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	var lostHomes []string
+	defer func() {
+		// After unlocking: umount can hang on an unreachable filer
+		for _, dir := range lostHomes {
+			unmountHome(dir)
+		}
+	}()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	defer func() {
+		// Nobody is connected yet; lock those whose owners don't come back
+		for id, s := range sessions {
+			if s.LockAfter > 0 && !s.ScreenLocked {
+				go scheduleScreenLock(id)
+			}
+		}
+	}()
+	for id, s := range saved {
+		if s.VM != "" {
+			// The console bridge went with the old process
+			if vmHost == nil || !vmHost.running(context.Background(), s.VM) || startConsoleBridge(id, s.Port, vmConsole(s.VM)) != nil {
+				log.Printf("Session %s: VM %s has gone, cleaning up", id, s.VM)
+				if vmHost != nil && s.Ephemeral {
+					vmHost.destroy(context.Background(), s.VM)
+				}
+				audit("session.stop", s.Username, id, map[string]string{"reason": "vm lost"})
+				continue
+			}
+		} else if s.Target != "" {
+			dial, err := restoredHostConsole(s)
+			if err == nil {
+				err = startConsoleBridge(id, s.Port, dial)
+			}
+			if err != nil {
+				log.Printf("Session %s: can't bridge %s again: %v", id, s.Target, err)
+				audit("session.stop", s.Username, id, map[string]string{"reason": "host lost"})
+				continue
+			}
+		} else {
+			alive := containerRunning(s.ContainerName)
+			if s.Suspended {
+				// No container by design; resumable while the overlay is mounted
+				alive = execRun(context.Background(), "mountpoint", "-q", filepath.Join(s.OverlayDir, "merged")) == nil
+			}
+			if !alive {
+				log.Printf("Session %s: container %s has gone, cleaning up", id, s.ContainerName)
+				execRun(context.Background(), "umount", "-l", filepath.Join(s.OverlayDir, "merged"))
+				releaseOverlay(s.OverlayDir, s.Ephemeral, s.Encrypted)
+				if s.HomeMount != "" {
+					lostHomes = append(lostHomes, s.HomeMount)
+				}
+				audit("session.stop", s.Username, id, map[string]string{"reason": "container lost"})
+				continue
+			}
+		}
+		// The user may have been cut off while the gateway was down
+		s.ID = id
+		s.LastActive = time.Now()
+		s.ExpiresAt = time.Time{}
+		sessions[id] = s
+		log.Printf("Session %s: reattached to %s for %s", id, s.ContainerName, s.Username)
+		audit("session.restore", s.Username, id, map[string]string{"container": s.ContainerName})
+	}
+	// Keep the homes reattached sessions still use
+	idle := lostHomes[:0]
+	for _, dir := range lostHomes {
+		if homeIdle(dir) && !slices.Contains(idle, dir) {
+			idle = append(idle, dir)
+		}
+	}
+	lostHomes = idle
+	saveSessions()
+	return nil
+}
+
+// containerRunning reports whether a docker container exists and is running.
+func containerRunning(name string) bool {
+	out, err := execOutput(context.Background(), "docker", "inspect", "-f", "{{.State.Running}}", name)
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
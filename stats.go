@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// GET /admin/stats aggregates usage for charting (a Grafana JSON or
+// Infinity data source, say) without parsing logs, from the ended sessions
+// on record (so going back at most session_retention) and the live ones:
+//
+//	GET /admin/stats?since=2024-09-01T00:00:00Z&bucket=hour&group=cs101
+//
+// It takes the session list's filters, since and until (RFC 3339; the
+// last 7 days by default) and bucket (hour or day, the default, in the
+// gateway's time zone), and answers with totals for the window (sessions,
+// distinct users, average and median length of those that ended, peak
+// concurrency and when it was reached, why sessions ended, the most used
+// images) and, per bucket, sessions started, distinct users, desktop hours
+// and peak concurrency.
+
+const (
+	defaultStatsWindow = 7 * 24 * time.Hour
+	maxStatsBuckets    = 2000
+	topImages          = 10
+)
+
+// UsageStats is the reply to GET /admin/stats.
+type UsageStats struct {
+	Since           time.Time      `json:"since"`
+	Until           time.Time      `json:"until"`
+	Bucket          string         `json:"bucket"`
+	Sessions        int            `json:"sessions"` // Started in the window
+	Users           int            `json:"users"`
+	AverageDuration int64          `json:"average_duration"` // Seconds, of sessions that ended in the window
+	MedianDuration  int64          `json:"median_duration"`
+	PeakConcurrency int            `json:"peak_concurrency"`
+	PeakAt          *time.Time     `json:"peak_at,omitempty"`
+	EndReasons      map[string]int `json:"end_reasons"`
+	TopImages       []ImageUsage   `json:"top_images"`
+	Buckets         []UsageBucket  `json:"buckets"`
+}
+
+// ImageUsage is how much one image was used.
+type ImageUsage struct {
+	Image    string  `json:"image"`
+	Sessions int     `json:"sessions"`
+	Hours    float64 `json:"hours"`
+}
+
+// UsageBucket is usage over one hour or day.
+type UsageBucket struct {
+	Start           time.Time `json:"start"`
+	Sessions        int       `json:"sessions"` // Started in the bucket
+	Users           int       `json:"users"`    // Distinct users with a desktop open in it
+	Hours           float64   `json:"hours"`    // Desktop hours within it
+	PeakConcurrency int       `json:"peak_concurrency"`
+}
+
+// usageSpan is one session's time on the gateway.
+type usageSpan struct {
+	user, image, reason string
+	start, end          time.Time
+	ended               bool
+}
+
+// bucketStart returns the start of the bucket t is in.
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.Local()
+	if bucket == "hour" {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// nextBucket returns the start of the bucket after the one starting at t.
+func nextBucket(t time.Time, bucket string) time.Time {
+	if bucket == "hour" {
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// laterOf returns the later of two times.
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// earlierOf returns the earlier of two times.
+func earlierOf(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// usageSpans returns the sessions, ended and live, that f selects and that
+// overlap [since, until).
+func usageSpans(f sessionFilter, since, until time.Time) ([]usageSpan, error) {
+	endedSessionsMu.Lock()
+	all, err := readEndedSessions()
+	endedSessionsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var spans []usageSpan
+	for _, e := range all {
+		s := Session{Username: e.Username, Desktop: e.Desktop, Ephemeral: e.Guest, Labels: e.Labels}
+		if e.EndedAt.After(since) && e.StartedAt.Before(until) && f.matches(s) {
+			spans = append(spans, usageSpan{e.Username, cmp.Or(e.Image, "unknown"), e.Reason, e.StartedAt, e.EndedAt, true})
+		}
+	}
+	now := time.Now()
+	sessionsMu.RLock()
+	for _, s := range sessions {
+		if s.StartedAt.Before(until) && f.matches(s) {
+			spans = append(spans, usageSpan{s.Username, cmp.Or(s.Image, "unknown"), "", s.StartedAt, now, false})
+		}
+	}
+	sessionsMu.RUnlock()
+	return spans, nil
+}
+
+// usageStats aggregates spans over [since, until).
+func usageStats(spans []usageSpan, since, until time.Time, bucket string) UsageStats {
+	st := UsageStats{Since: since, Until: until, Bucket: bucket, EndReasons: make(map[string]int), TopImages: []ImageUsage{}, Buckets: []UsageBucket{}}
+	index := make(map[time.Time]int)
+	for b := bucketStart(since, bucket); b.Before(until); b = nextBucket(b, bucket) {
+		index[b] = len(st.Buckets)
+		st.Buckets = append(st.Buckets, UsageBucket{Start: b})
+	}
+	bucketUsers := make([]map[string]bool, len(st.Buckets))
+	users := make(map[string]bool)
+	images := make(map[string]*ImageUsage)
+	var durations []int64
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	var events []event
+
+	for _, sp := range spans {
+		start, end := laterOf(sp.start, since), earlierOf(sp.end, until)
+		img := images[sp.image]
+		if img == nil {
+			img = &ImageUsage{Image: sp.image}
+			images[sp.image] = img
+		}
+		img.Hours += end.Sub(start).Hours()
+		if !sp.start.Before(since) {
+			st.Sessions++
+			users[sp.user] = true
+			img.Sessions++
+			if i, ok := index[bucketStart(sp.start, bucket)]; ok {
+				st.Buckets[i].Sessions++
+			}
+		}
+		if sp.ended && sp.end.Before(until) {
+			durations = append(durations, int64(sp.end.Sub(sp.start).Seconds()))
+			st.EndReasons[sp.reason]++
+		}
+		events = append(events, event{start, 1}, event{end, -1})
+		for b := bucketStart(start, bucket); b.Before(end); b = nextBucket(b, bucket) {
+			i, ok := index[b]
+			if !ok {
+				continue
+			}
+			st.Buckets[i].Hours += earlierOf(end, nextBucket(b, bucket)).Sub(laterOf(start, b)).Hours()
+			if bucketUsers[i] == nil {
+				bucketUsers[i] = make(map[string]bool)
+			}
+			bucketUsers[i][sp.user] = true
+		}
+	}
+	st.Users = len(users)
+	for i := range st.Buckets {
+		st.Buckets[i].Users = len(bucketUsers[i])
+	}
+
+	if len(durations) > 0 {
+		var total int64
+		for _, d := range durations {
+			total += d
+		}
+		slices.Sort(durations)
+		st.AverageDuration = total / int64(len(durations))
+		st.MedianDuration = durations[len(durations)/2]
+	}
+
+	// Concurrency: a sweep over starts and ends, ends first at the same time
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return events[i].delta < events[j].delta
+	})
+	running, b := 0, 0
+	for _, ev := range events {
+		// A session ending as a bucket begins isn't in it
+		for b+1 < len(st.Buckets) && (ev.at.After(st.Buckets[b+1].Start) || ev.delta > 0 && ev.at.Equal(st.Buckets[b+1].Start)) {
+			b++
+			st.Buckets[b].PeakConcurrency = running
+		}
+		running += ev.delta
+		if running > st.PeakConcurrency {
+			at := ev.at
+			st.PeakConcurrency, st.PeakAt = running, &at
+		}
+		if len(st.Buckets) > 0 && running > st.Buckets[b].PeakConcurrency {
+			st.Buckets[b].PeakConcurrency = running
+		}
+	}
+
+	for _, img := range images {
+		st.TopImages = append(st.TopImages, *img)
+	}
+	sort.Slice(st.TopImages, func(i, j int) bool {
+		a, b := st.TopImages[i], st.TopImages[j]
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		return a.Image < b.Image
+	})
+	if len(st.TopImages) > topImages {
+		st.TopImages = st.TopImages[:topImages]
+	}
+	return st
+}
+
+// adminStats handles GET /admin/stats.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	f, err := parseSessionFilter(r)
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	q := r.URL.Query()
+	bucket := cmp.Or(q.Get("bucket"), "day")
+	if bucket != "hour" && bucket != "day" {
+		writeJSONError(w, 400, errors.New("bucket must be hour or day"))
+		return
+	}
+	until, since := time.Now(), time.Time{}
+	for _, t := range []struct {
+		name string
+		to   *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := q.Get(t.name); v != "" {
+			if *t.to, err = time.Parse(time.RFC3339, v); err != nil {
+				writeJSONError(w, 400, fmt.Errorf("%s: %w", t.name, err))
+				return
+			}
+		}
+	}
+	if since.IsZero() {
+		since = until.Add(-defaultStatsWindow)
+	}
+	if !since.Before(until) {
+		writeJSONError(w, 400, errors.New("since must be before until"))
+		return
+	}
+	per := 24 * time.Hour
+	if bucket == "hour" {
+		per = time.Hour
+	}
+	if n := until.Sub(since) / per; n > maxStatsBuckets {
+		writeJSONError(w, 400, errors.New("too many buckets; narrow the window or use bucket=day (at most "+strconv.Itoa(maxStatsBuckets)+")"))
+		return
+	}
+	spans, err := usageSpans(f, since, until)
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, usageStats(spans, since, until, bucket))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// With idle_action = suspend, an idle session's container is removed to
+// free its memory and CPU, but the overlay stays mounted and the session
+// stays claimable. The next visit to the session runs the container again
+// on the same overlay: the user loses their open windows, but nothing on
+// disk, and doesn't have to log in again.
+
+var (
+	suspendedExpiry = 24 * time.Hour // How long a suspended session can be resumed
+	wakeMu          sync.Mutex       // Serializes wakes, which are rare and slow
+)
+
+// wakeTimeout is how long a woken desktop has to start serving noVNC.
+const wakeTimeout = 30 * time.Second
+
+var errNoCapacity = errors.New("no capacity to resume this desktop; try again shortly")
+
+// idleAction returns what idling does to u's sessions.
+func idleAction(u *User) string {
+	return u.settingKey("idle_action").In("stop", []string{"stop", "suspend"})
+}
+
+// runningSessions counts sessions with a container. The caller must hold
+// sessionsMu.
+func runningSessions() int {
+	n := 0
+	for _, s := range sessions {
+		if !s.Suspended {
+			n++
+		}
+	}
+	return n
+}
+
+// suspendSession removes an idle session's container, keeping the rest.
+func suspendSession(sessionID string) {
+	sessionsMu.Lock()
+	s, ok := sessions[sessionID]
+	if ok {
+		s.Suspended = true
+		s.ExpiresAt = time.Time{}
+		sessions[sessionID] = s
+		saveSessions()
+	}
+	sessionsMu.Unlock()
+	if !ok {
+		return
+	}
+	closeOwnerConns(sessionID)
+	if err := execRun(context.Background(), "docker", "rm", "-f", s.ContainerName); err != nil {
+		log.Printf("Session %s: removing container: %v", sessionID, err)
+	}
+	removeEgress(s.ContainerName)
+	dropShares(sessionID)
+	audit("session.suspend", s.Username, sessionID, nil)
+}
+
+// wakeSession runs a suspended session's container again and waits for it
+// to come up. It does nothing for a running session.
+func wakeSession(sessionID string) (Session, error) {
+	wakeMu.Lock()
+	defer wakeMu.Unlock()
+
+	sessionsMu.RLock()
+	s, ok := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !ok || !s.Suspended {
+		return s, nil
+	}
+	if s.Held {
+		return s, errHeld
+	}
+	if !reserveSlot(true) {
+		return s, errNoCapacity
+	}
+	defer releaseSlot()
+
+	var port int
+	err := retry(context.Background(), "Resuming container "+s.ContainerName, func() error {
+		port = randomPort()
+		return runContainer(context.Background(), s.ContainerName, port, s.RunArgs, s.Egress)
+	})
+	if err != nil {
+		return s, fmt.Errorf("starting container: %w", err)
+	}
+	if err := waitForPort(port, wakeTimeout); err != nil {
+		log.Printf("Session %s: %v", sessionID, err)
+	}
+
+	sessionsMu.Lock()
+	s, ok = sessions[sessionID]
+	if ok {
+		s.Port = port
+		s.Suspended = false
+		s.LastActive = time.Now()
+		sessions[sessionID] = s
+		saveSessions()
+	}
+	sessionsMu.Unlock()
+	go reapplyKeyboard(s)
+	audit("session.resume", s.Username, sessionID, nil)
+	return s, nil
+}
+
+// waitForPort waits until something accepts connections on a local port.
+func waitForPort(port int, timeout time.Duration) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			c.Close()
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("nothing listening on %s after %v", addr, timeout)
+}
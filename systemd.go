@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Under systemd the gateway can be socket-activated (a .socket unit owns the
+// listening port and passes it in as LISTEN_FDS), and as a Type=notify
+// service it reports readiness only once Docker answers and its sessions are
+// restored, so nothing ordered after it starts too early. With WatchdogSec
+// set it pings the watchdog while its session table is responsive, so a
+// wedged gateway gets restarted. Outside systemd all of this is a no-op.
+
+// dockerWait is how long startup waits for the Docker daemon to answer.
+var dockerWait = 2 * time.Minute
+
+// listen returns the socket passed in by systemd socket activation, or a
+// new listener on listenAddr.
+func listen() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || fds < 1 {
+		return net.Listen("tcp", listenAddr)
+	}
+	if fds > 1 {
+		log.Printf("systemd passed %d sockets; only the first is used", fds)
+	}
+	// Passed descriptors start at 3, after stdin, stdout and stderr
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket from systemd: %w", err)
+	}
+	return ln, nil
+}
+
+// sdNotify sends a state change to systemd, if it is listening.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // Abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
+
+// waitForDocker waits for the Docker daemon to answer. Restoring sessions
+// before it does would find every container gone and tear them all down.
+func waitForDocker() error {
+	deadline := time.Now().Add(dockerWait)
+	for {
+		if execRun(context.Background(), "docker", "info", "--format", "{{.ServerVersion}}") == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("docker did not answer within docker_wait")
+		}
+		sdNotify("STATUS=Waiting for Docker")
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// watchdogLoop pings the systemd watchdog at half its interval, as long as
+// the session table can be locked.
+func watchdogLoop() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		sessionsMu.Lock()
+		sessionsMu.Unlock()
+		sdNotify("WATCHDOG=1")
+	}
+}
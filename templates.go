@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The HTML templates are built into the binary, so the gateway runs without
+// a templates directory. Any file of the same name in templatesDir replaces
+// the built-in one. Templates are parsed once at startup, or on every
+// request with template_reload = true while working on them. The partials
+// (*.tmpl) are parsed into every page, and each page is parsed once per
+// language, with t translating messages into that language.
+
+//go:embed templates/*.html templates/*.tmpl
+var embeddedTemplates embed.FS
+
+var (
+	templateReload = false                       // Re-read templates on every request (for development)
+	templateCache  map[string]*template.Template // keyed by language + "/" + name
+	templateMu     sync.Mutex
+)
+
+// templatePartials are the shared partials parsed into every page.
+var templatePartials = []string{"brand.tmpl", "captcha.tmpl"}
+
+// templateFuncs returns the functions available in templates rendered in
+// the given language.
+func templateFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"brand":   brand,
+		"captcha": captcha,
+		"lang":    func() string { return lang },
+		"t": func(key string, args ...any) string {
+			return translate(lang, key, args...)
+		},
+	}
+}
+
+// loadTemplates parses every template, built-in or overridden.
+func loadTemplates() error {
+	names, err := fs.Glob(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	// Extra templates in the directory are allowed too
+	if extra, err := filepath.Glob(filepath.Join(templatesDir, "*.html")); err == nil {
+		names = append(names, extra...)
+	}
+	cache := make(map[string]*template.Template)
+	for _, n := range names {
+		name := filepath.Base(n)
+		for lang := range languages {
+			if cache[lang+"/"+name] != nil {
+				continue
+			}
+			tmpl, err := parseTemplate(name, lang)
+			if err != nil {
+				return err
+			}
+			cache[lang+"/"+name] = tmpl
+		}
+	}
+	templateMu.Lock()
+	templateCache = cache
+	templateMu.Unlock()
+	return nil
+}
+
+// parseTemplate parses one page along with the shared partials, preferring
+// templatesDir's copy of each.
+func parseTemplate(name, lang string) (*template.Template, error) {
+	tmpl := template.New(name).Funcs(templateFuncs(lang))
+	for _, file := range append([]string{name}, templatePartials...) {
+		var err error
+		path := filepath.Join(templatesDir, file)
+		if _, serr := os.Stat(path); serr == nil {
+			tmpl, err = tmpl.ParseFiles(path)
+		} else {
+			tmpl, err = tmpl.ParseFS(embeddedTemplates, "templates/"+file)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// renderTemplate renders an HTML template in the request's language.
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data any) {
+	renderPage(w, r, 200, name, data)
+}
+
+// renderPage renders an HTML template with the given status.
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	lang := requestLanguage(r)
+	var tmpl *template.Template
+	var err error
+	if templateReload {
+		tmpl, err = parseTemplate(name, lang)
+	} else {
+		templateMu.Lock()
+		tmpl = templateCache[lang+"/"+name]
+		templateMu.Unlock()
+		if tmpl == nil {
+			err = fs.ErrNotExist
+		}
+	}
+	if err != nil {
+		// Not an error page: that might well fail the same way
+		log.Printf("Loading template %s: %v", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	// Render fully first, so a failure can still be reported as an error
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Rendering %s: %v", name, err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+// Users who only need a shell can have a terminal instead of a desktop: a
+// user, group, role or desktop with "backend = terminal" gets the desktop
+// container running nothing but ttyd, a web terminal (xterm.js over a
+// websocket), on their overlay. The session page shows it in place of
+// noVNC, through the same proxy, so sharing (view-only viewers can't type),
+// shadowing, idle timeouts and recording (of the terminal's own websocket
+// traffic) apply as to a desktop. There is no display panel, printing or
+// clipboard relay: the browser's clipboard works in a terminal directly.
+
+// ttyd's client message types.
+const (
+	ttydInput  = '0'
+	ttydResize = '1'
+)
+
+// clientURL returns the page a session (or share token) is used through:
+// noVNC, or a terminal session's web terminal.
+func clientURL(s Session, id string, viewOnly bool, device DeviceProfile) string {
+	if s.Terminal {
+		return "/proxy/" + id + "/"
+	}
+	return vncClientURL(id, viewOnly, device)
+}
+
+// filterTerminal decides whether a client's web terminal message is
+// forwarded, returning its payload or nil. Typing and resizing are what a
+// view-only viewer may not do; typing is what keeps a session active.
+func (vs *vncStream) filterTerminal(f wsFrame) []byte {
+	if f.opcode == 0 {
+		// A continuation is treated as the message it continues
+		if vs.dropping {
+			return nil
+		}
+		return f.payload
+	}
+	vs.dropping = false
+	if len(f.payload) == 0 {
+		return f.payload
+	}
+	switch f.payload[0] {
+	case ttydInput:
+		if vs.opts.ViewOnly {
+			vs.dropping = true
+			return nil
+		}
+		if time.Since(vs.lastInput) > inputTouchInterval {
+			vs.lastInput = time.Now()
+			touchSession(vs.opts.SessionID)
+		}
+	case ttydResize:
+		if vs.opts.ViewOnly {
+			vs.dropping = true
+			return nil
+		}
+	}
+	if vs.rec != nil {
+		vs.rec.fromClient(f.payload)
+	}
+	return f.payload
+}
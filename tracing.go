@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With otlp_endpoint set (or $OTEL_EXPORTER_OTLP_ENDPOINT), the gateway
+// sends OpenTelemetry traces of starting desktops to a collector over
+// OTLP/HTTP: a login is a trace, with spans for starting the session,
+// mounting the overlay and the network home, and running the container,
+// followed by one for the wait until noVNC first answers through the proxy.
+// Each request through the VNC proxy gets a span in the session's trace,
+// lasting until the container's response headers arrive. A W3C traceparent
+// header on the login request makes it part of the caller's trace. Spans
+// are sent in batches; if the collector falls behind, spans are dropped
+// rather than slowing logins down.
+
+var (
+	otlpEndpoint     = ""             // OTLP/HTTP collector base URL ("" = no tracing)
+	traceServiceName = "lookingglass" // service.name reported with spans
+	traceClient      = &http.Client{Timeout: 10 * time.Second}
+	spanQueue        = make(chan *span, 1024)
+)
+
+const (
+	traceBatch    = 256
+	traceInterval = 5 * time.Second
+)
+
+// span is one timed operation in a trace. Its methods do nothing on a nil
+// span, which is what startSpan returns with tracing off.
+type span struct {
+	traceID, spanID, parentID string // Hex
+	name                      string
+	start, end                time.Time
+	attrs                     map[string]string
+	err                       error
+}
+
+type spanKey struct{}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span, a child of any span in ctx.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if otlpEndpoint == "" {
+		return ctx, nil
+	}
+	sp := &span{spanID: randomHex(8), name: name, start: time.Now(), attrs: make(map[string]string)}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		sp.traceID, sp.parentID = parent.traceID, parent.spanID
+	} else {
+		sp.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// withTraceparent returns ctx with the remote parent in a W3C traceparent
+// value, such as a request header or Session.Trace, if it is valid.
+func withTraceparent(ctx context.Context, tp string) context.Context {
+	parts := strings.Split(tp, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, &span{traceID: parts[1], spanID: parts[2]})
+}
+
+// traceRequest starts a span for a request, continuing the caller's trace.
+func traceRequest(r *http.Request, name string) (context.Context, *span) {
+	if otlpEndpoint == "" {
+		return r.Context(), nil
+	}
+	return startSpan(withTraceparent(r.Context(), r.Header.Get("traceparent")), name)
+}
+
+// traceparent returns the span's W3C traceparent, for its children
+// elsewhere.
+func (sp *span) traceparent() string {
+	if sp == nil {
+		return ""
+	}
+	return "00-" + sp.traceID + "-" + sp.spanID + "-01"
+}
+
+// set records an attribute, unless the span has finished.
+func (sp *span) set(key, value string) {
+	if sp != nil && sp.end.IsZero() {
+		sp.attrs[key] = value
+	}
+}
+
+// fail marks the span as failed, unless it has finished.
+func (sp *span) fail(err error) {
+	if sp != nil && err != nil && sp.end.IsZero() {
+		sp.err = err
+	}
+}
+
+// finish ends the span and queues it for export.
+func (sp *span) finish() {
+	if sp == nil || !sp.end.IsZero() {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case spanQueue <- sp:
+	default:
+		// The collector is behind; tracing mustn't hold anything up
+	}
+}
+
+// traceExportLoop sends finished spans to the collector in batches.
+func traceExportLoop() {
+	if otlpEndpoint == "" {
+		return
+	}
+	var batch []*span
+	tick := time.NewTicker(traceInterval)
+	for {
+		select {
+		case sp := <-spanQueue:
+			if batch = append(batch, sp); len(batch) < traceBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exportSpans(batch); err != nil {
+			log.Printf("Exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// otlpValue is an OTLP string attribute.
+type otlpValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+// exportSpans posts spans to the collector as OTLP/HTTP JSON.
+func exportSpans(spans []*span) error {
+	attr := func(k, v string) otlpValue { return otlpValue{k, map[string]string{"stringValue": v}} }
+	hostname, _ := os.Hostname()
+	var out []map[string]any
+	for _, sp := range spans {
+		attrs := []otlpValue{}
+		for k, v := range sp.attrs {
+			attrs = append(attrs, attr(k, v))
+		}
+		status := map[string]any{"code": 1} // Ok
+		if sp.err != nil {
+			status = map[string]any{"code": 2, "message": sp.err.Error()}
+		}
+		out = append(out, map[string]any{
+			"traceId":           sp.traceID,
+			"spanId":            sp.spanID,
+			"parentSpanId":      sp.parentID,
+			"name":              sp.name,
+			"kind":              1, // Internal
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		})
+	}
+	body, err := json.Marshal(map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": []otlpValue{
+			attr("service.name", traceServiceName), attr("host.name", hostname),
+		}},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]string{"name": "lookingglass"},
+			"spans": out,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := traceClient.Post(strings.TrimSuffix(otlpEndpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// traceFirstByte records the first time noVNC answers through the proxy for
+// a session, with a span from the session starting until then: how long a
+// user waits for their desktop once the container is up.
+func traceFirstByte(sessionID string) {
+	sessionsMu.Lock()
+	s, ok := sessions[sessionID]
+	if !ok || !s.FirstByte.IsZero() {
+		sessionsMu.Unlock()
+		return
+	}
+	s.FirstByte = time.Now()
+	sessions[sessionID] = s
+	saveSessions()
+	sessionsMu.Unlock()
+
+	if s.Trace == "" {
+		return
+	}
+	_, sp := startSpan(withTraceparent(context.Background(), s.Trace), "novnc.first_byte")
+	if sp == nil {
+		return
+	}
+	sp.start = s.StartedAt
+	sp.set("session", s.ID)
+	sp.finish()
+}
@@ -0,0 +1,54 @@
+#!/bin/bash
+# LookingGlass in-container agent.
+# Talks to the gateway at $LG_GATEWAY_URL, authenticated with $LG_AGENT_TOKEN:
+# - relays the clipboard between the desktop and the user's browser, in the
+#   directions the session's policy allows
+# - reports how long the desktop has gone without keyboard or mouse input
+
+[ -n "$LG_GATEWAY_URL" ] && [ -n "$LG_AGENT_TOKEN" ] || exec sleep infinity
+
+AUTH="Authorization: Bearer $LG_AGENT_TOKEN"
+HEADERS=$(mktemp)
+clip_seq=0
+clip_last=""
+activity_every=30
+activity_at=0
+
+# The session's data policy; the gateway refuses what it doesn't allow anyway
+clip_in=true
+clip_out=true
+for _ in 1 2 3 4 5; do
+  if policy=$(curl -fsS -H "$AUTH" "$LG_GATEWAY_URL/agent/policy"); then
+    grep -q '"clipboard_in":false' <<<"$policy" && clip_in=false
+    grep -q '"clipboard_out":false' <<<"$policy" && clip_out=false
+    break
+  fi
+  sleep 2
+done
+
+while sleep 1; do
+  # Browser -> desktop
+  if $clip_in && text=$(curl -fsS -D "$HEADERS" -H "$AUTH" "$LG_GATEWAY_URL/agent/clipboard?since=$clip_seq"); then
+    seq=$(tr -d '\r' < "$HEADERS" | awk -F': ' 'tolower($1) == "x-clipboard-seq" { print $2 }')
+    if [ -n "$seq" ] && [ "$seq" -gt "$clip_seq" ]; then
+      clip_seq=$seq
+      if grep -q '^HTTP/[0-9.]* 200' "$HEADERS"; then
+        printf '%s' "$text" | xclip -selection clipboard -i
+        clip_last=$text
+      fi
+    fi
+  fi
+
+  # Desktop -> browser
+  current=$(xclip -selection clipboard -o 2>/dev/null)
+  if $clip_out && [ "$current" != "$clip_last" ]; then
+    clip_last=$current
+    printf '%s' "$current" | curl -fsS -X POST -H "$AUTH" --data-binary @- "$LG_GATEWAY_URL/agent/clipboard" >/dev/null
+  fi
+
+  # Input idle time, for the gateway's idle detection
+  if [ $((SECONDS - activity_at)) -ge $activity_every ] && idle=$(xprintidle 2>/dev/null); then
+    activity_at=$SECONDS
+    curl -fsS -X POST -H "$AUTH" --data "idle=$idle" "$LG_GATEWAY_URL/agent/activity" >/dev/null
+  fi
+done
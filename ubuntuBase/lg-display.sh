@@ -0,0 +1,25 @@
+#!/bin/bash
+# Applies the display settings the gateway chose for the device the session
+# was started from, once the X server and the Xfce settings daemon are up.
+#   LG_RESOLUTION  initial desktop size, WIDTHxHEIGHT (phones)
+#   LG_DPI         font DPI
+
+export DISPLAY=${DISPLAY:-:1}
+
+for i in $(seq 30); do
+  xrandr >/dev/null 2>&1 && break
+  sleep 1
+done
+
+if [ -n "$LG_RESOLUTION" ]; then
+  /usr/local/bin/lg-resize "$LG_RESOLUTION"
+fi
+
+if [ -n "$LG_DPI" ]; then
+  echo "Xft.dpi: $LG_DPI" | xrdb -merge
+  # xfsettingsd starts with the session and would override xrdb
+  for i in $(seq 30); do
+    xfconf-query -c xsettings -p /Xft/DPI -n -t int -s "$LG_DPI" 2>/dev/null && break
+    sleep 1
+  done
+fi
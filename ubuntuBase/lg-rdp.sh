@@ -0,0 +1,17 @@
+#!/bin/bash
+# Connects to a Windows desktop for an RDP session (backend = rdp), run by
+# lg-session.sh as the session's app, so it reconnects when closed. The
+# gateway passes the target in LG_RDP_* and the password, if it has one, in
+# a file; without one, the Windows logon screen asks for it.
+
+args=(/v:"$LG_RDP_HOST" /u:"$LG_RDP_USER" /dynamic-resolution +clipboard /cert-tofu)
+if [ -n "$LG_RDP_DOMAIN" ]; then
+  args+=(/d:"$LG_RDP_DOMAIN")
+fi
+if [ -r /run/lg-rdp/password ]; then
+  # xfreerdp blanks the password out of its command line once read
+  args+=(/p:"$(cat /run/lg-rdp/password)")
+else
+  args+=(-sec-nla)
+fi
+exec xfreerdp "${args[@]}" $LG_RDP_OPTIONS
@@ -0,0 +1,28 @@
+#!/bin/bash
+# Resize the desktop and define its monitor layout.
+# Usage: lg-resize WIDTHxHEIGHT [WxH+X+Y ...]
+# With no monitors the whole desktop is one screen; otherwise each WxH+X+Y
+# becomes a RandR virtual monitor, so panels and maximised windows treat
+# them as separate screens.
+
+export DISPLAY=${DISPLAY:-:1}
+fb=$1
+shift
+[ -n "$fb" ] || { echo "usage: lg-resize WIDTHxHEIGHT [WxH+X+Y ...]" >&2; exit 2; }
+
+xrandr --fb "$fb" || exit 1
+
+# Drop the previous layout
+for m in $(xrandr --listmonitors | awk '$2 ~ /lg-/ { gsub(/[+*]/, "", $2); print $2 }'); do
+  xrandr --delmonitor "$m"
+done
+
+i=0
+for mon in "$@"; do
+  w=${mon%%x*}
+  rest=${mon#*x}
+  h=${rest%%+*}
+  offset=${rest#*+}
+  xrandr --setmonitor "lg-$i" "$w/0x$h/0+$offset" none || exit 1
+  i=$((i + 1))
+done
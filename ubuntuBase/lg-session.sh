@@ -0,0 +1,14 @@
+#!/bin/bash
+# Runs the desktop environment or, for an app profile (LG_APP, set by the
+# gateway), just that application fullscreen under a minimal window manager.
+# The app is started again whenever it is closed.
+
+if [ -z "$LG_APP" ]; then
+  exec /usr/bin/startxfce4
+fi
+
+matchbox-window-manager -use_titlebar no -use_cursor yes &
+while true; do
+  sh -c "$LG_APP"
+  sleep 1
+done
@@ -0,0 +1,31 @@
+#!/bin/bash
+# Draws the session's watermark (the user, their address and the time, say)
+# over the desktop, click-through and always on top, so screenshots and
+# photos of the screen carry it. The gateway sets LG_WATERMARK=1 when the
+# session has one; the text is fetched from it again every minute.
+
+[ -n "$LG_WATERMARK" ] && [ -n "$LG_GATEWAY_URL" ] && [ -n "$LG_AGENT_TOKEN" ] || exec sleep infinity
+
+export DISPLAY=${DISPLAY:-:1}
+AUTH="Authorization: Bearer $LG_AGENT_TOKEN"
+FONT='-misc-fixed-bold-r-normal--18-*-*-*-*-*-iso10646-1'
+EVERY=60
+
+until xrandr >/dev/null 2>&1; do
+  sleep 1
+done
+
+while true; do
+  text=$(curl -fsS -H "$AUTH" "$LG_GATEWAY_URL/agent/watermark")
+  if [ -z "$text" ]; then
+    sleep "$EVERY"
+    continue
+  fi
+  # A little longer than a minute, so the next one is up before these go
+  for pos in "top left" "middle center" "bottom right"; do
+    set -- $pos
+    printf '%s\n' "$text" | osd_cat -p "$1" -A "$2" -o 40 -i 40 -d $((EVERY + 2)) \
+      -f "$FONT" -c '#a0a0a0' -O 1 -u '#303030' &
+  done
+  sleep "$EVERY"
+done
@@ -1,6 +1,12 @@
 #!/bin/bash
 # Entrypoint for containers that use OverlayFS as a root substitute.
-# This script chroots into /mnt/overlay (if mounted) and starts supervisord there.
+# This script chroots into /mnt/overlay (if mounted) and starts supervisord there,
+# or for a terminal session (LG_TERMINAL, set by the gateway) just ttyd, serving
+# the desktop user's shell on the port noVNC would use.
+
+if [ -n "$LG_TERMINAL" ]; then
+  TERMINAL=(/usr/bin/ttyd --port 8080 /bin/su - docker)
+fi
 
 OVERLAY=/mnt/overlay
 
@@ -20,9 +26,16 @@ mkdir -p "$OVERLAY/tmp/.X11-unix"
 chmod 1777 "$OVERLAY/tmp" "$OVERLAY/tmp/.X11-unix"
 
 
+  if [ -n "$LG_TERMINAL" ]; then
+    exec chroot "$OVERLAY" "${TERMINAL[@]}"
+  fi
+
   # Enter overlay and launch supervisord (manages Xfce, x11vnc, novnc)
   exec chroot "$OVERLAY" /usr/bin/supervisord -c /etc/supervisor/conf.d/supervisord.conf
 else
+  if [ -n "$LG_TERMINAL" ]; then
+    exec "${TERMINAL[@]}"
+  fi
   echo "[!] Overlay root not found, running fallback supervisord"
   exec /usr/bin/supervisord -c /etc/supervisor/conf.d/supervisord.conf
 fi
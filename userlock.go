@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Starting a persistent desktop is serialized per user and desktop, so that
+// simultaneous logins (a double-clicked button, two devices at once) can't
+// both mount the same upperdir and start two containers on it. Guests are
+// exempt: every guest login gets a fresh overlay of its own. With several
+// gateways the lock is also taken in the cluster store, waiting at most
+// clusterLockWait for another gateway to finish with it, and a desktop's
+// route is published before the lock is let go, so the next gateway to
+// take it finds the desktop running.
+
+var (
+	desktopLocks   = make(map[string]*desktopLock)
+	desktopLocksMu sync.Mutex
+	errLockBusy    = errors.New("desktop busy on another gateway; try again shortly")
+)
+
+// desktopLock is a mutex shared by everyone starting the same desktop.
+type desktopLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockDesktop locks a user's desktop against concurrent starts, returning
+// the function that unlocks it. If another gateway holds the desktop's
+// cluster lock for longer than clusterLockWait, it is only locked locally
+// and errLockBusy is returned with the unlock function.
+func lockDesktop(username, desktop string) (unlock func(), err error) {
+	key := username + "\x00" + desktop
+	desktopLocksMu.Lock()
+	l, ok := desktopLocks[key]
+	if !ok {
+		l = &desktopLock{}
+		desktopLocks[key] = l
+	}
+	l.refs++
+	desktopLocksMu.Unlock()
+
+	l.mu.Lock()
+	unlockCluster := func() {}
+	if cluster != nil {
+		if unlockCluster, err = clusterLock("desktop:"+username+"/"+desktop, clusterLockTTL, clusterLockWait); err != nil {
+			if err != errLockBusy {
+				log.Printf("Cluster store: locking %s's desktop, locking locally only: %v", username, err)
+				err = nil
+			}
+			unlockCluster = func() {}
+		}
+	}
+	return func() {
+		unlockCluster()
+		l.mu.Unlock()
+		desktopLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(desktopLocks, key)
+		}
+		desktopLocksMu.Unlock()
+	}, err
+}
+
+// startOrFind returns the running session of u's desktop, starting one if
+// there is none. Concurrent calls for the same desktop all get the same
+// session; started reports whether this call was the one to start it.
+// Nothing is started while maintenance is due or under way, whatever asked
+// for the desktop.
+func startOrFind(ctx context.Context, u *User, password, remote string) (sessionID string, started bool, err error) {
+	start := func() (string, bool, error) {
+		if end, closed := maintenanceClosed(time.Now()); closed {
+			return "", false, &startError{503, "closed for maintenance until " + end.Format("15:04")}
+		}
+		// Mounts and docker run are left to the start workers
+		if werr := onStartWorker(ctx, func() { sessionID, err = startSession(ctx, u, password, remote) }); werr != nil {
+			return "", false, werr
+		}
+		return sessionID, err == nil, err
+	}
+	if u.overlay() == "ephemeral" {
+		return start()
+	}
+	unlock, err := lockDesktop(u.Name, u.Desktop)
+	defer unlock()
+	if err != nil {
+		return "", false, &startError{409, err.Error()}
+	}
+	if s, ok := findDesktopSession(u.Name, u.Desktop); ok {
+		return s.ID, false, nil
+	}
+	if cluster == nil {
+		return start()
+	}
+	route := "user:" + u.Name + "/" + u.Desktop
+	if node := routeNode(route); node != "" {
+		return "", false, &startError{409, "desktop already running on " + node}
+	}
+	sessionID, started, err = start()
+	if started {
+		// Before the lock goes, not at clusterLoop's next pass
+		if err := publishRoute(route); err != nil {
+			log.Printf("Cluster store: publishing %s: %v", route, err)
+		}
+	}
+	return sessionID, started, err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// User is a user's configuration from <username>.conf. Settings missing from
+// the user's [user] section fall back to their groups (see groups.go), then
+// to the [role <name>] section of the gateway config named by their (or
+// their group's) "role" key.
+//
+// A user may also own several named desktops, each a [desktop <name>]
+// section of their config. A User returned by forDesktop reads that
+// section's settings first.
+type User struct {
+	Name    string
+	Desktop string // Named desktop ("" = the user's only desktop)
+	Device  string // Device class logging in, for display settings ("" = unknown)
+	file    *ini.File
+	conf    *ini.Section
+	desk    *ini.Section   // nil unless Desktop is set
+	groups  []*ini.Section // [group <name>] sections the user is in, in order
+	role    *ini.Section   // nil if the user has no role
+}
+
+// loginNameRe is what any user's name must look like, since names end up in
+// file paths, container names and command arguments: no slashes, no leading
+// dot or dash, nothing too long to fit a container name. usernameRe, for
+// new users, also insists on lower case.
+var loginNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// validUsername reports whether a name is safe to look up as a user.
+func validUsername(name string) bool {
+	return loginNameRe.MatchString(name)
+}
+
+// loadUser reads a user's config. It returns an error wrapping os.ErrNotExist
+// for unknown users, including names that could never be valid (such as
+// ../../etc/passwd).
+func loadUser(username string) (*User, error) {
+	if !validUsername(username) {
+		return nil, &os.PathError{Op: "load user", Path: username, Err: os.ErrNotExist}
+	}
+	confPath := filepath.Join(userConfDir, username+".conf")
+	cfg := ini.Empty()
+	_, err := os.Stat(confPath)
+	switch {
+	case err == nil:
+		if cfg, err = ini.Load(confPath); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		// Members of a group with a passwords file need no file of their own
+		password, ok := groupPassword(username)
+		if !ok {
+			return nil, err
+		}
+		cfg.Section("user").Key("password").SetValue(password)
+	default:
+		return nil, err
+	}
+	u := &User{Name: username, file: cfg, conf: cfg.Section("user")}
+	u.groups = userGroups(username, u.conf.Key("groups").Strings(","))
+	if role := u.setting("role"); role != "" && gatewayCfg != nil {
+		u.role, _ = gatewayCfg.GetSection("role " + role)
+	}
+	return u, nil
+}
+
+// desktops returns the names of the user's named desktops, if any.
+func (u *User) desktops() []string {
+	var names []string
+	for _, sec := range u.file.Sections() {
+		if name, ok := strings.CutPrefix(sec.Name(), "desktop "); ok && desktopNameRe.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// forDesktop returns the user as seen by one of their named desktops, by
+// an app profile (app:<name>, see apps.go) or by a catalog entry
+// (image:<name>, see catalog.go).
+func (u *User) forDesktop(name string) (*User, error) {
+	if app, ok := strings.CutPrefix(name, appPrefix); ok {
+		return u.forApp(app)
+	}
+	if image, ok := strings.CutPrefix(name, imagePrefix); ok {
+		return u.forImage(image)
+	}
+	if host, ok := strings.CutPrefix(name, hostPrefix); ok {
+		return u.forHost(host)
+	}
+	sec, err := u.file.GetSection("desktop " + name)
+	if err != nil || !desktopNameRe.MatchString(name) {
+		return nil, errUnknownDesktop
+	}
+	d := *u
+	d.Desktop, d.desk = name, sec
+	return &d, nil
+}
+
+// overlay returns the overlay setting for the user's desktop: a named
+// desktop lives in desktops/<name> under the user's overlay unless it sets
+// its own.
+func (u *User) overlay() string {
+	if u.desk != nil && !u.desk.HasKey("overlay") {
+		if base := u.setting("overlay"); base != "" && base != "ephemeral" {
+			return filepath.Join(base, "desktops", u.Desktop)
+		}
+	}
+	return u.setting("overlay")
+}
+
+// overlayDesktops returns the user's desktops with overlays of their own,
+// as forDesktop names them: named desktops, apps and catalog images.
+func (u *User) overlayDesktops() []string {
+	names := u.desktops()
+	for _, app := range u.apps() {
+		names = append(names, appPrefix+app)
+	}
+	for _, image := range u.catalog() {
+		names = append(names, imagePrefix+image)
+	}
+	return names
+}
+
+// encrypted reports whether any of the user's desktops keeps an fscrypt
+// overlay, whose key is protected by the user's password.
+func (u *User) encrypted() bool {
+	if u.overlay() != "ephemeral" && u.setting("encryption") == "fscrypt" {
+		return true
+	}
+	for _, name := range u.overlayDesktops() {
+		if d, err := u.forDesktop(name); err == nil && d.overlay() != "ephemeral" && d.setting("encryption") == "fscrypt" {
+			return true
+		}
+	}
+	return false
+}
+
+// setting returns a user setting, falling back to the user's groups and
+// role. In settings from a group or role, {user} stands for the user's name
+// (as in overlay = /srv/overlays/{user}).
+func (u *User) setting(key string) string {
+	if u.desk != nil && u.desk.HasKey(key) {
+		return u.desk.Key(key).String()
+	}
+	if u.conf.HasKey(key) {
+		return u.conf.Key(key).String()
+	}
+	for _, g := range u.groups {
+		if g.HasKey(key) {
+			return strings.ReplaceAll(g.Key(key).String(), "{user}", u.Name)
+		}
+	}
+	if u.role != nil {
+		return strings.ReplaceAll(u.role.Key(key).String(), "{user}", u.Name)
+	}
+	return ""
+}
+
+// settingKey returns the key holding a setting, for typed access. Keys that
+// are set nowhere come back empty.
+func (u *User) settingKey(key string) *ini.Key {
+	if u.desk != nil && u.desk.HasKey(key) {
+		return u.desk.Key(key)
+	}
+	if u.conf.HasKey(key) {
+		return u.conf.Key(key)
+	}
+	for _, g := range u.groups {
+		if g.HasKey(key) {
+			return g.Key(key)
+		}
+	}
+	if u.role != nil && u.role.HasKey(key) {
+		return u.role.Key(key)
+	}
+	return u.conf.Key(key)
+}
+
+// checkPassword reports whether password is the user's password, which
+// may be stored hashed (see hashPassword). Disabled users have none.
+func (u *User) checkPassword(password string) bool {
+	if u.conf.Key("disabled").MustBool(false) {
+		return false
+	}
+	want := u.conf.Key("password").String()
+	if strings.HasPrefix(want, passwordHashPrefix) {
+		return checkPasswordHash(password, want)
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"gopkg.in/ini.v1"
+)
+
+// Some workloads can't run in a container at all (another kernel, Windows,
+// drivers). A user, group, role or desktop with "backend = vm" gets a full
+// virtual machine instead, on the hypervisor the [vm] section names:
+//
+//	libvirt  Domains cloned with virt-clone from the template domain
+//	         vm_template names, on the libvirt at uri (qemu:///system by
+//	         default). vm_user_data, a cloud-init user-data file with {user}
+//	         replaced by the username, is attached as a NoCloud seed disk
+//	         made with cloud-localds.
+//	proxmox  Full clones of the template VM whose ID vm_template gives, on
+//	         node of the Proxmox VE cluster at url; token is an API token,
+//	         user@realm!name=secret. ciuser is set to the username, and
+//	         vm_user_data, if given, is the cicustom user-data snippet (such
+//	         as local:snippets/desktop.yaml).
+//
+// Each user's desktop keeps its VM, named after them and the desktop: it is
+// cloned on first use, shut down when the session ends and booted again for
+// the next one. Guests get a VM of their own, destroyed when they leave.
+//
+// The VM's VNC console is bridged onto the session's port as a websocket,
+// so the bundled noVNC client, view-only links, sharing and recording work
+// as for a container; a console password (libvirt's, or Proxmox's one-time
+// ticket) is answered by the gateway. Nothing runs inside the VM for the
+// gateway, so there's no clipboard relay, file exchange, printing, reset,
+// snapshots or suspending; an idle VM session is ended. A VM that stops on
+// its own ends its session.
+
+var (
+	vmHost          vmHypervisor       // nil = no VM backend
+	vmCreateTimeout = 10 * time.Minute // Longest cloning a new VM may take
+	vmStopTimeout   = 2 * time.Minute  // Clean shutdown before the VM is powered off
+	vmPrefix        = "lg-"            // Start of VM names
+	vmSeedDir       = "/srv/overlays/vm-seeds"
+)
+
+var errNoVMBackend = errors.New("no [vm] provider is configured")
+
+// vmSpec describes the VM a user's desktop runs.
+type vmSpec struct {
+	Template string // Domain name or VM ID to clone
+	UserData string // Cloud-init user-data, as the hypervisor takes it
+	User     string
+}
+
+// vmHypervisor runs desktop VMs.
+type vmHypervisor interface {
+	// provision creates the VM unless it already exists.
+	provision(ctx context.Context, name string, spec vmSpec) error
+	start(ctx context.Context, name string) error
+	// shutdown shuts the VM down, powering it off after vmStopTimeout.
+	shutdown(ctx context.Context, name string) error
+	destroy(ctx context.Context, name string) error
+	running(ctx context.Context, name string) bool
+	// console connects to the VM's VNC server, returning its password.
+	console(ctx context.Context, name string) (io.ReadWriteCloser, string, error)
+}
+
+// loadVMs reads the [vm] section.
+func loadVMs(sec *ini.Section) error {
+	vmHost = nil
+	vmCreateTimeout = sec.Key("create_timeout").MustDuration(vmCreateTimeout)
+	vmStopTimeout = sec.Key("stop_timeout").MustDuration(vmStopTimeout)
+	vmPrefix = sec.Key("name_prefix").MustString(vmPrefix)
+	vmSeedDir = sec.Key("seed_dir").MustString(filepath.Join(overlayRoot, "vm-seeds"))
+	switch provider := sec.Key("provider").String(); provider {
+	case "":
+	case "libvirt":
+		vmHost = &libvirtHost{uri: sec.Key("uri").MustString("qemu:///system")}
+	case "proxmox":
+		token, err := resolveSecret(sec.Key("token").String())
+		if err != nil {
+			return fmt.Errorf("vm: token: %v", err)
+		}
+		vmHost = &proxmoxHost{proxmoxProvider{
+			url:   strings.TrimRight(sec.Key("url").String(), "/"),
+			token: token,
+			node:  sec.Key("node").String(),
+		}}
+	default:
+		return fmt.Errorf("vm: unknown provider %q", provider)
+	}
+	return nil
+}
+
+var vmNameJunk = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// vmNameFor names the VM a user's desktop runs in. The hash keeps names
+// distinct where sanitising them wouldn't.
+func vmNameFor(u *User) string {
+	desktop := u.Desktop
+	if desktop == "" || desktop == mainDesktop {
+		desktop = "main"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(u.Name + "\x00" + desktop))
+	name := vmNameJunk.ReplaceAllString(strings.ToLower(u.Name+"-"+desktop), "-")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	return fmt.Sprintf("%s%s-%08x", vmPrefix, strings.Trim(name, "-"), h.Sum32())
+}
+
+// startVMSession is startSession for a desktop with backend = vm.
+func startVMSession(ctx context.Context, u *User, remote, sharingPolicy, clientCert, trace string) (sessionID string, err error) {
+	if vmHost == nil {
+		return "", &startError{500, "Config error: backend = vm, but " + errNoVMBackend.Error()}
+	}
+	if novncVersion == "" {
+		return "", &startError{500, "Config error: VM desktops need the bundled noVNC client"}
+	}
+	spec := vmSpec{Template: u.setting("vm_template"), UserData: u.setting("vm_user_data"), User: u.Name}
+	if spec.Template == "" {
+		return "", &startError{500, "Config error: backend = vm needs vm_template"}
+	}
+	guest := u.overlay() == "ephemeral"
+	name := vmNameFor(u)
+	if guest {
+		name = vmPrefix + "guest-" + randSeq(8)
+	}
+
+	id := newSessionID()
+	ev := hookEvent{Session: id, Username: u.Name, Desktop: u.Desktop, Container: name, Guest: guest, Image: spec.Template, Remote: remote}
+	if err := runHook(ctx, "pre_start", hookPreStart, ev); err != nil {
+		return "", &startError{500, err.Error()}
+	}
+	defer func() {
+		if err != nil {
+			ev.Reason = "start_failed"
+			logHook(context.Background(), "post_stop", hookPostStop, ev)
+		}
+	}()
+
+	progress(ctx, "mounting")
+	err = timeStep(ctx, "vm.provision", func(sp *span) error {
+		sp.set("vm", name)
+		sp.set("template", spec.Template)
+		ctx, cancel := context.WithTimeout(ctx, vmCreateTimeout)
+		defer cancel()
+		return vmHost.provision(ctx, name, spec)
+	})
+	if err != nil {
+		return "", &startError{500, "Failed to create VM: " + err.Error()}
+	}
+	stopVM := func() {
+		stopVMSession(context.Background(), Session{VM: name, Ephemeral: guest})
+	}
+
+	progress(ctx, "container")
+	err = timeStep(ctx, "vm.start", func(sp *span) error {
+		sp.set("vm", name)
+		if vmHost.running(ctx, name) {
+			return nil // Left running when the gateway last stopped it
+		}
+		return vmHost.start(ctx, name)
+	})
+	if err != nil {
+		stopVM()
+		return "", &startError{500, "Failed to start VM: " + err.Error()}
+	}
+
+	// The console answers from the moment the VM is powered on, so the
+	// user watches it boot
+	sessionID = id
+	var port int
+	err = retry(ctx, "Bridging console of "+name, func() error {
+		port = randomPort()
+		return startConsoleBridge(sessionID, port, vmConsole(name))
+	})
+	if err != nil {
+		stopVM()
+		return "", &startError{500, "Failed to bridge VM console: " + err.Error()}
+	}
+
+	idleTimeout, maxLifetime := sessionLimits(u, guest)
+	sessionsMu.Lock()
+	sessions[sessionID] = withViewOnly(u, Session{
+		ID:              sessionID,
+		Username:        u.Name,
+		Desktop:         u.Desktop,
+		Image:           spec.Template,
+		ContainerName:   name,
+		VM:              name,
+		Port:            port,
+		LastActive:      time.Now(),
+		Ephemeral:       guest,
+		OwnerToken:      newAgentToken(),
+		ClipboardPolicy: "none",
+		SharingPolicy:   sharingPolicy,
+		Record:          u.settingKey("record").MustBool(false),
+		StartedAt:       time.Now(),
+		IdleTimeout:     idleTimeout,
+		MaxLifetime:     maxLifetime,
+		IdleAction:      "stop",
+		Scan:            "none",
+		ClientCert:      clientCert,
+		Trace:           trace,
+		LockAfter:       u.settingKey("lock_on_disconnect").MustDuration(0),
+	})
+	saveSessions()
+	sessionsMu.Unlock()
+	audit("session.start", u.Name, sessionID, map[string]string{
+		"vm": name, "template": spec.Template, "remote": remote,
+	})
+	ev.Port = port
+	logHook(ctx, "post_start", hookPostStart, ev)
+	return sessionID, nil
+}
+
+// stopVMSession tears down a VM session's bridge and VM.
+func stopVMSession(ctx context.Context, s Session) {
+	stopConsoleBridge(s.ID)
+	var err error
+	if s.Ephemeral {
+		err = vmHost.destroy(ctx, s.VM)
+	} else {
+		err = vmHost.shutdown(ctx, s.VM)
+	}
+	if err != nil {
+		log.Printf("Session %s: stopping VM %s: %v", s.ID, s.VM, err)
+	}
+}
+
+// vmWatchLoop ends the sessions of VMs that have stopped on their own
+// (shut down from inside, or killed on the hypervisor).
+func vmWatchLoop() {
+	for {
+		time.Sleep(30 * time.Second)
+		if vmHost == nil {
+			continue
+		}
+		sessionsMu.RLock()
+		var vms []Session
+		for _, s := range sessions {
+			if s.VM != "" {
+				vms = append(vms, s)
+			}
+		}
+		sessionsMu.RUnlock()
+		for _, s := range vms {
+			if !vmHost.running(context.Background(), s.VM) {
+				log.Printf("Session %s: VM %s has stopped, ending session", s.ID, s.VM)
+				audit("session.crash", s.Username, s.ID, map[string]string{"vm": s.VM})
+				stopSession(s.ID, endCrashed)
+			}
+		}
+	}
+}
+
+// vmConsole returns a VM's console, for startConsoleBridge.
+func vmConsole(name string) consoleDialer {
+	return func(ctx context.Context) (io.ReadWriteCloser, string, error) {
+		return vmHost.console(ctx, name)
+	}
+}
+
+// --- libvirt, through virsh ---
+
+type libvirtHost struct {
+	uri string
+}
+
+// virsh runs a virsh command against the configured libvirt.
+func (h *libvirtHost) virsh(ctx context.Context, args ...string) (string, error) {
+	out, err := execOutput(ctx, "virsh", append([]string{"-c", h.uri}, args...)...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func (h *libvirtHost) provision(ctx context.Context, name string, spec vmSpec) error {
+	if _, err := h.virsh(ctx, "dominfo", name); err == nil {
+		return nil
+	}
+	if _, err := timedCommand(ctx, vmCreateTimeout, "virt-clone", "--connect", h.uri,
+		"--original", spec.Template, "--name", name, "--auto-clone"); err != nil {
+		return err
+	}
+	if spec.UserData == "" {
+		return nil
+	}
+	err := h.attachSeed(ctx, name, spec)
+	if err != nil {
+		h.destroy(context.WithoutCancel(ctx), name)
+	}
+	return err
+}
+
+// attachSeed makes a new VM's cloud-init seed disk and attaches it.
+func (h *libvirtHost) attachSeed(ctx context.Context, name string, spec vmSpec) error {
+	data, err := os.ReadFile(spec.UserData)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vmSeedDir, 0700); err != nil {
+		return err
+	}
+	userData := filepath.Join(vmSeedDir, name+".user-data")
+	seed := filepath.Join(vmSeedDir, name+".iso")
+	defer os.Remove(userData)
+	data = bytes.ReplaceAll(data, []byte("{user}"), []byte(spec.User))
+	if err := os.WriteFile(userData, data, 0600); err != nil {
+		return err
+	}
+	if err := execRun(ctx, "cloud-localds", seed, userData); err != nil {
+		return err
+	}
+	_, err = h.virsh(ctx, "attach-disk", name, seed, "sdz", "--type", "cdrom", "--mode", "readonly", "--config")
+	return err
+}
+
+func (h *libvirtHost) start(ctx context.Context, name string) error {
+	_, err := h.virsh(ctx, "start", name)
+	return err
+}
+
+func (h *libvirtHost) shutdown(ctx context.Context, name string) error {
+	if !h.running(ctx, name) {
+		return nil
+	}
+	if _, err := h.virsh(ctx, "shutdown", name); err == nil {
+		deadline := time.Now().Add(vmStopTimeout)
+		for time.Now().Before(deadline) {
+			if !h.running(ctx, name) {
+				return nil
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}
+	_, err := h.virsh(ctx, "destroy", name)
+	return err
+}
+
+func (h *libvirtHost) destroy(ctx context.Context, name string) error {
+	if _, err := h.virsh(ctx, "destroy", name); err != nil && h.running(ctx, name) {
+		return err
+	}
+	_, err := h.virsh(ctx, "undefine", name, "--remove-all-storage", "--nvram")
+	os.Remove(filepath.Join(vmSeedDir, name+".iso"))
+	return err
+}
+
+func (h *libvirtHost) running(ctx context.Context, name string) bool {
+	state, err := h.virsh(ctx, "domstate", name)
+	return err == nil && state == "running"
+}
+
+// console connects to the VNC server domdisplay names, such as
+// vnc://:secret@127.0.0.1:0 (display 0, port 5900).
+func (h *libvirtHost) console(ctx context.Context, name string) (io.ReadWriteCloser, string, error) {
+	display, err := h.virsh(ctx, "domdisplay", "--type", "vnc", "--include-password", name)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := url.Parse(display)
+	if err != nil || u.Scheme != "vnc" {
+		return nil, "", fmt.Errorf("unexpected display %q", display)
+	}
+	var n int
+	if _, err := fmt.Sscan(u.Port(), &n); err != nil {
+		return nil, "", fmt.Errorf("unexpected display %q", display)
+	}
+	password, _ := u.User.Password()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), fmt.Sprint(5900+n)))
+	return conn, password, err
+}
+
+// --- Proxmox VE ---
+
+type proxmoxHost struct {
+	proxmoxProvider
+}
+
+// vmid looks up the ID of the VM called name on the node.
+func (h *proxmoxHost) vmid(ctx context.Context, name string) (string, error) {
+	data, err := h.call(ctx, "GET", "/cluster/resources?type=vm", nil)
+	if err != nil {
+		return "", err
+	}
+	var vms []struct {
+		VMID int    `json:"vmid"`
+		Name string `json:"name"`
+		Node string `json:"node"`
+	}
+	if err := json.Unmarshal(data, &vms); err != nil {
+		return "", err
+	}
+	for _, vm := range vms {
+		if vm.Name == name && vm.Node == h.node {
+			return fmt.Sprint(vm.VMID), nil
+		}
+	}
+	return "", &cloudError{404, "no VM named " + name}
+}
+
+func (h *proxmoxHost) provision(ctx context.Context, name string, spec vmSpec) error {
+	if _, err := h.vmid(ctx, name); !isNotFound(err) {
+		return err // nil when it already exists
+	}
+	var template int
+	if _, err := fmt.Sscan(spec.Template, &template); err != nil {
+		return fmt.Errorf("vm_template %q is not a VM ID", spec.Template)
+	}
+	id, err := h.clone(ctx, template, name)
+	if err != nil {
+		return err
+	}
+	cfg := url.Values{"ciuser": {spec.User}}
+	if spec.UserData != "" {
+		cfg.Set("cicustom", "user="+spec.UserData)
+	}
+	if _, err = h.call(ctx, "POST", "/nodes/"+h.node+"/qemu/"+id+"/config", cfg); err != nil {
+		h.proxmoxProvider.destroy(context.WithoutCancel(ctx), cloudVM{ID: id, Name: name})
+	}
+	return err
+}
+
+// vmCall makes an API call about the VM called name, waiting for the task
+// it starts.
+func (h *proxmoxHost) vmCall(ctx context.Context, name, path string, form url.Values) error {
+	id, err := h.vmid(ctx, name)
+	if err != nil {
+		return err
+	}
+	upid, err := h.call(ctx, "POST", "/nodes/"+h.node+"/qemu/"+id+path, form)
+	if err != nil {
+		return err
+	}
+	return h.wait(ctx, upid)
+}
+
+func (h *proxmoxHost) start(ctx context.Context, name string) error {
+	return h.vmCall(ctx, name, "/status/start", url.Values{})
+}
+
+func (h *proxmoxHost) shutdown(ctx context.Context, name string) error {
+	if !h.running(ctx, name) {
+		return nil
+	}
+	return h.vmCall(ctx, name, "/status/shutdown", url.Values{
+		"timeout":   {fmt.Sprint(int(vmStopTimeout.Seconds()))},
+		"forceStop": {"1"},
+	})
+}
+
+func (h *proxmoxHost) destroy(ctx context.Context, name string) error {
+	id, err := h.vmid(ctx, name)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return h.proxmoxProvider.destroy(ctx, cloudVM{ID: id, Name: name})
+}
+
+func (h *proxmoxHost) running(ctx context.Context, name string) bool {
+	id, err := h.vmid(ctx, name)
+	if err != nil {
+		return false
+	}
+	data, err := h.call(ctx, "GET", "/nodes/"+h.node+"/qemu/"+id+"/status/current", nil)
+	if err != nil {
+		return false
+	}
+	var st struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(data, &st)
+	return st.Status == "running"
+}
+
+// console opens a VNC proxy to the VM and connects to it through the API's
+// websocket. The proxy's one-time ticket is its password.
+func (h *proxmoxHost) console(ctx context.Context, name string) (io.ReadWriteCloser, string, error) {
+	id, err := h.vmid(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := h.call(ctx, "POST", "/nodes/"+h.node+"/qemu/"+id+"/vncproxy", url.Values{"websocket": {"1"}})
+	if err != nil {
+		return nil, "", err
+	}
+	var proxy struct {
+		Port   json.Number `json:"port"`
+		Ticket string      `json:"ticket"`
+	}
+	if err := json.Unmarshal(data, &proxy); err != nil {
+		return nil, "", err
+	}
+	wsURL := strings.Replace(h.url, "http", "ws", 1) + "/api2/json/nodes/" + h.node + "/qemu/" + id +
+		"/vncwebsocket?" + url.Values{"port": {proxy.Port.String()}, "vncticket": {proxy.Ticket}}.Encode()
+	cfg, err := websocket.NewConfig(wsURL, h.url)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.Protocol = []string{"binary"}
+	cfg.Header = http.Header{"Authorization": {"PVEAPIToken=" + h.token}}
+	cfg.Dialer = &net.Dialer{Timeout: 10 * time.Second}
+	ws, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, proxy.Ticket, nil
+}
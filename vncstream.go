@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxClientFrame is the largest websocket frame payload accepted from a
+// client. RFB client messages are tiny; clipboard text is the biggest.
+const maxClientFrame = 1 << 20
+
+var errFrameTooLarge = errors.New("client websocket frame too large")
+
+// vncStream wraps the backend side of a proxied noVNC websocket once the
+// upgrade has happened. httputil.ReverseProxy copies the client's bytes into
+// Write and the server's bytes out of Read, so the gateway sees both
+// directions of the RFB conversation. Client frames are decoded and, for
+// view-only viewers, stripped of keyboard, pointer and clipboard messages
+// before being re-framed for the server.
+type vncStream struct {
+	io.ReadWriteCloser // Backend connection from the reverse proxy
+
+	opts vncOptions
+	rec  *recorder // nil unless the session is recorded
+
+	mu       sync.Mutex
+	inbuf    []byte // Client bytes not yet forming a whole websocket frame
+	client   rfbClientParser
+	srvFrame wsFrameParser // Server frames, watched for the RFB handshake
+
+	lastInput  time.Time // When input last marked the session active
+	encodings  []int32   // The client's last SetEncodings list, before rewriting
+	fragmented bool      // The last client frame forwarded was not final
+	dropping   bool      // The client's terminal message being continued is dropped
+}
+
+// inputTouchInterval limits how often VNC input marks its session active.
+const inputTouchInterval = 5 * time.Second
+
+// vncOptions controls how a proxied VNC connection is handled.
+type vncOptions struct {
+	SessionID   string
+	Username    string
+	ViewOnly    bool      // Drop all input from this viewer
+	Expires     time.Time // Cut the connection off at this time (zero = never)
+	Record      bool      // Record the connection's traffic
+	Owner       bool      // The session owner, not a share link viewer
+	Shadow      string    // The share token of an admin shadowing the session
+	Quality     *int      // JPEG quality level imposed on the client (nil = its own)
+	Compression *int      // Compression level imposed on the client (nil = its own)
+	Terminal    bool      // A web terminal's connection rather than noVNC's
+}
+
+// vncUpgradeHook returns a ReverseProxy ModifyResponse function that wraps
+// noVNC websocket upgrades in a vncStream.
+func vncUpgradeHook(opts vncOptions) func(*http.Response) error {
+	return func(res *http.Response) error {
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			return nil
+		}
+		backend, ok := res.Body.(io.ReadWriteCloser)
+		if !ok {
+			return errors.New("upgrade response body is not writable")
+		}
+		vs := &vncStream{ReadWriteCloser: backend, opts: opts}
+		vs.client.rewrite = vs.rewrite
+		if opts.Record {
+			rec, err := startRecording(opts.SessionID, opts.Username)
+			if err != nil {
+				// Refuse rather than allow an unrecorded connection
+				return fmt.Errorf("starting recording: %w", err)
+			}
+			vs.rec = rec
+		}
+		vs.srvFrame.onPayload = func(b []byte) {
+			vs.client.observeServer(b)
+			if vs.rec != nil {
+				vs.rec.fromServer(b)
+			}
+		}
+		if opts.Owner {
+			trackOwnerConn(opts.SessionID, vs)
+		}
+		if opts.Shadow != "" {
+			trackShadowConn(opts.Shadow, vs)
+		}
+		if !opts.Expires.IsZero() {
+			time.AfterFunc(time.Until(opts.Expires), func() { vs.Close() })
+		}
+		res.Body = vs
+		return nil
+	}
+}
+
+// Close ends the connection and any recording of it.
+func (vs *vncStream) Close() error {
+	if vs.opts.Owner {
+		untrackOwnerConn(vs.opts.SessionID, vs)
+	}
+	if vs.opts.Shadow != "" {
+		untrackShadowConn(vs.opts.Shadow, vs)
+	}
+	if vs.rec != nil {
+		vs.rec.close()
+	}
+	return vs.ReadWriteCloser.Close()
+}
+
+// Read passes server bytes through untouched, watching the handshake.
+func (vs *vncStream) Read(p []byte) (int, error) {
+	n, err := vs.ReadWriteCloser.Read(p)
+	if n > 0 {
+		vs.mu.Lock()
+		vs.srvFrame.feed(p[:n])
+		vs.mu.Unlock()
+	}
+	return n, err
+}
+
+// Write decodes complete client frames, filters their RFB payload and
+// forwards the result. Partial frames are held until the rest arrives, up
+// to maxClientFrame: a client declaring a bigger one is cut off rather than
+// buffered without end.
+func (vs *vncStream) Write(p []byte) (int, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vs.inbuf = append(vs.inbuf, p...)
+	var out bytes.Buffer
+	for {
+		f, n, ok := parseWSFrame(vs.inbuf)
+		if !ok {
+			if length, _, ok := wsFrameHeader(vs.inbuf); ok && length > maxClientFrame || len(vs.inbuf) > maxClientFrame+14 {
+				return 0, errFrameTooLarge
+			}
+			break
+		}
+		vs.inbuf = vs.inbuf[n:]
+		if f.opcode >= 0x8 {
+			// Control frames (close, ping, pong) pass through as-is
+			writeWSFrame(&out, f.fin, f.opcode, f.payload)
+			continue
+		}
+		if vs.opts.Terminal {
+			// Whole web terminal messages are forwarded or dropped
+			if kept := vs.filterTerminal(f); kept != nil {
+				writeWSFrame(&out, f.fin, f.opcode, kept)
+			}
+			continue
+		}
+		kept := vs.client.feed(f.payload, vs.allow)
+		if vs.rec != nil && len(kept) > 0 {
+			vs.rec.fromClient(kept)
+		}
+		if len(kept) > 0 || f.fin {
+			writeWSFrame(&out, f.fin, f.opcode, kept)
+			vs.fragmented = !f.fin
+		}
+	}
+	if out.Len() > 0 {
+		if _, err := vs.ReadWriteCloser.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// allow decides whether a client RFB message is forwarded. Forwarded input
+// is what keeps a session from going idle; framebuffer update requests,
+// which noVNC sends whether or not anyone is there, are not.
+func (vs *vncStream) allow(msgType byte) bool {
+	switch msgType {
+	case rfbKeyEvent, rfbPointerEvent, rfbClientCutText, rfbQEMUMessage:
+		if vs.opts.ViewOnly {
+			return false
+		}
+		if time.Since(vs.lastInput) > inputTouchInterval {
+			vs.lastInput = time.Now()
+			touchSession(vs.opts.SessionID)
+		}
+	}
+	return true
+}
+
+// Pseudo-encodings by which an RFB client asks for a JPEG quality or
+// compression level, each the first of a range of ten for levels 0-9.
+const (
+	rfbQualityLevel0     = -32
+	rfbCompressionLevel0 = -256
+)
+
+// rewrite imposes the connection's quality and compression levels on the
+// client's SetEncodings messages, remembering what the client asked for.
+func (vs *vncStream) rewrite(msg []byte) []byte {
+	if msg[0] != rfbSetEncodings {
+		return msg
+	}
+	vs.encodings = make([]int32, binary.BigEndian.Uint16(msg[2:]))
+	for i := range vs.encodings {
+		vs.encodings[i] = int32(binary.BigEndian.Uint32(msg[4+4*i:]))
+	}
+	return vs.setEncodingsMsg()
+}
+
+// setEncodingsMsg builds a SetEncodings message from the client's encodings
+// and the imposed levels.
+func (vs *vncStream) setEncodingsMsg() []byte {
+	level := func(e, first int32, imposed *int) bool {
+		return imposed != nil && e >= first && e <= first+9
+	}
+	var encs []int32
+	for _, e := range vs.encodings {
+		if !level(e, rfbQualityLevel0, vs.opts.Quality) && !level(e, rfbCompressionLevel0, vs.opts.Compression) {
+			encs = append(encs, e)
+		}
+	}
+	if vs.opts.Quality != nil {
+		encs = append(encs, rfbQualityLevel0+int32(*vs.opts.Quality))
+	}
+	if vs.opts.Compression != nil {
+		encs = append(encs, rfbCompressionLevel0+int32(*vs.opts.Compression))
+	}
+	msg := make([]byte, 4+4*len(encs))
+	msg[0] = rfbSetEncodings
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(encs)))
+	for i, e := range encs {
+		binary.BigEndian.PutUint32(msg[4+4*i:], uint32(e))
+	}
+	return msg
+}
+
+// setControls changes the connection's view-only mode and imposed levels.
+// New levels are sent to the server straight away, as a SetEncodings with
+// the client's own encodings, rather than waiting for the client to send one.
+func (vs *vncStream) setControls(viewOnly bool, quality, compression *int) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.opts.ViewOnly = viewOnly
+	vs.opts.Quality, vs.opts.Compression = quality, compression
+	if vs.encodings == nil || vs.fragmented {
+		// Not at a message boundary yet; the client's next request gets them
+		return
+	}
+	msg := vs.setEncodingsMsg()
+	if vs.rec != nil {
+		vs.rec.fromClient(msg)
+	}
+	var out bytes.Buffer
+	writeWSFrame(&out, true, 0x2, msg) // Binary frame
+	if _, err := vs.ReadWriteCloser.Write(out.Bytes()); err != nil {
+		log.Printf("Session %s: sending encodings: %v", vs.opts.SessionID, err)
+	}
+}
+
+// --- WebSocket framing (RFC 6455) ---
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte // Unmasked
+}
+
+// wsFrameHeader decodes the header at the start of b: the declared payload
+// length and the header's own length (masking key included), or ok=false
+// if b does not yet hold the whole header.
+func wsFrameHeader(b []byte) (length uint64, n int, ok bool) {
+	if len(b) < 2 {
+		return 0, 0, false
+	}
+	length = uint64(b[1] & 0x7f)
+	n = 2
+	switch length {
+	case 126:
+		if len(b) < n+2 {
+			return 0, 0, false
+		}
+		length = uint64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if len(b) < n+8 {
+			return 0, 0, false
+		}
+		length = binary.BigEndian.Uint64(b[n:])
+		n += 8
+	}
+	if b[1]&0x80 != 0 {
+		n += 4
+	}
+	return length, n, len(b) >= n
+}
+
+// parseWSFrame decodes one frame from the start of b, returning the frame
+// and its encoded length, or ok=false if b does not yet hold a whole frame.
+func parseWSFrame(b []byte) (f wsFrame, n int, ok bool) {
+	length, n, ok := wsFrameHeader(b)
+	if !ok || uint64(len(b)-n) < length {
+		return f, 0, false
+	}
+	f.fin = b[0]&0x80 != 0
+	f.opcode = b[0] & 0x0f
+	var mask []byte
+	if b[1]&0x80 != 0 {
+		mask = b[n-4 : n]
+	}
+	f.payload = make([]byte, length)
+	copy(f.payload, b[n:n+int(length)])
+	for i := range f.payload {
+		if mask != nil {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, n + int(length), true
+}
+
+// writeWSFrame encodes a client-to-server frame. Client frames must be
+// masked; an all-zero mask key leaves the payload bytes unchanged.
+func writeWSFrame(w *bytes.Buffer, fin bool, opcode byte, payload []byte) {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	w.WriteByte(b0)
+	switch l := len(payload); {
+	case l < 126:
+		w.WriteByte(0x80 | byte(l))
+	case l <= 0xffff:
+		w.WriteByte(0x80 | 126)
+		binary.Write(w, binary.BigEndian, uint16(l))
+	default:
+		w.WriteByte(0x80 | 127)
+		binary.Write(w, binary.BigEndian, uint64(l))
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	w.Write(payload)
+}
+
+// wsFrameParser incrementally decodes a stream of websocket frames.
+type wsFrameParser struct {
+	buf       []byte
+	onPayload func([]byte)
+}
+
+func (p *wsFrameParser) feed(b []byte) {
+	p.buf = append(p.buf, b...)
+	for {
+		f, n, ok := parseWSFrame(p.buf)
+		if !ok {
+			return
+		}
+		p.buf = p.buf[n:]
+		if f.opcode < 0x8 && p.onPayload != nil {
+			p.onPayload(f.payload)
+		}
+	}
+}
+
+// --- RFB client message parsing (RFC 6143 plus common extensions) ---
+
+const (
+	rfbSetPixelFormat         = 0
+	rfbSetEncodings           = 2
+	rfbFramebufferUpdateReq   = 3
+	rfbKeyEvent               = 4
+	rfbPointerEvent           = 5
+	rfbClientCutText          = 6
+	rfbEnableContinuousUpdate = 150
+	rfbClientFence            = 248
+	rfbXVP                    = 250
+	rfbSetDesktopSize         = 251
+	rfbQEMUMessage            = 255
+)
+
+// Handshake stages of the client side of an RFB connection.
+const (
+	rfbStageVersion  = iota // Waiting for the client's 12-byte version
+	rfbStageSecType         // 3.7+: client picks a security type
+	rfbStageAuth            // VNC auth: 16-byte challenge response
+	rfbStageInit            // ClientInit: shared flag
+	rfbStageMessages        // Normal client-to-server messages
+	rfbStageBroken          // Unparseable; everything is dropped if filtering
+)
+
+// rfbClientParser splits the client's RFB byte stream into messages so
+// individual message types can be dropped.
+type rfbClientParser struct {
+	stage   int
+	minor   int    // Client protocol minor version (3, 7 or 8)
+	buf     []byte // Bytes of an incomplete message
+	srvHead []byte // First bytes from the server (version, 3.3 security type)
+
+	rewrite func(msg []byte) []byte // Optionally replaces forwarded messages
+}
+
+// observeServer records the start of the server's stream; RFB 3.3 servers
+// dictate the security type rather than letting the client choose.
+func (p *rfbClientParser) observeServer(b []byte) {
+	if need := 16 - len(p.srvHead); need > 0 {
+		if len(b) > need {
+			b = b[:need]
+		}
+		p.srvHead = append(p.srvHead, b...)
+	}
+}
+
+// feed consumes client bytes and returns those that should be forwarded.
+// Handshake bytes are always kept; each whole message is kept only if allow
+// returns true for its type.
+func (p *rfbClientParser) feed(b []byte, allow func(byte) bool) []byte {
+	p.buf = append(p.buf, b...)
+	var out []byte
+	for len(p.buf) > 0 {
+		n, msgType, ok := p.next()
+		if !ok {
+			break
+		}
+		if n < 0 {
+			// Lost track of the stream: fail closed if filtering
+			p.stage = rfbStageBroken
+			if allow(rfbKeyEvent) {
+				out = append(out, p.buf...)
+			}
+			p.buf = nil
+			break
+		}
+		if p.stage != rfbStageMessages || msgType < 0 {
+			out = append(out, p.buf[:n]...)
+		} else if allow(byte(msgType)) {
+			msg := p.buf[:n]
+			if p.rewrite != nil {
+				msg = p.rewrite(msg)
+			}
+			out = append(out, msg...)
+		}
+		p.advance()
+		p.buf = p.buf[n:]
+	}
+	return out
+}
+
+// next returns the length of the next unit in buf and its message type (-1
+// for handshake bytes), ok=false if more bytes are needed, or n=-1 if the
+// stream cannot be parsed.
+func (p *rfbClientParser) next() (n int, msgType int, ok bool) {
+	b := p.buf
+	switch p.stage {
+	case rfbStageVersion:
+		if len(b) < 12 {
+			return 0, -1, false
+		}
+		p.minor = int(b[10] - '0') // "RFB 003.008\n"
+		return 12, -1, true
+	case rfbStageSecType:
+		return 1, -1, true
+	case rfbStageAuth:
+		if len(b) < 16 {
+			return 0, -1, false
+		}
+		return 16, -1, true
+	case rfbStageInit:
+		return 1, -1, true
+	case rfbStageBroken:
+		return -1, -1, true
+	}
+
+	need := func(l int) (int, int, bool) {
+		if len(b) < l {
+			return 0, int(b[0]), false
+		}
+		return l, int(b[0]), true
+	}
+	switch b[0] {
+	case rfbSetPixelFormat:
+		return need(20)
+	case rfbSetEncodings:
+		if len(b) < 4 {
+			return 0, 0, false
+		}
+		return need(4 + 4*int(binary.BigEndian.Uint16(b[2:])))
+	case rfbFramebufferUpdateReq, rfbEnableContinuousUpdate:
+		return need(10)
+	case rfbKeyEvent:
+		return need(8)
+	case rfbPointerEvent:
+		return need(6)
+	case rfbClientCutText:
+		if len(b) < 8 {
+			return 0, 0, false
+		}
+		l := int32(binary.BigEndian.Uint32(b[4:]))
+		if l < 0 {
+			l = -l // Extended clipboard pseudo-message
+		}
+		return need(8 + int(l))
+	case rfbClientFence:
+		if len(b) < 9 {
+			return 0, 0, false
+		}
+		return need(9 + int(b[8]))
+	case rfbXVP:
+		return need(4)
+	case rfbSetDesktopSize:
+		if len(b) < 8 {
+			return 0, 0, false
+		}
+		return need(8 + 16*int(b[6]))
+	case rfbQEMUMessage:
+		if len(b) < 2 {
+			return 0, 0, false
+		}
+		if b[1] == 0 { // Extended key event
+			return need(12)
+		}
+	}
+	log.Printf("RFB: unknown client message type %d, input filtering stops", b[0])
+	return -1, int(b[0]), true
+}
+
+// advance moves the handshake on after a unit has been consumed.
+func (p *rfbClientParser) advance() {
+	switch p.stage {
+	case rfbStageVersion:
+		if p.minor >= 7 {
+			p.stage = rfbStageSecType
+			return
+		}
+		// 3.3: the server's 4-byte security type follows its version
+		p.stage = rfbStageInit
+		if len(p.srvHead) >= 16 && binary.BigEndian.Uint32(p.srvHead[12:]) == 2 {
+			p.stage = rfbStageAuth
+		}
+	case rfbStageSecType:
+		p.stage = rfbStageInit
+		if p.buf[0] == 2 { // VNC authentication
+			p.stage = rfbStageAuth
+		}
+	case rfbStageAuth:
+		p.stage = rfbStageInit
+	case rfbStageInit:
+		p.stage = rfbStageMessages
+	}
+}
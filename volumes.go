@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Volume is an extra host directory bind-mounted into a session container.
+type Volume struct {
+	Source   string // Host path (e.g. an NFS export mounted on the host)
+	Target   string // Path as seen from inside the desktop
+	ReadOnly bool   // Mount read-only
+}
+
+// parseVolumes parses "volumes" entries from a user config.
+// Each entry has the form host:container[:ro|rw].
+func parseVolumes(entries []string) ([]Volume, error) {
+	var vols []Volume
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		parts := strings.Split(e, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid volume %q (want host:container[:ro|rw])", e)
+		}
+		v := Volume{Source: filepath.Clean(parts[0]), Target: path.Clean(parts[1])}
+		if !filepath.IsAbs(v.Source) || !path.IsAbs(v.Target) {
+			return nil, fmt.Errorf("invalid volume %q: paths must be absolute", e)
+		}
+		if v.Target == "/" {
+			return nil, fmt.Errorf("invalid volume %q: cannot mount over the root", e)
+		}
+		if len(parts) == 3 {
+			switch parts[2] {
+			case "ro":
+				v.ReadOnly = true
+			case "rw":
+			default:
+				return nil, fmt.Errorf("invalid volume %q: unknown mode %q", e, parts[2])
+			}
+		}
+		vols = append(vols, v)
+	}
+	return vols, nil
+}
+
+// dockerArgs returns the docker run arguments for the volume. The desktop
+// chroots into /mnt/overlay, so targets are mounted beneath it.
+func (v Volume) dockerArgs() []string {
+	spec := v.Source + ":" + path.Join("/mnt/overlay", v.Target)
+	if v.ReadOnly {
+		spec += ":ro"
+	}
+	return []string{"-v", spec}
+}
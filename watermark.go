@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A per-user (group, role or image) "watermark" overlays text on the
+// desktop itself, so every screenshot, screen recording and photo of the
+// screen carries it, as a deterrent against leaks. The text may name the
+// user, the address the owner's browser last connected from, the time, the
+// session and the desktop:
+//
+//	watermark = {user} {ip} {time}
+//
+// The desktop's lg-watermark.sh (started with LG_WATERMARK=1) fetches the
+// text from /agent/watermark every minute and draws it, click-through and
+// always on top, over the top, middle and bottom of the screen. Terminals,
+// VMs and external hosts have no agent to draw it, so "config check" warns
+// about watermarks set for them.
+
+const watermarkTimeFormat = "2006-01-02 15:04 MST"
+
+// unwatermarked returns the kind of session (VM, web terminal or external
+// host) that can't show u's watermark, or "" if it has none or will show it.
+func unwatermarked(u *User) string {
+	if u.setting("watermark") == "" {
+		return ""
+	}
+	if protocol, _, ok := u.externalHost(); ok && protocol == "vnc" {
+		return "external host"
+	}
+	switch u.setting("backend") {
+	case "vm":
+		return "VM"
+	case "terminal":
+		return "web terminal"
+	}
+	return ""
+}
+
+// watermarkArgs returns the docker run arguments that start a session's
+// watermark.
+func watermarkArgs(u *User) []string {
+	if u.setting("watermark") == "" {
+		return nil
+	}
+	return []string{"-e", "LG_WATERMARK=1"}
+}
+
+// watermarkText fills in a session's watermark.
+func watermarkText(s Session, now time.Time) string {
+	return strings.NewReplacer(
+		"{user}", s.Username,
+		"{ip}", s.ClientAddr,
+		"{time}", now.Format(watermarkTimeFormat),
+		"{session}", s.ID,
+		"{desktop}", s.Desktop,
+	).Replace(s.Watermark)
+}
+
+// noteClientAddr records where a session's owner connected from, for its
+// watermark.
+func noteClientAddr(sessionID, remoteAddr string) {
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[sessionID]
+	if !ok || s.Watermark == "" || s.ClientAddr == ip.String() {
+		return
+	}
+	s.ClientAddr = ip.String()
+	sessions[sessionID] = s
+	saveSessions()
+}
+
+// agentWatermark serves GET /agent/watermark for the in-container agent:
+// the session's watermark, or 204 if it has none.
+func agentWatermark(w http.ResponseWriter, r *http.Request) {
+	_, s, ok := agentSession(r)
+	if !ok {
+		httpError(w, r, 401, "error.unauthorized")
+		return
+	}
+	if s.Watermark == "" {
+		w.WriteHeader(204)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, watermarkText(s, time.Now()))
+}
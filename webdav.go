@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// The WebDAV share at /dav/ exposes a user's exchange directory (the same
+// one the file browser serves) so it can be mounted from a laptop. Users
+// authenticate with their LookingGlass username and password. For view_only
+// users the share is read-only.
+
+var (
+	davLocksMu sync.Mutex
+	davLocks   = make(map[string]webdav.LockSystem) // Per-share lock state
+)
+
+// davHandler serves the authenticated per-user WebDAV share.
+func davHandler(w http.ResponseWriter, r *http.Request) {
+	if loginBlocked(r.RemoteAddr) {
+		httpError(w, r, 429, "error.too_many_attempts")
+		return
+	}
+	if geoBlocked(w, r, "") {
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	var u *User
+	if ok {
+		u, _ = loadUser(username)
+	}
+	if u == nil || !u.checkPassword(password) {
+		if ok {
+			audit("login.failed", username, "", map[string]string{"reason": "bad password", "remote": r.RemoteAddr, "via": "webdav"})
+			loginFailed(r.RemoteAddr)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="LookingGlass"`)
+		httpError(w, r, 401, "error.unauthorized")
+		return
+	}
+
+	// Users with named desktops have a share per desktop, at /dav/<name>/
+	prefix := "/dav"
+	if len(u.desktops()) > 0 {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/dav/"), "/")
+		d, err := u.forDesktop(name)
+		if err != nil {
+			httpError(w, r, 404, "error.desktop_not_found")
+			return
+		}
+		u, prefix = d, "/dav/"+name
+	}
+
+	overlayDir := u.overlay()
+	encrypted := u.setting("encryption") == "fscrypt"
+	if overlayDir == "" || overlayDir == "ephemeral" {
+		httpError(w, r, 403, "error.no_storage")
+		return
+	}
+	s, live := findDesktopSession(username, u.Desktop)
+	if encrypted && !live {
+		// fscrypt only unlocks the overlay while a session is running
+		httpError(w, r, 423, "error.storage_locked")
+		return
+	}
+	policy := u.setting("file_transfer")
+	viewOnly := u.settingKey("view_only").MustBool(false)
+	if viewOnly {
+		policy = viewOnlyFiles(policy)
+	}
+	switch {
+	case policy == "none":
+		httpError(w, r, 403, "error.files_disabled")
+		return
+	case viewOnly && !davReadOnly(r.Method):
+		httpError(w, r, 403, "error.view_only_locked")
+		return
+	case r.Method == http.MethodPut && !fileTransferAllows(policy, "upload"):
+		httpError(w, r, 403, "error.upload_disabled")
+		return
+	case r.Method == http.MethodGet && !fileTransferAllows(policy, "download"):
+		httpError(w, r, 403, "error.download_disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut, "MKCOL", "COPY":
+		if live && overQuota(s) {
+			httpError(w, r, 507, "error.quota_full")
+			return
+		}
+	}
+	root := exchangePath(overlayDir, encrypted)
+	if err := prepareExchange(root); err != nil {
+		serverError(w, r, 500, err)
+		return
+	}
+
+	davLocksMu.Lock()
+	ls, ok := davLocks[prefix+"@"+username]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[prefix+"@"+username] = ls
+	}
+	davLocksMu.Unlock()
+
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: exchangeFS(root),
+		LockSystem: ls,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s (%s): %v", r.Method, r.URL.Path, username, err)
+			}
+		},
+	}
+	if r.Method == http.MethodPut {
+		body, err := scanDavUpload(r, scanPolicy(u), username, s.ID, root, strings.TrimPrefix(r.URL.Path, prefix))
+		switch {
+		case errors.Is(err, errInfected):
+			httpError(w, r, 422, "error.upload_infected")
+			return
+		case errors.Is(err, errScanFailed):
+			httpError(w, r, 503, "error.upload_unscanned")
+			return
+		case err != nil:
+			log.Printf("WebDAV upload %s (%s): %v", r.URL.Path, username, err)
+			httpError(w, r, 400, "error.upload_failed")
+			return
+		}
+		if body != nil {
+			defer body.Close()
+			r.Body = body
+		}
+	}
+	h.ServeHTTP(w, r)
+}
+
+// davReadOnly reports whether a WebDAV method leaves the share unchanged.
+func davReadOnly(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// scanDavUpload spools a WebDAV upload to a temporary file in the exchange
+// directory and scans it there, before the WebDAV handler writes it into
+// place as rel. It returns the scanned copy to be written in place of the
+// request body, or nil if the user's uploads aren't scanned.
+func scanDavUpload(r *http.Request, policy, user, sessionID, root, rel string) (io.ReadCloser, error) {
+	if policy == "none" {
+		return nil, nil
+	}
+	tmp, err := os.CreateTemp(root, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	// Unlinked once scanned; the open file is all that's needed
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r.Body); err == nil {
+		err = scanUpload(r.Context(), policy, user, sessionID, tmp.Name(), rel)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// exchangeFS is a webdav.FileSystem rooted at an exchange directory. Unlike
+// webdav.Dir it refuses to follow symlinks out of the directory, since the
+// desktop user can create arbitrary symlinks in it. New files and
+// directories are owned by the desktop user.
+type exchangeFS string
+
+// resolve maps a WebDAV name onto the host. Names that don't exist yet
+// resolve through their (existing, checked) parent directory.
+func (fs exchangeFS) resolve(name string) (string, error) {
+	p, err := resolveExchange(string(fs), name)
+	if !os.IsNotExist(err) {
+		return p, err
+	}
+	if fi, lerr := os.Lstat(filepath.Join(string(fs), filepath.FromSlash(path.Clean("/"+name)))); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", errOutsideExchange // dangling symlink
+	}
+	dir, err := resolveExchange(string(fs), path.Dir(path.Clean("/"+name)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(name)), nil
+}
+
+func (fs exchangeFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, perm); err != nil {
+		return err
+	}
+	return os.Chown(p, desktopUID, desktopUID)
+}
+
+func (fs exchangeFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(p)
+	f, err := os.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if os.IsNotExist(statErr) {
+		f.Chown(desktopUID, desktopUID)
+	}
+	return f, nil
+}
+
+func (fs exchangeFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return os.ErrPermission // never remove the share itself
+	}
+	// Only the parent is resolved: a symlink is removed, not what it points to
+	clean := path.Clean("/" + name)
+	dir, err := resolveExchange(string(fs), path.Dir(clean))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(dir, path.Base(clean)))
+}
+
+func (fs exchangeFS) Rename(ctx context.Context, oldName, newName string) error {
+	if path.Clean("/"+oldName) == "/" {
+		return os.ErrPermission
+	}
+	oldPath, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (fs exchangeFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
@@ -0,0 +1,65 @@
+package main
+
+import "context"
+
+// Starting a desktop (mounts, an image pull, docker run) is done by a fixed
+// pool of start_workers, taking jobs in order from a backlog of at most
+// start_backlog. A burst of logins therefore runs a bounded number of
+// mounts and docker runs at once, however many arrive; once the backlog is
+// full, further starts fail straight away rather than piling up.
+
+var (
+	startWorkers = 4  // Desktops started at once
+	startBacklog = 64 // Starts waiting for a worker before more are refused
+	startJobs    chan func()
+)
+
+var errStartBusy = &startError{503, "too many desktops starting; try again shortly"}
+
+// startWorkerPool starts the workers.
+func startWorkerPool() {
+	startJobs = make(chan func(), startBacklog)
+	for i := 0; i < max(startWorkers, 1); i++ {
+		go func() {
+			for job := range startJobs {
+				job()
+			}
+		}()
+	}
+}
+
+// onStartWorker runs fn on a worker and waits for it to finish, or fails
+// with errStartBusy if the backlog is full. If ctx ends while fn is still
+// waiting for a worker, fn doesn't run. A panic in fn is passed on to
+// the caller, as though fn had run there. Without the pool (as in the
+// command line tools), fn runs directly.
+func onStartWorker(ctx context.Context, fn func()) error {
+	if startJobs == nil {
+		fn()
+		return nil
+	}
+	_, sp := startSpan(ctx, "worker.wait")
+	done := make(chan any, 1)
+	skipped := false
+	job := func() {
+		sp.finish()
+		defer func() { done <- recover() }()
+		if skipped = ctx.Err() != nil; !skipped {
+			fn()
+		}
+	}
+	select {
+	case startJobs <- job:
+	default:
+		sp.fail(errStartBusy)
+		sp.finish()
+		return errStartBusy
+	}
+	if p := <-done; p != nil {
+		panic(p)
+	}
+	if skipped {
+		return ctx.Err() // Given up on while waiting
+	}
+	return nil
+}